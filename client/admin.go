@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// The admin API needs a client created WithAdminToken.
+
+// SetMarketStatus changes the trading status of a market, reason is kept in
+// the audit log of the exchange.
+func (c *Client) SetMarketStatus(market server.Market, status server.MarketStatus, reason string) (*server.MarketRes, error) {
+	return c.SetMarketStatusContext(context.Background(), market, status, reason)
+}
+
+func (c *Client) SetMarketStatusContext(ctx context.Context, market server.Market, status server.MarketStatus, reason string) (*server.MarketRes, error) {
+	marketRes := &server.MarketRes{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodPut,
+		path:       fmt.Sprintf("/admin/markets/%s/status", url.PathEscape(string(market))),
+		body:       &server.MarketStatusReq{Status: status, Reason: reason},
+		idempotent: true,
+	}, http.StatusOK, marketRes)
+	if err != nil {
+		return nil, err
+	}
+
+	return marketRes, nil
+}
+
+// SetIndexPrice sets the index price the price bands of a market follow.
+func (c *Client) SetIndexPrice(market server.Market, price float64) (*server.MarketRes, error) {
+	return c.SetIndexPriceContext(context.Background(), market, price)
+}
+
+func (c *Client) SetIndexPriceContext(ctx context.Context, market server.Market, price float64) (*server.MarketRes, error) {
+	marketRes := &server.MarketRes{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodPut,
+		path:       fmt.Sprintf("/admin/markets/%s/index-price", url.PathEscape(string(market))),
+		body:       &server.IndexPriceReq{Price: price},
+		idempotent: true,
+	}, http.StatusOK, marketRes)
+	if err != nil {
+		return nil, err
+	}
+
+	return marketRes, nil
+}
+
+func (c *Client) GetLogLevel() (string, error) {
+	return c.GetLogLevelContext(context.Background())
+}
+
+func (c *Client) GetLogLevelContext(ctx context.Context) (string, error) {
+	return c.logLevel(ctx, request{
+		method:     http.MethodGet,
+		path:       "/admin/log-level",
+		idempotent: true,
+	})
+}
+
+// SetLogLevel changes the level of the logger of the exchange and returns
+// the new level.
+func (c *Client) SetLogLevel(level string) (string, error) {
+	return c.SetLogLevelContext(context.Background(), level)
+}
+
+func (c *Client) SetLogLevelContext(ctx context.Context, level string) (string, error) {
+	return c.logLevel(ctx, request{
+		method:     http.MethodPut,
+		path:       "/admin/log-level",
+		body:       &server.LogLevelReq{Level: level},
+		idempotent: true,
+	})
+}
+
+func (c *Client) logLevel(ctx context.Context, r request) (string, error) {
+	logLevelRes := &server.LogLevelRes{}
+
+	if err := c.call(ctx, r, http.StatusOK, logLevelRes); err != nil {
+		return "", err
+	}
+
+	return logLevelRes.Level, nil
+}
+
+// Deposit credits a user with amount whole units of an asset the exchange
+// settles on its internal ledger and returns the new balance.
+func (c *Client) Deposit(userID string, asset server.Asset, amount float64) (*server.BalanceRes, error) {
+	return c.DepositContext(context.Background(), userID, asset, amount)
+}
+
+func (c *Client) DepositContext(ctx context.Context, userID string, asset server.Asset, amount float64) (*server.BalanceRes, error) {
+	balance := &server.BalanceRes{}
+
+	err := c.call(ctx, request{
+		method: http.MethodPost,
+		path:   "/admin/deposits",
+		body:   &server.DepositReq{UserID: userID, Asset: asset, Amount: amount},
+	}, http.StatusOK, balance)
+	if err != nil {
+		return nil, err
+	}
+
+	return balance, nil
+}
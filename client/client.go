@@ -2,236 +2,666 @@ package client
 
 import (
 	"bytes"
-	"crypto_exchange/order_book"
+	"context"
 	"crypto_exchange/server"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const baseURL = "http://localhost:3000"
+const DefaultBaseURL = "http://localhost:3000"
 
 type Client struct {
-	*http.Client
+	http       *http.Client
+	baseURL    string
+	timeout    *time.Duration
+	retry      RetryPolicy
+	userID     string
+	apiKey     string
+	adminToken string
 }
 
-func NewClient() *Client {
-	return &Client{
-		Client: http.DefaultClient,
+// NewClient returns a client of the exchange at DefaultBaseURL with a
+// timeout of DefaultTimeout and DefaultRetryPolicy, unless opts say
+// otherwise.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL: DefaultBaseURL,
+		retry:   DefaultRetryPolicy,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	switch {
+	case c.http == nil:
+		timeout := DefaultTimeout
+		if c.timeout != nil {
+			timeout = *c.timeout
+		}
+		c.http = &http.Client{Timeout: timeout}
+	case c.timeout != nil:
+		// don't change the timeout of a client the caller may share
+		hc := *c.http
+		hc.Timeout = *c.timeout
+		c.http = &hc
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+
+	return c
 }
 
-type PlaceOrderArgs struct {
-	UserID string
-	IsBid  bool
-	Size   float64
-	Price  float64
+// request describes a call of the exchange. Idempotent requests are safe to
+// send again after a network error, when the exchange may have handled them.
+type request struct {
+	method     string
+	path       string
+	query      url.Values
+	userID     string
+	body       any
+	idempotent bool
 }
 
-func (c *Client) PlaceLimitOrder(args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
-	url := baseURL + "/order"
+// call sends r and decodes the response into out unless out is nil. Any
+// status but want is returned as an *APIError.
+func (c *Client) call(ctx context.Context, r request, want int, out any) error {
+	_, err := c.callHeader(ctx, r, want, out)
+	return err
+}
 
-	data := &server.PlaceOrderReq{
-		UserID:    args.UserID,
-		Market:    server.ETH,
-		OrderType: server.LimitOrder,
-		IsBid:     args.IsBid,
-		Size:      args.Size,
-		Price:     args.Price,
+// callHeader is call returning the header of the response.
+func (c *Client) callHeader(ctx context.Context, r request, want int, out any) (http.Header, error) {
+	var body []byte
+	if r.body != nil {
+		var err error
+		if body, err = json.Marshal(r.body); err != nil {
+			return nil, err
+		}
 	}
 
-	body, err := json.Marshal(data)
+	res, err := c.do(ctx, r, body)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+	if res.StatusCode != want {
+		return nil, decodeError(res)
+	}
+	defer closeBody(res)
+
+	if out == nil {
+		return res.Header, nil
+	}
+
+	return res.Header, json.NewDecoder(res.Body).Decode(out)
+}
+
+// do sends r and retries it as long as the retry policy allows, waiting as
+// long as the Retry-After header of a rate limited response asks for or
+// backing off exponentially.
+func (c *Client) do(ctx context.Context, r request, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, r, body)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := c.http.Do(req)
+		wait, retry := c.shouldRetry(ctx, r, res, err, attempt)
+		if !retry {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, res.Body)
+			closeBody(res)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
+func (c *Client) newRequest(ctx context.Context, r request, body []byte) (*http.Request, error) {
+	target := c.baseURL + r.path
+	if len(r.query) > 0 {
+		target += "?" + r.query.Encode()
+	}
 
-	res, err := c.Do(req)
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, target, reader)
 	if err != nil {
 		return nil, err
 	}
 
-	placeOrderRes := &server.PlaceOrderRes{}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	userID := r.userID
+	if userID == "" {
+		userID = c.userID
+	}
+	if userID != "" {
+		req.Header.Set(server.HeaderUserID, userID)
+	}
+
+	c.setCredentials(req.Header)
+
+	return req, nil
+}
+
+// setCredentials adds the API key and the admin token of the client to
+// header.
+func (c *Client) setCredentials(header http.Header) {
+	if c.apiKey != "" {
+		header.Set(server.HeaderAPIKey, c.apiKey)
+	}
+	if c.adminToken != "" {
+		header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+}
+
+// shouldRetry reports whether attempt of r, which got res or err, is tried
+// again and after how long. A rate limited request never reached the engine
+// so it is always retried, other failures only if r is idempotent.
+func (c *Client) shouldRetry(ctx context.Context, r request, res *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.retry.MaxRetries || ctx.Err() != nil {
+		return 0, false
+	}
+
+	wait := c.retry.wait(attempt)
 
-	err = json.NewDecoder(res.Body).Decode(placeOrderRes)
+	switch {
+	case err != nil:
+		return wait, r.idempotent
+	case res.StatusCode == http.StatusTooManyRequests:
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return wait, true
+	case res.StatusCode == http.StatusBadGateway,
+		res.StatusCode == http.StatusServiceUnavailable,
+		res.StatusCode == http.StatusGatewayTimeout:
+		return wait, r.idempotent
+	}
+
+	return 0, false
+}
+
+// closeBody closes the body of a response once it has been read. Failing
+// to close it leaves nothing for the caller to do, so the error is dropped.
+func closeBody(res *http.Response) {
+	_ = res.Body.Close()
+}
+
+// PlaceOrderArgs describes an order. A ClientOrderID makes retrying the
+// order safe, placing it again while it is open returns the original order.
+// Orders are placed in the ETH market unless Market says otherwise.
+type PlaceOrderArgs struct {
+	UserID        string
+	ClientOrderID string
+	Market        server.Market
+	IsBid         bool
+	Size          float64
+	Price         float64
+}
+
+func (c *Client) RegisterUser(privateKey string) (*server.UserRes, error) {
+	return c.RegisterUserContext(context.Background(), privateKey)
+}
+
+// RegisterUserContext registers a user. It isn't retried after network
+// errors, a retry could register the user twice.
+func (c *Client) RegisterUserContext(ctx context.Context, privateKey string) (*server.UserRes, error) {
+	userRes := &server.UserRes{}
+
+	err := c.call(ctx, request{
+		method: http.MethodPost,
+		path:   "/users",
+		body:   &server.RegisterUserReq{PrivateKey: privateKey},
+	}, http.StatusCreated, userRes)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 
-	return placeOrderRes, nil
+	return userRes, nil
+}
+
+func (c *Client) PlaceLimitOrder(args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
+	return c.PlaceLimitOrderContext(context.Background(), args)
+}
+
+func (c *Client) PlaceLimitOrderContext(ctx context.Context, args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
+	return c.placeOrder(ctx, args, server.LimitOrder)
 }
 
 func (c *Client) PlaceMarketOrder(args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
-	url := baseURL + "/order"
+	return c.PlaceMarketOrderContext(context.Background(), args)
+}
+
+func (c *Client) PlaceMarketOrderContext(ctx context.Context, args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
+	return c.placeOrder(ctx, args, server.MarketOrder)
+}
+
+// placeOrder places an order, retrying it after network errors only if it
+// has a ClientOrderID.
+func (c *Client) placeOrder(ctx context.Context, args *PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error) {
+	userID := args.UserID
+	if userID == "" {
+		userID = c.userID
+	}
+
+	market := args.Market
+	if market == "" {
+		market = server.ETH
+	}
 
 	data := &server.PlaceOrderReq{
-		UserID:    args.UserID,
-		Market:    server.ETH,
-		OrderType: server.MarketOrder,
-		IsBid:     args.IsBid,
-		Size:      args.Size,
+		UserID:        userID,
+		ClientOrderID: args.ClientOrderID,
+		Market:        market,
+		OrderType:     orderType,
+		IsBid:         args.IsBid,
+		Size:          args.Size,
 	}
+	if orderType == server.LimitOrder {
+		data.Price = args.Price
+	}
+
+	placeOrderRes := &server.PlaceOrderRes{}
 
-	body, err := json.Marshal(data)
+	err := c.call(ctx, request{
+		method:     http.MethodPost,
+		path:       "/order",
+		userID:     userID,
+		body:       data,
+		idempotent: args.ClientOrderID != "",
+	}, http.StatusOK, placeOrderRes)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+	return placeOrderRes, nil
+}
+
+// AmendOrderArgs changes the price or size of an open limit order, a zero
+// Price or Size keeps the current one. Size is what is left open of the
+// order after the amendment. ClientOrderID names the replacement, which
+// keeps the client order ID of the order if it is empty.
+type AmendOrderArgs struct {
+	UserID        string
+	ClientOrderID string
+	Price         float64
+	Size          float64
+}
+
+func (c *Client) AmendOrder(orderID string, args *AmendOrderArgs) (*server.AmendOrderRes, error) {
+	return c.AmendOrderContext(context.Background(), orderID, args)
+}
+
+// AmendOrderContext replaces an open limit order with one of the new price
+// and size, the result holds the ID of the replacement. It isn't retried
+// after network errors, the order may have been replaced already.
+func (c *Client) AmendOrderContext(ctx context.Context, orderID string, args *AmendOrderArgs) (*server.AmendOrderRes, error) {
+	userID := args.UserID
+	if userID == "" {
+		userID = c.userID
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	res := &server.AmendOrderRes{}
 
-	res, err := c.Do(req)
+	err := c.call(ctx, request{
+		method: http.MethodPut,
+		path:   "/order/" + url.PathEscape(orderID),
+		userID: userID,
+		body:   &server.AmendOrderReq{UserID: userID, ClientOrderID: args.ClientOrderID, Price: args.Price, Size: args.Size},
+	}, http.StatusOK, res)
 	if err != nil {
 		return nil, err
 	}
 
-	placeOrderRes := &server.PlaceOrderRes{}
+	return res, nil
+}
+
+// BatchOrdersArgs places and cancels orders of a user in one request, see
+// server.BatchOrdersReq. Orders are placed in the ETH market unless their
+// Market says otherwise.
+type BatchOrdersArgs struct {
+	UserID    string
+	AllOrNone bool
+	Ops       []server.BatchOrderOp
+}
 
-	err = json.NewDecoder(res.Body).Decode(placeOrderRes)
+func (c *Client) BatchOrders(args *BatchOrdersArgs) (*server.BatchOrdersRes, error) {
+	return c.BatchOrdersContext(context.Background(), args)
+}
+
+// BatchOrdersContext executes the operations of a batch in order, the
+// result of each is in the response even if it failed. It is retried after
+// network errors only if every order placed has a ClientOrderID.
+func (c *Client) BatchOrdersContext(ctx context.Context, args *BatchOrdersArgs) (*server.BatchOrdersRes, error) {
+	userID := args.UserID
+	if userID == "" {
+		userID = c.userID
+	}
+
+	idempotent := true
+	ops := make([]server.BatchOrderOp, len(args.Ops))
+	for i, op := range args.Ops {
+		if op.Op == server.BatchPlace {
+			if op.Market == "" {
+				op.Market = server.ETH
+			}
+			idempotent = idempotent && op.ClientOrderID != ""
+		}
+		ops[i] = op
+	}
+
+	res := &server.BatchOrdersRes{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodPost,
+		path:       "/orders/batch",
+		userID:     userID,
+		body:       &server.BatchOrdersReq{UserID: userID, AllOrNone: args.AllOrNone, Ops: ops},
+		idempotent: idempotent,
+	}, http.StatusOK, res)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 
-	return placeOrderRes, nil
+	return res, nil
 }
 
 func (c *Client) CancelOrder(orderID string) error {
-	url := baseURL + "/order/" + orderID
+	return c.CancelOrderContext(context.Background(), orderID)
+}
 
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
-	if err != nil {
-		return err
-	}
+func (c *Client) CancelOrderContext(ctx context.Context, orderID string) error {
+	return c.call(ctx, request{
+		method:     http.MethodDelete,
+		path:       "/order/" + url.PathEscape(orderID),
+		idempotent: true,
+	}, http.StatusOK, nil)
+}
+
+func (c *Client) GetOrderBook(market server.Market) (*server.OrderBookRes, error) {
+	return c.GetOrderBookContext(context.Background(), market)
+}
 
-	req.Header.Set("Content-Type", "application/json")
+func (c *Client) GetOrderBookContext(ctx context.Context, market server.Market) (*server.OrderBookRes, error) {
+	orderBookRes := &server.OrderBookRes{}
 
-	res, err := c.Do(req)
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       "/book/" + url.PathEscape(string(market)),
+		idempotent: true,
+	}, http.StatusOK, orderBookRes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Println("Order cancel:", res.Status)
+	return orderBookRes, nil
+}
 
-	return nil
+// GetBookDepth returns the first depth levels of each side of the book of
+// market, every level if depth is zero.
+func (c *Client) GetBookDepth(market server.Market, depth int) (*server.BookDepthRes, error) {
+	return c.GetBookDepthContext(context.Background(), market, depth)
 }
 
-func (c *Client) GetBestPrice(market server.Market, limitType string) (float64, error) {
-	url := fmt.Sprintf("%s/book/%s/best-price?type=%s", baseURL, market, limitType)
+func (c *Client) GetBookDepthContext(ctx context.Context, market server.Market, depth int) (*server.BookDepthRes, error) {
+	res, _, err := c.bookDepth(ctx, market, depth)
+	return res, err
+}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return 0, err
+// bookDepth returns the levels of the book of market and the sequence
+// number of the last book stream event they include.
+func (c *Client) bookDepth(ctx context.Context, market server.Market, depth int) (*server.BookDepthRes, uint64, error) {
+	query := url.Values{}
+	if depth > 0 {
+		query.Set("depth", strconv.Itoa(depth))
 	}
 
-	res, err := c.Do(req)
+	depthRes := &server.BookDepthRes{}
+
+	header, err := c.callHeader(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/book/%s/depth", url.PathEscape(string(market))),
+		query:      query,
+		idempotent: true,
+	}, http.StatusOK, depthRes)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("GetBestPrice: %s", res.Status)
+	seq, err := sequence(header)
+	if err != nil {
+		return nil, 0, err
 	}
 
+	return depthRes, seq, nil
+}
+
+func (c *Client) GetBestPrice(market server.Market, limitType string) (float64, error) {
+	return c.GetBestPriceContext(context.Background(), market, limitType)
+}
+
+func (c *Client) GetBestPriceContext(ctx context.Context, market server.Market, limitType string) (float64, error) {
 	bestPrice := &server.BestPrice{}
 
-	err = json.NewDecoder(res.Body).Decode(bestPrice)
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/book/%s/best-price", url.PathEscape(string(market))),
+		query:      url.Values{"type": {limitType}},
+		idempotent: true,
+	}, http.StatusOK, bestPrice)
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 
 	return bestPrice.Price, nil
 }
 
 func (c *Client) GetUserOrders(market server.Market, userID string) (*server.UserOrders, error) {
-	url := fmt.Sprintf("%s/users/%s/%s/orders", baseURL, market, userID)
+	return c.GetUserOrdersContext(context.Background(), market, userID)
+}
+
+func (c *Client) GetUserOrdersContext(ctx context.Context, market server.Market, userID string) (*server.UserOrders, error) {
+	userOrders := &server.UserOrders{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/users/%s/%s/orders", url.PathEscape(string(market)), url.PathEscape(userID)),
+		idempotent: true,
+	}, http.StatusOK, userOrders)
+	if err != nil {
+		return nil, err
+	}
+
+	return userOrders, nil
+}
+
+func (c *Client) GetTrades(market server.Market) ([]*server.Trade, error) {
+	return c.GetTradesContext(context.Background(), market)
+}
+
+func (c *Client) GetTradesContext(ctx context.Context, market server.Market) ([]*server.Trade, error) {
+	var trades []*server.Trade
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       "/trades/" + url.PathEscape(string(market)),
+		idempotent: true,
+	}, http.StatusOK, &trades)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := c.Do(req)
+	return trades, nil
+}
+
+func (c *Client) GetOrderByClientID(userID, clientOrderID string) (*server.Order, error) {
+	return c.GetOrderByClientIDContext(context.Background(), userID, clientOrderID)
+}
+
+func (c *Client) GetOrderByClientIDContext(ctx context.Context, userID, clientOrderID string) (*server.Order, error) {
+	order := &server.Order{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/order/client/%s/%s", url.PathEscape(userID), url.PathEscape(clientOrderID)),
+		idempotent: true,
+	}, http.StatusOK, order)
 	if err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GetUserOrders: %s", res.Status)
+	return order, nil
+}
+
+func (c *Client) CancelOrderByClientID(userID, clientOrderID string) error {
+	return c.CancelOrderByClientIDContext(context.Background(), userID, clientOrderID)
+}
+
+func (c *Client) CancelOrderByClientIDContext(ctx context.Context, userID, clientOrderID string) error {
+	return c.call(ctx, request{
+		method:     http.MethodDelete,
+		path:       fmt.Sprintf("/order/client/%s/%s", url.PathEscape(userID), url.PathEscape(clientOrderID)),
+		userID:     userID,
+		idempotent: true,
+	}, http.StatusOK, nil)
+}
+
+func (c *Client) GetOrder(orderID string) (*server.OrderRecord, error) {
+	return c.GetOrderContext(context.Background(), orderID)
+}
+
+func (c *Client) GetOrderContext(ctx context.Context, orderID string) (*server.OrderRecord, error) {
+	order := &server.OrderRecord{}
+
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       "/order/" + url.PathEscape(orderID),
+		idempotent: true,
+	}, http.StatusOK, order)
+	if err != nil {
+		return nil, err
 	}
 
-	userOrders := &server.UserOrders{}
+	return order, nil
+}
+
+// GetOrderHistory returns the orders of a user, newest first. An empty
+// status returns orders in every status.
+func (c *Client) GetOrderHistory(userID string, status server.OrderStatus) ([]server.OrderRecord, error) {
+	return c.GetOrderHistoryContext(context.Background(), userID, status)
+}
+
+func (c *Client) GetOrderHistoryContext(ctx context.Context, userID string, status server.OrderStatus) ([]server.OrderRecord, error) {
+	query := url.Values{}
+	if status != "" {
+		query.Set("status", string(status))
+	}
 
-	err = json.NewDecoder(res.Body).Decode(userOrders)
+	var orders []server.OrderRecord
+
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/users/%s/orders", url.PathEscape(userID)),
+		query:      query,
+		userID:     userID,
+		idempotent: true,
+	}, http.StatusOK, &orders)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 
-	return userOrders, nil
+	return orders, nil
+}
+
+func (c *Client) GetMarkets() ([]server.MarketRes, error) {
+	return c.GetMarketsContext(context.Background())
 }
 
-func (c *Client) GetTrades(market server.Market) ([]*order_book.Trade, error) {
-	url := fmt.Sprintf("%s/trades/%s", baseURL, market)
+func (c *Client) GetMarketsContext(ctx context.Context) ([]server.MarketRes, error) {
+	var markets []server.MarketRes
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       "/markets",
+		idempotent: true,
+	}, http.StatusOK, &markets)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := c.Do(req)
+	return markets, nil
+}
+
+// GetBalances returns the balances of a user in the assets whose settlers
+// keep balances.
+func (c *Client) GetBalances(userID string) ([]server.BalanceRes, error) {
+	return c.GetBalancesContext(context.Background(), userID)
+}
+
+func (c *Client) GetBalancesContext(ctx context.Context, userID string) ([]server.BalanceRes, error) {
+	var balances []server.BalanceRes
+
+	err := c.call(ctx, request{
+		method:     http.MethodGet,
+		path:       fmt.Sprintf("/users/%s/balances", url.PathEscape(userID)),
+		userID:     userID,
+		idempotent: true,
+	}, http.StatusOK, &balances)
 	if err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GetUserOrders: %s", res.Status)
+	return balances, nil
+}
+
+// CancelAll cancels the open orders of a user, only in market and on side
+// ("bid" or "ask") unless they are empty.
+func (c *Client) CancelAll(userID string, market server.Market, side string) (*server.CancelAllRes, error) {
+	return c.CancelAllContext(context.Background(), userID, market, side)
+}
+
+func (c *Client) CancelAllContext(ctx context.Context, userID string, market server.Market, side string) (*server.CancelAllRes, error) {
+	query := url.Values{"user_id": {userID}}
+	if market != "" {
+		query.Set("market", string(market))
+	}
+	if side != "" {
+		query.Set("side", side)
 	}
 
-	var trades []*order_book.Trade
+	cancelAllRes := &server.CancelAllRes{}
 
-	err = json.NewDecoder(res.Body).Decode(&trades)
+	err := c.call(ctx, request{
+		method:     http.MethodDelete,
+		path:       "/orders",
+		query:      query,
+		userID:     userID,
+		idempotent: true,
+	}, http.StatusOK, cancelAllRes)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		err = res.Body.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 
-	return trades, nil
+	return cancelAllRes, nil
 }
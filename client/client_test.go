@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"invalid_request","message":"invalid request","details":{"size":"must be a positive number"}}`))
+	}))
+	defer ts.Close()
+
+	cl := NewClient(WithBaseURL(ts.URL))
+	_, err := cl.PlaceLimitOrder(&PlaceOrderArgs{UserID: "user"})
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("%v is not an APIError", err)
+	}
+	assert(t, apiErr.StatusCode, http.StatusBadRequest)
+	assert(t, apiErr.Code, server.CodeInvalidRequest)
+	assert(t, apiErr.Details, map[string]string{"size": "must be a positive number"})
+}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"price":3500}`))
+	}))
+	defer ts.Close()
+
+	price, err := NewClient(WithBaseURL(ts.URL)).GetBestPrice(server.ETH, "bid")
+	assert(t, err, nil)
+	assert(t, price, 3500.0)
+	assert(t, calls, 3)
+}
+
+func TestClientOptions(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte(`{"order_id":"order"}`))
+	}))
+	defer ts.Close()
+
+	cl := NewClient(WithBaseURL(ts.URL+"/"), WithUserID("user"), WithAPIKey("key"), WithAdminToken("token"))
+
+	res, err := cl.PlaceLimitOrder(&PlaceOrderArgs{Size: 1, Price: 3500})
+	assert(t, err, nil)
+	assert(t, res.OrderID, "order")
+	assert(t, header.Get(server.HeaderUserID), "user")
+	assert(t, header.Get(server.HeaderAPIKey), "key")
+	assert(t, header.Get("Authorization"), "Bearer token")
+
+	_, err = cl.PlaceLimitOrder(&PlaceOrderArgs{UserID: "other", Size: 1, Price: 3500})
+	assert(t, err, nil)
+	assert(t, header.Get(server.HeaderUserID), "other")
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"order_id":"order"}`))
+	}))
+	defer ts.Close()
+
+	cl := NewClient(WithBaseURL(ts.URL), WithRetryPolicy(RetryPolicy{MaxRetries: 1, Backoff: time.Millisecond}))
+
+	// without a client order ID the order may have been placed
+	_, err := cl.PlaceLimitOrder(&PlaceOrderArgs{UserID: "user", Size: 1, Price: 3500})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("%v is not an APIError", err)
+	}
+	assert(t, apiErr.StatusCode, http.StatusServiceUnavailable)
+	assert(t, calls.Load(), int32(1))
+
+	calls.Store(0)
+	res, err := cl.PlaceLimitOrder(&PlaceOrderArgs{UserID: "user", ClientOrderID: "quote-1", Size: 1, Price: 3500})
+	assert(t, err, nil)
+	assert(t, res.OrderID, "order")
+	assert(t, calls.Load(), int32(2))
+}
+
+func TestClientContext(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := NewClient(WithBaseURL(ts.URL)).GetTradesContext(ctx, server.ETH)
+	assert(t, errors.Is(err, context.DeadlineExceeded), true)
+
+	_, err = NewClient(WithBaseURL(ts.URL), WithTimeout(50*time.Millisecond), WithRetryPolicy(RetryPolicy{})).GetTrades(server.ETH)
+	if err == nil {
+		t.Fatal("request didn't time out")
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto_exchange/server"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// APIError is an error response of the exchange. Callers inspect it with
+// errors.As to tell, for example, an unknown market from a rejected order.
+type APIError struct {
+	StatusCode int
+	Code       server.ErrorCode
+	Message    string
+	Details    map[string]string
+}
+
+func (e *APIError) Error() string {
+	if len(e.Details) == 0 {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("%d %s: %s %v", e.StatusCode, e.Code, e.Message, e.Details)
+}
+
+// decodeError reads the error envelope of a failed response. Responses that
+// aren't an envelope, like the ones of a proxy, keep the status only.
+func decodeError(res *http.Response) error {
+	defer closeBody(res)
+
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Message:    http.StatusText(res.StatusCode),
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return apiErr
+	}
+
+	var envelope server.APIError
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Code != "" {
+		apiErr.Code = envelope.Code
+		apiErr.Message = envelope.Message
+		apiErr.Details = envelope.Details
+	}
+
+	return apiErr
+}
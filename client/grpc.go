@@ -0,0 +1,449 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/exchangepb"
+	"crypto_exchange/server"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"strconv"
+)
+
+const DefaultGRPCTarget = "localhost:3001"
+
+// GRPCClient calls the gRPC API of the exchange. It takes and returns the
+// types of the REST client, errors of the exchange are returned as
+// *APIError.
+type GRPCClient struct {
+	conn   *grpc.ClientConn
+	api    exchangepb.ExchangeClient
+	userID string
+}
+
+// DialGRPC returns a client of the gRPC API at target, without TLS unless
+// opts say otherwise. Calls are made for userID unless they name another
+// user, it may be empty, with the API key given by WithGRPCAPIKey.
+func DialGRPC(target, userID string, opts ...grpc.DialOption) (*GRPCClient, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCClient{
+		conn:   conn,
+		api:    exchangepb.NewExchangeClient(conn),
+		userID: userID,
+	}, nil
+}
+
+// WithGRPCAPIKey sends the API key of the user of a GRPCClient with every
+// call, calls made for the user need it.
+func WithGRPCAPIKey(apiKey string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(apiKeyCredentials(apiKey))
+}
+
+// apiKeyCredentials puts an API key in the metadata of calls. It is sent
+// without TLS too, like the X-API-Key header of the REST client.
+type apiKeyCredentials string
+
+func (k apiKeyCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{server.MetadataAPIKey: string(k)}, nil
+}
+
+func (k apiKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// outgoing names the user of a call in its metadata.
+func (c *GRPCClient) outgoing(ctx context.Context, userID string) context.Context {
+	if userID = c.user(userID); userID == "" {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, server.MetadataUserID, userID)
+}
+
+func (c *GRPCClient) user(userID string) string {
+	if userID == "" {
+		return c.userID
+	}
+
+	return userID
+}
+
+func (c *GRPCClient) PlaceLimitOrder(ctx context.Context, args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
+	return c.placeOrder(ctx, args, server.LimitOrder)
+}
+
+func (c *GRPCClient) PlaceMarketOrder(ctx context.Context, args *PlaceOrderArgs) (*server.PlaceOrderRes, error) {
+	return c.placeOrder(ctx, args, server.MarketOrder)
+}
+
+func (c *GRPCClient) placeOrder(ctx context.Context, args *PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error) {
+	userID := c.user(args.UserID)
+
+	market := args.Market
+	if market == "" {
+		market = server.ETH
+	}
+
+	req := &exchangepb.PlaceOrderRequest{
+		UserId:        userID,
+		ClientOrderId: args.ClientOrderID,
+		Market:        string(market),
+		Type:          string(orderType),
+		IsBid:         args.IsBid,
+		Size:          args.Size,
+	}
+	if orderType == server.LimitOrder {
+		req.Price = args.Price
+	}
+
+	res, err := c.api.PlaceOrder(c.outgoing(ctx, userID), req)
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+
+	return &server.PlaceOrderRes{
+		Message:       res.Message,
+		OrderID:       res.OrderId,
+		ClientOrderID: res.ClientOrderId,
+	}, nil
+}
+
+func (c *GRPCClient) CancelOrder(ctx context.Context, orderID string) error {
+	_, err := c.api.CancelOrder(c.outgoing(ctx, ""), &exchangepb.CancelOrderRequest{OrderId: orderID})
+
+	return fromStatus(err)
+}
+
+// AmendOrder replaces an open limit order with one of the new price and
+// size, the result holds the ID of the replacement.
+func (c *GRPCClient) AmendOrder(ctx context.Context, orderID string, args *AmendOrderArgs) (*server.AmendOrderRes, error) {
+	userID := c.user(args.UserID)
+
+	res, err := c.api.AmendOrder(c.outgoing(ctx, userID), &exchangepb.AmendOrderRequest{
+		OrderId:       orderID,
+		UserId:        userID,
+		ClientOrderId: args.ClientOrderID,
+		Price:         args.Price,
+		Size:          args.Size,
+	})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+
+	return &server.AmendOrderRes{
+		Message:         res.Message,
+		OrderID:         res.OrderId,
+		ReplacedOrderID: res.ReplacedOrderId,
+		ClientOrderID:   res.ClientOrderId,
+	}, nil
+}
+
+// GetBookDepth returns the levels of a book, all of them unless depth
+// limits the levels of each side, with the sequence number of the last
+// update of the book they include.
+func (c *GRPCClient) GetBookDepth(ctx context.Context, market server.Market, depth int) (*server.BookDepthRes, uint64, error) {
+	book, err := c.api.GetBook(c.outgoing(ctx, ""), &exchangepb.GetBookRequest{Market: string(market), Depth: int32(depth)})
+	if err != nil {
+		return nil, 0, fromStatus(err)
+	}
+
+	return &server.BookDepthRes{
+		Bids:     fromPBLevels(book.Bids),
+		Asks:     fromPBLevels(book.Asks),
+		Checksum: book.Checksum,
+	}, book.Seq, nil
+}
+
+// GetTrades returns the trades of a market, oldest first.
+func (c *GRPCClient) GetTrades(ctx context.Context, market server.Market) ([]*server.Trade, error) {
+	res, err := c.api.GetTrades(c.outgoing(ctx, ""), &exchangepb.GetTradesRequest{Market: string(market)})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+
+	trades := make([]*server.Trade, len(res.Trades))
+	for i, trade := range res.Trades {
+		trades[i] = fromPBTrade(trade)
+	}
+
+	return trades, nil
+}
+
+// GetOrderHistory returns the orders of a user, newest first, only those in
+// status unless it is empty.
+func (c *GRPCClient) GetOrderHistory(ctx context.Context, userID string, status server.OrderStatus) ([]server.OrderRecord, error) {
+	userID = c.user(userID)
+
+	res, err := c.api.GetUserOrders(c.outgoing(ctx, userID), &exchangepb.GetUserOrdersRequest{UserId: userID, Status: string(status)})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+
+	return fromPBOrders(res.Orders), nil
+}
+
+// GRPCStream delivers the events of a gRPC stream, starting with its
+// snapshots. Unlike Stream it doesn't reconnect, Events is closed once the
+// stream ends and Err tells why.
+type GRPCStream struct {
+	events chan Event
+	cancel context.CancelFunc
+	err    error
+}
+
+// StreamMarketData streams the channels of a market, book, trades and
+// ticker, all of them if none are given. The book channel starts with an
+// EventBookSnapshot, so the events can be applied to a LocalBook.
+func (c *GRPCClient) StreamMarketData(ctx context.Context, market server.Market, channels ...string) (*GRPCStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := c.api.StreamMarketData(c.outgoing(ctx, ""), &exchangepb.StreamMarketDataRequest{
+		Market:   string(market),
+		Channels: channels,
+	})
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+
+	return newGRPCStream(ctx, cancel, stream, func() (Event, error) {
+		data, err := stream.Recv()
+		if err != nil {
+			return Event{}, err
+		}
+		return fromPBMarketData(data), nil
+	})
+}
+
+// StreamOrders streams the changes to the orders of the user of the client,
+// starting with an EventOrdersSnapshot.
+func (c *GRPCClient) StreamOrders(ctx context.Context) (*GRPCStream, error) {
+	if c.userID == "" {
+		return nil, ErrNoUser
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := c.api.StreamOrders(c.outgoing(ctx, ""), &exchangepb.StreamOrdersRequest{UserId: c.userID})
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err)
+	}
+
+	return newGRPCStream(ctx, cancel, stream, func() (Event, error) {
+		update, err := stream.Recv()
+		if err != nil {
+			return Event{}, err
+		}
+		return fromPBOrderUpdate(update), nil
+	})
+}
+
+// newGRPCStream delivers the events recv returns until it fails. The
+// exchange marks the header of a stream once it is subscribed, the error of
+// a stream whose header isn't marked is returned.
+func newGRPCStream(ctx context.Context, cancel context.CancelFunc, stream grpc.ClientStream, recv func() (Event, error)) (*GRPCStream, error) {
+	if header, _ := stream.Header(); len(header.Get(server.MetadataSubscribed)) == 0 {
+		_, err := recv()
+		cancel()
+		return nil, fromStatus(err)
+	}
+
+	s := &GRPCStream{
+		events: make(chan Event, streamBuffer),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(s.events)
+
+		for {
+			event, err := recv()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+					s.err = fromStatus(err)
+				}
+				return
+			}
+
+			select {
+			case s.events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *GRPCStream) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns why the stream ended once Events is closed, nil if it was
+// closed or its context is done.
+func (s *GRPCStream) Err() error {
+	return s.err
+}
+
+func (s *GRPCStream) Close() {
+	s.cancel()
+}
+
+// fromStatus returns the error of the exchange a gRPC status carries as an
+// *APIError, other errors as they are.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || err == nil {
+		return err
+	}
+
+	var apiErr *APIError
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == server.ErrorDomain {
+			statusCode, _ := strconv.Atoi(info.Metadata[server.ErrorMetadataStatus])
+			apiErr = &APIError{
+				StatusCode: statusCode,
+				Code:       server.ErrorCode(info.Reason),
+				Message:    st.Message(),
+			}
+		}
+	}
+	if apiErr == nil {
+		return err
+	}
+
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			apiErr.Details = make(map[string]string)
+			for _, violation := range badRequest.FieldViolations {
+				apiErr.Details[violation.Field] = violation.Description
+			}
+		}
+	}
+
+	return apiErr
+}
+
+func fromPBMarketData(data *exchangepb.MarketData) Event {
+	event := Event{
+		Market: server.Market(data.Market),
+		Seq:    data.Seq,
+	}
+
+	switch v := data.Data.(type) {
+	case *exchangepb.MarketData_Book:
+		event.Type = EventBookSnapshot
+		event.Book = &server.BookUpdate{
+			Bids:     fromPBLevels(v.Book.Bids),
+			Asks:     fromPBLevels(v.Book.Asks),
+			Checksum: v.Book.Checksum,
+		}
+	case *exchangepb.MarketData_BookUpdate:
+		event.Type = EventBookUpdate
+		event.Book = &server.BookUpdate{
+			Bids:     fromPBLevels(v.BookUpdate.Bids),
+			Asks:     fromPBLevels(v.BookUpdate.Asks),
+			Checksum: v.BookUpdate.Checksum,
+		}
+	case *exchangepb.MarketData_Trade:
+		event.Type = EventTrade
+		event.Trade = fromPBTrade(v.Trade)
+	case *exchangepb.MarketData_Ticker:
+		event.Type = EventTicker
+		event.Ticker = &server.Ticker{
+			BidPrice: v.Ticker.BidPrice,
+			BidSize:  v.Ticker.BidSize,
+			AskPrice: v.Ticker.AskPrice,
+			AskSize:  v.Ticker.AskSize,
+		}
+	}
+
+	return event
+}
+
+func fromPBOrderUpdate(update *exchangepb.OrderUpdate) Event {
+	event := Event{Seq: update.Seq}
+
+	switch v := update.Data.(type) {
+	case *exchangepb.OrderUpdate_Snapshot:
+		event.Type = EventOrdersSnapshot
+		event.Orders = fromPBOrders(v.Snapshot.Orders)
+	case *exchangepb.OrderUpdate_Order:
+		order := fromPBOrder(v.Order)
+		event.Type = EventOrder
+		event.Market = order.Market
+		event.Order = &order
+	}
+
+	return event
+}
+
+func fromPBLevels(levels []*exchangepb.BookLevel) []server.BookLevel {
+	res := make([]server.BookLevel, len(levels))
+	for i, level := range levels {
+		res[i] = server.BookLevel{Price: level.Price, Size: level.Size}
+	}
+
+	return res
+}
+
+func fromPBTrade(trade *exchangepb.Trade) *server.Trade {
+	res := &server.Trade{
+		ID:        trade.Id,
+		IsBid:     trade.IsBid,
+		Price:     trade.Price,
+		Size:      trade.Size,
+		Timestamp: trade.Timestamp,
+		MakerFee:  trade.MakerFee,
+		TakerFee:  trade.TakerFee,
+	}
+	if trade.SettlementStatus != "" {
+		res.Settlement = &server.Settlement{TradeID: trade.Id, Status: server.SettlementStatus(trade.SettlementStatus)}
+	}
+
+	return res
+}
+
+func fromPBOrders(orders []*exchangepb.Order) []server.OrderRecord {
+	res := make([]server.OrderRecord, len(orders))
+	for i, order := range orders {
+		res[i] = fromPBOrder(order)
+	}
+
+	return res
+}
+
+func fromPBOrder(order *exchangepb.Order) server.OrderRecord {
+	return server.OrderRecord{
+		ID:            order.Id,
+		ClientOrderID: order.ClientOrderId,
+		UserID:        order.UserId,
+		Market:        server.Market(order.Market),
+		Type:          server.OrderType(order.Type),
+		IsBid:         order.IsBid,
+		Price:         order.Price,
+		Size:          order.Size,
+		ExecutedSize:  order.ExecutedSize,
+		AvgFillPrice:  order.AvgFillPrice,
+		Status:        server.OrderStatus(order.Status),
+		Reason:        order.Reason,
+		CreatedAt:     order.CreatedAt.AsTime(),
+		UpdatedAt:     order.UpdatedAt.AsTime(),
+	}
+}
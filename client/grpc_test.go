@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGRPCClient(t *testing.T) {
+	ex := newExchange(t)
+
+	e := echo.New()
+	ex.Routes(e)
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := ex.GRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	cl := NewClient(WithBaseURL(ts.URL))
+	maker, err := cl.RegisterUser("")
+	assert(t, err, nil)
+	taker, err := cl.RegisterUser("")
+	assert(t, err, nil)
+
+	gc, err := DialGRPC(lis.Addr().String(), maker.ID, WithGRPCAPIKey(maker.APIKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = gc.StreamMarketData(ctx, "DOGE")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("%v is not an APIError", err)
+	}
+	assert(t, apiErr.StatusCode, http.StatusBadRequest)
+	assert(t, apiErr.Code, server.CodeInvalidRequest)
+	if apiErr.Details["market"] == "" {
+		t.Errorf("no details for market in %+v", apiErr)
+	}
+
+	_, err = gc.PlaceLimitOrder(ctx, &PlaceOrderArgs{Size: 2})
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("%v is not an APIError", err)
+	}
+	assert(t, apiErr.Code, server.CodeInvalidRequest)
+	if apiErr.Details["price"] == "" {
+		t.Errorf("no details for price in %+v", apiErr)
+	}
+
+	res, err := gc.PlaceLimitOrder(ctx, &PlaceOrderArgs{IsBid: true, Size: 2, Price: 3400})
+	assert(t, err, nil)
+
+	stream, err := gc.StreamMarketData(ctx, server.ETH, server.ChannelBook)
+	assert(t, err, nil)
+	defer stream.Close()
+
+	book := NewLocalBook(server.ETH)
+	next := func() {
+		t.Helper()
+
+		select {
+		case event, ok := <-stream.Events():
+			if !ok {
+				t.Fatalf("stream ended: %v", stream.Err())
+			}
+			assert(t, book.Apply(event), nil)
+		case <-ctx.Done():
+			t.Fatal("no event")
+		}
+	}
+
+	next()
+	best, ok := book.BestBid()
+	assert(t, ok, true)
+	assert(t, best, server.BookLevel{Price: 3400, Size: 2})
+
+	amended, err := gc.AmendOrder(ctx, res.OrderID, &AmendOrderArgs{Price: 3450})
+	assert(t, err, nil)
+	assert(t, amended.ReplacedOrderID, res.OrderID)
+
+	for best.Price != 3450 {
+		next()
+		best, _ = book.BestBid()
+	}
+	assert(t, best, server.BookLevel{Price: 3450, Size: 2})
+
+	_, err = NewClient(WithBaseURL(ts.URL), WithAPIKey(taker.APIKey)).PlaceMarketOrder(&PlaceOrderArgs{UserID: taker.ID, Size: 2})
+	assert(t, err, nil)
+
+	for book.Synced() {
+		if _, ok := book.BestBid(); !ok {
+			break
+		}
+		next()
+	}
+	_, ok = book.BestBid()
+	assert(t, ok, false)
+
+	orders, err := gc.GetOrderHistory(ctx, "", server.OrderFilled)
+	assert(t, err, nil)
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, amended.OrderID)
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrChecksumMismatch = errors.New("client: local book doesn't match the checksum of the exchange")
+
+// LocalBook is a replica of the levels of a market built from the snapshots
+// and updates of its book stream, queried without asking the exchange.
+// Every update is verified against the checksum the exchange publishes with
+// it. It is safe for concurrent use.
+type LocalBook struct {
+	mu     sync.RWMutex
+	market server.Market
+	// bids from the highest price down, asks from the lowest up
+	bids   []server.BookLevel
+	asks   []server.BookLevel
+	seq    uint64
+	synced bool
+}
+
+func NewLocalBook(market server.Market) *LocalBook {
+	return &LocalBook{market: market}
+}
+
+// Apply applies a book snapshot or update of the market of the book, other
+// events are ignored and so are updates until the first snapshot. If the
+// book doesn't match the checksum of the event it returns
+// ErrChecksumMismatch and stays out of sync until the next snapshot.
+func (b *LocalBook) Apply(event Event) error {
+	if event.Market != b.market || event.Book == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch event.Type {
+	case EventBookSnapshot:
+		b.bids = append([]server.BookLevel(nil), event.Book.Bids...)
+		b.asks = append([]server.BookLevel(nil), event.Book.Asks...)
+		b.synced = true
+	case EventBookUpdate:
+		if !b.synced {
+			return nil
+		}
+		for _, level := range event.Book.Bids {
+			b.bids = setLevel(b.bids, level, true)
+		}
+		for _, level := range event.Book.Asks {
+			b.asks = setLevel(b.asks, level, false)
+		}
+	default:
+		return nil
+	}
+
+	b.seq = event.Seq
+	if server.BookChecksum(b.bids, b.asks) != event.Book.Checksum {
+		b.synced = false
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// setLevel sets a level of a side sorted best first, removing it if its size
+// is zero.
+func setLevel(levels []server.BookLevel, level server.BookLevel, isBid bool) []server.BookLevel {
+	i := sort.Search(len(levels), func(i int) bool {
+		if isBid {
+			return levels[i].Price <= level.Price
+		}
+		return levels[i].Price >= level.Price
+	})
+
+	found := i < len(levels) && levels[i].Price == level.Price
+	switch {
+	case found && level.Size == 0:
+		return append(levels[:i], levels[i+1:]...)
+	case found:
+		levels[i] = level
+	case level.Size != 0:
+		levels = append(levels, server.BookLevel{})
+		copy(levels[i+1:], levels[i:])
+		levels[i] = level
+	}
+
+	return levels
+}
+
+func (b *LocalBook) Market() server.Market {
+	return b.market
+}
+
+// Synced reports whether the book holds a snapshot with every update since
+// applied and verified.
+func (b *LocalBook) Synced() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.synced
+}
+
+// Seq returns the sequence number of the last book event applied.
+func (b *LocalBook) Seq() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.seq
+}
+
+func (b *LocalBook) BestBid() (server.BookLevel, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.bids) == 0 {
+		return server.BookLevel{}, false
+	}
+
+	return b.bids[0], true
+}
+
+func (b *LocalBook) BestAsk() (server.BookLevel, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.asks) == 0 {
+		return server.BookLevel{}, false
+	}
+
+	return b.asks[0], true
+}
+
+// Depth returns the first n levels of each side, best first, every level if
+// n is zero.
+func (b *LocalBook) Depth(n int) (bids, asks []server.BookLevel) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return firstLevels(b.bids, n), firstLevels(b.asks, n)
+}
+
+func firstLevels(levels []server.BookLevel, n int) []server.BookLevel {
+	if n == 0 || n > len(levels) {
+		n = len(levels)
+	}
+
+	return append([]server.BookLevel(nil), levels[:n]...)
+}
+
+// VWAP returns the average price a market order of size on the given side
+// would fill at, a bid filling against the asks. ok is false if the book
+// doesn't hold enough volume.
+func (b *LocalBook) VWAP(isBid bool, size float64) (price float64, ok bool) {
+	if size <= 0 {
+		return 0, false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	levels := b.bids
+	if isBid {
+		levels = b.asks
+	}
+
+	var filled, notional float64
+	for _, level := range levels {
+		fill := min(level.Size, size-filled)
+		filled += fill
+		notional += fill * level.Price
+
+		if filled >= size {
+			return notional / filled, true
+		}
+	}
+
+	return 0, false
+}
+
+// MirrorBook returns a LocalBook of market kept up to date from the book
+// stream until ctx is done. It returns once the book holds its first
+// snapshot. A book failing its checksum is synced again from a snapshot.
+func (c *Client) MirrorBook(ctx context.Context, market server.Market) (*LocalBook, error) {
+	stream, err := c.Subscribe(ctx, BookStream(market))
+	if err != nil {
+		return nil, err
+	}
+
+	book := NewLocalBook(market)
+	synced := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		defer stream.Close()
+
+		for event := range stream.Events() {
+			if err := book.Apply(event); errors.Is(err, ErrChecksumMismatch) {
+				stream.Reconnect()
+			}
+			if event.Type == EventBookSnapshot {
+				once.Do(func() { close(synced) })
+			}
+		}
+	}()
+
+	select {
+	case <-synced:
+		return book, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"crypto_exchange/server/servertest"
+	"testing"
+	"time"
+)
+
+// startExchange serves an exchange with a fake settler for the duration of
+// the test and returns its URL.
+func startExchange(t *testing.T) string {
+	t.Helper()
+
+	return servertest.Serve(t, newExchange(t))
+}
+
+// newExchange returns an exchange with a fake settler that settles trades
+// for the duration of the test.
+func newExchange(t *testing.T) *server.Exchange {
+	t.Helper()
+
+	return servertest.NewExchange(t, servertest.Config())
+}
+
+func TestLocalBook(t *testing.T) {
+	book := NewLocalBook(server.ETH)
+
+	bids := []server.BookLevel{{Price: 101, Size: 1}, {Price: 100, Size: 2}}
+	asks := []server.BookLevel{{Price: 102, Size: 3}, {Price: 104, Size: 1}}
+
+	// updates before the first snapshot are ignored
+	err := book.Apply(Event{Type: EventBookUpdate, Market: server.ETH, Book: &server.BookUpdate{}})
+	assert(t, err, nil)
+	assert(t, book.Synced(), false)
+
+	err = book.Apply(Event{Type: EventBookSnapshot, Market: server.ETH, Seq: 4, Book: &server.BookUpdate{
+		Bids:     bids,
+		Asks:     asks,
+		Checksum: server.BookChecksum(bids, asks),
+	}})
+	assert(t, err, nil)
+	assert(t, book.Synced(), true)
+
+	best, ok := book.BestBid()
+	assert(t, ok, true)
+	assert(t, best, server.BookLevel{Price: 101, Size: 1})
+
+	price, ok := book.VWAP(true, 4)
+	assert(t, ok, true)
+	assert(t, price, (3*102+104)/4.0)
+	_, ok = book.VWAP(true, 5)
+	assert(t, ok, false)
+
+	bids = []server.BookLevel{{Price: 100.5, Size: 1}, {Price: 100, Size: 2}}
+	asks = []server.BookLevel{{Price: 103, Size: 2}, {Price: 104, Size: 1}}
+	err = book.Apply(Event{Type: EventBookUpdate, Market: server.ETH, Seq: 5, Book: &server.BookUpdate{
+		Bids:     []server.BookLevel{{Price: 101}, {Price: 100.5, Size: 1}},
+		Asks:     []server.BookLevel{{Price: 102}, {Price: 103, Size: 2}},
+		Checksum: server.BookChecksum(bids, asks),
+	}})
+	assert(t, err, nil)
+
+	depthBids, depthAsks := book.Depth(0)
+	assert(t, depthBids, bids)
+	assert(t, depthAsks, asks)
+	depthBids, _ = book.Depth(1)
+	assert(t, depthBids, bids[:1])
+
+	err = book.Apply(Event{Type: EventBookUpdate, Market: server.ETH, Seq: 6, Book: &server.BookUpdate{
+		Bids:     []server.BookLevel{{Price: 99, Size: 1}},
+		Checksum: 1,
+	}})
+	assert(t, err, ErrChecksumMismatch)
+	assert(t, book.Synced(), false)
+}
+
+func TestMirrorBook(t *testing.T) {
+	cl := NewClient(WithBaseURL(startExchange(t)))
+
+	maker, err := cl.RegisterUser("")
+	assert(t, err, nil)
+	taker, err := cl.RegisterUser("")
+	assert(t, err, nil)
+
+	makerClient := NewClient(WithBaseURL(cl.baseURL), WithUserID(maker.ID), WithAPIKey(maker.APIKey))
+	takerClient := NewClient(WithBaseURL(cl.baseURL), WithUserID(taker.ID), WithAPIKey(taker.APIKey))
+
+	_, err = makerClient.PlaceLimitOrder(&PlaceOrderArgs{IsBid: true, Size: 2, Price: 3400})
+	assert(t, err, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	book, err := takerClient.MirrorBook(ctx, server.ETH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, price := range []float64{3500, 3500.5, 3600} {
+		_, err = makerClient.PlaceLimitOrder(&PlaceOrderArgs{Size: 1.1, Price: price})
+		assert(t, err, nil)
+	}
+	_, err = takerClient.PlaceMarketOrder(&PlaceOrderArgs{IsBid: true, Size: 1.5})
+	assert(t, err, nil)
+
+	depth, err := cl.GetBookDepth(server.ETH, 0)
+	assert(t, err, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bids, asks := book.Depth(0)
+		if book.Synced() && equalLevels(bids, depth.Bids) && equalLevels(asks, depth.Asks) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("local book %v %v doesn't match %v %v", bids, asks, depth.Bids, depth.Asks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	best, _ := book.BestAsk()
+	assert(t, best.Price, 3500.5)
+}
+
+func equalLevels(a, b []server.BookLevel) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"net/http"
+	"time"
+)
+
+const DefaultTimeout = 10 * time.Second
+
+// RetryPolicy decides how often and how long apart a request is retried.
+// Requests the exchange rate limited are always retried, idempotent ones
+// also on network errors and when a gateway in front of the exchange fails.
+// The zero value disables retries.
+type RetryPolicy struct {
+	MaxRetries int
+	// Backoff is the wait before the first retry, it doubles with every
+	// further retry up to MaxBackoff. A longer Retry-After header wins.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// wait returns how long to wait before retry attempt+1.
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	wait := p.Backoff << attempt
+	if p.MaxBackoff > 0 && (wait > p.MaxBackoff || wait <= 0) {
+		wait = p.MaxBackoff
+	}
+
+	return wait
+}
+
+type Option func(*Client)
+
+// WithBaseURL sets the URL of the exchange, DefaultBaseURL by default.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithHTTPClient sends requests with hc. Its timeout is kept unless
+// WithTimeout is given too.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithTimeout bounds every attempt of a request, including reading the
+// response. Zero means no timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = &timeout
+	}
+}
+
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// WithUserID makes requests for userID unless a call names another user.
+func WithUserID(userID string) Option {
+	return func(c *Client) {
+		c.userID = userID
+	}
+}
+
+// WithAPIKey sends the API key of the user of the client with every
+// request, requests made for the user need it.
+func WithAPIKey(apiKey string) Option {
+	return func(c *Client) {
+		c.apiKey = apiKey
+	}
+}
+
+// WithAdminToken sends token as the bearer token of every request, the
+// admin API requires it.
+func WithAdminToken(token string) Option {
+	return func(c *Client) {
+		c.adminToken = token
+	}
+}
@@ -0,0 +1,471 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventTrade          EventType = "trade"
+	EventBookSnapshot   EventType = "book_snapshot"
+	EventBookUpdate     EventType = "book_update"
+	EventTicker         EventType = "ticker"
+	EventOrder          EventType = "order"
+	EventOrdersSnapshot EventType = "orders_snapshot"
+	EventMarketStatus   EventType = "market_status"
+	EventError          EventType = "error"
+	EventDisconnected   EventType = "disconnected"
+
+	// the exchange pings every 15 seconds
+	streamReadTimeout  = 45 * time.Second
+	streamWriteTimeout = 5 * time.Second
+	streamBuffer       = 256
+)
+
+var ErrNoUser = errors.New("client: streams need a user, see WithUserID")
+
+type EventType string
+
+// Event is a message of a stream, which of its fields is set depends on
+// Type. A snapshot replaces what the consumer knows of a book or of the
+// open orders of the user, one is sent after subscribing and whenever the
+// stream missed events.
+type Event struct {
+	Type   EventType
+	Market server.Market
+	// Seq is the sequence number of the event in its stream, or the one of
+	// the last event a snapshot includes.
+	Seq    uint64
+	Trade  *server.Trade
+	Book   *server.BookUpdate
+	Ticker *server.Ticker
+	Order  *server.OrderRecord
+	Orders []server.OrderRecord
+	Status *server.MarketStatusEvent
+	// Err is the error of an EventError or why the stream disconnected.
+	Err error
+}
+
+// Subscription names a stream of the exchange.
+type Subscription struct {
+	Channel string
+	Market  server.Market
+}
+
+func TradeStream(market server.Market) Subscription {
+	return Subscription{Channel: server.ChannelTrades, Market: market}
+}
+
+func BookStream(market server.Market) Subscription {
+	return Subscription{Channel: server.ChannelBook, Market: market}
+}
+
+func TickerStream(market server.Market) Subscription {
+	return Subscription{Channel: server.ChannelTicker, Market: market}
+}
+
+// OrderStream carries the changes to the orders of the user of the client.
+func OrderStream() Subscription {
+	return Subscription{Channel: server.ChannelOrders}
+}
+
+// Stream delivers the events of its subscriptions. When the connection
+// drops it reconnects with backoff, subscribes again and catches up from
+// REST snapshots, as it does when it notices a gap in the sequence numbers
+// of a stream.
+type Stream struct {
+	c      *Client
+	subs   []Subscription
+	seqs   map[Subscription]*streamSeq
+	events chan Event
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// streamSeq is the sequence number a subscription is at. started is unset
+// until the trades stream was subscribed the first time, trades before
+// that aren't delivered.
+type streamSeq struct {
+	seq     uint64
+	started bool
+}
+
+// Subscribe opens a stream of subs for the user of the client until ctx is
+// done or the stream is closed. The session belongs to the user of the API
+// key of the client, OrderStream needs one, see WithAPIKey. Events have to
+// be read, a consumer falling behind makes the exchange drop the connection
+// and the stream catch up.
+func (c *Client) Subscribe(ctx context.Context, subs ...Subscription) (*Stream, error) {
+	if c.userID == "" {
+		return nil, ErrNoUser
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		c:      c,
+		subs:   subs,
+		seqs:   make(map[Subscription]*streamSeq),
+		events: make(chan Event, streamBuffer),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	for _, sub := range subs {
+		s.seqs[sub] = &streamSeq{}
+	}
+
+	go s.run(ctx, conn)
+
+	return s, nil
+}
+
+// Events returns the events of the stream, it is closed once the stream
+// ends.
+func (s *Stream) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Stream) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Reconnect drops the connection of the stream, which reconnects and starts
+// every subscription from a snapshot again, for example once a replica
+// built from the stream no longer matches the exchange.
+func (s *Stream) Reconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.baseURL + "/ws")
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+
+	header := http.Header{}
+	header.Set(server.HeaderUserID, c.userID)
+	c.setCredentials(header)
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: c.http.Timeout,
+	}
+
+	conn, res, err := dialer.DialContext(ctx, u.String(), header)
+	if errors.Is(err, websocket.ErrBadHandshake) && res != nil {
+		return nil, decodeError(res)
+	}
+
+	return conn, err
+}
+
+func (s *Stream) run(ctx context.Context, conn *websocket.Conn) {
+	defer close(s.done)
+	defer close(s.events)
+
+	attempt := 0
+	for {
+		if conn != nil {
+			err := s.session(ctx, conn)
+			if ctx.Err() != nil || !s.emit(ctx, Event{Type: EventDisconnected, Err: err}) {
+				return
+			}
+			attempt = 0
+		}
+
+		timer := time.NewTimer(s.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		attempt++
+
+		conn, _ = s.c.dial(ctx)
+	}
+}
+
+// backoff returns the wait before reconnecting attempt, following the
+// retry policy of the client without its limit on retries.
+func (s *Stream) backoff(attempt int) time.Duration {
+	policy := s.c.retry
+	if policy.Backoff <= 0 {
+		policy = DefaultRetryPolicy
+	}
+
+	return policy.wait(attempt)
+}
+
+// streamMessage is a WSEvent whose data is decoded once its type is known.
+type streamMessage struct {
+	Type    string          `json:"type"`
+	Channel string          `json:"channel"`
+	Market  server.Market   `json:"market"`
+	Seq     uint64          `json:"seq"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// session subscribes on conn and handles its messages until it fails.
+func (s *Stream) session(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(streamWriteTimeout))
+	})
+
+	for _, sub := range s.subs {
+		cmd := server.WSCommand{Op: server.WSOpSubscribe, Channel: sub.Channel, Market: sub.Market}
+		if err := conn.WriteJSON(cmd); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var msg streamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+
+		if err := s.handle(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Stream) handle(ctx context.Context, msg streamMessage) error {
+	sub := Subscription{Channel: msg.Channel, Market: msg.Market}
+
+	switch msg.Type {
+	case server.WSEventError:
+		var envelope server.APIError
+		if err := json.Unmarshal(msg.Data, &envelope); err != nil {
+			return err
+		}
+		return s.deliver(ctx, Event{Type: EventError, Err: &APIError{
+			StatusCode: http.StatusBadRequest,
+			Code:       envelope.Code,
+			Message:    envelope.Message,
+			Details:    envelope.Details,
+		}})
+	case server.WSEventMarketStatus:
+		var status server.MarketStatusEvent
+		if err := json.Unmarshal(msg.Data, &status); err != nil {
+			return err
+		}
+		return s.deliver(ctx, Event{Type: EventMarketStatus, Market: status.Market, Status: &status})
+	case server.WSEventSubscribed:
+		return s.subscribed(ctx, sub, msg)
+	case server.WSEventUnsubscribed:
+		return nil
+	}
+
+	seq, ok := s.seqs[sub]
+	if !ok || msg.Seq <= seq.seq {
+		// not subscribed or already part of a snapshot
+		return nil
+	}
+
+	if msg.Seq > seq.seq+1 && sub.Channel != server.ChannelTicker {
+		if err := s.resync(ctx, sub, seq); err != nil {
+			return err
+		}
+		if msg.Seq <= seq.seq {
+			return nil
+		}
+	}
+	seq.seq = msg.Seq
+
+	event := Event{Market: msg.Market, Seq: msg.Seq}
+	var data any
+	switch msg.Type {
+	case server.WSEventTrade:
+		event.Type, event.Trade = EventTrade, &server.Trade{}
+		data = event.Trade
+	case server.WSEventBook:
+		event.Type, event.Book = EventBookUpdate, &server.BookUpdate{}
+		data = event.Book
+	case server.WSEventTicker:
+		event.Type, event.Ticker = EventTicker, &server.Ticker{}
+		data = event.Ticker
+	case server.WSEventOrder:
+		event.Type, event.Order = EventOrder, &server.OrderRecord{}
+		data = event.Order
+	default:
+		return nil
+	}
+
+	if err := json.Unmarshal(msg.Data, data); err != nil {
+		return err
+	}
+
+	return s.deliver(ctx, event)
+}
+
+// subscribed starts a subscription at the sequence number the exchange
+// acknowledged it with. The ticker comes with the top of book, the book and
+// orders start from a snapshot and trades missed while disconnected are
+// caught up on.
+func (s *Stream) subscribed(ctx context.Context, sub Subscription, msg streamMessage) error {
+	seq, ok := s.seqs[sub]
+	if !ok {
+		return nil
+	}
+
+	switch sub.Channel {
+	case server.ChannelTicker:
+		seq.seq = msg.Seq
+
+		ticker := &server.Ticker{}
+		if err := json.Unmarshal(msg.Data, ticker); err != nil {
+			return err
+		}
+		return s.deliver(ctx, Event{Type: EventTicker, Market: sub.Market, Seq: msg.Seq, Ticker: ticker})
+	case server.ChannelTrades:
+		if !seq.started {
+			seq.seq, seq.started = msg.Seq, true
+			return nil
+		}
+	}
+
+	return s.resync(ctx, sub, seq)
+}
+
+// resync catches a subscription up from a REST snapshot and moves it to the
+// sequence number of the snapshot.
+func (s *Stream) resync(ctx context.Context, sub Subscription, seq *streamSeq) error {
+	switch sub.Channel {
+	case server.ChannelBook:
+		depth, snapshotSeq, err := s.c.bookDepth(ctx, sub.Market, 0)
+		if err != nil {
+			return err
+		}
+
+		seq.seq = snapshotSeq
+		return s.deliver(ctx, Event{
+			Type:   EventBookSnapshot,
+			Market: sub.Market,
+			Seq:    snapshotSeq,
+			Book:   &server.BookUpdate{Bids: depth.Bids, Asks: depth.Asks, Checksum: depth.Checksum},
+		})
+	case server.ChannelTrades:
+		var trades []*server.Trade
+		header, err := s.c.callHeader(ctx, request{
+			method:     http.MethodGet,
+			path:       "/trades/" + url.PathEscape(string(sub.Market)),
+			idempotent: true,
+		}, http.StatusOK, &trades)
+		if err != nil {
+			return err
+		}
+		snapshotSeq, err := sequence(header)
+		if err != nil {
+			return err
+		}
+
+		// the nth trade of a market has sequence number n, fewer trades
+		// than delivered mean the exchange restarted
+		from := seq.seq
+		if from > uint64(len(trades)) {
+			from = 0
+		}
+
+		seq.seq = snapshotSeq
+		for i := from; i < uint64(len(trades)); i++ {
+			if err := s.deliver(ctx, Event{Type: EventTrade, Market: sub.Market, Seq: i + 1, Trade: trades[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	case server.ChannelOrders:
+		var orders []server.OrderRecord
+		header, err := s.c.callHeader(ctx, request{
+			method:     http.MethodGet,
+			path:       fmt.Sprintf("/users/%s/orders", url.PathEscape(s.c.userID)),
+			idempotent: true,
+		}, http.StatusOK, &orders)
+		if err != nil {
+			return err
+		}
+		snapshotSeq, err := sequence(header)
+		if err != nil {
+			return err
+		}
+
+		open := make([]server.OrderRecord, 0)
+		for _, order := range orders {
+			if order.Status.IsOpen() {
+				open = append(open, order)
+			}
+		}
+
+		seq.seq = snapshotSeq
+		return s.deliver(ctx, Event{Type: EventOrdersSnapshot, Seq: snapshotSeq, Orders: open})
+	}
+
+	return nil
+}
+
+func (s *Stream) deliver(ctx context.Context, event Event) error {
+	if !s.emit(ctx, event) {
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+func (s *Stream) emit(ctx context.Context, event Event) bool {
+	select {
+	case s.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sequence returns the sequence number a REST snapshot is at.
+func sequence(header http.Header) (uint64, error) {
+	seq, err := strconv.ParseUint(header.Get(server.HeaderSequence), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("client: snapshot without a valid %s header", server.HeaderSequence)
+	}
+
+	return seq, nil
+}
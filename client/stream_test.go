@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamResync(t *testing.T) {
+	var bookSeq, sessions atomic.Int64
+	bookSeq.Store(6)
+	snapshots := make(chan struct{}, 10)
+
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/book/ETH/depth", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(server.HeaderSequence, strconv.FormatInt(bookSeq.Load(), 10))
+		json.NewEncoder(w).Encode(server.BookDepthRes{
+			Bids: []server.BookLevel{{Price: 100, Size: 2}, {Price: 99, Size: 3}},
+		})
+		snapshots <- struct{}{}
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var cmd server.WSCommand
+		if err := conn.ReadJSON(&cmd); err != nil {
+			return
+		}
+		send := func(event server.WSEvent) {
+			event.Channel, event.Market = cmd.Channel, cmd.Market
+			conn.WriteJSON(event)
+		}
+
+		if sessions.Add(1) > 1 {
+			send(server.WSEvent{Type: server.WSEventSubscribed, Seq: uint64(bookSeq.Load())})
+			conn.ReadMessage()
+			return
+		}
+
+		send(server.WSEvent{Type: server.WSEventSubscribed, Seq: 5})
+		<-snapshots
+		// part of the snapshot
+		send(server.WSEvent{Type: server.WSEventBook, Seq: 6, Data: server.BookUpdate{}})
+		send(server.WSEvent{Type: server.WSEventBook, Seq: 7, Data: server.BookUpdate{Bids: []server.BookLevel{{Price: 101, Size: 1}}}})
+		// 8 goes missing
+		bookSeq.Store(9)
+		send(server.WSEvent{Type: server.WSEventBook, Seq: 9, Data: server.BookUpdate{}})
+		<-snapshots
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	_, err := NewClient(WithBaseURL(ts.URL)).Subscribe(context.Background(), BookStream(server.ETH))
+	assert(t, err, ErrNoUser)
+
+	cl := NewClient(WithBaseURL(ts.URL), WithUserID("user"), WithRetryPolicy(RetryPolicy{Backoff: time.Millisecond}))
+	stream, err := cl.Subscribe(context.Background(), BookStream(server.ETH))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	next := func() Event {
+		t.Helper()
+
+		select {
+		case event := <-stream.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	snapshot := &server.BookUpdate{Bids: []server.BookLevel{{Price: 100, Size: 2}, {Price: 99, Size: 3}}}
+
+	event := next()
+	assert(t, event.Type, EventBookSnapshot)
+	assert(t, event.Seq, uint64(6))
+	assert(t, event.Book, snapshot)
+
+	event = next()
+	assert(t, event.Type, EventBookUpdate)
+	assert(t, event.Seq, uint64(7))
+
+	// the gap is filled from a new snapshot
+	event = next()
+	assert(t, event.Type, EventBookSnapshot)
+	assert(t, event.Seq, uint64(9))
+
+	event = next()
+	assert(t, event.Type, EventDisconnected)
+
+	// reconnected and subscribed again
+	event = next()
+	assert(t, event.Type, EventBookSnapshot)
+	assert(t, event.Seq, uint64(9))
+	assert(t, sessions.Load(), int64(2))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"errors"
+	"time"
+)
+
+// streamRetry is how long the feed polls before trying to open a stream
+// again after opening one failed.
+const streamRetry = 10 * time.Second
+
+// feed keeps the state of a market up to date from the streams of the
+// exchange, polling its REST API instead while there is no stream.
+type feed struct {
+	client   *client.Client
+	state    *state
+	userID   string
+	interval time.Duration
+}
+
+// run feeds the state until ctx is done.
+func (f *feed) run(ctx context.Context) {
+	subs := []client.Subscription{client.BookStream(f.state.market), client.TradeStream(f.state.market)}
+	if f.userID != "" {
+		subs = append(subs, client.OrderStream())
+	}
+
+	for ctx.Err() == nil {
+		stream, err := f.client.Subscribe(ctx, subs...)
+		if err != nil {
+			f.state.setSource(sourcePolling, err)
+
+			// without a user there are no streams to wait for
+			retry := streamRetry
+			if errors.Is(err, client.ErrNoUser) {
+				retry = 0
+			}
+			f.pollFor(ctx, retry)
+			continue
+		}
+
+		f.consume(ctx, stream)
+		stream.Close()
+	}
+}
+
+// consume applies the events of stream until it ends, polling while it is
+// disconnected. A stream counts as connected again once its book was synced
+// from a snapshot.
+func (f *feed) consume(ctx context.Context, stream *client.Stream) {
+	live := false
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-stream.Events():
+			if !ok {
+				return
+			}
+
+			switch event.Type {
+			case client.EventDisconnected:
+				live = false
+				f.state.setSource(sourcePolling, event.Err)
+			case client.EventBookSnapshot:
+				if !live {
+					live = true
+					f.state.setSource(sourceStream, nil)
+				}
+			}
+
+			if err := f.state.apply(event); errors.Is(err, client.ErrChecksumMismatch) {
+				stream.Reconnect()
+			}
+		case <-ticker.C:
+			if !live {
+				f.poll(ctx)
+			}
+		}
+	}
+}
+
+// pollFor polls every interval for d, or until ctx is done if d is zero.
+func (f *feed) pollFor(ctx context.Context, d time.Duration) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		f.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll replaces the state with the book, trades and open orders fetched
+// from the REST API.
+func (f *feed) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, f.interval)
+	defer cancel()
+
+	depth, err := f.client.GetBookDepthContext(ctx, f.state.market, 0)
+	if err != nil {
+		f.state.setSource(sourcePolling, err)
+		return
+	}
+
+	trades, err := f.client.GetTradesContext(ctx, f.state.market)
+	if err != nil {
+		f.state.setSource(sourcePolling, err)
+		return
+	}
+
+	var orders []server.OrderRecord
+	if f.userID != "" {
+		history, err := f.client.GetOrderHistoryContext(ctx, f.userID, "")
+		if err != nil {
+			f.state.setSource(sourcePolling, err)
+			return
+		}
+		orders = make([]server.OrderRecord, 0)
+		for _, order := range history {
+			if order.Status.IsOpen() {
+				orders = append(orders, order)
+			}
+		}
+	}
+
+	if err := f.state.applyPoll(depth, trades, orders); err != nil {
+		f.state.setSource(sourcePolling, err)
+	}
+}
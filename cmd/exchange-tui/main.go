@@ -0,0 +1,58 @@
+// Command exchange-tui monitors a market of the exchange in the terminal. It
+// shows a depth ladder, the recent trades and the open orders of the user
+// and places orders entered in its order entry panel.
+//
+//	exchange-tui [-url URL] [-user ID -api-key KEY] [-market M] [-depth N] [-poll D]
+//
+// It follows the streams of the exchange and polls its REST API while they
+// are unavailable, which they always are without a user.
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	var (
+		baseURL = flag.String("url", envOr("EXCHANGE_URL", client.DefaultBaseURL), "URL of the exchange")
+		userID  = flag.String("user", os.Getenv("EXCHANGE_USER_ID"), "ID of the user to trade as, read only without")
+		apiKey  = flag.String("api-key", os.Getenv("EXCHANGE_API_KEY"), "API key of the user")
+		market  = flag.String("market", string(server.ETH), "market to show")
+		depth   = flag.Int("depth", 15, "levels per side of the ladder")
+		poll    = flag.Duration("poll", time.Second, "interval to poll at while there is no stream")
+	)
+	flag.Parse()
+
+	opts := []client.Option{client.WithBaseURL(*baseURL)}
+	if *userID != "" {
+		opts = append(opts, client.WithUserID(*userID), client.WithAPIKey(*apiKey))
+	}
+	cl := client.NewClient(opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	st := newState(server.Market(*market))
+	f := &feed{client: cl, state: st, userID: *userID, interval: *poll}
+	go f.run(ctx)
+
+	if err := newUI(cl, st, *userID, *depth).run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "exchange-tui:", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"crypto_exchange/server/servertest"
+	"github.com/gdamore/tcell/v2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// startExchange serves an exchange with a fake settler for the duration of
+// the test and returns its URL.
+func startExchange(t *testing.T) string {
+	t.Helper()
+
+	return servertest.Serve(t, servertest.NewExchange(t, servertest.Config()))
+}
+
+func TestState(t *testing.T) {
+	st := newState(server.ETH)
+
+	for _, trade := range []*server.Trade{
+		{ID: "b", Timestamp: 2},
+		{ID: "a", Timestamp: 1},
+		{ID: "c", Timestamp: 3},
+		{ID: "b", Timestamp: 2},
+	} {
+		st.apply(client.Event{Type: client.EventTrade, Market: server.ETH, Trade: trade})
+	}
+	var ids []string
+	for _, trade := range st.recentTrades() {
+		ids = append(ids, trade.ID)
+	}
+	assert(t, ids, []string{"c", "b", "a"})
+
+	bids := []server.BookLevel{{Price: 99, Size: 2}}
+	asks := []server.BookLevel{{Price: 101, Size: 1}, {Price: 102, Size: 3}}
+	err := st.apply(client.Event{Type: client.EventBookSnapshot, Market: server.ETH, Book: &server.BookUpdate{
+		Bids:     bids,
+		Asks:     asks,
+		Checksum: server.BookChecksum(bids, asks),
+	}})
+	assert(t, err, nil)
+
+	st.apply(client.Event{Type: client.EventOrdersSnapshot, Orders: []server.OrderRecord{
+		{ID: "1", Market: server.ETH, IsBid: true, Price: 99, Size: 1.5, ExecutedSize: 0.5, Status: server.OrderPartiallyFilled},
+		{ID: "2", Market: server.ETH, Price: 102, Size: 1, Status: server.OrderNew},
+		{ID: "3", Market: server.ETH, Price: 101, Size: 1, Status: server.OrderFilled},
+	}})
+	assert(t, st.ladder(10), []ladderRow{
+		{Price: 102, Size: 3, Mine: 1},
+		{Price: 101, Size: 1},
+		{IsBid: true, Price: 99, Size: 2, Mine: 1},
+	})
+	assert(t, st.ladder(1), []ladderRow{
+		{Price: 101, Size: 1},
+		{IsBid: true, Price: 99, Size: 2, Mine: 1},
+	})
+
+	st.apply(client.Event{Type: client.EventOrder, Order: &server.OrderRecord{ID: "2", Market: server.ETH, Status: server.OrderCancelled}})
+	orders := st.openOrders()
+	assert(t, len(orders), 1)
+	assert(t, orders[0].ID, "1")
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	url := startExchange(t)
+	cl := client.NewClient(client.WithBaseURL(url))
+
+	user, err := cl.RegisterUser("")
+	assert(t, err, nil)
+	userClient := client.NewClient(client.WithBaseURL(url), client.WithUserID(user.ID), client.WithAPIKey(user.APIKey))
+	_, err = userClient.PlaceLimitOrder(&client.PlaceOrderArgs{Size: 2, Price: 3500})
+	assert(t, err, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// without a user the feed polls
+	polled := newState(server.ETH)
+	go (&feed{client: cl, state: polled, interval: 20 * time.Millisecond}).run(ctx)
+	waitFor(t, "the polled book", func() bool { return len(polled.ladder(10)) == 1 })
+	source, _, _ := polled.status()
+	assert(t, source, sourcePolling)
+
+	// with one it follows the streams
+	streamed := newState(server.ETH)
+	go (&feed{client: userClient, state: streamed, userID: user.ID, interval: time.Hour}).run(ctx)
+	waitFor(t, "the stream", func() bool {
+		source, _, _ := streamed.status()
+		return source == sourceStream
+	})
+
+	_, err = userClient.PlaceLimitOrder(&client.PlaceOrderArgs{IsBid: true, Size: 1, Price: 3400})
+	assert(t, err, nil)
+	_, err = userClient.PlaceMarketOrder(&client.PlaceOrderArgs{IsBid: true, Size: 0.5})
+	assert(t, err, nil)
+
+	waitFor(t, "the streamed trade", func() bool { return len(streamed.recentTrades()) == 1 })
+	waitFor(t, "the streamed orders", func() bool { return len(streamed.openOrders()) == 2 })
+	assert(t, streamed.ladder(10), []ladderRow{
+		{Price: 3500, Size: 1.5, Mine: 1.5},
+		{IsBid: true, Price: 3400, Size: 1, Mine: 1},
+	})
+
+	waitFor(t, "the polled trade", func() bool { return len(polled.recentTrades()) == 1 })
+}
+
+// screenText returns the text on screen.
+func screenText(screen tcell.SimulationScreen) string {
+	cells, width, _ := screen.GetContents()
+
+	var b strings.Builder
+	for i, cell := range cells {
+		if len(cell.Runes) > 0 {
+			b.WriteRune(cell.Runes[0])
+		}
+		if (i+1)%width == 0 {
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.String()
+}
+
+func TestUI(t *testing.T) {
+	st := newState(server.ETH)
+	asks := []server.BookLevel{{Price: 3500.5, Size: 2}}
+	st.apply(client.Event{Type: client.EventBookSnapshot, Market: server.ETH, Book: &server.BookUpdate{
+		Asks:     asks,
+		Checksum: server.BookChecksum(nil, asks),
+	}})
+	st.apply(client.Event{Type: client.EventTrade, Market: server.ETH, Trade: &server.Trade{ID: "t", Price: 3499.25, Size: 1}})
+
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(120, 40)
+
+	u := newUI(client.NewClient(), st, "", 10)
+	u.app.SetScreen(screen)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- u.run(ctx) }()
+
+	// QueueUpdate returns once the update ran on the event loop
+	shows := func(texts ...string) func() bool {
+		return func() bool {
+			var text string
+			u.app.QueueUpdate(func() { text = screenText(screen) })
+			for _, s := range texts {
+				if !strings.Contains(text, s) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	waitFor(t, "the ladder and the trades", shows("3500.5", "3499.25", "read only"))
+
+	// placing an order needs a user
+	u.app.QueueUpdateDraw(u.placeOrder)
+	waitFor(t, "the message", shows("pass -user"))
+
+	cancel()
+	assert(t, <-done, nil)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"sort"
+	"sync"
+)
+
+const (
+	sourceStream  = "stream"
+	sourcePolling = "polling"
+
+	maxTrades = 100
+)
+
+type (
+	// state is what the UI shows of a market, fed by the stream or by
+	// polling. It is safe for concurrent use.
+	state struct {
+		mu     sync.Mutex
+		market server.Market
+		book   *client.LocalBook
+		// trades newest first
+		trades []*server.Trade
+		// open orders of the user by ID
+		orders map[string]server.OrderRecord
+		source string
+		err    error
+		// version changes with every change, so unchanged state isn't drawn
+		// again
+		version uint64
+	}
+
+	// ladderRow is a price level of the ladder, Mine is the size the user
+	// has open at it.
+	ladderRow struct {
+		IsBid bool
+		Price float64
+		Size  float64
+		Mine  float64
+	}
+)
+
+func newState(market server.Market) *state {
+	return &state{
+		market: market,
+		book:   client.NewLocalBook(market),
+		orders: make(map[string]server.OrderRecord),
+		source: sourcePolling,
+	}
+}
+
+// apply applies an event of the stream. A book that no longer matches the
+// exchange returns client.ErrChecksumMismatch.
+func (s *state) apply(event client.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+
+	switch event.Type {
+	case client.EventBookSnapshot, client.EventBookUpdate:
+		return s.book.Apply(event)
+	case client.EventTrade:
+		if event.Market == s.market {
+			s.addTrade(event.Trade)
+		}
+	case client.EventOrder:
+		s.setOrder(*event.Order)
+	case client.EventOrdersSnapshot:
+		s.setOrders(event.Orders)
+	}
+
+	return nil
+}
+
+// addTrade adds a trade unless it is known already, keeping the newest
+// maxTrades.
+func (s *state) addTrade(trade *server.Trade) {
+	i := sort.Search(len(s.trades), func(i int) bool {
+		return s.trades[i].Timestamp <= trade.Timestamp
+	})
+	for j := i; j < len(s.trades) && s.trades[j].Timestamp == trade.Timestamp; j++ {
+		if s.trades[j].ID == trade.ID {
+			return
+		}
+	}
+	if i >= maxTrades {
+		return
+	}
+
+	s.trades = append(s.trades, nil)
+	copy(s.trades[i+1:], s.trades[i:])
+	s.trades[i] = trade
+	if len(s.trades) > maxTrades {
+		s.trades = s.trades[:maxTrades]
+	}
+}
+
+func (s *state) setOrder(order server.OrderRecord) {
+	if order.Market != s.market || !order.Status.IsOpen() {
+		delete(s.orders, order.ID)
+		return
+	}
+
+	s.orders[order.ID] = order
+}
+
+func (s *state) setOrders(orders []server.OrderRecord) {
+	s.orders = make(map[string]server.OrderRecord)
+	for _, order := range orders {
+		s.setOrder(order)
+	}
+}
+
+// applyPoll replaces the state with what was polled, trades oldest first as
+// the exchange lists them. Orders are left alone if nil.
+func (s *state) applyPoll(depth *server.BookDepthRes, trades []*server.Trade, orders []server.OrderRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+
+	s.source = sourcePolling
+	s.err = nil
+
+	s.trades = make([]*server.Trade, 0, min(len(trades), maxTrades))
+	for i := len(trades) - 1; i >= 0 && len(s.trades) < maxTrades; i-- {
+		s.trades = append(s.trades, trades[i])
+	}
+
+	if orders != nil {
+		s.setOrders(orders)
+	}
+
+	return s.book.Apply(client.Event{
+		Type:   client.EventBookSnapshot,
+		Market: s.market,
+		Book:   &server.BookUpdate{Bids: depth.Bids, Asks: depth.Asks, Checksum: depth.Checksum},
+	})
+}
+
+// setSource records where the state comes from and the error that made it
+// change, if any.
+func (s *state) setSource(source string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+
+	s.source = source
+	s.err = err
+}
+
+func (s *state) status() (source string, err error, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.source, s.err, s.version
+}
+
+func (s *state) recentTrades() []*server.Trade {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*server.Trade(nil), s.trades...)
+}
+
+// openOrders returns the open orders of the user, best price first on each
+// side, bids first.
+func (s *state) openOrders() []server.OrderRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders := make([]server.OrderRecord, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		a, b := orders[i], orders[j]
+		switch {
+		case a.IsBid != b.IsBid:
+			return a.IsBid
+		case a.Price != b.Price:
+			return a.IsBid == (a.Price > b.Price)
+		default:
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+	})
+
+	return orders
+}
+
+// ladder returns up to depth levels of each side, asks from the highest
+// price down to the spread followed by the bids.
+func (s *state) ladder(depth int) []ladderRow {
+	bids, asks := s.book.Depth(depth)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mine := make(map[ladderRow]float64)
+	for _, order := range s.orders {
+		mine[ladderRow{IsBid: order.IsBid, Price: order.Price}] += order.Size - order.ExecutedSize
+	}
+
+	rows := make([]ladderRow, 0, len(bids)+len(asks))
+	for i := len(asks) - 1; i >= 0; i-- {
+		rows = append(rows, ladderRow{
+			Price: asks[i].Price,
+			Size:  asks[i].Size,
+			Mine:  mine[ladderRow{Price: asks[i].Price}],
+		})
+	}
+	for _, level := range bids {
+		rows = append(rows, ladderRow{
+			IsBid: true,
+			Price: level.Price,
+			Size:  level.Size,
+			Mine:  mine[ladderRow{IsBid: true, Price: level.Price}],
+		})
+	}
+
+	return rows
+}
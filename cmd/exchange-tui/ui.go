@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"strconv"
+	"time"
+)
+
+const (
+	sideBuy  = "buy"
+	sideSell = "sell"
+
+	// redrawInterval is how often the state is checked for changes to draw
+	redrawInterval = 100 * time.Millisecond
+)
+
+var (
+	bidColor = tcell.ColorGreen
+	askColor = tcell.ColorRed
+)
+
+// ui draws the state of a market and places the orders entered. Its fields
+// are only touched on the goroutine of the application.
+type ui struct {
+	app    *tview.Application
+	client *client.Client
+	state  *state
+	userID string
+	depth  int
+
+	ladder *tview.Table
+	trades *tview.Table
+	orders *tview.Table
+	form   *tview.Form
+	side   *tview.DropDown
+	kind   *tview.DropDown
+	price  *tview.InputField
+	size   *tview.InputField
+	status *tview.TextView
+
+	// shown are the orders in the orders table, below its header
+	shown   []server.OrderRecord
+	message string
+	version uint64
+}
+
+func newUI(cl *client.Client, st *state, userID string, depth int) *ui {
+	u := &ui{
+		app:    tview.NewApplication(),
+		client: cl,
+		state:  st,
+		userID: userID,
+		depth:  depth,
+		ladder: newTable("Ladder " + string(st.market)),
+		trades: newTable("Trades"),
+		orders: newTable("Open orders"),
+		status: tview.NewTextView().SetDynamicColors(true),
+	}
+	u.version = ^uint64(0)
+
+	u.side = tview.NewDropDown().SetLabel("Side ").SetOptions([]string{sideBuy, sideSell}, nil).SetCurrentOption(0)
+	u.kind = tview.NewDropDown().SetLabel("Type ").SetOptions([]string{string(server.LimitOrder), string(server.MarketOrder)}, nil).SetCurrentOption(0)
+	u.price = tview.NewInputField().SetLabel("Price ").SetFieldWidth(14).SetAcceptanceFunc(tview.InputFieldFloat)
+	u.size = tview.NewInputField().SetLabel("Size ").SetFieldWidth(14).SetAcceptanceFunc(tview.InputFieldFloat)
+
+	u.form = tview.NewForm().
+		AddFormItem(u.side).
+		AddFormItem(u.kind).
+		AddFormItem(u.price).
+		AddFormItem(u.size).
+		AddButton("Place", u.placeOrder).
+		AddButton("Cancel all", u.cancelAll).
+		SetCancelFunc(func() { u.app.SetFocus(u.ladder) })
+	u.form.SetBorder(true).SetTitle("Order entry (Esc: ladder)")
+
+	// Tab moves on from the ladder to the orders and to the order entry,
+	// Enter on a level takes its price into the order entry
+	u.ladder.SetSelectedFunc(u.selectLevel)
+	u.ladder.SetInputCapture(u.tableKeys(u.orders, nil))
+	u.orders.SetInputCapture(u.tableKeys(u.form, func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Rune() {
+		case 'c':
+			u.cancelSelected()
+			return nil
+		case 'C':
+			u.cancelAll()
+			return nil
+		}
+		return event
+	}))
+
+	top := tview.NewFlex().
+		AddItem(u.ladder, 0, 1, true).
+		AddItem(u.trades, 0, 1, false)
+	bottom := tview.NewFlex().
+		AddItem(u.orders, 0, 2, false).
+		AddItem(u.form, 0, 1, false)
+	root := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(top, 0, 2, true).
+		AddItem(bottom, 0, 1, false).
+		AddItem(u.status, 1, 0, false)
+
+	u.app.SetRoot(root, true).SetFocus(u.ladder)
+
+	return u
+}
+
+func newTable(title string) *tview.Table {
+	table := tview.NewTable().SetFixed(1, 0).SetSelectable(true, false)
+	table.SetBorder(true).SetTitle(title)
+
+	return table
+}
+
+// tableKeys handles the keys shared by the tables, q quits and Tab focuses
+// next. Other keys go to more if it isn't nil.
+func (u *ui) tableKeys(next tview.Primitive, more func(*tcell.EventKey) *tcell.EventKey) func(*tcell.EventKey) *tcell.EventKey {
+	return func(event *tcell.EventKey) *tcell.EventKey {
+		switch {
+		case event.Key() == tcell.KeyTab:
+			u.app.SetFocus(next)
+			return nil
+		case event.Rune() == 'q':
+			u.app.Stop()
+			return nil
+		case more != nil:
+			return more(event)
+		}
+		return event
+	}
+}
+
+// run shows the UI until it is quit or ctx is done.
+func (u *ui) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(redrawInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				u.app.Stop()
+				return
+			case <-ticker.C:
+				u.app.QueueUpdateDraw(u.render)
+			}
+		}
+	}()
+
+	return u.app.Run()
+}
+
+// render draws the state unless it didn't change since it was drawn last.
+func (u *ui) render() {
+	source, err, version := u.state.status()
+	if version == u.version {
+		return
+	}
+	u.version = version
+
+	u.renderLadder()
+	u.renderTrades()
+	u.renderOrders()
+	u.renderStatus(source, err)
+}
+
+func (u *ui) renderLadder() {
+	u.ladder.Clear()
+	setHeader(u.ladder, "BID", "PRICE", "ASK", "MINE")
+
+	for i, row := range u.state.ladder(u.depth) {
+		bid, ask, color := "", formatFloat(row.Size), askColor
+		if row.IsBid {
+			bid, ask, color = ask, "", bidColor
+		}
+		mine := ""
+		if row.Mine > 0 {
+			mine = formatFloat(row.Mine)
+		}
+
+		u.ladder.SetCell(i+1, 0, tview.NewTableCell(bid).SetTextColor(bidColor).SetAlign(tview.AlignRight).SetExpansion(1))
+		u.ladder.SetCell(i+1, 1, tview.NewTableCell(formatFloat(row.Price)).SetTextColor(color).SetAlign(tview.AlignCenter).SetExpansion(1))
+		u.ladder.SetCell(i+1, 2, tview.NewTableCell(ask).SetTextColor(askColor).SetExpansion(1))
+		u.ladder.SetCell(i+1, 3, tview.NewTableCell(mine).SetAlign(tview.AlignRight).SetExpansion(1))
+	}
+}
+
+func (u *ui) renderTrades() {
+	u.trades.Clear()
+	setHeader(u.trades, "TIME", "SIDE", "PRICE", "SIZE")
+
+	for i, trade := range u.state.recentTrades() {
+		side, color := sideSell, askColor
+		if trade.IsBid {
+			side, color = sideBuy, bidColor
+		}
+
+		u.trades.SetCell(i+1, 0, tview.NewTableCell(time.Unix(0, trade.Timestamp).Format(time.TimeOnly)))
+		u.trades.SetCell(i+1, 1, tview.NewTableCell(side).SetTextColor(color))
+		u.trades.SetCell(i+1, 2, tview.NewTableCell(formatFloat(trade.Price)).SetAlign(tview.AlignRight).SetExpansion(1))
+		u.trades.SetCell(i+1, 3, tview.NewTableCell(formatFloat(trade.Size)).SetAlign(tview.AlignRight).SetExpansion(1))
+	}
+}
+
+func (u *ui) renderOrders() {
+	u.orders.Clear()
+	u.orders.SetTitle("Open orders (c: cancel, C: cancel all, Tab: order entry)")
+	setHeader(u.orders, "ID", "SIDE", "PRICE", "SIZE", "FILLED", "STATUS")
+
+	u.shown = u.state.openOrders()
+	for i, order := range u.shown {
+		side, color := sideSell, askColor
+		if order.IsBid {
+			side, color = sideBuy, bidColor
+		}
+
+		u.orders.SetCell(i+1, 0, tview.NewTableCell(order.ID[:min(8, len(order.ID))]))
+		u.orders.SetCell(i+1, 1, tview.NewTableCell(side).SetTextColor(color))
+		u.orders.SetCell(i+1, 2, tview.NewTableCell(formatFloat(order.Price)).SetAlign(tview.AlignRight))
+		u.orders.SetCell(i+1, 3, tview.NewTableCell(formatFloat(order.Size)).SetAlign(tview.AlignRight))
+		u.orders.SetCell(i+1, 4, tview.NewTableCell(formatFloat(order.ExecutedSize)).SetAlign(tview.AlignRight))
+		u.orders.SetCell(i+1, 5, tview.NewTableCell(string(order.Status)).SetExpansion(1))
+	}
+}
+
+func (u *ui) renderStatus(source string, err error) {
+	user := u.userID
+	if user == "" {
+		user = "none, read only"
+	}
+
+	text := fmt.Sprintf(" %s | %s | user %s", u.state.market, source, user)
+	if err != nil {
+		text += " | [red]" + tview.Escape(err.Error()) + "[-]"
+	}
+	if u.message != "" {
+		text += " | " + tview.Escape(u.message)
+	}
+
+	u.status.SetText(text)
+}
+
+func setHeader(table *tview.Table, columns ...string) {
+	for i, column := range columns {
+		table.SetCell(0, i, tview.NewTableCell(column).SetSelectable(false).SetTextColor(tcell.ColorYellow))
+	}
+}
+
+// selectLevel takes the price of a level of the ladder into the order entry.
+func (u *ui) selectLevel(row, _ int) {
+	if cell := u.ladder.GetCell(row, 1); cell.Text != "" {
+		u.price.SetText(cell.Text)
+		u.app.SetFocus(u.form)
+	}
+}
+
+// show shows message in the status line.
+func (u *ui) show(message string) {
+	u.message = message
+	u.version = ^uint64(0)
+	u.render()
+}
+
+// notify shows the result of an order action, it is called from the
+// goroutines sending them.
+func (u *ui) notify(message string) {
+	u.app.QueueUpdateDraw(func() { u.show(message) })
+}
+
+func (u *ui) placeOrder() {
+	if u.userID == "" {
+		u.show("pass -user to place orders")
+		return
+	}
+
+	_, side := u.side.GetCurrentOption()
+	_, kind := u.kind.GetCurrentOption()
+	size, err := strconv.ParseFloat(u.size.GetText(), 64)
+	if err != nil {
+		u.show("invalid size")
+		return
+	}
+	args := &client.PlaceOrderArgs{
+		UserID: u.userID,
+		Market: u.state.market,
+		IsBid:  side == sideBuy,
+		Size:   size,
+	}
+	if server.OrderType(kind) == server.LimitOrder {
+		if args.Price, err = strconv.ParseFloat(u.price.GetText(), 64); err != nil {
+			u.show("invalid price")
+			return
+		}
+	}
+
+	go func() {
+		var res *server.PlaceOrderRes
+		var err error
+		if server.OrderType(kind) == server.MarketOrder {
+			res, err = u.client.PlaceMarketOrder(args)
+		} else {
+			res, err = u.client.PlaceLimitOrder(args)
+		}
+		if err != nil {
+			u.notify("order rejected: " + err.Error())
+			return
+		}
+		u.notify(fmt.Sprintf("%s %s %s placed: %s", kind, side, formatFloat(size), res.OrderID))
+	}()
+}
+
+func (u *ui) cancelSelected() {
+	row, _ := u.orders.GetSelection()
+	if row < 1 || row > len(u.shown) {
+		return
+	}
+	orderID := u.shown[row-1].ID
+
+	go func() {
+		if err := u.client.CancelOrder(orderID); err != nil {
+			u.notify("cancel failed: " + err.Error())
+			return
+		}
+		u.notify("cancelled " + orderID)
+	}()
+}
+
+func (u *ui) cancelAll() {
+	if u.userID == "" {
+		return
+	}
+
+	go func() {
+		res, err := u.client.CancelAll(u.userID, u.state.market, "")
+		if err != nil {
+			u.notify("cancel all failed: " + err.Error())
+			return
+		}
+		u.notify(fmt.Sprintf("cancelled %d orders", res.Cancelled))
+	}()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var orderHeader = []string{"ID", "MARKET", "SIDE", "TYPE", "PRICE", "SIZE", "FILLED", "AVG PRICE", "STATUS", "CREATED"}
+
+func orderRow(order server.OrderRecord) []string {
+	return []string{
+		order.ID,
+		string(order.Market),
+		side(order.IsBid),
+		string(order.Type),
+		formatFloat(order.Price),
+		formatFloat(order.Size),
+		formatFloat(order.ExecutedSize),
+		formatFloat(order.AvgFillPrice),
+		string(order.Status),
+		formatTime(order.CreatedAt),
+	}
+}
+
+var (
+	tradeHeader = []string{"TIME", "ID", "SIDE", "PRICE", "SIZE"}
+	// widths of the columns of followed trades, IDs are UUIDs
+	tradeWidths = []int{19, 36, 4, 12, 12}
+)
+
+func tradeRow(trade *server.Trade) []string {
+	return []string{
+		formatTime(time.Unix(0, trade.Timestamp)),
+		trade.ID,
+		side(trade.IsBid),
+		formatFloat(trade.Price),
+		formatFloat(trade.Size),
+	}
+}
+
+func marketRow(market server.MarketRes) []string {
+	band := ""
+	if market.PriceBand != nil {
+		band = formatFloat(market.PriceBand.Low) + "-" + formatFloat(market.PriceBand.High)
+	}
+
+	return []string{string(market.Name), string(market.Base), string(market.Quote), string(market.Status), band}
+}
+
+var marketHeader = []string{"NAME", "BASE", "QUOTE", "STATUS", "PRICE BAND"}
+
+// parseSide parses the side of an order, buy and sell are accepted for bid
+// and ask.
+func parseSide(s string) (isBid bool, err error) {
+	switch s {
+	case "bid", "buy":
+		return true, nil
+	case "ask", "sell":
+		return false, nil
+	default:
+		return false, fmt.Errorf("side must be bid or ask, not %q", s)
+	}
+}
+
+func runRegister(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("register", flag.ContinueOnError)
+	key := fs.String("key", "", "hex encoded private key of the user, generated if empty")
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	user, err := e.client.RegisterUserContext(ctx, *key)
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(user, []string{"ID", "ADDRESS", "API KEY"}, [][]string{{user.ID, user.Address, user.APIKey}})
+}
+
+func runMarkets(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("markets", flag.ContinueOnError)
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	markets, err := e.client.GetMarketsContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(markets))
+	for _, market := range markets {
+		rows = append(rows, marketRow(market))
+	}
+
+	return e.out.print(markets, marketHeader, rows)
+}
+
+func runLimit(ctx context.Context, e *env, args []string) error {
+	return placeOrder(ctx, e, "limit", args)
+}
+
+func runMarket(ctx context.Context, e *env, args []string) error {
+	return placeOrder(ctx, e, "market", args)
+}
+
+func placeOrder(ctx context.Context, e *env, name string, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var (
+		sideFlag = fs.String("side", "", "bid (buy) or ask (sell)")
+		size     = fs.Float64("size", 0, "size of the order")
+		price    = new(float64)
+		market   = fs.String("market", string(server.ETH), "market to trade in")
+		clientID = fs.String("client-id", "", "client order ID, makes retrying the order safe")
+	)
+	if name == "limit" {
+		fs.Float64Var(price, "price", 0, "limit price of the order")
+	}
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	userID, err := e.requireUser()
+	if err != nil {
+		return err
+	}
+	isBid, err := parseSide(*sideFlag)
+	if err != nil {
+		return err
+	}
+
+	orderArgs := &client.PlaceOrderArgs{
+		UserID:        userID,
+		ClientOrderID: *clientID,
+		Market:        server.Market(*market),
+		IsBid:         isBid,
+		Size:          *size,
+		Price:         *price,
+	}
+
+	var res *server.PlaceOrderRes
+	if name == "limit" {
+		res, err = e.client.PlaceLimitOrderContext(ctx, orderArgs)
+	} else {
+		res, err = e.client.PlaceMarketOrderContext(ctx, orderArgs)
+	}
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(res, []string{"ORDER ID", "CLIENT ORDER ID", "MESSAGE"}, [][]string{{res.OrderID, res.ClientOrderID, res.Message}})
+}
+
+func runCancel(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	clientID := fs.String("client-id", "", "client order ID of the order instead of its ID")
+	if err := e.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	var orderID string
+	switch {
+	case *clientID != "" && fs.NArg() == 0:
+		userID, err := e.requireUser()
+		if err != nil {
+			return err
+		}
+		order, err := e.client.GetOrderByClientIDContext(ctx, userID, *clientID)
+		if err != nil {
+			return err
+		}
+		orderID = order.ID
+	case *clientID == "" && fs.NArg() == 1:
+		orderID = fs.Arg(0)
+	default:
+		fs.Usage()
+		return errUsage
+	}
+
+	if err := e.client.CancelOrderContext(ctx, orderID); err != nil {
+		return err
+	}
+
+	order, err := e.client.GetOrderContext(ctx, orderID)
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(order, orderHeader, [][]string{orderRow(*order)})
+}
+
+func runCancelAll(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("cancel-all", flag.ContinueOnError)
+	var (
+		market   = fs.String("market", "", "only cancel orders in this market")
+		sideFlag = fs.String("side", "", "only cancel bids or asks")
+	)
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	userID, err := e.requireUser()
+	if err != nil {
+		return err
+	}
+	if *sideFlag != "" {
+		isBid, err := parseSide(*sideFlag)
+		if err != nil {
+			return err
+		}
+		*sideFlag = side(isBid)
+	}
+
+	res, err := e.client.CancelAllContext(ctx, userID, server.Market(*market), *sideFlag)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(res.OrderIDs))
+	for _, orderID := range res.OrderIDs {
+		rows = append(rows, []string{orderID})
+	}
+
+	return e.out.print(res, []string{"CANCELLED ORDER ID"}, rows)
+}
+
+func runOrders(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("orders", flag.ContinueOnError)
+	var (
+		status = fs.String("status", "", "only list orders in this status")
+		all    = fs.Bool("all", false, "list orders in every status")
+	)
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	userID, err := e.requireUser()
+	if err != nil {
+		return err
+	}
+
+	orders, err := e.client.GetOrderHistoryContext(ctx, userID, server.OrderStatus(*status))
+	if err != nil {
+		return err
+	}
+
+	// without a status only the open orders are listed
+	if *status == "" && !*all {
+		open := orders[:0]
+		for _, order := range orders {
+			if order.Status.IsOpen() {
+				open = append(open, order)
+			}
+		}
+		orders = open
+	}
+
+	rows := make([][]string, 0, len(orders))
+	for _, order := range orders {
+		rows = append(rows, orderRow(order))
+	}
+
+	return e.out.print(orders, orderHeader, rows)
+}
+
+func runBook(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("book", flag.ContinueOnError)
+	var (
+		market = fs.String("market", string(server.ETH), "market of the book")
+		depth  = fs.Int("depth", 10, "levels per side, every level if 0")
+	)
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	book, err := e.client.GetBookDepthContext(ctx, server.Market(*market), *depth)
+	if err != nil {
+		return err
+	}
+
+	// asks from the highest price down to the spread, then the bids
+	rows := make([][]string, 0, len(book.Asks)+len(book.Bids))
+	for i := len(book.Asks) - 1; i >= 0; i-- {
+		rows = append(rows, []string{"ask", formatFloat(book.Asks[i].Price), formatFloat(book.Asks[i].Size)})
+	}
+	for _, level := range book.Bids {
+		rows = append(rows, []string{"bid", formatFloat(level.Price), formatFloat(level.Size)})
+	}
+
+	return e.out.print(book, []string{"SIDE", "PRICE", "SIZE"}, rows)
+}
+
+// runTrades prints the last trades of a market and, with -f, every trade
+// after them until interrupted.
+func runTrades(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("trades", flag.ContinueOnError)
+	var (
+		market = fs.String("market", string(server.ETH), "market of the trades")
+		n      = fs.Int("n", 20, "number of past trades to show, every trade if 0")
+		follow = fs.Bool("f", false, "follow new trades, needs a user")
+	)
+	if err := e.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	if !*follow {
+		trades, err := e.client.GetTradesContext(ctx, server.Market(*market))
+		if err != nil {
+			return err
+		}
+		trades = lastTrades(trades, *n)
+
+		rows := make([][]string, 0, len(trades))
+		for _, trade := range trades {
+			rows = append(rows, tradeRow(trade))
+		}
+
+		return e.out.print(trades, tradeHeader, rows)
+	}
+
+	if _, err := e.requireUser(); err != nil {
+		return err
+	}
+
+	// subscribe first so that no trade falls between the list and the stream
+	stream, err := e.client.Subscribe(ctx, client.TradeStream(server.Market(*market)))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	trades, err := e.client.GetTradesContext(ctx, server.Market(*market))
+	if err != nil {
+		return err
+	}
+
+	if err := e.out.header(tradeHeader, tradeWidths); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(trades))
+	for _, trade := range lastTrades(trades, *n) {
+		if err := e.out.stream(trade, tradeRow(trade)); err != nil {
+			return err
+		}
+	}
+	for _, trade := range trades {
+		seen[trade.ID] = true
+	}
+
+	for event := range stream.Events() {
+		switch event.Type {
+		case client.EventTrade:
+			if seen[event.Trade.ID] {
+				continue
+			}
+			seen[event.Trade.ID] = true
+			if err := e.out.stream(event.Trade, tradeRow(event.Trade)); err != nil {
+				return err
+			}
+		case client.EventError:
+			return event.Err
+		case client.EventDisconnected:
+			fmt.Fprintln(e.stderr, "disconnected, reconnecting:", event.Err)
+		}
+	}
+
+	return nil
+}
+
+// lastTrades returns the last n trades, every trade if n is zero.
+func lastTrades(trades []*server.Trade, n int) []*server.Trade {
+	if n <= 0 || n >= len(trades) {
+		return trades
+	}
+
+	return trades[len(trades)-n:]
+}
+
+func runBalances(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("balances", flag.ContinueOnError)
+	if err := e.parse(fs, args, 1); err != nil {
+		return err
+	}
+
+	userID := fs.Arg(0)
+	if userID == "" {
+		var err error
+		if userID, err = e.requireUser(); err != nil {
+			return err
+		}
+	}
+
+	balances, err := e.client.GetBalancesContext(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(balances))
+	for _, balance := range balances {
+		rows = append(rows, []string{string(balance.Asset), formatFloat(balance.Amount), balance.Units})
+	}
+
+	return e.out.print(balances, []string{"ASSET", "AMOUNT", "UNITS"}, rows)
+}
+
+// runAdmin runs the admin subcommands, they need -admin-token.
+//
+//	admin status MARKET STATUS [-reason R]
+//	admin index-price MARKET PRICE
+//	admin log-level [LEVEL]
+//	admin deposit USER ASSET AMOUNT
+func runAdmin(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(e.stderr, "usage: exchangectl %s\n", e.usage)
+		return errUsage
+	}
+
+	switch args[0] {
+	case "status":
+		fs := flag.NewFlagSet("admin status", flag.ContinueOnError)
+		reason := fs.String("reason", "", "why the status changes, kept in the audit log")
+		e.usage = "admin status [-reason R] MARKET STATUS"
+		if err := e.parse(fs, args[1:], 2); err != nil {
+			return err
+		}
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return errUsage
+		}
+
+		market, err := e.client.SetMarketStatusContext(ctx, server.Market(fs.Arg(0)), server.MarketStatus(fs.Arg(1)), *reason)
+		if err != nil {
+			return err
+		}
+
+		return e.out.print(market, marketHeader, [][]string{marketRow(*market)})
+	case "index-price":
+		fs := flag.NewFlagSet("admin index-price", flag.ContinueOnError)
+		e.usage = "admin index-price MARKET PRICE"
+		if err := e.parse(fs, args[1:], 2); err != nil {
+			return err
+		}
+		price, err := strconv.ParseFloat(fs.Arg(1), 64)
+		if fs.NArg() != 2 || err != nil {
+			fs.Usage()
+			return errUsage
+		}
+
+		market, err := e.client.SetIndexPriceContext(ctx, server.Market(fs.Arg(0)), price)
+		if err != nil {
+			return err
+		}
+
+		return e.out.print(market, marketHeader, [][]string{marketRow(*market)})
+	case "log-level":
+		fs := flag.NewFlagSet("admin log-level", flag.ContinueOnError)
+		e.usage = "admin log-level [LEVEL]"
+		if err := e.parse(fs, args[1:], 1); err != nil {
+			return err
+		}
+
+		var level string
+		var err error
+		if fs.NArg() == 1 {
+			level, err = e.client.SetLogLevelContext(ctx, fs.Arg(0))
+		} else {
+			level, err = e.client.GetLogLevelContext(ctx)
+		}
+		if err != nil {
+			return err
+		}
+
+		return e.out.print(server.LogLevelRes{Level: level}, []string{"LEVEL"}, [][]string{{level}})
+	case "deposit":
+		fs := flag.NewFlagSet("admin deposit", flag.ContinueOnError)
+		e.usage = "admin deposit USER ASSET AMOUNT"
+		if err := e.parse(fs, args[1:], 3); err != nil {
+			return err
+		}
+		amount, err := strconv.ParseFloat(fs.Arg(2), 64)
+		if fs.NArg() != 3 || err != nil {
+			fs.Usage()
+			return errUsage
+		}
+
+		balance, err := e.client.DepositContext(ctx, fs.Arg(0), server.Asset(fs.Arg(1)), amount)
+		if err != nil {
+			return err
+		}
+
+		return e.out.print(balance, []string{"ASSET", "AMOUNT", "UNITS"}, [][]string{{string(balance.Asset), formatFloat(balance.Amount), balance.Units}})
+	default:
+		return errors.New("unknown admin command " + strconv.Quote(args[0]))
+	}
+}
@@ -0,0 +1,187 @@
+// Command exchangectl trades on and operates the exchange through its HTTP
+// API.
+//
+//	exchangectl [-url URL] [-user ID] [-api-key KEY] [-admin-token TOKEN] [-o table|json] <command> [flags] [args]
+//
+// Run exchangectl without a command for the list of commands, and
+// exchangectl <command> -h for the flags of one.
+package main
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+)
+
+// errUsage is returned for bad command lines, after the usage was printed.
+var errUsage = errors.New("usage")
+
+type (
+	// env is what commands run with, the client acts as the user given with
+	// -user, authenticated by -api-key, and sends the admin token given with
+	// -admin-token.
+	env struct {
+		client *client.Client
+		userID string
+		out    *printer
+		stderr io.Writer
+		// usage is the usage line of the command being run
+		usage string
+	}
+
+	command struct {
+		usage   string
+		summary string
+		run     func(ctx context.Context, e *env, args []string) error
+	}
+)
+
+var commands = map[string]command{
+	"register":   {"register [-key HEX]", "register a user", runRegister},
+	"markets":    {"markets", "list the markets", runMarkets},
+	"limit":      {"limit -side bid|ask -size SIZE -price PRICE [-market M] [-client-id ID]", "place a limit order", runLimit},
+	"market":     {"market -side bid|ask -size SIZE [-market M] [-client-id ID]", "place a market order", runMarket},
+	"cancel":     {"cancel ORDER_ID | cancel -client-id ID", "cancel an order", runCancel},
+	"cancel-all": {"cancel-all [-market M] [-side bid|ask]", "cancel every open order", runCancelAll},
+	"orders":     {"orders [-status S | -all]", "list open orders", runOrders},
+	"book":       {"book [-market M] [-depth N]", "show the book of a market", runBook},
+	"trades":     {"trades [-market M] [-n N] [-f]", "show and follow the trades of a market", runTrades},
+	"balances":   {"balances [USER_ID]", "show the balances of a user", runBalances},
+	"admin":      {"admin status|index-price|log-level|deposit ...", "change markets and the exchange", runAdmin},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	switch {
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "exchangectl:", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command line args, writing results to stdout and usage and
+// progress to stderr.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("exchangectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		baseURL    = fs.String("url", envOr("EXCHANGE_URL", client.DefaultBaseURL), "URL of the exchange")
+		userID     = fs.String("user", os.Getenv("EXCHANGE_USER_ID"), "ID of the user to act as")
+		apiKey     = fs.String("api-key", os.Getenv("EXCHANGE_API_KEY"), "API key of the user")
+		adminToken = fs.String("admin-token", os.Getenv("EXCHANGE_ADMIN_TOKEN"), "token of the admin API")
+		format     = fs.String("o", formatTable, "output format: table or json")
+		timeout    = fs.Duration("timeout", client.DefaultTimeout, "timeout of each request")
+	)
+	fs.Usage = func() { usage(fs) }
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if *format != formatTable && *format != formatJSON {
+		fmt.Fprintf(stderr, "unknown output format %q\n", *format)
+		return errUsage
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		if fs.NArg() > 0 {
+			fmt.Fprintf(stderr, "unknown command %q\n", fs.Arg(0))
+		}
+		usage(fs)
+		return errUsage
+	}
+
+	opts := []client.Option{
+		client.WithBaseURL(*baseURL),
+		client.WithTimeout(*timeout),
+	}
+	if *userID != "" {
+		opts = append(opts, client.WithUserID(*userID))
+	}
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	if *adminToken != "" {
+		opts = append(opts, client.WithAdminToken(*adminToken))
+	}
+
+	return cmd.run(ctx, &env{
+		client: client.NewClient(opts...),
+		userID: *userID,
+		out:    newPrinter(stdout, *format),
+		stderr: stderr,
+		usage:  cmd.usage,
+	}, fs.Args()[1:])
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: exchangectl [flags] <command> [command flags] [args]")
+	fmt.Fprintln(w, "\ncommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprintln(w, "\nflags:")
+	fs.PrintDefaults()
+}
+
+// parse parses the flags of a command, which takes at most maxArgs
+// arguments.
+func (e *env) parse(fs *flag.FlagSet, args []string, maxArgs int) error {
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: exchangectl %s\n", e.usage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() > maxArgs {
+		fs.Usage()
+		return errUsage
+	}
+
+	return nil
+}
+
+// requireUser returns the user given with -user, commands acting for a user
+// fail without one.
+func (e *env) requireUser() (string, error) {
+	if e.userID == "" {
+		return "", errors.New("no user, pass -user or set EXCHANGE_USER_ID")
+	}
+
+	return e.userID, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.DateTime)
+}
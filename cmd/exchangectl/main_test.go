@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto_exchange/server"
+	"crypto_exchange/server/servertest"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token-0123456789"
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// startExchange serves an exchange with a fake settler for the duration of
+// the test and returns its URL.
+func startExchange(t *testing.T) string {
+	t.Helper()
+
+	cfg := servertest.Config()
+	cfg.Admin.Tokens = map[string]string{"test": testAdminToken}
+
+	return servertest.Serve(t, servertest.NewExchange(t, cfg))
+}
+
+// runCommand runs exchangectl against url and returns what it printed.
+func runCommand(t *testing.T, url string, args ...string) (string, error) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), append([]string{"-url", url}, args...), &stdout, &stderr)
+
+	return stdout.String(), err
+}
+
+// runJSON runs exchangectl with JSON output and decodes it into out.
+func runJSON(t *testing.T, url string, out any, args ...string) {
+	t.Helper()
+
+	stdout, err := runCommand(t, url, append([]string{"-o", "json"}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(stdout), out); err != nil {
+		t.Fatalf("decoding %q: %v", stdout, err)
+	}
+}
+
+func TestExchangectl(t *testing.T) {
+	url := startExchange(t)
+
+	var maker, taker server.UserRes
+	runJSON(t, url, &maker, "register")
+	runJSON(t, url, &taker, "register")
+
+	var placed server.PlaceOrderRes
+	runJSON(t, url, &placed, "-user", maker.ID, "-api-key", maker.APIKey, "limit", "-side", "sell", "-size", "3", "-price", "3500", "-client-id", "a")
+	runJSON(t, url, &placed, "-user", maker.ID, "-api-key", maker.APIKey, "limit", "-side", "ask", "-size", "2", "-price", "3600")
+	_, err := runCommand(t, url, "-user", taker.ID, "-api-key", taker.APIKey, "market", "-side", "buy", "-size", "1")
+	assert(t, err, nil)
+
+	// the book as a table, asks from the highest price down
+	stdout, err := runCommand(t, url, "book", "-depth", "5")
+	assert(t, err, nil)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	assert(t, len(lines), 3)
+	assert(t, strings.Fields(lines[1]), []string{"ask", "3600", "2"})
+	assert(t, strings.Fields(lines[2]), []string{"ask", "3500", "2"})
+
+	var orders []server.OrderRecord
+	runJSON(t, url, &orders, "-user", maker.ID, "-api-key", maker.APIKey, "orders")
+	assert(t, len(orders), 2)
+	runJSON(t, url, &orders, "-user", taker.ID, "-api-key", taker.APIKey, "orders", "-all")
+	assert(t, len(orders), 1)
+	assert(t, orders[0].Status, server.OrderFilled)
+
+	var trades []server.Trade
+	runJSON(t, url, &trades, "trades")
+	assert(t, len(trades), 1)
+	assert(t, trades[0].Price, 3500.0)
+
+	var cancelled server.OrderRecord
+	runJSON(t, url, &cancelled, "-user", maker.ID, "-api-key", maker.APIKey, "cancel", "-client-id", "a")
+	assert(t, cancelled.Status, server.OrderCancelled)
+
+	var cancelAll server.CancelAllRes
+	runJSON(t, url, &cancelAll, "-user", maker.ID, "-api-key", maker.APIKey, "cancel-all", "-side", "sell")
+	assert(t, cancelAll.OrderIDs, []string{placed.OrderID})
+
+	// the fake settler keeps no balances
+	var balances []server.BalanceRes
+	runJSON(t, url, &balances, "-api-key", maker.APIKey, "balances", maker.ID)
+	assert(t, balances, []server.BalanceRes{})
+
+	var level server.LogLevelRes
+	runJSON(t, url, &level, "-admin-token", testAdminToken, "admin", "log-level", "debug")
+	assert(t, level.Level, "DEBUG")
+
+	var market server.MarketRes
+	runJSON(t, url, &market, "-admin-token", testAdminToken, "admin", "status", "-reason", "test", "ETH", "halted")
+	assert(t, market.Status, server.MarketHalted)
+
+	_, err = runCommand(t, url, "orders")
+	assert(t, err.Error(), "no user, pass -user or set EXCHANGE_USER_ID")
+	_, err = runCommand(t, url, "admin", "log-level")
+	assert(t, strings.Contains(err.Error(), "401"), true)
+	_, err = runCommand(t, url, "nonsense")
+	assert(t, errors.Is(err, errUsage), true)
+	_, err = runCommand(t, url, "limit", "-side", "bid", "extra")
+	assert(t, errors.Is(err, errUsage), true)
+}
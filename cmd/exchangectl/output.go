@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printer writes results either as aligned tables or as the JSON the
+// exchange returned them in.
+type printer struct {
+	w      io.Writer
+	format string
+	widths []int
+}
+
+func newPrinter(w io.Writer, format string) *printer {
+	return &printer{w: w, format: format}
+}
+
+// print writes v as indented JSON, or the rows under header as a table.
+func (p *printer) print(v any, header []string, rows [][]string) error {
+	if p.format == formatJSON {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// header starts a table whose rows are written one at a time with stream,
+// its columns are padded to widths so that the rows stay aligned.
+func (p *printer) header(header []string, widths []int) error {
+	p.widths = widths
+	if p.format == formatJSON {
+		return nil
+	}
+
+	_, err := fmt.Fprintln(p.w, p.pad(header))
+	return err
+}
+
+// stream writes v as a line of JSON, or row as a line of the table started
+// with header.
+func (p *printer) stream(v any, row []string) error {
+	if p.format == formatJSON {
+		return json.NewEncoder(p.w).Encode(v)
+	}
+
+	_, err := fmt.Fprintln(p.w, p.pad(row))
+	return err
+}
+
+func (p *printer) pad(row []string) string {
+	var b strings.Builder
+	for i, cell := range row {
+		width := 0
+		if i < len(p.widths) {
+			width = p.widths[i]
+		}
+		if i == len(row)-1 {
+			width = 0
+		} else {
+			cell += "  "
+			width += 2
+		}
+		fmt.Fprintf(&b, "%-*s", width, cell)
+	}
+
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func side(isBid bool) string {
+	if isBid {
+		return "bid"
+	}
+
+	return "ask"
+}
@@ -0,0 +1,230 @@
+package fix
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+type AcceptorConfig struct {
+	// CompID is the SenderCompID of the acceptor.
+	CompID string
+	// StoreDir holds the stores of the sessions.
+	StoreDir string
+	// Counterparties maps the SenderCompIDs allowed to log on to the
+	// Password their Logon has to carry.
+	Counterparties map[string]string
+	Logger         *slog.Logger
+}
+
+// Acceptor serves the sessions of its counterparties, one session of each at
+// a time. The store of a counterparty stays open between its sessions.
+type Acceptor struct {
+	cfg AcceptorConfig
+	app Application
+	log *slog.Logger
+
+	mu       sync.Mutex
+	lis      net.Listener
+	stores   map[string]*Store
+	sessions map[string]*Session
+	closed   bool
+}
+
+func NewAcceptor(cfg AcceptorConfig, app Application) *Acceptor {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Acceptor{
+		cfg:      cfg,
+		app:      app,
+		log:      logger.With("sender_comp_id", cfg.CompID),
+		stores:   make(map[string]*Store),
+		sessions: make(map[string]*Session),
+	}
+}
+
+// Serve accepts connections on lis until Close is called.
+func (a *Acceptor) Serve(lis net.Listener) error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrSessionClosed
+	}
+	a.lis = lis
+	a.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			a.mu.Lock()
+			closed := a.closed
+			a.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		go a.serveConn(conn)
+	}
+}
+
+// serveConn logs on the session of the initiator connected over conn.
+func (a *Acceptor) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(logonTimeout))
+	msg, err := ReadMessage(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		a.log.Warn("reading fix logon", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+
+	// nothing of the session, not even its store, is touched before the
+	// counterparty proved who it is
+	target := msg.Get(TagSenderCompID)
+	if msg.Type() != MsgLogon || msg.Get(TagTargetCompID) != a.cfg.CompID || !a.authenticate(target, msg.Get(TagPassword)) {
+		a.log.Warn("refusing fix logon", "remote_addr", conn.RemoteAddr().String(), "msg_type", msg.Type(), "target_comp_id", target)
+		conn.Close()
+		return
+	}
+
+	store, err := a.store(target)
+	if err != nil {
+		a.log.Error("opening fix store", "target_comp_id", target, "error", err)
+		conn.Close()
+		return
+	}
+
+	s := newSession(SessionConfig{
+		SenderCompID: a.cfg.CompID,
+		TargetCompID: target,
+		Logger:       a.cfg.Logger,
+	}, store, &acceptorApp{Application: a.app, a: a}, conn)
+
+	if !a.claim(s) {
+		s.refuse("session already logged on")
+		return
+	}
+
+	if err := s.accept(r, msg); err != nil {
+		a.release(s)
+		a.log.Warn("fix logon failed", "target_comp_id", target, "error", err)
+		conn.Close()
+	}
+}
+
+// authenticate reports whether compID is a counterparty and password is
+// its password.
+func (a *Acceptor) authenticate(compID, password string) bool {
+	expected, ok := a.cfg.Counterparties[compID]
+	if !ok || expected == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+func (a *Acceptor) store(target string) (*Store, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if st, ok := a.stores[target]; ok {
+		return st, nil
+	}
+
+	st, err := OpenStore(a.cfg.StoreDir, a.cfg.CompID+"-"+target)
+	if err != nil {
+		return nil, err
+	}
+	a.stores[target] = st
+
+	return st, nil
+}
+
+// claim makes s the session of its counterparty unless another one is
+// logged on.
+func (a *Acceptor) claim(s *Session) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed || a.sessions[s.TargetCompID()] != nil {
+		return false
+	}
+	a.sessions[s.TargetCompID()] = s
+
+	return true
+}
+
+func (a *Acceptor) release(s *Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.sessions[s.TargetCompID()] == s {
+		delete(a.sessions, s.TargetCompID())
+	}
+}
+
+// Session returns the logged on session of a counterparty.
+func (a *Acceptor) Session(compID string) (*Session, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[compID]
+	return s, ok
+}
+
+// Close stops accepting connections and logs out every session.
+func (a *Acceptor) Close() error {
+	a.mu.Lock()
+	a.closed = true
+	lis := a.lis
+	sessions := make([]*Session, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		sessions = append(sessions, s)
+	}
+	a.mu.Unlock()
+
+	var errs []error
+	if lis != nil {
+		errs = append(errs, lis.Close())
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Logout("acceptor shutting down")
+		}()
+	}
+	wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, st := range a.stores {
+		errs = append(errs, st.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// acceptorApp frees the counterparty of a session once it ends.
+type acceptorApp struct {
+	Application
+	a *Acceptor
+}
+
+func (app *acceptorApp) OnLogout(s *Session) {
+	app.a.release(s)
+	app.Application.OnLogout(s)
+}
@@ -0,0 +1,302 @@
+package fix
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// recorder is an Application that hands the messages it gets to the test.
+type recorder struct {
+	msgs    chan *Message
+	logons  chan *Session
+	logouts chan *Session
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		msgs:    make(chan *Message, 100),
+		logons:  make(chan *Session, 10),
+		logouts: make(chan *Session, 10),
+	}
+}
+
+func (r *recorder) OnLogon(s *Session)               { r.logons <- s }
+func (r *recorder) OnLogout(s *Session)              { r.logouts <- s }
+func (r *recorder) FromApp(s *Session, msg *Message) { r.msgs <- msg }
+
+func (r *recorder) next(t *testing.T) *Message {
+	t.Helper()
+
+	select {
+	case msg := <-r.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+func startAcceptor(t *testing.T, dir string, app Application) (*Acceptor, string) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAcceptor(AcceptorConfig{CompID: "EXCHANGE", StoreDir: dir, Counterparties: map[string]string{"CLIENT": "client-password"}}, app)
+	go a.Serve(lis)
+	t.Cleanup(func() { a.Close() })
+
+	return a, lis.Addr().String()
+}
+
+func openStore(t *testing.T, dir string) *Store {
+	t.Helper()
+
+	st, err := OpenStore(dir, "CLIENT-EXCHANGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	return st
+}
+
+var clientConfig = SessionConfig{SenderCompID: "CLIENT", TargetCompID: "EXCHANGE", HeartBtInt: time.Second, Password: "client-password"}
+
+func TestMessage(t *testing.T) {
+	msg := NewMessage(MsgNewOrderSingle).
+		Set(TagClOrdID, "order-1").
+		SetFloat(TagPrice, 3500.5).
+		SetInt(TagMsgSeqNum, 7).
+		Set(TagSenderCompID, "CLIENT")
+
+	data := msg.Bytes()
+	if !strings.HasPrefix(string(data), "8=FIX.4.4\x019=") || !strings.Contains(string(data), "\x0135=D\x0149=CLIENT\x0134=7\x01") {
+		t.Errorf("unexpected framing %q", data)
+	}
+
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, parsed.Type(), MsgNewOrderSingle)
+	assert(t, parsed.Get(TagClOrdID), "order-1")
+	price, err := parsed.Float(TagPrice)
+	assert(t, err, nil)
+	assert(t, price, 3500.5)
+
+	_, err = parsed.Int(TagOrderQty)
+	assert(t, err, &FieldError{Tag: TagOrderQty, Reason: RejectRequiredTagMissing})
+
+	data[len(data)-3]++
+	_, err = ParseMessage(data)
+	if !errors.Is(err, ErrGarbled) {
+		t.Errorf("corrupted checksum gave %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	dir := t.TempDir()
+	server := newRecorder()
+	a, addr := startAcceptor(t, dir, server)
+
+	client := newRecorder()
+	s, err := Dial(addr, clientConfig, openStore(t, t.TempDir()), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-client.logons
+	as := <-server.logons
+	assert(t, as.TargetCompID(), "CLIENT")
+
+	// a second session of the same counterparty is refused
+	_, err = Dial(addr, clientConfig, openStore(t, t.TempDir()), newRecorder())
+	if err == nil || !strings.Contains(err.Error(), "already logged on") {
+		t.Errorf("second logon gave %v", err)
+	}
+
+	assert(t, s.Send(NewMessage(MsgNewOrderSingle).Set(TagClOrdID, "order-1")), nil)
+	msg := server.next(t)
+	assert(t, msg.Get(TagClOrdID), "order-1")
+	assert(t, msg.SeqNum(), 2)
+
+	assert(t, as.Send(NewMessage(MsgExecutionReport).Set(TagClOrdID, "order-1")), nil)
+	assert(t, client.next(t).Get(TagClOrdID), "order-1")
+
+	s.Logout("")
+	assert(t, s.Err(), nil)
+	<-server.logouts
+	if _, ok := a.Session("CLIENT"); ok {
+		t.Error("session still registered after logout")
+	}
+}
+
+func TestResend(t *testing.T) {
+	dir := t.TempDir()
+	clientDir := t.TempDir()
+	server := newRecorder()
+	_, addr := startAcceptor(t, dir, server)
+
+	client := newRecorder()
+	store := openStore(t, clientDir)
+	s, err := Dial(addr, clientConfig, store, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := <-server.logons
+
+	for _, id := range []string{"exec-1", "exec-2"} {
+		assert(t, as.Send(NewMessage(MsgExecutionReport).Set(TagExecID, id)), nil)
+		client.next(t)
+	}
+	s.Logout("")
+	<-server.logouts
+
+	// the initiator lost the messages after its logon
+	store.Close()
+	store = openStore(t, clientDir)
+	assert(t, store.NextTargetSeq(), 5)
+	assert(t, store.SetNextTargetSeq(2), nil)
+
+	s, err = Dial(addr, clientConfig, store, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Logout("")
+
+	for _, id := range []string{"exec-1", "exec-2"} {
+		msg := client.next(t)
+		assert(t, msg.Get(TagExecID), id)
+		assert(t, msg.Bool(TagPossDupFlag), true)
+		if !msg.Has(TagOrigSendingTime) {
+			t.Error("resent message without OrigSendingTime")
+		}
+	}
+
+	// the gap is closed, new messages follow on
+	as = <-server.logons
+	assert(t, as.Send(NewMessage(MsgExecutionReport).Set(TagExecID, "exec-3")), nil)
+	msg := client.next(t)
+	assert(t, msg.Get(TagExecID), "exec-3")
+	assert(t, msg.Bool(TagPossDupFlag), false)
+	assert(t, store.NextTargetSeq(), msg.SeqNum()+1)
+}
+
+func TestSequenceTooLow(t *testing.T) {
+	server := newRecorder()
+	_, addr := startAcceptor(t, t.TempDir(), server)
+
+	clientDir := t.TempDir()
+	store := openStore(t, clientDir)
+	s, err := Dial(addr, clientConfig, store, newRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-server.logons
+	s.Logout("")
+	<-server.logouts
+
+	assert(t, store.SetNextSenderSeq(1), nil)
+	_, err = Dial(addr, clientConfig, store, newRecorder())
+	if err == nil || !strings.Contains(err.Error(), "MsgSeqNum too low") {
+		t.Errorf("logon with a reused sequence number gave %v", err)
+	}
+
+	// starting over is allowed
+	cfg := clientConfig
+	cfg.ResetSeqNum = true
+	s, err = Dial(addr, cfg, store, newRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Logout("")
+}
+
+func TestLogonPassword(t *testing.T) {
+	server := newRecorder()
+	a, addr := startAcceptor(t, t.TempDir(), server)
+
+	store := openStore(t, t.TempDir())
+	s, err := Dial(addr, clientConfig, store, newRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-server.logons
+	s.Logout("")
+	<-server.logouts
+	next := a.stores["CLIENT"].NextTargetSeq()
+
+	// a wrong password neither logs on nor resets the sequence numbers
+	for _, password := range []string{"", "wrong-password"} {
+		cfg := clientConfig
+		cfg.Password = password
+		cfg.ResetSeqNum = true
+		if _, err := Dial(addr, cfg, openStore(t, t.TempDir()), newRecorder()); err == nil {
+			t.Errorf("logon with password %q accepted", password)
+		}
+	}
+	assert(t, a.stores["CLIENT"].NextTargetSeq(), next)
+	select {
+	case <-server.logons:
+		t.Error("application told about a refused logon")
+	default:
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	server := newRecorder()
+	_, addr := startAcceptor(t, t.TempDir(), server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	logon := NewMessage(MsgLogon).
+		Set(TagSenderCompID, "CLIENT").
+		Set(TagTargetCompID, "EXCHANGE").
+		SetInt(TagMsgSeqNum, 1).
+		SetInt(TagEncryptMethod, 0).
+		SetInt(TagHeartBtInt, 1).
+		Set(TagPassword, clientConfig.Password)
+	if _, err := conn.Write(logon.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client never answers, the acceptor sends heartbeats, tests the
+	// line and gives up
+	var types []string
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msg, err := ReadMessage(r)
+		if err != nil {
+			break
+		}
+		types = append(types, msg.Type())
+	}
+
+	assert(t, types[0], MsgLogon)
+	assert(t, strings.Contains(strings.Join(types, ","), MsgHeartbeat), true)
+	assert(t, strings.Contains(strings.Join(types, ","), MsgTestRequest), true)
+
+	s := <-server.logouts
+	if !errors.Is(s.Err(), ErrHeartbeatTimeout) {
+		t.Errorf("session ended with %v", s.Err())
+	}
+}
@@ -0,0 +1,457 @@
+// Package fix implements the session layer of FIX 4.4 over TCP: framing of
+// tag=value messages, logon, heartbeats, sequence numbers kept in a Store
+// across connections and the resending of messages a counterparty missed.
+// An Acceptor serves the sessions of known counterparties, Dial opens a
+// session as the initiator.
+package fix
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BeginString = "FIX.4.4"
+
+	soh = '\x01'
+
+	// maxBodyLength bounds the messages read from a counterparty.
+	maxBodyLength = 1 << 16
+
+	timeFormat = "20060102-15:04:05.000"
+)
+
+// Tag is the number of a field.
+type Tag int
+
+// Fields of the standard header and trailer and of the session messages.
+const (
+	TagBeginSeqNo          Tag = 7
+	TagBeginString         Tag = 8
+	TagBodyLength          Tag = 9
+	TagCheckSum            Tag = 10
+	TagEndSeqNo            Tag = 16
+	TagMsgSeqNum           Tag = 34
+	TagMsgType             Tag = 35
+	TagNewSeqNo            Tag = 36
+	TagPossDupFlag         Tag = 43
+	TagRefSeqNum           Tag = 45
+	TagSenderCompID        Tag = 49
+	TagSendingTime         Tag = 52
+	TagTargetCompID        Tag = 56
+	TagText                Tag = 58
+	TagEncryptMethod       Tag = 98
+	TagHeartBtInt          Tag = 108
+	TagTestReqID           Tag = 112
+	TagOrigSendingTime     Tag = 122
+	TagGapFillFlag         Tag = 123
+	TagResetSeqNumFlag     Tag = 141
+	TagRefTagID            Tag = 371
+	TagRefMsgType          Tag = 372
+	TagSessionRejectReason Tag = 373
+	TagUsername            Tag = 553
+	TagPassword            Tag = 554
+)
+
+// Fields of the order entry messages.
+const (
+	TagAccount              Tag = 1
+	TagAvgPx                Tag = 6
+	TagClOrdID              Tag = 11
+	TagCumQty               Tag = 14
+	TagExecID               Tag = 17
+	TagLastPx               Tag = 31
+	TagLastQty              Tag = 32
+	TagOrderID              Tag = 37
+	TagOrderQty             Tag = 38
+	TagOrdStatus            Tag = 39
+	TagOrdType              Tag = 40
+	TagOrigClOrdID          Tag = 41
+	TagPrice                Tag = 44
+	TagSide                 Tag = 54
+	TagSymbol               Tag = 55
+	TagTimeInForce          Tag = 59
+	TagTransactTime         Tag = 60
+	TagCxlRejReason         Tag = 102
+	TagOrdRejReason         Tag = 103
+	TagExecType             Tag = 150
+	TagLeavesQty            Tag = 151
+	TagBusinessRejectReason Tag = 380
+	TagCxlRejResponseTo     Tag = 434
+)
+
+// Message types.
+const (
+	MsgHeartbeat                 = "0"
+	MsgTestRequest               = "1"
+	MsgResendRequest             = "2"
+	MsgReject                    = "3"
+	MsgSequenceReset             = "4"
+	MsgLogout                    = "5"
+	MsgExecutionReport           = "8"
+	MsgOrderCancelReject         = "9"
+	MsgLogon                     = "A"
+	MsgNewOrderSingle            = "D"
+	MsgOrderCancelRequest        = "F"
+	MsgOrderCancelReplaceRequest = "G"
+	MsgBusinessMessageReject     = "j"
+)
+
+// SessionRejectReason values of a Reject.
+const (
+	RejectInvalidTag          = 0
+	RejectRequiredTagMissing  = 1
+	RejectValueIncorrect      = 5
+	RejectIncorrectDataFormat = 6
+	RejectInvalidMsgType      = 11
+	RejectOther               = 99
+)
+
+// headerTags are written first, in this order, after BeginString and
+// BodyLength.
+var headerTags = []Tag{TagMsgType, TagSenderCompID, TagTargetCompID, TagMsgSeqNum, TagPossDupFlag, TagSendingTime, TagOrigSendingTime}
+
+// IsAdmin reports whether msgType is a message of the session layer.
+func IsAdmin(msgType string) bool {
+	switch msgType {
+	case MsgHeartbeat, MsgTestRequest, MsgResendRequest, MsgReject, MsgSequenceReset, MsgLogout, MsgLogon:
+		return true
+	}
+
+	return false
+}
+
+type field struct {
+	tag   Tag
+	value string
+}
+
+// Message is a FIX message, its fields in the order they were set.
+// BeginString, BodyLength and CheckSum are added when it is written.
+type Message struct {
+	fields []field
+}
+
+// FieldError tells why a field of a message can't be used, Reason is the
+// SessionRejectReason of the Reject answering the message.
+type FieldError struct {
+	Tag    Tag
+	Reason int
+}
+
+func (e *FieldError) Error() string {
+	switch e.Reason {
+	case RejectRequiredTagMissing:
+		return fmt.Sprintf("required tag %d missing", e.Tag)
+	case RejectIncorrectDataFormat:
+		return fmt.Sprintf("incorrect data format for tag %d", e.Tag)
+	default:
+		return fmt.Sprintf("value is incorrect for tag %d", e.Tag)
+	}
+}
+
+func NewMessage(msgType string) *Message {
+	return new(Message).Set(TagMsgType, msgType)
+}
+
+func (m *Message) Type() string {
+	return m.Get(TagMsgType)
+}
+
+// Get returns the value of tag, empty if the message doesn't have it.
+func (m *Message) Get(tag Tag) string {
+	value, _ := m.lookup(tag)
+	return value
+}
+
+func (m *Message) Has(tag Tag) bool {
+	_, ok := m.lookup(tag)
+	return ok
+}
+
+func (m *Message) lookup(tag Tag) (string, bool) {
+	for _, f := range m.fields {
+		if f.tag == tag {
+			return f.value, true
+		}
+	}
+
+	return "", false
+}
+
+// Set sets tag to value, replacing the value the message has for it.
+func (m *Message) Set(tag Tag, value string) *Message {
+	for i := range m.fields {
+		if m.fields[i].tag == tag {
+			m.fields[i].value = value
+			return m
+		}
+	}
+
+	m.fields = append(m.fields, field{tag: tag, value: value})
+	return m
+}
+
+func (m *Message) SetInt(tag Tag, value int) *Message {
+	return m.Set(tag, strconv.Itoa(value))
+}
+
+func (m *Message) SetFloat(tag Tag, value float64) *Message {
+	return m.Set(tag, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (m *Message) SetBool(tag Tag, value bool) *Message {
+	if value {
+		return m.Set(tag, "Y")
+	}
+	return m.Set(tag, "N")
+}
+
+// SetTime sets tag to t as a UTCTimestamp with milliseconds.
+func (m *Message) SetTime(tag Tag, t time.Time) *Message {
+	return m.Set(tag, t.UTC().Format(timeFormat))
+}
+
+// Remove drops tag from the message.
+func (m *Message) Remove(tag Tag) *Message {
+	for i := range m.fields {
+		if m.fields[i].tag == tag {
+			m.fields = append(m.fields[:i], m.fields[i+1:]...)
+			break
+		}
+	}
+
+	return m
+}
+
+// Required returns the value of tag, a *FieldError if it is missing or
+// empty.
+func (m *Message) Required(tag Tag) (string, error) {
+	value, ok := m.lookup(tag)
+	if !ok || value == "" {
+		return "", &FieldError{Tag: tag, Reason: RejectRequiredTagMissing}
+	}
+
+	return value, nil
+}
+
+func (m *Message) Int(tag Tag) (int, error) {
+	value, err := m.Required(tag)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &FieldError{Tag: tag, Reason: RejectIncorrectDataFormat}
+	}
+
+	return n, nil
+}
+
+func (m *Message) Float(tag Tag) (float64, error) {
+	value, err := m.Required(tag)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, &FieldError{Tag: tag, Reason: RejectIncorrectDataFormat}
+	}
+
+	return f, nil
+}
+
+// Bool reports whether tag is Y, a missing field is false.
+func (m *Message) Bool(tag Tag) bool {
+	return m.Get(tag) == "Y"
+}
+
+func (m *Message) Time(tag Tag) (time.Time, error) {
+	value, err := m.Required(tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	for _, layout := range []string{timeFormat, "20060102-15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, &FieldError{Tag: tag, Reason: RejectIncorrectDataFormat}
+}
+
+func (m *Message) SeqNum() int {
+	seq, _ := m.Int(TagMsgSeqNum)
+	return seq
+}
+
+func (m *Message) Clone() *Message {
+	return &Message{fields: append([]field(nil), m.fields...)}
+}
+
+// Bytes encodes the message with its BeginString, BodyLength and CheckSum.
+func (m *Message) Bytes() []byte {
+	var body bytes.Buffer
+	for _, tag := range headerTags {
+		if value, ok := m.lookup(tag); ok {
+			writeField(&body, tag, value)
+		}
+	}
+	for _, f := range m.fields {
+		if !isHeaderTag(f.tag) && f.tag != TagBeginString && f.tag != TagBodyLength && f.tag != TagCheckSum {
+			writeField(&body, f.tag, f.value)
+		}
+	}
+
+	var buf bytes.Buffer
+	writeField(&buf, TagBeginString, BeginString)
+	writeField(&buf, TagBodyLength, strconv.Itoa(body.Len()))
+	buf.Write(body.Bytes())
+	writeField(&buf, TagCheckSum, fmt.Sprintf("%03d", checksum(buf.Bytes())))
+
+	return buf.Bytes()
+}
+
+// Readable returns the fields of the message separated by |, for logs.
+func (m *Message) Readable() string {
+	return strings.ReplaceAll(string(m.Bytes()), string(soh), "|")
+}
+
+func isHeaderTag(tag Tag) bool {
+	for _, t := range headerTags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeField(buf *bytes.Buffer, tag Tag, value string) {
+	buf.WriteString(strconv.Itoa(int(tag)))
+	buf.WriteByte('=')
+	buf.WriteString(value)
+	buf.WriteByte(soh)
+}
+
+func checksum(data []byte) int {
+	var sum int
+	for _, b := range data {
+		sum += int(b)
+	}
+
+	return sum % 256
+}
+
+// ErrGarbled is returned for a message that can't be framed.
+var ErrGarbled = errors.New("fix: garbled message")
+
+// ReadMessage reads the next message from r, checking its BeginString,
+// BodyLength and CheckSum.
+func ReadMessage(r *bufio.Reader) (*Message, error) {
+	var frame bytes.Buffer
+
+	tag, value, err := readField(r, &frame)
+	if err != nil {
+		return nil, err
+	}
+	if tag != TagBeginString || value != BeginString {
+		return nil, fmt.Errorf("%w: begins with %d=%s", ErrGarbled, tag, value)
+	}
+
+	tag, value, err = readField(r, &frame)
+	if err != nil {
+		return nil, err
+	}
+	length, convErr := strconv.Atoi(value)
+	if tag != TagBodyLength || convErr != nil || length <= 0 || length > maxBodyLength {
+		return nil, fmt.Errorf("%w: invalid body length %d=%s", ErrGarbled, tag, value)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	frame.Write(body)
+
+	tag, value, err = readField(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tag != TagCheckSum || value != fmt.Sprintf("%03d", checksum(frame.Bytes())) {
+		return nil, fmt.Errorf("%w: checksum mismatch %d=%s", ErrGarbled, tag, value)
+	}
+
+	return parseBody(body)
+}
+
+// readField reads the next tag=value field, adding it to frame unless it is
+// nil.
+func readField(r *bufio.Reader, frame *bytes.Buffer) (Tag, string, error) {
+	data, err := r.ReadSlice(soh)
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return 0, "", ErrGarbled
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if frame != nil {
+		frame.Write(data)
+	}
+
+	tag, value, ok := parseField(data[:len(data)-1])
+	if !ok {
+		return 0, "", fmt.Errorf("%w: invalid field %q", ErrGarbled, data)
+	}
+
+	return tag, value, nil
+}
+
+func parseField(data []byte) (Tag, string, bool) {
+	tag, value, ok := bytes.Cut(data, []byte{'='})
+	if !ok {
+		return 0, "", false
+	}
+
+	n, err := strconv.Atoi(string(tag))
+	if err != nil || n <= 0 {
+		return 0, "", false
+	}
+
+	return Tag(n), string(value), true
+}
+
+func parseBody(body []byte) (*Message, error) {
+	if body[len(body)-1] != soh {
+		return nil, fmt.Errorf("%w: body doesn't end with a field", ErrGarbled)
+	}
+
+	m := &Message{}
+	for _, data := range bytes.Split(body[:len(body)-1], []byte{soh}) {
+		tag, value, ok := parseField(data)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid field %q", ErrGarbled, data)
+		}
+		m.fields = append(m.fields, field{tag: tag, value: value})
+	}
+
+	if len(m.fields) == 0 || m.fields[0].tag != TagMsgType {
+		return nil, fmt.Errorf("%w: MsgType isn't the third field", ErrGarbled)
+	}
+
+	return m, nil
+}
+
+// ParseMessage decodes a message encoded with Bytes.
+func ParseMessage(data []byte) (*Message, error) {
+	return ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+}
@@ -0,0 +1,696 @@
+package fix
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// logonTimeout bounds the wait for the Logon of the counterparty.
+	logonTimeout = 10 * time.Second
+	// logoutTimeout bounds the wait for the counterparty to answer a Logout.
+	logoutTimeout = 2 * time.Second
+	writeTimeout  = 10 * time.Second
+)
+
+var (
+	// ErrSessionClosed is returned when sending on a session that ended.
+	ErrSessionClosed = errors.New("fix: session closed")
+	// ErrHeartbeatTimeout ends a session whose counterparty went silent.
+	ErrHeartbeatTimeout = errors.New("fix: heartbeat timeout")
+)
+
+// Application handles the application messages of sessions.
+type Application interface {
+	// OnLogon is called once a session is logged on, before any of its
+	// application messages is handled.
+	OnLogon(s *Session)
+	// OnLogout is called once a logged on session ends.
+	OnLogout(s *Session)
+	// FromApp handles an application message. Messages are handled one at a
+	// time in the order of their sequence numbers, a handler that blocks
+	// holds up the heartbeats of the session.
+	FromApp(s *Session, msg *Message)
+}
+
+type SessionConfig struct {
+	SenderCompID string
+	TargetCompID string
+	// HeartBtInt is the heartbeat interval the initiator asks for, whole
+	// seconds. The acceptor uses the one of the Logon.
+	HeartBtInt time.Duration
+	// ResetSeqNum makes the initiator start the session over at sequence
+	// number 1.
+	ResetSeqNum bool
+	// Password is sent in the Logon of the initiator.
+	Password string
+	Logger   *slog.Logger
+}
+
+// Session is a logged on FIX session over a connection. Messages received
+// are checked against the sequence number the Store expects, a gap is
+// filled by asking the counterparty to resend before the messages after it
+// are handled.
+type Session struct {
+	cfg   SessionConfig
+	store *Store
+	app   Application
+	conn  net.Conn
+	log   *slog.Logger
+
+	// mu serializes sending, so sequence numbers go out in order
+	mu         sync.Mutex
+	heartBt    time.Duration
+	lastSent   time.Time
+	loggingOut bool
+	closed     bool
+
+	// state of the receiving side, used by run alone
+	lastRecv    time.Time
+	testReqSent bool
+	// pending holds the messages received ahead of a gap, nil for those
+	// already handled
+	pending  map[int]*Message
+	resendTo int
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newSession(cfg SessionConfig, store *Store, app Application, conn net.Conn) *Session {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Session{
+		cfg:     cfg,
+		store:   store,
+		app:     app,
+		conn:    conn,
+		log:     logger.With("sender_comp_id", cfg.SenderCompID, "target_comp_id", cfg.TargetCompID),
+		heartBt: cfg.HeartBtInt,
+		pending: make(map[int]*Message),
+		done:    make(chan struct{}),
+	}
+}
+
+// Dial opens a session to the acceptor at addr, logging on with the
+// sequence numbers of store. It returns once the acceptor answered the
+// Logon.
+func Dial(addr string, cfg SessionConfig, store *Store, app Application) (*Session, error) {
+	if cfg.HeartBtInt < time.Second {
+		return nil, fmt.Errorf("fix: heartbeat interval %s is below a second", cfg.HeartBtInt)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, logonTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSession(cfg, store, app, conn)
+	r := bufio.NewReader(conn)
+
+	if cfg.ResetSeqNum {
+		if err := store.Reset(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	logon := NewMessage(MsgLogon).
+		SetInt(TagEncryptMethod, 0).
+		SetInt(TagHeartBtInt, int(cfg.HeartBtInt/time.Second))
+	if cfg.ResetSeqNum {
+		logon.SetBool(TagResetSeqNumFlag, true)
+	}
+	if cfg.Password != "" {
+		logon.Set(TagPassword, cfg.Password)
+	}
+	if err := s.Send(logon); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(logonTimeout))
+	msg, err := ReadMessage(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fix: waiting for logon: %w", err)
+	}
+	if msg.Type() == MsgLogout {
+		conn.Close()
+		return nil, fmt.Errorf("fix: logon refused: %s", msg.Get(TagText))
+	}
+	if msg.Type() != MsgLogon {
+		conn.Close()
+		return nil, fmt.Errorf("fix: logon answered with message type %s", msg.Type())
+	}
+
+	if err := s.logon(msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go s.run(r)
+
+	return s, nil
+}
+
+// accept logs on the session of an initiator that sent msg, answering with
+// a Logon.
+func (s *Session) accept(r *bufio.Reader, msg *Message) error {
+	heartBt, err := msg.Int(TagHeartBtInt)
+	if err != nil || heartBt <= 0 {
+		s.refuse("HeartBtInt must be a positive number of seconds")
+		return fmt.Errorf("fix: invalid heartbeat interval %q", msg.Get(TagHeartBtInt))
+	}
+	if method := msg.Get(TagEncryptMethod); method != "" && method != "0" {
+		s.refuse("EncryptMethod must be 0")
+		return fmt.Errorf("fix: unsupported encryption %s", method)
+	}
+	s.heartBt = time.Duration(heartBt) * time.Second
+
+	if msg.Bool(TagResetSeqNumFlag) {
+		if err := s.store.Reset(); err != nil {
+			return err
+		}
+	}
+
+	if seq := msg.SeqNum(); seq < s.store.NextTargetSeq() {
+		text := fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", s.store.NextTargetSeq(), seq)
+		s.refuse(text)
+		return errors.New("fix: " + text)
+	}
+
+	reply := NewMessage(MsgLogon).
+		SetInt(TagEncryptMethod, 0).
+		SetInt(TagHeartBtInt, heartBt)
+	if msg.Bool(TagResetSeqNumFlag) {
+		reply.SetBool(TagResetSeqNumFlag, true)
+	}
+	if err := s.Send(reply); err != nil {
+		return err
+	}
+
+	if err := s.logon(msg); err != nil {
+		return err
+	}
+
+	go s.run(r)
+
+	return nil
+}
+
+// refuse answers a Logon that can't be accepted with a Logout.
+func (s *Session) refuse(text string) {
+	s.Send(NewMessage(MsgLogout).Set(TagText, text))
+	s.conn.Close()
+}
+
+// logon takes the sequence number of the Logon of the counterparty, asking
+// for the messages missed before it, and tells the application.
+func (s *Session) logon(msg *Message) error {
+	s.lastRecv = time.Now()
+
+	seq, expected := msg.SeqNum(), s.store.NextTargetSeq()
+	switch {
+	case seq < expected:
+		text := fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", expected, seq)
+		s.Send(NewMessage(MsgLogout).Set(TagText, text))
+		return errors.New("fix: " + text)
+	case seq > expected:
+		s.pending[seq] = nil
+		if err := s.requestResend(expected, seq); err != nil {
+			return err
+		}
+	default:
+		if err := s.store.SetNextTargetSeq(seq + 1); err != nil {
+			return err
+		}
+	}
+
+	s.log.Info("fix session logged on", "heartbeat", s.heartBt)
+	s.app.OnLogon(s)
+
+	return nil
+}
+
+func (s *Session) SenderCompID() string {
+	return s.cfg.SenderCompID
+}
+
+func (s *Session) TargetCompID() string {
+	return s.cfg.TargetCompID
+}
+
+// Done is closed once the session ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err tells why the session ended once Done is closed, nil after a Logout.
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+// Send sends msg with the next sequence number. Application messages are
+// stored before they are sent so they can be resent.
+func (s *Session) Send(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+
+	seq := s.store.NextSenderSeq()
+	msg.Set(TagSenderCompID, s.cfg.SenderCompID).
+		Set(TagTargetCompID, s.cfg.TargetCompID).
+		SetInt(TagMsgSeqNum, seq).
+		SetTime(TagSendingTime, time.Now())
+	data := msg.Bytes()
+
+	if !IsAdmin(msg.Type()) {
+		if err := s.store.SaveMessage(seq, data); err != nil {
+			return err
+		}
+	}
+	if err := s.store.SetNextSenderSeq(seq + 1); err != nil {
+		return err
+	}
+
+	return s.writeLocked(data)
+}
+
+func (s *Session) writeLocked(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+	s.lastSent = time.Now()
+
+	return nil
+}
+
+// Reject answers msg with a session level Reject, taking the tag and the
+// reason from err if it is a *FieldError.
+func (s *Session) Reject(msg *Message, err error) error {
+	reject := NewMessage(MsgReject).
+		SetInt(TagRefSeqNum, msg.SeqNum()).
+		Set(TagRefMsgType, msg.Type()).
+		Set(TagText, err.Error())
+
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		reject.SetInt(TagRefTagID, int(fe.Tag)).SetInt(TagSessionRejectReason, fe.Reason)
+	} else {
+		reject.SetInt(TagSessionRejectReason, RejectOther)
+	}
+
+	return s.Send(reject)
+}
+
+// Logout ends the session, waiting a little for the counterparty to answer
+// the Logout.
+func (s *Session) Logout(text string) {
+	s.mu.Lock()
+	s.loggingOut = true
+	s.mu.Unlock()
+
+	msg := NewMessage(MsgLogout)
+	if text != "" {
+		msg.Set(TagText, text)
+	}
+	if err := s.Send(msg); err != nil {
+		s.Close()
+		return
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(logoutTimeout):
+		s.Close()
+	}
+}
+
+// Close drops the connection of the session without a Logout.
+func (s *Session) Close() {
+	s.conn.Close()
+}
+
+func (s *Session) end(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		s.conn.Close()
+		s.err = err
+		if err != nil {
+			s.log.Warn("fix session ended", "error", err)
+		} else {
+			s.log.Info("fix session logged out")
+		}
+
+		s.app.OnLogout(s)
+		close(s.done)
+	})
+}
+
+// run handles the messages of the counterparty and keeps the heartbeats
+// going until the session ends.
+func (s *Session) run(r *bufio.Reader) {
+	msgs := make(chan *Message)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ReadMessage(r)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	tick := time.NewTicker(max(s.heartBt/10, 10*time.Millisecond))
+	defer tick.Stop()
+
+	for {
+		select {
+		case msg := <-msgs:
+			s.lastRecv = time.Now()
+			s.testReqSent = false
+
+			done, err := s.handle(msg)
+			if done || err != nil {
+				s.end(err)
+				return
+			}
+		case err := <-errc:
+			s.mu.Lock()
+			loggingOut := s.loggingOut
+			s.mu.Unlock()
+			if loggingOut {
+				err = nil
+			}
+			s.end(err)
+			return
+		case now := <-tick.C:
+			if err := s.heartbeat(now); err != nil {
+				s.end(err)
+				return
+			}
+		}
+	}
+}
+
+// heartbeat sends a Heartbeat when nothing was sent for an interval and
+// a TestRequest when nothing was received for a bit longer. The session
+// ends if the TestRequest goes unanswered.
+func (s *Session) heartbeat(now time.Time) error {
+	s.mu.Lock()
+	idle := now.Sub(s.lastSent)
+	s.mu.Unlock()
+
+	if idle >= s.heartBt {
+		if err := s.Send(NewMessage(MsgHeartbeat)); err != nil {
+			return err
+		}
+	}
+
+	silent := now.Sub(s.lastRecv)
+	grace := s.heartBt / 5
+	switch {
+	case silent > 2*s.heartBt+grace:
+		return ErrHeartbeatTimeout
+	case silent > s.heartBt+grace && !s.testReqSent:
+		s.testReqSent = true
+		return s.Send(NewMessage(MsgTestRequest).Set(TagTestReqID, strconv.FormatInt(now.UnixNano(), 10)))
+	}
+
+	return nil
+}
+
+// handle checks the sequence number of msg and handles it and the pending
+// messages following it. done is true once the session logged out.
+func (s *Session) handle(msg *Message) (done bool, err error) {
+	if msg.Get(TagSenderCompID) != s.cfg.TargetCompID || msg.Get(TagTargetCompID) != s.cfg.SenderCompID {
+		text := fmt.Sprintf("CompID problem, %s to %s", msg.Get(TagSenderCompID), msg.Get(TagTargetCompID))
+		s.Send(NewMessage(MsgLogout).Set(TagText, text))
+		return false, errors.New("fix: " + text)
+	}
+
+	seq, err := msg.Int(TagMsgSeqNum)
+	if err != nil {
+		s.Send(NewMessage(MsgLogout).Set(TagText, "MsgSeqNum missing"))
+		return false, fmt.Errorf("fix: %w", err)
+	}
+
+	// a SequenceReset that isn't a gap fill ignores the sequence numbers
+	if msg.Type() == MsgSequenceReset && !msg.Bool(TagGapFillFlag) {
+		return false, s.sequenceReset(msg)
+	}
+
+	expected := s.store.NextTargetSeq()
+	switch {
+	case seq < expected:
+		if msg.Bool(TagPossDupFlag) {
+			return false, nil
+		}
+		text := fmt.Sprintf("MsgSeqNum too low, expecting %d but received %d", expected, seq)
+		s.Send(NewMessage(MsgLogout).Set(TagText, text))
+		return false, errors.New("fix: " + text)
+	case seq > expected:
+		switch msg.Type() {
+		case MsgResendRequest:
+			// resending can't wait for the gap to be filled
+			s.pending[seq] = nil
+			if err := s.resend(msg); err != nil {
+				return false, err
+			}
+		case MsgLogout:
+			return true, s.logout()
+		default:
+			s.pending[seq] = msg
+		}
+
+		// the resend asked for runs up to the last message, one at a time
+		if s.resendTo == 0 {
+			return false, s.requestResend(expected, seq)
+		}
+		return false, nil
+	}
+
+	if done, err := s.process(msg); done || err != nil {
+		return done, err
+	}
+
+	for {
+		next := s.store.NextTargetSeq()
+		for seq := range s.pending {
+			if seq < next {
+				delete(s.pending, seq)
+			}
+		}
+
+		msg, ok := s.pending[next]
+		if !ok {
+			break
+		}
+		delete(s.pending, next)
+
+		if msg == nil {
+			if err := s.store.SetNextTargetSeq(next + 1); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if done, err := s.process(msg); done || err != nil {
+			return done, err
+		}
+	}
+
+	if s.store.NextTargetSeq() > s.resendTo {
+		s.resendTo = 0
+	}
+
+	return false, nil
+}
+
+// process handles a message with the expected sequence number.
+func (s *Session) process(msg *Message) (done bool, err error) {
+	seq := msg.SeqNum()
+
+	if msg.Type() == MsgSequenceReset {
+		newSeq, err := msg.Int(TagNewSeqNo)
+		if err == nil && newSeq <= seq {
+			err = &FieldError{Tag: TagNewSeqNo, Reason: RejectValueIncorrect}
+		}
+		if err != nil {
+			if err := s.store.SetNextTargetSeq(seq + 1); err != nil {
+				return false, err
+			}
+			return false, s.Reject(msg, err)
+		}
+		return false, s.store.SetNextTargetSeq(newSeq)
+	}
+
+	if err := s.store.SetNextTargetSeq(seq + 1); err != nil {
+		return false, err
+	}
+
+	switch msg.Type() {
+	case MsgHeartbeat, MsgReject:
+		if msg.Type() == MsgReject {
+			s.log.Warn("fix message rejected", "ref_seq_num", msg.Get(TagRefSeqNum), "text", msg.Get(TagText))
+		}
+	case MsgTestRequest:
+		return false, s.Send(NewMessage(MsgHeartbeat).Set(TagTestReqID, msg.Get(TagTestReqID)))
+	case MsgResendRequest:
+		return false, s.resend(msg)
+	case MsgLogout:
+		return true, s.logout()
+	case MsgLogon:
+		return false, s.Reject(msg, errors.New("already logged on"))
+	default:
+		s.app.FromApp(s, msg)
+	}
+
+	return false, nil
+}
+
+// logout answers the Logout of the counterparty unless it answers one.
+func (s *Session) logout() error {
+	s.mu.Lock()
+	loggingOut := s.loggingOut
+	s.mu.Unlock()
+
+	if loggingOut {
+		return nil
+	}
+
+	return s.Send(NewMessage(MsgLogout))
+}
+
+// sequenceReset moves the expected sequence number forward.
+func (s *Session) sequenceReset(msg *Message) error {
+	newSeq, err := msg.Int(TagNewSeqNo)
+	if err == nil && newSeq < s.store.NextTargetSeq() {
+		err = &FieldError{Tag: TagNewSeqNo, Reason: RejectValueIncorrect}
+	}
+	if err != nil {
+		return s.Reject(msg, err)
+	}
+
+	for seq := range s.pending {
+		if seq < newSeq {
+			delete(s.pending, seq)
+		}
+	}
+
+	return s.store.SetNextTargetSeq(newSeq)
+}
+
+// requestResend asks for the messages from begin on, received is the
+// sequence number that revealed the gap.
+func (s *Session) requestResend(begin, received int) error {
+	s.resendTo = received
+	s.log.Info("fix sequence gap, asking for resend", "begin", begin, "received", received)
+
+	return s.Send(NewMessage(MsgResendRequest).
+		SetInt(TagBeginSeqNo, begin).
+		SetInt(TagEndSeqNo, 0))
+}
+
+// resend answers a ResendRequest. Stored application messages are sent
+// again with PossDupFlag set, the session messages in between are skipped
+// with a SequenceReset in gap fill mode.
+func (s *Session) resend(msg *Message) error {
+	begin, err := msg.Int(TagBeginSeqNo)
+	if err != nil {
+		return s.Reject(msg, err)
+	}
+	end, err := msg.Int(TagEndSeqNo)
+	if err != nil {
+		return s.Reject(msg, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.store.NextSenderSeq() - 1
+	if end == 0 || end > last {
+		end = last
+	}
+	if begin < 1 || begin > end {
+		return nil
+	}
+
+	s.log.Info("fix resending", "begin", begin, "end", end)
+
+	stored := s.store.Messages(begin, end)
+	gap := 0
+	for seq := begin; seq <= end; seq++ {
+		data, ok := stored[seq]
+		if !ok {
+			if gap == 0 {
+				gap = seq
+			}
+			continue
+		}
+
+		orig, err := ParseMessage(data)
+		if err != nil {
+			return err
+		}
+
+		if gap != 0 {
+			if err := s.gapFillLocked(gap, seq); err != nil {
+				return err
+			}
+			gap = 0
+		}
+
+		orig.SetBool(TagPossDupFlag, true).
+			Set(TagOrigSendingTime, orig.Get(TagSendingTime)).
+			SetTime(TagSendingTime, time.Now())
+		if err := s.writeLocked(orig.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if gap != 0 {
+		return s.gapFillLocked(gap, end+1)
+	}
+
+	return nil
+}
+
+// gapFillLocked skips the messages from seq up to newSeq. s.mu must be held.
+func (s *Session) gapFillLocked(seq, newSeq int) error {
+	msg := NewMessage(MsgSequenceReset).
+		Set(TagSenderCompID, s.cfg.SenderCompID).
+		Set(TagTargetCompID, s.cfg.TargetCompID).
+		SetInt(TagMsgSeqNum, seq).
+		SetBool(TagPossDupFlag, true).
+		SetTime(TagSendingTime, time.Now()).
+		SetBool(TagGapFillFlag, true).
+		SetInt(TagNewSeqNo, newSeq)
+
+	return s.writeLocked(msg.Bytes())
+}
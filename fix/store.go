@@ -0,0 +1,198 @@
+package fix
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store keeps the sequence numbers of a session and the application messages
+// it sent, so a session picks up where it left off after a restart and can
+// resend what its counterparty missed. Sequence numbers are written to
+// <name>.seqnums, messages are appended to <name>.messages.
+type Store struct {
+	mu        sync.Mutex
+	seqPath   string
+	msgPath   string
+	msgs      *os.File
+	senderSeq int
+	targetSeq int
+	sent      map[int][]byte
+}
+
+type storeSeqs struct {
+	NextSenderSeq int `json:"next_sender_seq"`
+	NextTargetSeq int `json:"next_target_seq"`
+}
+
+type storedMessage struct {
+	Seq int    `json:"seq"`
+	Msg string `json:"msg"`
+}
+
+// OpenStore opens the store of the session called name in dir, a new
+// session starts at sequence number 1 on both sides.
+func OpenStore(dir, name string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	st := &Store{
+		seqPath:   filepath.Join(dir, name+".seqnums"),
+		msgPath:   filepath.Join(dir, name+".messages"),
+		senderSeq: 1,
+		targetSeq: 1,
+		sent:      make(map[int][]byte),
+	}
+
+	data, err := os.ReadFile(st.seqPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var seqs storeSeqs
+		if err := json.Unmarshal(data, &seqs); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", st.seqPath, err)
+		}
+		st.senderSeq, st.targetSeq = seqs.NextSenderSeq, seqs.NextTargetSeq
+	}
+
+	if err := st.loadMessages(); err != nil {
+		return nil, err
+	}
+
+	st.msgs, err = os.OpenFile(st.msgPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (st *Store) loadMessages() error {
+	f, err := os.Open(st.msgPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 2*maxBodyLength)
+	for scanner.Scan() {
+		var msg storedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			// a write cut short by a crash, the message was never sent
+			break
+		}
+		st.sent[msg.Seq] = []byte(msg.Msg)
+	}
+
+	return scanner.Err()
+}
+
+// NextSenderSeq returns the sequence number of the next message sent.
+func (st *Store) NextSenderSeq() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.senderSeq
+}
+
+// NextTargetSeq returns the sequence number expected of the next message
+// received.
+func (st *Store) NextTargetSeq() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.targetSeq
+}
+
+func (st *Store) SetNextSenderSeq(seq int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.senderSeq = seq
+	return st.saveSeqs()
+}
+
+func (st *Store) SetNextTargetSeq(seq int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.targetSeq = seq
+	return st.saveSeqs()
+}
+
+// SaveMessage stores an application message sent with seq.
+func (st *Store) SaveMessage(seq int, msg []byte) error {
+	data, err := json.Marshal(storedMessage{Seq: seq, Msg: string(msg)})
+	if err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, err := st.msgs.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	st.sent[seq] = msg
+
+	return nil
+}
+
+// Messages returns the stored messages sent with sequence numbers from begin
+// to end.
+func (st *Store) Messages(begin, end int) map[int][]byte {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	msgs := make(map[int][]byte)
+	for seq, msg := range st.sent {
+		if seq >= begin && seq <= end {
+			msgs[seq] = msg
+		}
+	}
+
+	return msgs
+}
+
+// Reset starts the session over at sequence number 1 on both sides and
+// drops the stored messages.
+func (st *Store) Reset() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if err := st.msgs.Truncate(0); err != nil {
+		return err
+	}
+	st.sent = make(map[int][]byte)
+	st.senderSeq, st.targetSeq = 1, 1
+
+	return st.saveSeqs()
+}
+
+func (st *Store) Close() error {
+	return st.msgs.Close()
+}
+
+func (st *Store) saveSeqs() error {
+	data, err := json.Marshal(storeSeqs{NextSenderSeq: st.senderSeq, NextTargetSeq: st.targetSeq})
+	if err != nil {
+		return err
+	}
+
+	tmp := st.seqPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, st.seqPath)
+}
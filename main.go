@@ -1,38 +1,148 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto_exchange/client"
 	"crypto_exchange/server"
-	"fmt"
-	"math"
+	"crypto_exchange/strategy"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-const maxOrders = 3
+const (
+	maxOrders = 3
+
+	// demoDeposit is the USD every demo user starts with, the quote of the
+	// demo market is kept on the ledger of the exchange.
+	demoDeposit = 10_000_000_000
+)
 
 var (
 	dur = 2 * time.Second
 )
 
 func main() {
-	go server.StartServer()
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	adminToken := demoAdminToken(&cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Run(ctx, cfg)
+	}()
 
 	time.Sleep(time.Second)
 
-	cl := client.NewClient()
+	url := baseURL(cfg.HTTP.Addr)
+	cl := client.NewClient(client.WithBaseURL(url), client.WithAdminToken(adminToken))
+
+	users := registerUsers(cl, 3)
+	fundUsers(cl, users)
 
-	seedMarket(cl)
+	seedMarket(userClient(url, users[0]), users[0].ID)
 
-	go makeMarketSimple(cl)
+	go runBot(userClient(url, users[1]), users[1].ID, &strategy.MarketMaker{Size: 1000, Improve: 100, MaxOrders: maxOrders}, dur)
 
 	time.Sleep(time.Second)
 
-	marketOrderPlacer(cl)
+	runBot(userClient(url, users[2]), users[2].ID, &strategy.MarketTaker{Size: 1000}, dur*2)
+
+	// shut the exchange down so the last trades are batched for settlement
+	stop()
+	if err := <-stopped; err != nil {
+		log.Fatal(err)
+	}
+}
+
+// baseURL returns the URL the bots reach the server listening on addr at.
+func baseURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return client.DefaultBaseURL
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// registerUsers registers n demo users. Their private keys are taken from the
+// comma separated EXCHANGE_DEMO_KEYS environment variable, missing keys are
+// generated by the exchange.
+func registerUsers(cl *client.Client, n int) []*server.UserRes {
+	var keys []string
+	if env := os.Getenv("EXCHANGE_DEMO_KEYS"); env != "" {
+		keys = strings.Split(env, ",")
+	}
+
+	users := make([]*server.UserRes, n)
+	for i := 0; i < n; i++ {
+		var key string
+		if i < len(keys) {
+			key = strings.TrimSpace(keys[i])
+		}
+
+		user, err := cl.RegisterUser(key)
+		if err != nil {
+			panic(err)
+		}
+		users[i] = user
+	}
+
+	return users
+}
+
+// userClient returns a client acting as user.
+func userClient(url string, user *server.UserRes) *client.Client {
+	return client.NewClient(client.WithBaseURL(url), client.WithUserID(user.ID), client.WithAPIKey(user.APIKey))
+}
+
+// demoAdminToken returns the token the demo funds its users with, adding a
+// random one to cfg if it has none.
+func demoAdminToken(cfg *server.Config) string {
+	for _, token := range cfg.Admin.Tokens {
+		return token
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+	cfg.Admin.Tokens = map[string]string{"demo": token}
+
+	return token
+}
+
+// fundUsers deposits demoDeposit USD to every demo user, a configuration
+// without USD on the ledger leaves them unfunded.
+func fundUsers(cl *client.Client, users []*server.UserRes) {
+	for _, user := range users {
+		if _, err := cl.Deposit(user.ID, "USD", demoDeposit); err != nil {
+			log.Printf("demo users aren't funded: %v", err)
+			return
+		}
+	}
 }
 
-func seedMarket(cl *client.Client) {
+func seedMarket(cl *client.Client, userID string) {
 	bid := &client.PlaceOrderArgs{
-		UserID: "1",
+		UserID: userID,
 		IsBid:  true,
 		Size:   2_000_000,
 		Price:  3500,
@@ -43,7 +153,7 @@ func seedMarket(cl *client.Client) {
 	}
 
 	ask := &client.PlaceOrderArgs{
-		UserID: "1",
+		UserID: userID,
 		Size:   2_000_000,
 		Price:  3600,
 	}
@@ -53,81 +163,15 @@ func seedMarket(cl *client.Client) {
 	}
 }
 
-func makeMarketSimple(cl *client.Client) {
-	for range time.Tick(dur) {
-		orders, err := cl.GetUserOrders(server.ETH, "2")
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Println("user orders:", orders)
-
-		bestBid, err := cl.GetBestPrice(server.ETH, "bid")
-		if err != nil {
-			fmt.Println(err)
-		}
-		bestAsk, err := cl.GetBestPrice(server.ETH, "ask")
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		spread := math.Abs(bestBid - bestAsk)
-		fmt.Println("Exchange spread:", spread)
-
-		if len(orders.Bids) < maxOrders {
-			bidOrderArgs := &client.PlaceOrderArgs{
-				UserID: "2",
-				IsBid:  true,
-				Size:   1000,
-				Price:  bestBid + 100,
-			}
-			bidOrderID, err := cl.PlaceLimitOrder(bidOrderArgs)
-			if err != nil {
-				fmt.Println(bidOrderID)
-			}
-		}
-
-		if len(orders.Asks) < maxOrders {
-			askOrderArgs := &client.PlaceOrderArgs{
-				UserID: "2",
-				Size:   1000,
-				Price:  bestAsk - 100,
-			}
-			askOrderID, err := cl.PlaceLimitOrder(askOrderArgs)
-			if err != nil {
-				fmt.Println(askOrderID)
-			}
-		}
-
-		fmt.Println("Best bid price:", bestBid)
-		fmt.Println("Best ask price:", bestAsk)
+// runBot runs a demo strategy for userID, quitting the demo if it fails.
+func runBot(cl *client.Client, userID string, s strategy.Strategy, interval time.Duration) {
+	cfg := strategy.Config{
+		Market:   server.ETH,
+		Interval: interval,
+		Logger:   slog.Default().With("user_id", userID),
 	}
-}
-
-func marketOrderPlacer(cl *client.Client) {
-	for range time.Tick(dur * 2) {
-		trades, err := cl.GetTrades(server.ETH)
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Println("trades:", trades)
 
-		marketAskOrderArgs := &client.PlaceOrderArgs{
-			UserID: "3",
-			Size:   1000,
-		}
-		askOrderID, err := cl.PlaceMarketOrder(marketAskOrderArgs)
-		if err != nil {
-			fmt.Println(askOrderID)
-		}
-
-		marketBidOrderArgs := &client.PlaceOrderArgs{
-			UserID: "3",
-			IsBid:  true,
-			Size:   1000,
-		}
-		bidOrderID, err := cl.PlaceMarketOrder(marketBidOrderArgs)
-		if err != nil {
-			fmt.Println(bidOrderID)
-		}
+	if err := strategy.Run(context.Background(), strategy.NewClientVenue(cl), s, cfg); err != nil {
+		log.Fatal(err)
 	}
 }
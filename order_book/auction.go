@@ -0,0 +1,108 @@
+package order_book
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AuctionPrice returns the price at which the crossed part of the book
+// would uncross and the volume traded at it. The price maximizes the
+// volume, ties go to the smallest imbalance between bids and asks and then
+// to the price closest to reference. ok is false if the book isn't crossed.
+func (ob *OrderBook) AuctionPrice(reference float64) (price, volume float64, ok bool) {
+	bids, asks := ob.BidLimitsList(), ob.AskLimitsList()
+	if len(bids) == 0 || len(asks) == 0 || bids[0].Price < asks[0].Price {
+		return 0, 0, false
+	}
+
+	bestImbalance := math.Inf(1)
+	for _, candidate := range append(append(Limits(nil), bids...), asks...) {
+		p := candidate.Price
+
+		var demand, supply float64
+		for _, limit := range bids {
+			if limit.Price >= p {
+				demand += limit.TotalVolume
+			}
+		}
+		for _, limit := range asks {
+			if limit.Price <= p {
+				supply += limit.TotalVolume
+			}
+		}
+
+		executable := math.Min(demand, supply)
+		imbalance := math.Abs(demand - supply)
+
+		switch {
+		case executable > volume,
+			executable == volume && imbalance < bestImbalance,
+			executable == volume && imbalance == bestImbalance && math.Abs(p-reference) < math.Abs(price-reference):
+			price, volume, bestImbalance = p, executable, imbalance
+		}
+	}
+
+	return price, volume, volume > 0
+}
+
+// Uncross matches the crossed part of the book at its auction price, in
+// price then time priority on both sides. Auction trades have no aggressor,
+// their IsBid is false. The book must be able to match.
+func (ob *OrderBook) Uncross(reference float64) (float64, []Match) {
+	if !ob.status.CanMatch() {
+		panic(fmt.Sprintf("auction uncrossed in %s book", ob.status))
+	}
+
+	price, _, ok := ob.AuctionPrice(reference)
+	if !ok {
+		return 0, nil
+	}
+
+	start := time.Now()
+
+	bids := append(Limits(nil), ob.BidLimitsList()...)
+	asks := append(Limits(nil), ob.AskLimitsList()...)
+
+	var matches []Match
+	for len(bids) > 0 && len(asks) > 0 && bids[0].Price >= price && asks[0].Price <= price {
+		bidLimit, askLimit := bids[0], asks[0]
+		bid, ask := bidLimit.Orders[0], askLimit.Orders[0]
+
+		size := math.Min(bid.Size, ask.Size)
+		bid.Size -= size
+		ask.Size -= size
+		bidLimit.TotalVolume -= size
+		askLimit.TotalVolume -= size
+
+		matches = append(matches, Match{
+			Bid:        bid,
+			Ask:        ask,
+			SizeFilled: size,
+			Price:      price,
+		})
+
+		if bid.IsFilled() {
+			bidLimit.DeleteOrder(bid)
+			if len(bidLimit.Orders) == 0 {
+				ob.deleteLimit(bidLimit, true)
+				bids = bids[1:]
+			}
+		}
+		if ask.IsFilled() {
+			askLimit.DeleteOrder(ask)
+			if len(askLimit.Orders) == 0 {
+				ob.deleteLimit(askLimit, false)
+				asks = asks[1:]
+			}
+		}
+	}
+
+	ob.recordTrades(matches, false)
+
+	if ob.hooks != nil {
+		ob.hooks.AuctionUncrossed(ob, price, matches, time.Since(start))
+	}
+
+	return price, matches
+}
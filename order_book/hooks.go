@@ -0,0 +1,18 @@
+package order_book
+
+import "time"
+
+// Hooks is notified of changes to an order book, for example to record
+// metrics without the book depending on a metrics library. Hooks run
+// synchronously while the book is changed, so they may read the book but
+// must not change it.
+type Hooks interface {
+	LimitOrderPlaced(ob *OrderBook, order *Order)
+	MarketOrderFilled(ob *OrderBook, order *Order, matches []Match, took time.Duration)
+	OrderCancelled(ob *OrderBook, order *Order)
+	AuctionUncrossed(ob *OrderBook, price float64, matches []Match, took time.Duration)
+}
+
+func (ob *OrderBook) SetHooks(hooks Hooks) {
+	ob.hooks = hooks
+}
@@ -6,6 +6,7 @@ import (
 )
 
 type Match struct {
+	TradeID    string
 	Ask        *Order
 	Bid        *Order
 	SizeFilled float64
@@ -49,7 +50,9 @@ func (l *Limit) DeleteOrder(order *Order) {
 
 	sort.Sort(l.Orders)
 
+	l.OrderBook.OrdersMu.Lock()
 	delete(l.OrderBook.Orders, order.ID)
+	l.OrderBook.OrdersMu.Unlock()
 }
 
 func (l *Limit) Fill(order *Order) []Match {
@@ -7,12 +7,13 @@ import (
 )
 
 type Order struct {
-	ID        string
-	UserID    string
-	Size      float64
-	IsBid     bool
-	Timestamp int64
-	Limit     *Limit
+	ID            string
+	ClientOrderID string
+	UserID        string
+	Size          float64
+	IsBid         bool
+	Timestamp     int64
+	Limit         *Limit
 }
 
 func NewOrder(userID string, size float64, isBid bool) *Order {
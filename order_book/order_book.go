@@ -2,12 +2,14 @@ package order_book
 
 import (
 	"fmt"
+	"github.com/google/uuid"
 	"sort"
 	"sync"
 	"time"
 )
 
 type Trade struct {
+	ID        string
 	IsBid     bool
 	Price     float64
 	Size      float64
@@ -22,6 +24,8 @@ type OrderBook struct {
 	OrdersMu      sync.RWMutex
 	Orders        map[string]*Order
 	Trades        []*Trade
+	hooks         Hooks
+	status        Status
 }
 
 func NewOrderBook() *OrderBook {
@@ -29,10 +33,15 @@ func NewOrderBook() *OrderBook {
 		BidLimits: make(map[float64]*Limit),
 		AskLimits: make(map[float64]*Limit),
 		Orders:    make(map[string]*Order),
+		status:    StatusOpen,
 	}
 }
 
 func (ob *OrderBook) PlaceLimitOrder(order *Order, price float64) {
+	if !ob.status.CanPlaceLimit() {
+		panic(fmt.Sprintf("limit order placed in %s book", ob.status))
+	}
+
 	var limit *Limit
 
 	if order.IsBid {
@@ -57,45 +66,95 @@ func (ob *OrderBook) PlaceLimitOrder(order *Order, price float64) {
 	ob.OrdersMu.Lock()
 	ob.Orders[order.ID] = order
 	ob.OrdersMu.Unlock()
+
+	if ob.hooks != nil {
+		ob.hooks.LimitOrderPlaced(ob, order)
+	}
 }
 
 func (ob *OrderBook) PlaceMarketOrder(order *Order) []Match {
-	var (
-		matches        []Match
-		limitsToDelete []*Limit
-	)
+	if !ob.status.CanMatch() {
+		panic(fmt.Sprintf("market order placed in %s book", ob.status))
+	}
 
 	if order.IsBid {
 		if order.Size > ob.AsksTotalVolume() {
 			panic(fmt.Sprintf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.AsksTotalVolume(), order.Size))
 		}
-		for _, limit := range ob.AskLimitsList() {
-			limitMatches := limit.Fill(order)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				limitsToDelete = append(limitsToDelete, limit)
-			}
-
-			if order.IsFilled() {
-				break
-			}
-		}
 	} else {
 		if order.Size > ob.BidsTotalVolume() {
 			panic(fmt.Sprintf("not enough volume [size: %.2f] for market order [size: %.2f]", ob.BidsTotalVolume(), order.Size))
 		}
-		for _, limit := range ob.BidLimitsList() {
-			limitMatches := limit.Fill(order)
-			matches = append(matches, limitMatches...)
+	}
 
-			if len(limit.Orders) == 0 {
-				limitsToDelete = append(limitsToDelete, limit)
-			}
+	return ob.fillMarketOrder(order, nil)
+}
 
-			if order.IsFilled() {
-				break
-			}
+// PlaceMarketOrderWithin fills order against the limits priced no worse than
+// bound, a bid isn't filled above bound and an ask not below it. What can't
+// be filled within the bound is left in order.Size.
+func (ob *OrderBook) PlaceMarketOrderWithin(order *Order, bound float64) []Match {
+	if !ob.status.CanMatch() {
+		panic(fmt.Sprintf("market order placed in %s book", ob.status))
+	}
+
+	return ob.fillMarketOrder(order, func(price float64) bool {
+		return withinBound(order.IsBid, price, bound)
+	})
+}
+
+// VolumeWithin returns the volume a market order on the given side can fill
+// at prices no worse than bound.
+func (ob *OrderBook) VolumeWithin(isBid bool, bound float64) float64 {
+	limits := ob.bidLimitsList
+	if isBid {
+		limits = ob.askLimitsList
+	}
+
+	var volume float64
+	for _, limit := range limits {
+		if withinBound(isBid, limit.Price, bound) {
+			volume += limit.TotalVolume
+		}
+	}
+
+	return volume
+}
+
+func withinBound(isBid bool, price, bound float64) bool {
+	if isBid {
+		return price <= bound
+	}
+
+	return price >= bound
+}
+
+func (ob *OrderBook) fillMarketOrder(order *Order, within func(price float64) bool) []Match {
+	var (
+		matches        []Match
+		limitsToDelete []*Limit
+		start          = time.Now()
+	)
+
+	limits := ob.BidLimitsList()
+	if order.IsBid {
+		limits = ob.AskLimitsList()
+	}
+
+	for _, limit := range limits {
+		if within != nil && !within(limit.Price) {
+			break
+		}
+
+		limitMatches := limit.Fill(order)
+		matches = append(matches, limitMatches...)
+
+		if len(limit.Orders) == 0 {
+			limitsToDelete = append(limitsToDelete, limit)
+		}
+
+		if order.IsFilled() {
+			break
 		}
 	}
 
@@ -103,18 +162,29 @@ func (ob *OrderBook) PlaceMarketOrder(order *Order) []Match {
 		ob.deleteLimit(l, !order.IsBid)
 	}
 
-	for _, match := range matches {
+	ob.recordTrades(matches, order.IsBid)
+
+	if ob.hooks != nil {
+		ob.hooks.MarketOrderFilled(ob, order, matches, time.Since(start))
+	}
+
+	return matches
+}
+
+// recordTrades records a trade for every match and sets its ID on the match.
+func (ob *OrderBook) recordTrades(matches []Match, isBid bool) {
+	for i, match := range matches {
 		trade := &Trade{
-			IsBid:     order.IsBid,
+			ID:        uuid.NewString(),
+			IsBid:     isBid,
 			Size:      match.SizeFilled,
 			Price:     match.Price,
 			Timestamp: time.Now().UnixNano(),
 		}
 
 		ob.Trades = append(ob.Trades, trade)
+		matches[i].TradeID = trade.ID
 	}
-
-	return matches
 }
 
 func (ob *OrderBook) BidsTotalVolume() float64 {
@@ -166,6 +236,10 @@ func (ob *OrderBook) deleteLimit(limit *Limit, isBid bool) {
 }
 
 func (ob *OrderBook) CancelOrder(order *Order) {
+	if !ob.status.CanCancel() {
+		panic(fmt.Sprintf("order cancelled in %s book", ob.status))
+	}
+
 	limit := order.Limit
 	limit.DeleteOrder(order)
 
@@ -173,7 +247,13 @@ func (ob *OrderBook) CancelOrder(order *Order) {
 		ob.deleteLimit(limit, order.IsBid)
 	}
 
+	ob.OrdersMu.Lock()
 	delete(ob.Orders, order.ID)
+	ob.OrdersMu.Unlock()
+
+	if ob.hooks != nil {
+		ob.hooks.OrderCancelled(ob, order)
+	}
 }
 
 type UserOrders struct {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -109,3 +110,134 @@ func TestCancelOrder(t *testing.T) {
 	_, ok := orderBook.Orders[buyOrder.ID]
 	assert(t, ok, false)
 }
+
+type recordingHooks struct {
+	events []string
+}
+
+func (h *recordingHooks) LimitOrderPlaced(ob *OrderBook, order *Order) {
+	h.events = append(h.events, fmt.Sprintf("placed %s", order.UserID))
+}
+
+func (h *recordingHooks) MarketOrderFilled(ob *OrderBook, order *Order, matches []Match, took time.Duration) {
+	h.events = append(h.events, fmt.Sprintf("filled %s in %d matches", order.UserID, len(matches)))
+}
+
+func (h *recordingHooks) OrderCancelled(ob *OrderBook, order *Order) {
+	h.events = append(h.events, fmt.Sprintf("cancelled %s", order.UserID))
+}
+
+func (h *recordingHooks) AuctionUncrossed(ob *OrderBook, price float64, matches []Match, took time.Duration) {
+	h.events = append(h.events, fmt.Sprintf("uncrossed at %.0f in %d matches", price, len(matches)))
+}
+
+func TestHooks(t *testing.T) {
+	hooks := &recordingHooks{}
+	orderBook := NewOrderBook()
+	orderBook.SetHooks(hooks)
+
+	sellOrderA := NewOrder("1", 5, false)
+	orderBook.PlaceLimitOrder(sellOrderA, 10_000)
+	sellOrderB := NewOrder("2", 5, false)
+	orderBook.PlaceLimitOrder(sellOrderB, 11_000)
+
+	orderBook.PlaceMarketOrder(NewOrder("3", 7, true))
+	orderBook.CancelOrder(sellOrderB)
+
+	assert(t, hooks.events, []string{
+		"placed 1",
+		"placed 2",
+		"filled 3 in 2 matches",
+		"cancelled 2",
+	})
+}
+
+func TestStatus(t *testing.T) {
+	mustPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s didn't panic", name)
+			}
+		}()
+		fn()
+	}
+
+	orderBook := NewOrderBook()
+	assert(t, orderBook.Status(), StatusOpen)
+
+	sellOrder := NewOrder("1", 5, false)
+	orderBook.PlaceLimitOrder(sellOrder, 10_000)
+
+	orderBook.SetStatus(StatusPostOnly)
+	orderBook.PlaceLimitOrder(NewOrder("2", 5, true), 9_000)
+	mustPanic("market order when post only", func() { orderBook.PlaceMarketOrder(NewOrder("3", 1, true)) })
+
+	orderBook.SetStatus(StatusHalted)
+	mustPanic("limit order when halted", func() { orderBook.PlaceLimitOrder(NewOrder("4", 1, true), 9_000) })
+	mustPanic("cancel when halted", func() { orderBook.CancelOrder(sellOrder) })
+
+	orderBook.SetStatus(StatusCancelOnly)
+	mustPanic("limit order when cancel only", func() { orderBook.PlaceLimitOrder(NewOrder("5", 1, true), 9_000) })
+	orderBook.CancelOrder(sellOrder)
+	assert(t, orderBook.AsksTotalVolume(), 0.0)
+
+	mustPanic("unknown status", func() { orderBook.SetStatus("closed") })
+}
+
+func TestPlaceMarketOrderWithin(t *testing.T) {
+	orderBook := NewOrderBook()
+	orderBook.PlaceLimitOrder(NewOrder("1", 5, false), 10_000)
+	orderBook.PlaceLimitOrder(NewOrder("2", 5, false), 10_500)
+	orderBook.PlaceLimitOrder(NewOrder("3", 5, false), 11_000)
+
+	assert(t, orderBook.VolumeWithin(true, 10_500), 10.0)
+
+	buyOrder := NewOrder("4", 12, true)
+	matches := orderBook.PlaceMarketOrderWithin(buyOrder, 10_500)
+
+	assert(t, len(matches), 2)
+	assert(t, buyOrder.Size, 2.0)
+	assert(t, orderBook.AsksTotalVolume(), 5.0)
+	assert(t, len(orderBook.Trades), 2)
+}
+
+func TestUncross(t *testing.T) {
+	hooks := &recordingHooks{}
+	orderBook := NewOrderBook()
+	orderBook.SetStatus(StatusPostOnly)
+
+	orderBook.PlaceLimitOrder(NewOrder("1", 4, true), 10_200)
+	orderBook.PlaceLimitOrder(NewOrder("2", 3, true), 10_000)
+	orderBook.PlaceLimitOrder(NewOrder("3", 2, true), 9_800)
+	orderBook.PlaceLimitOrder(NewOrder("4", 3, false), 9_900)
+	orderBook.PlaceLimitOrder(NewOrder("5", 3, false), 10_100)
+	orderBook.PlaceLimitOrder(NewOrder("6", 5, false), 10_300)
+
+	price, volume, ok := orderBook.AuctionPrice(10_000)
+	assert(t, ok, true)
+	assert(t, price, 10_100.0)
+	assert(t, volume, 4.0)
+
+	orderBook.SetStatus(StatusOpen)
+	orderBook.SetHooks(hooks)
+	price, matches := orderBook.Uncross(10_000)
+
+	assert(t, price, 10_100.0)
+	assert(t, hooks.events, []string{"uncrossed at 10100 in 2 matches"})
+
+	var filled float64
+	for _, match := range matches {
+		assert(t, match.Price, 10_100.0)
+		assert(t, match.Bid.UserID, "1")
+		filled += match.SizeFilled
+	}
+	assert(t, filled, 4.0)
+
+	// the book is no longer crossed
+	assert(t, orderBook.BidLimitsList()[0].Price, 10_000.0)
+	assert(t, orderBook.AskLimitsList()[0].Price, 10_100.0)
+	assert(t, orderBook.AskLimitsList()[0].TotalVolume, 2.0)
+	_, _, ok = orderBook.AuctionPrice(10_000)
+	assert(t, ok, false)
+}
@@ -0,0 +1,55 @@
+package order_book
+
+import "fmt"
+
+const (
+	StatusOpen Status = "open"
+	// StatusHalted freezes the book, orders are neither placed nor
+	// cancelled.
+	StatusHalted Status = "halted"
+	// StatusCancelOnly only lets orders be cancelled.
+	StatusCancelOnly Status = "cancel_only"
+	// StatusPostOnly only lets limit orders rest in the book, nothing is
+	// matched.
+	StatusPostOnly Status = "post_only"
+)
+
+// Status is the trading status of an order book, it controls which orders
+// the book accepts.
+type Status string
+
+func (s Status) IsValid() bool {
+	switch s {
+	case StatusOpen, StatusHalted, StatusCancelOnly, StatusPostOnly:
+		return true
+	default:
+		return false
+	}
+}
+
+// CanPlaceLimit reports whether limit orders can be placed.
+func (s Status) CanPlaceLimit() bool {
+	return s == StatusOpen || s == StatusPostOnly
+}
+
+// CanMatch reports whether market orders can be matched.
+func (s Status) CanMatch() bool {
+	return s == StatusOpen
+}
+
+// CanCancel reports whether orders can be cancelled.
+func (s Status) CanCancel() bool {
+	return s != StatusHalted
+}
+
+func (ob *OrderBook) Status() Status {
+	return ob.status
+}
+
+func (ob *OrderBook) SetStatus(status Status) {
+	if !status.IsValid() {
+		panic(fmt.Sprintf("unknown order book status %q", status))
+	}
+
+	ob.status = status
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+const (
+	adminContextKey = "admin"
+
+	minAdminTokenLength = 16
+)
+
+// AdminConfig holds the bearer tokens of the operators allowed to use the
+// admin API by operator name. Without tokens the admin API is disabled.
+type AdminConfig struct {
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+// adminAuth lets requests through that carry the token of an operator and
+// records the operator as the acting user.
+func (ex *Exchange) adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(ex.admins) == 0 {
+			return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "admin API is disabled")
+		}
+
+		if token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); !ok || token == "" {
+			return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "missing admin token")
+		}
+
+		name, ok := ex.adminToken(c)
+		if !ok {
+			return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "invalid admin token")
+		}
+		c.Set(adminContextKey, name)
+		req := c.Request()
+		c.SetRequest(req.WithContext(withPrincipal(req.Context(), "admin:"+name)))
+
+		return next(c)
+	}
+}
+
+// adminToken returns the operator whose token a request carries.
+func (ex *Exchange) adminToken(c echo.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	for name, adminToken := range ex.admins {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// adminName returns the operator making an admin request.
+func adminName(c echo.Context) string {
+	name, _ := c.Get(adminContextKey).(string)
+	return "admin:" + name
+}
+
+// handleIssueAPIKey replaces the API key of a user, for users who lost
+// theirs or were registered before users had keys.
+func (ex *Exchange) handleIssueAPIKey(c echo.Context) error {
+	userID := c.Param("userID")
+
+	apiKey, err := ex.Users.IssueAPIKey(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return errNotFound("user")
+	}
+	if err != nil {
+		return err
+	}
+
+	user, err := ex.Users.Get(userID)
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	ctx := c.Request().Context()
+	loggerFrom(ctx).Info("api key issued", "user_id", userID)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:   adminName(c),
+		Action:  AuditAPIKeyIssued,
+		Details: map[string]any{"user_id": userID},
+	})
+
+	res := toUserRes(user)
+	res.APIKey = apiKey
+
+	return c.JSON(http.StatusOK, res)
+}
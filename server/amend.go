@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+type (
+	// AmendOrderReq changes the price or size of an open limit order of
+	// UserID, a zero Price or Size keeps the current one. Size is what is
+	// left open of the order after the amendment. ClientOrderID names the
+	// replacement, which keeps the client order ID of the order if it is
+	// empty.
+	AmendOrderReq struct {
+		UserID        string  `json:"user_id"`
+		ClientOrderID string  `json:"client_order_id,omitempty"`
+		Price         float64 `json:"price,omitempty"`
+		Size          float64 `json:"size,omitempty"`
+	}
+
+	AmendOrderRes struct {
+		Message         string `json:"message"`
+		OrderID         string `json:"order_id"`
+		ReplacedOrderID string `json:"replaced_order_id"`
+		ClientOrderID   string `json:"client_order_id,omitempty"`
+	}
+)
+
+func (req *AmendOrderReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserID)
+
+	if req.Price == 0 && req.Size == 0 {
+		fe.add("price", "price or size is required")
+	}
+	if req.Price != 0 {
+		fe.positive("price", req.Price)
+	}
+	if req.Size != 0 {
+		fe.positive("size", req.Size)
+	}
+
+	return fe.err()
+}
+
+// amendOrder replaces an open limit order with one of the new price and
+// size, keeping its client order ID. The replacement loses the time priority
+// of the order, which is closed as replaced. Nothing changes if the
+// replacement can't be placed.
+func (ex *Exchange) amendOrder(ctx context.Context, requester, orderID string, data AmendOrderReq) (*AmendOrderRes, error) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	market, orderBook, order, ok := ex.findOrder(orderID)
+	if !ok || order.UserID != data.UserID {
+		return nil, errNotFound("order")
+	}
+
+	record, err := ex.Orders.Get(order.ID)
+	if err != nil {
+		return nil, errNotFound("order")
+	}
+
+	replacement := PlaceOrderReq{
+		UserID:        order.UserID,
+		ClientOrderID: order.ClientOrderID,
+		Market:        market,
+		OrderType:     LimitOrder,
+		IsBid:         order.IsBid,
+		Size:          order.Size,
+		Price:         record.Price,
+	}
+	if data.Size != 0 {
+		replacement.Size = data.Size
+	}
+	if data.Price != 0 {
+		replacement.Price = data.Price
+	}
+	if data.ClientOrderID != "" {
+		replacement.ClientOrderID = data.ClientOrderID
+	}
+
+	// check what could reject the replacement while the order is untouched
+	if err := checkCancelAllowed(market, orderBook); err != nil {
+		return nil, err
+	}
+	if err := checkOrderAllowed(market, orderBook, LimitOrder); err != nil {
+		return nil, err
+	}
+	if err := ex.guards[market].checkLimit(orderBook, replacement.Price); err != nil {
+		return nil, err
+	}
+	key := clientOrderKey{userID: order.UserID, clientOrderID: replacement.ClientOrderID}
+	if replacement.ClientOrderID != order.ClientOrderID && ex.clientIDs.inUse(key, ex.isOpen) {
+		return nil, NewAPIError(http.StatusConflict, CodeConflict, "client order id is in use")
+	}
+
+	// the replacement may take over the client order ID
+	if order.ClientOrderID != "" {
+		ex.clientIDs.release(clientOrderKey{userID: order.UserID, clientOrderID: order.ClientOrderID})
+	}
+
+	res, err := ex.placeOrderLocked(ctx, orderBook, replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	if requester == "" {
+		requester = order.UserID
+	}
+	ex.closeOrder(ctx, requester, orderBook, order, OrderReplaced, "replaced by "+res.OrderID)
+
+	return &AmendOrderRes{
+		Message:         "Order replaced",
+		OrderID:         res.OrderID,
+		ReplacedOrderID: order.ID,
+		ClientOrderID:   res.ClientOrderID,
+	}, nil
+}
+
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	var data AmendOrderReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+	if err := authorize(c, data.UserID); err != nil {
+		return err
+	}
+
+	res, err := ex.amendOrder(c.Request().Context(), principal(c), c.Param("id"), data)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
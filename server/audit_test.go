@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+)
+
+// send sends a request with the given headers to the exchange. Unless they
+// set X-API-Key or Authorization, even to empty, it carries the API key of
+// the user it is made for.
+func (te *testExchange) send(t *testing.T, method, path string, body any, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody.Bytes()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	_, hasAPIKey := header[HeaderAPIKey]
+	if _, hasToken := header[echo.HeaderAuthorization]; !hasAPIKey && !hasToken {
+		if apiKey := te.apiKey(path, reqBody.Bytes()); apiKey != "" {
+			req.Header.Set(HeaderAPIKey, apiKey)
+		}
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	te.e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// auditEntries reads the audit log of the exchange.
+func (te *testExchange) auditEntries(t *testing.T) []AuditEntry {
+	t.Helper()
+
+	f, err := os.Open(te.audit.f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("decoding audit entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestAuditTrail(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	rec := te.send(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      10,
+		Price:     3500,
+	}, map[string]string{echo.HeaderXRequestID: "req-ask"})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(echo.HeaderXRequestID), "req-ask")
+
+	var ask PlaceOrderRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &ask); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = te.send(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, map[string]string{echo.HeaderXRequestID: "req-bid"})
+	assert(t, rec.Code, http.StatusOK)
+
+	var bid PlaceOrderRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &bid); err != nil {
+		t.Fatal(err)
+	}
+
+	// the seller's API key acts, whoever the request claims to be for
+	rec = te.send(t, http.MethodDelete, "/order/"+ask.OrderID, nil, map[string]string{HeaderUserID: buyer.ID})
+	assert(t, rec.Code, http.StatusOK)
+	cancelRequestID := rec.Header().Get(echo.HeaderXRequestID)
+	if cancelRequestID == "" {
+		t.Fatal("no request ID generated")
+	}
+
+	type action struct {
+		RequestID     string
+		Actor         string
+		ClaimedUserID string
+		Action        AuditAction
+		OrderID       string
+	}
+	var actions []action
+	for _, entry := range te.auditEntries(t) {
+		assert(t, entry.Market, ETH)
+		actions = append(actions, action{entry.RequestID, entry.Actor, entry.ClaimedUserID, entry.Action, entry.OrderID})
+	}
+
+	assert(t, actions, []action{
+		{"req-ask", seller.ID, "", AuditOrderPlaced, ask.OrderID},
+		{"req-bid", buyer.ID, "", AuditOrderPlaced, bid.OrderID},
+		{"req-bid", buyer.ID, "", AuditOrderFilled, bid.OrderID},
+		{cancelRequestID, seller.ID, buyer.ID, AuditOrderCancelled, ask.OrderID},
+	})
+
+	// the request placing the market order is traced into settlement
+	te.Settlement.Flush()
+	te.waitForTrades(t, ETH, 1)
+
+	jobs := te.Pipeline.Queue().List("")
+	assert(t, len(jobs), 1)
+	if !slices.Contains(jobs[0].RequestIDs, "req-bid") {
+		t.Errorf("settlement job request IDs %v don't include the market order", jobs[0].RequestIDs)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// HeaderAPIKey carries the API key of the user making a request, the
+	// key is returned when the user is registered.
+	HeaderAPIKey = "X-API-Key"
+)
+
+// authenticate records who makes a request: the user of its API key or the
+// operator of its admin token. A request with an invalid API key is
+// rejected, one without credentials goes on unauthenticated.
+func (ex *Exchange) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if apiKey := req.Header.Get(HeaderAPIKey); apiKey != "" {
+			user, err := ex.Users.Authenticate(apiKey)
+			if err != nil {
+				return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "invalid API key")
+			}
+			c.SetRequest(req.WithContext(withPrincipal(req.Context(), user.ID)))
+		} else if name, ok := ex.adminToken(c); ok {
+			c.Set(adminContextKey, name)
+			c.SetRequest(req.WithContext(withPrincipal(req.Context(), "admin:"+name)))
+		}
+
+		return next(c)
+	}
+}
+
+// principal returns who made a request: the ID of the user of its API key,
+// "admin:" and the name of an operator, or empty if it carried no
+// credentials.
+func principal(c echo.Context) string {
+	return principalFrom(c.Request().Context())
+}
+
+// authorize checks that a request acting for userID is made by that user
+// or by an operator.
+func authorize(c echo.Context, userID string) error {
+	return checkUser(principal(c), c.Get(adminContextKey) != nil, userID)
+}
+
+// authorizeOrder checks that a request acting on an order is made by its
+// user or by an operator. The orders of other users are not found.
+func (ex *Exchange) authorizeOrder(c echo.Context, orderID string) error {
+	return ex.checkOrderUser(principal(c), c.Get(adminContextKey) != nil, orderID)
+}
+
+// checkUser checks that principal p, an operator if admin, may act for
+// userID.
+func checkUser(p string, admin bool, userID string) error {
+	switch {
+	case p == "":
+		return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "missing API key")
+	case p != userID && !admin:
+		return NewAPIError(http.StatusForbidden, CodeForbidden, "API key doesn't belong to user "+userID)
+	}
+
+	return nil
+}
+
+// checkOrderUser checks that principal p, an operator if admin, may act on
+// an order.
+func (ex *Exchange) checkOrderUser(p string, admin bool, orderID string) error {
+	if p == "" {
+		return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "missing API key")
+	}
+
+	order, err := ex.Orders.Get(orderID)
+	if err != nil || checkUser(p, admin, order.UserID) != nil {
+		return errNotFound("order")
+	}
+
+	return nil
+}
+
+// ipExtractor returns how the IP of a request is found. Without trusted
+// proxies it is the address the request came from, otherwise the last
+// address of X-Forwarded-For not added by one of them.
+func (cfg HTTPConfig) ipExtractor() (echo.IPExtractor, error) {
+	if len(cfg.TrustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("http.trusted_proxies: %w", err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// checkOrigin returns whether a WebSocket handshake may be accepted: one
+// without an Origin header, which browsers always send, one from a page of
+// the API's own host or one from an allowed origin.
+func (cfg HTTPConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range cfg.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIssueAPIKey(t *testing.T) {
+	te, _, _ := newLedgerExchange(t)
+	user := te.registerUser(t)
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer 0123456789abcdef"}
+
+	rec := te.send(t, http.MethodPost, "/admin/users/"+user.ID+"/api-key", nil, admin)
+	assert(t, rec.Code, http.StatusOK)
+	var issued UserRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, issued.ID, user.ID)
+
+	// only the new key is accepted
+	assert(t, te.send(t, http.MethodGet, "/markets", nil, map[string]string{HeaderAPIKey: user.APIKey}).Code, http.StatusUnauthorized)
+	assert(t, te.send(t, http.MethodGet, "/markets", nil, map[string]string{HeaderAPIKey: issued.APIKey}).Code, http.StatusOK)
+
+	entries := te.auditEntries(t)
+	assert(t, entries[len(entries)-1].Actor, "admin:ops")
+	assert(t, entries[len(entries)-1].Action, AuditAPIKeyIssued)
+
+	assert(t, te.send(t, http.MethodPost, "/admin/users/unknown/api-key", nil, admin).Code, http.StatusNotFound)
+	assert(t, te.send(t, http.MethodPost, "/admin/users/"+user.ID+"/api-key", nil, nil).Code, http.StatusUnauthorized)
+}
+
+func TestAuthorize(t *testing.T) {
+	te, _, _ := newLedgerExchange(t)
+	alice := te.registerUser(t)
+	bob := te.registerUser(t)
+	orderID := te.placeLimit(t, bob.ID, false, 1, 3600)
+
+	asAlice := map[string]string{HeaderAPIKey: alice.APIKey}
+	for _, tc := range []struct {
+		method, path string
+		body         any
+		status       int
+	}{
+		{http.MethodPost, "/order", &PlaceOrderReq{UserID: bob.ID, Market: ETH, OrderType: LimitOrder, Size: 1, Price: 3600}, http.StatusForbidden},
+		{http.MethodGet, "/order/" + orderID, nil, http.StatusNotFound},
+		{http.MethodPut, "/order/" + orderID, &AmendOrderReq{UserID: bob.ID, Price: 3700}, http.StatusForbidden},
+		{http.MethodDelete, "/order/" + orderID, nil, http.StatusNotFound},
+		{http.MethodDelete, "/orders?user_id=" + bob.ID, nil, http.StatusForbidden},
+		{http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: bob.ID, TimeoutMs: 1}, http.StatusForbidden},
+		{http.MethodPost, "/orders/batch", &BatchOrdersReq{UserID: bob.ID, Ops: []BatchOrderOp{{Op: BatchCancel, OrderID: orderID}}}, http.StatusForbidden},
+		{http.MethodGet, "/users/ETH/" + bob.ID + "/orders", nil, http.StatusForbidden},
+		{http.MethodGet, "/users/" + bob.ID + "/orders", nil, http.StatusForbidden},
+		{http.MethodGet, "/users/" + bob.ID + "/balances", nil, http.StatusForbidden},
+	} {
+		assert(t, te.send(t, tc.method, tc.path, tc.body, asAlice).Code, tc.status)
+		assert(t, te.send(t, tc.method, tc.path, tc.body, map[string]string{HeaderAPIKey: "", HeaderUserID: bob.ID}).Code, http.StatusUnauthorized)
+	}
+
+	order, _ := te.Orders.Get(orderID)
+	assert(t, order.Status, OrderNew)
+
+	// operators act for every user
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer 0123456789abcdef"}
+	assert(t, te.send(t, http.MethodDelete, "/orders?user_id="+bob.ID, nil, admin).Code, http.StatusOK)
+	order, _ = te.Orders.Get(orderID)
+	assert(t, order.Status, OrderCancelled)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	cfg := HTTPConfig{AllowedOrigins: []string{"https://app.example.com"}}
+
+	for origin, allowed := range map[string]bool{
+		"":                         true,
+		"http://exchange.test":     true,
+		"https://app.example.com":  true,
+		"https://evil.example.com": false,
+		"null":                     false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://exchange.test/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		assert(t, cfg.checkOrigin(r), allowed)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+type (
+	// BalanceReader is implemented by settlers that can tell how much of
+	// their asset a user holds.
+	BalanceReader interface {
+		BalanceOf(ctx context.Context, user *User) (*big.Int, error)
+	}
+
+	// BalanceRes is the balance of a user in an asset, Units in the smallest
+	// unit of the asset and Amount in whole units.
+	BalanceRes struct {
+		Asset  Asset   `json:"asset"`
+		Units  string  `json:"units"`
+		Amount float64 `json:"amount"`
+	}
+
+	// DepositReq credits a user with Amount whole units of an asset settled
+	// on the internal ledger.
+	DepositReq struct {
+		UserID string  `json:"user_id"`
+		Asset  Asset   `json:"asset"`
+		Amount float64 `json:"amount"`
+	}
+)
+
+func (req *DepositReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserID)
+	fe.required("asset", string(req.Asset))
+	fe.positive("amount", req.Amount)
+
+	return fe.err()
+}
+
+// fromUnits converts an amount in the smallest unit of an asset with the
+// given decimals to whole units.
+func fromUnits(units *big.Int, decimals uint8) float64 {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	amount, _ := new(big.Rat).SetFrac(units, scale).Float64()
+
+	return amount
+}
+
+// handleGetBalances returns the balances of a user in every asset whose
+// settler can read them, sorted by asset.
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	user, err := ex.Users.Get(c.Param("userID"))
+	if err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, user.ID); err != nil {
+		return err
+	}
+
+	assets := make([]Asset, 0, len(ex.settlers))
+	for asset := range ex.settlers {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i] < assets[j]
+	})
+
+	balances := make([]BalanceRes, 0, len(assets))
+	for _, asset := range assets {
+		reader, ok := ex.settlers[asset].(BalanceReader)
+		if !ok {
+			continue
+		}
+
+		units, err := reader.BalanceOf(c.Request().Context(), user)
+		if err != nil {
+			return err
+		}
+
+		balances = append(balances, BalanceRes{
+			Asset:  asset,
+			Units:  units.String(),
+			Amount: fromUnits(units, ex.assets[asset].Decimals),
+		})
+	}
+
+	return c.JSON(http.StatusOK, balances)
+}
+
+// handleDeposit credits a user with an asset of the internal ledger, which
+// has no other way in, and returns the new balance.
+func (ex *Exchange) handleDeposit(c echo.Context) error {
+	var data DepositReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	user, err := ex.Users.Get(data.UserID)
+	if err != nil {
+		return errNotFound("user")
+	}
+
+	if _, ok := ex.settlers[data.Asset]; !ok {
+		return errNotFound("asset")
+	}
+	ledger, ok := ex.settlers[data.Asset].(*LedgerSettler)
+	if !ok {
+		return NewAPIError(http.StatusConflict, CodeConflict, fmt.Sprintf("asset %s isn't settled on the ledger", data.Asset))
+	}
+
+	decimals := ex.assets[data.Asset].Decimals
+	units := toUnits(data.Amount, decimals)
+	if err := ledger.Deposit(user.ID, units); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	loggerFrom(ctx).Info("deposit", "user_id", user.ID, "asset", data.Asset, "units", units)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  adminName(c),
+		Action: AuditDeposit,
+		Details: map[string]any{
+			"user_id": user.ID,
+			"asset":   data.Asset,
+			"units":   units.String(),
+		},
+	})
+
+	balance := ledger.Balance(user.ID)
+
+	return c.JSON(http.StatusOK, BalanceRes{
+		Asset:  data.Asset,
+		Units:  balance.String(),
+		Amount: fromUnits(balance, decimals),
+	})
+}
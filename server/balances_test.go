@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetBalances(t *testing.T) {
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{
+		{Asset: "ETH", Settler: SettlerFake},
+		{Asset: "USD", Decimals: 2, Settler: SettlerLedger},
+	}
+
+	ledger := NewLedgerSettler()
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": NewFakeSettler(), "USD": ledger})
+
+	user := te.registerUser(t)
+	assert(t, ledger.Deposit(user.ID, big.NewInt(12345)), nil)
+
+	// the fake settler keeps no balances
+	var balances []BalanceRes
+	status := te.do(t, http.MethodGet, "/users/"+user.ID+"/balances", nil, &balances)
+	assert(t, status, http.StatusOK)
+	assert(t, balances, []BalanceRes{{Asset: "USD", Units: "12345", Amount: 123.45}})
+
+	status = te.do(t, http.MethodGet, "/users/nobody/balances", nil, nil)
+	assert(t, status, http.StatusNotFound)
+}
+
+// newLedgerExchange returns an exchange trading ETH, settled by a fake
+// settler, against USD kept on the ledger.
+func newLedgerExchange(t *testing.T) (*testExchange, *FakeSettler, *LedgerSettler) {
+	t.Helper()
+
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return startLedgerExchange(t, users, FeeConfig{})
+}
+
+// startLedgerExchange starts an exchange of ETH, on a fake settler, against
+// USD on the ledger, charging fees.
+func startLedgerExchange(t *testing.T, users *UserStore, fees FeeConfig) (*testExchange, *FakeSettler, *LedgerSettler) {
+	t.Helper()
+
+	cfg := testConfig()
+	cfg.Fees = fees
+	cfg.Markets = DefaultMarkets
+	cfg.Assets = []AssetConfig{
+		{Asset: "ETH", Settler: SettlerFake},
+		{Asset: "USD", Decimals: 2, Settler: SettlerLedger},
+	}
+	cfg.Admin.Tokens = map[string]string{"ops": "0123456789abcdef"}
+	cfg.RateLimit.Enabled = false
+
+	eth, usd := NewFakeSettler(), NewLedgerSettler()
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": eth, "USD": usd})
+
+	return te, eth, usd
+}
+
+func TestDeposit(t *testing.T) {
+	te, _, usd := newLedgerExchange(t)
+	user := te.registerUser(t)
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer 0123456789abcdef"}
+
+	rec := te.send(t, http.MethodPost, "/admin/deposits", &DepositReq{UserID: user.ID, Asset: "USD", Amount: 12.5}, admin)
+	assert(t, rec.Code, http.StatusOK)
+	rec = te.send(t, http.MethodPost, "/admin/deposits", &DepositReq{UserID: user.ID, Asset: "USD", Amount: 0.25}, admin)
+	assert(t, rec.Code, http.StatusOK)
+
+	var balance BalanceRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &balance); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance, BalanceRes{Asset: "USD", Units: "1275", Amount: 12.75})
+	assert(t, usd.Balance(user.ID), big.NewInt(1275))
+
+	entries := te.auditEntries(t)
+	assert(t, entries[len(entries)-1].Actor, "admin:ops")
+	assert(t, entries[len(entries)-1].Action, AuditDeposit)
+
+	for _, c := range []struct {
+		req    DepositReq
+		status int
+	}{
+		{DepositReq{UserID: user.ID, Asset: "ETH", Amount: 1}, http.StatusConflict},
+		{DepositReq{UserID: user.ID, Asset: "BTC", Amount: 1}, http.StatusNotFound},
+		{DepositReq{UserID: "nobody", Asset: "USD", Amount: 1}, http.StatusNotFound},
+		{DepositReq{UserID: user.ID, Asset: "USD"}, http.StatusBadRequest},
+	} {
+		rec := te.send(t, http.MethodPost, "/admin/deposits", &c.req, admin)
+		assert(t, rec.Code, c.status)
+	}
+
+	rec = te.send(t, http.MethodPost, "/admin/deposits", &DepositReq{UserID: user.ID, Asset: "USD", Amount: 1}, nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+}
+
+func TestLedgerSettlerReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger", "USD.json")
+	ledger, err := OpenLedgerSettler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, bob := &User{ID: "alice"}, &User{ID: "bob"}
+	assert(t, ledger.Deposit(alice.ID, big.NewInt(100)), nil)
+	ref, err := ledger.Transfer(context.Background(), alice, bob, big.NewInt(30))
+	assert(t, err, nil)
+
+	// a record cut short by a crash is dropped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"to":"bob","amo`)
+	f.Close()
+
+	reopened, err := OpenLedgerSettler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, reopened.Balance(alice.ID), big.NewInt(70))
+	assert(t, reopened.Balance(bob.ID), big.NewInt(30))
+	confirmations, err := reopened.Confirmations(context.Background(), ref)
+	assert(t, err, nil)
+	assert(t, confirmations, finalConfirmations)
+
+	// records are appended after the dropped one
+	assert(t, reopened.Deposit(bob.ID, big.NewInt(5)), nil)
+	reopened, err = OpenLedgerSettler(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, reopened.Balance(bob.ID), big.NewInt(35))
+}
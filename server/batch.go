@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/order_book"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+const (
+	// MaxBatchOrders is the number of operations a batch can hold.
+	MaxBatchOrders = 50
+
+	BatchPlace  = "place"
+	BatchCancel = "cancel"
+
+	// CodeBatchAborted is the error of the operations of an all-or-nothing
+	// batch that were not executed because another one failed.
+	CodeBatchAborted ErrorCode = "batch_aborted"
+)
+
+type (
+	// BatchOrdersReq places and cancels orders of UserID in one request. The
+	// operations are executed in order with no other order change in
+	// between. An all-or-nothing batch is checked before anything is
+	// executed and executes none of its operations if one of them would
+	// fail, it can only hold limit orders and cancels.
+	BatchOrdersReq struct {
+		UserID    string         `json:"user_id"`
+		AllOrNone bool           `json:"all_or_none,omitempty"`
+		Ops       []BatchOrderOp `json:"ops"`
+	}
+
+	// BatchOrderOp places an order described by the fields of PlaceOrderReq
+	// or cancels an open order named by OrderID or ClientOrderID.
+	BatchOrderOp struct {
+		Op            string    `json:"op"`
+		OrderID       string    `json:"order_id,omitempty"`
+		ClientOrderID string    `json:"client_order_id,omitempty"`
+		Market        Market    `json:"market,omitempty"`
+		Type          OrderType `json:"type,omitempty"`
+		IsBid         bool      `json:"is_bid,omitempty"`
+		Size          float64   `json:"size,omitempty"`
+		Price         float64   `json:"price,omitempty"`
+	}
+
+	// BatchOrderResult is the outcome of an operation, Status is the status
+	// the operation would have been answered with on its own and Error is
+	// set if it failed.
+	BatchOrderResult struct {
+		Op            string    `json:"op"`
+		Status        int       `json:"status"`
+		Message       string    `json:"message,omitempty"`
+		OrderID       string    `json:"order_id,omitempty"`
+		ClientOrderID string    `json:"client_order_id,omitempty"`
+		Error         *APIError `json:"error,omitempty"`
+	}
+
+	// BatchOrdersRes holds the results of the operations of a batch in
+	// their order.
+	BatchOrdersRes struct {
+		Results []BatchOrderResult `json:"results"`
+	}
+)
+
+func (req *BatchOrdersReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserID)
+
+	switch {
+	case len(req.Ops) == 0:
+		fe.add("ops", "is required")
+	case len(req.Ops) > MaxBatchOrders:
+		fe.add("ops", fmt.Sprintf("must hold at most %d operations", MaxBatchOrders))
+	}
+
+	for i, op := range req.Ops {
+		field := fmt.Sprintf("ops[%d]", i)
+		switch {
+		case op.Op != BatchPlace && op.Op != BatchCancel:
+			fe.add(field+".op", "must be place or cancel")
+		case op.Op == BatchCancel && op.OrderID == "" && op.ClientOrderID == "":
+			fe.add(field+".order_id", "order_id or client_order_id is required")
+		case req.AllOrNone && op.Op == BatchPlace && op.Type == MarketOrder:
+			fe.add(field+".type", "market orders can't be part of an all-or-nothing batch")
+		}
+	}
+
+	return fe.err()
+}
+
+func (op BatchOrderOp) placeOrderReq(userID string) PlaceOrderReq {
+	return PlaceOrderReq{
+		UserID:        userID,
+		ClientOrderID: op.ClientOrderID,
+		Market:        op.Market,
+		OrderType:     op.Type,
+		IsBid:         op.IsBid,
+		Size:          op.Size,
+		Price:         op.Price,
+	}
+}
+
+func (ex *Exchange) handleBatchOrders(c echo.Context) error {
+	var data BatchOrdersReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	if _, err := ex.Users.Get(data.UserID); err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, data.UserID); err != nil {
+		return err
+	}
+
+	// every order placed takes from the order bucket like a single one
+	errs := make([]error, len(data.Ops))
+	if ex.limiter != nil {
+		for i, op := range data.Ops {
+			if op.Op == BatchPlace && !ex.limiter.takeOrder(data.UserID, op.Market).allowed {
+				ex.metrics.order(op.Market, op.Type, orderRejected)
+				errs[i] = errRateLimit()
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, ex.batchOrders(c.Request().Context(), actor(c, data.UserID), data, errs))
+}
+
+// batchOrders executes the operations of a batch, errs holds the errors of
+// the operations already known to fail.
+func (ex *Exchange) batchOrders(ctx context.Context, actor string, data BatchOrdersReq, errs []error) *BatchOrdersRes {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	res := &BatchOrdersRes{Results: make([]BatchOrderResult, len(data.Ops))}
+
+	if data.AllOrNone && !ex.checkBatchLocked(data, errs) {
+		for i, op := range data.Ops {
+			err := errs[i]
+			if err == nil {
+				err = NewAPIError(http.StatusFailedDependency, CodeBatchAborted, "another operation of the batch failed")
+			}
+			res.Results[i] = batchError(op, err)
+		}
+		return res
+	}
+
+	for i, op := range data.Ops {
+		if errs[i] != nil {
+			res.Results[i] = batchError(op, errs[i])
+			continue
+		}
+
+		switch op.Op {
+		case BatchPlace:
+			res.Results[i] = ex.batchPlaceLocked(ctx, data.UserID, op)
+		case BatchCancel:
+			res.Results[i] = ex.batchCancelLocked(ctx, actor, data.UserID, op)
+		}
+	}
+
+	return res
+}
+
+// checkBatchLocked checks every operation of an all-or-nothing batch against
+// the books as the operations before it leave them, recording why an
+// operation would fail in errs. It reports whether all of them would
+// succeed. Limit orders never trade, so along the batch only the orders of
+// the user change. The book lock must be held.
+func (ex *Exchange) checkBatchLocked(data BatchOrdersReq, errs []error) bool {
+	var (
+		// client order IDs of the orders placed by the batch
+		placed    = make(map[string]bool)
+		cancelled = make(map[string]bool)
+		ok        = true
+	)
+
+	for i, op := range data.Ops {
+		switch {
+		case errs[i] != nil:
+		case op.Op == BatchPlace:
+			errs[i] = ex.checkBatchPlace(op.placeOrderReq(data.UserID))
+			if op.ClientOrderID != "" {
+				placed[op.ClientOrderID] = true
+			}
+
+		case op.OrderID == "" && placed[op.ClientOrderID]:
+			// cancels an order placed by the batch
+			delete(placed, op.ClientOrderID)
+
+		default:
+			market, orderBook, order, err := ex.batchTargetLocked(data.UserID, op)
+			switch {
+			case err != nil:
+				errs[i] = err
+			case cancelled[order.ID]:
+				errs[i] = errNotFound("order")
+			default:
+				errs[i] = checkCancelAllowed(market, orderBook)
+				cancelled[order.ID] = true
+			}
+		}
+
+		if errs[i] != nil {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// checkBatchPlace checks what could reject a limit order of an all-or-nothing
+// batch.
+func (ex *Exchange) checkBatchPlace(data PlaceOrderReq) error {
+	if err := data.Validate(); err != nil {
+		return err
+	}
+
+	orderBook, err := ex.checkOrder(data)
+	if err != nil {
+		return err
+	}
+
+	if err := checkOrderAllowed(data.Market, orderBook, data.OrderType); err != nil {
+		return err
+	}
+
+	if err := ex.guards[data.Market].checkLimit(orderBook, data.Price); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ex *Exchange) batchPlaceLocked(ctx context.Context, userID string, op BatchOrderOp) BatchOrderResult {
+	data := op.placeOrderReq(userID)
+	if err := data.Validate(); err != nil {
+		return batchError(op, err)
+	}
+
+	orderBook, err := ex.checkOrder(data)
+	if err != nil {
+		return batchError(op, err)
+	}
+
+	res, err := ex.placeOrderLocked(ctx, orderBook, data)
+	if err != nil {
+		return batchError(op, err)
+	}
+
+	return BatchOrderResult{
+		Op:            op.Op,
+		Status:        http.StatusOK,
+		Message:       res.Message,
+		OrderID:       res.OrderID,
+		ClientOrderID: res.ClientOrderID,
+	}
+}
+
+func (ex *Exchange) batchCancelLocked(ctx context.Context, actor, userID string, op BatchOrderOp) BatchOrderResult {
+	market, orderBook, order, err := ex.batchTargetLocked(userID, op)
+	if err != nil {
+		return batchError(op, err)
+	}
+
+	if err := checkCancelAllowed(market, orderBook); err != nil {
+		return batchError(op, err)
+	}
+
+	ex.cancelOrder(ctx, actor, orderBook, order, OrderCancelled)
+	if order.ClientOrderID != "" {
+		ex.clientIDs.release(clientOrderKey{userID: userID, clientOrderID: order.ClientOrderID})
+	}
+
+	return BatchOrderResult{
+		Op:            op.Op,
+		Status:        http.StatusOK,
+		Message:       "Order deleted",
+		OrderID:       order.ID,
+		ClientOrderID: order.ClientOrderID,
+	}
+}
+
+// batchTargetLocked finds the open order of the user a cancel operation
+// names. The book lock must be held.
+func (ex *Exchange) batchTargetLocked(userID string, op BatchOrderOp) (Market, *order_book.OrderBook, *order_book.Order, error) {
+	orderID := op.OrderID
+	if orderID == "" {
+		co, ok := ex.clientIDs.get(clientOrderKey{userID: userID, clientOrderID: op.ClientOrderID})
+		if !ok || co.res == nil {
+			return "", nil, nil, errNotFound("order")
+		}
+		orderID = co.res.OrderID
+	}
+
+	market, orderBook, order, ok := ex.findOrder(orderID)
+	if !ok || order.UserID != userID {
+		return "", nil, nil, errNotFound("order")
+	}
+
+	return market, orderBook, order, nil
+}
+
+func batchError(op BatchOrderOp, err error) BatchOrderResult {
+	apiErr := toAPIError(err)
+
+	return BatchOrderResult{
+		Op:            op.Op,
+		Status:        apiErr.Status,
+		OrderID:       op.OrderID,
+		ClientOrderID: op.ClientOrderID,
+		Error:         apiErr,
+	}
+}
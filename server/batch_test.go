@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBatchOrders(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+
+	var quote PlaceOrderRes
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:        user.ID,
+		ClientOrderID: "quote-1",
+		Market:        ETH,
+		OrderType:     LimitOrder,
+		Size:          10,
+		Price:         3500,
+	}, &quote)
+
+	var res BatchOrdersRes
+	status := te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID: user.ID,
+		Ops: []BatchOrderOp{
+			{Op: BatchCancel, ClientOrderID: "quote-1"},
+			{Op: BatchPlace, ClientOrderID: "quote-2", Market: ETH, Type: LimitOrder, Size: 10, Price: 3510},
+			{Op: BatchPlace, Market: ETH, Type: LimitOrder, IsBid: true, Size: 5, Price: 3490},
+			{Op: BatchPlace, Market: ETH, Type: LimitOrder, Size: -1, Price: 3520},
+			{Op: BatchCancel, OrderID: quote.OrderID},
+		},
+	}, &res)
+	assert(t, status, http.StatusOK)
+	assert(t, len(res.Results), 5)
+
+	assert(t, res.Results[0].Status, http.StatusOK)
+	assert(t, res.Results[0].OrderID, quote.OrderID)
+	assert(t, res.Results[1].Status, http.StatusOK)
+	assert(t, res.Results[1].ClientOrderID, "quote-2")
+	assert(t, res.Results[2].Status, http.StatusOK)
+	assert(t, res.Results[3].Status, http.StatusBadRequest)
+	assert(t, res.Results[3].Error.Details["size"], "must be a positive number")
+	// already cancelled by the first operation
+	assert(t, res.Results[4].Status, http.StatusNotFound)
+
+	var book BookDepthRes
+	te.do(t, http.MethodGet, "/book/ETH/depth", nil, &book)
+	assert(t, book.Asks, []BookLevel{{Price: 3510, Size: 10}})
+	assert(t, book.Bids, []BookLevel{{Price: 3490, Size: 5}})
+
+	var record OrderRecord
+	te.do(t, http.MethodGet, "/order/"+quote.OrderID, nil, &record)
+	assert(t, record.Status, OrderCancelled)
+
+	other := te.registerUser(t)
+	te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID: other.ID,
+		Ops:    []BatchOrderOp{{Op: BatchCancel, OrderID: res.Results[1].OrderID}},
+	}, &res)
+	assert(t, res.Results[0].Status, http.StatusNotFound)
+}
+
+func TestBatchOrdersAllOrNone(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+
+	var quote PlaceOrderRes
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:        user.ID,
+		ClientOrderID: "quote-1",
+		Market:        ETH,
+		OrderType:     LimitOrder,
+		Size:          10,
+		Price:         3500,
+	}, &quote)
+
+	var res BatchOrdersRes
+	te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID:    user.ID,
+		AllOrNone: true,
+		Ops: []BatchOrderOp{
+			{Op: BatchCancel, ClientOrderID: "quote-1"},
+			{Op: BatchPlace, ClientOrderID: "quote-2", Market: ETH, Type: LimitOrder, Size: 10, Price: 3510},
+			{Op: BatchCancel, ClientOrderID: "quote-1"},
+		},
+	}, &res)
+	assert(t, res.Results[0].Status, http.StatusFailedDependency)
+	assert(t, res.Results[0].Error.Code, CodeBatchAborted)
+	assert(t, res.Results[1].Error.Code, CodeBatchAborted)
+	assert(t, res.Results[2].Status, http.StatusNotFound)
+
+	var book BookDepthRes
+	te.do(t, http.MethodGet, "/book/ETH/depth", nil, &book)
+	assert(t, book.Asks, []BookLevel{{Price: 3500, Size: 10}})
+
+	// an order placed by the batch can be cancelled by it
+	te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID:    user.ID,
+		AllOrNone: true,
+		Ops: []BatchOrderOp{
+			{Op: BatchCancel, ClientOrderID: "quote-1"},
+			{Op: BatchPlace, ClientOrderID: "quote-2", Market: ETH, Type: LimitOrder, Size: 10, Price: 3510},
+			{Op: BatchPlace, ClientOrderID: "quote-3", Market: ETH, Type: LimitOrder, Size: 10, Price: 3520},
+			{Op: BatchCancel, ClientOrderID: "quote-3"},
+		},
+	}, &res)
+	for i, result := range res.Results {
+		if result.Status != http.StatusOK {
+			t.Errorf("operation %d failed: %+v", i, result.Error)
+		}
+	}
+
+	te.do(t, http.MethodGet, "/book/ETH/depth", nil, &book)
+	assert(t, book.Asks, []BookLevel{{Price: 3510, Size: 10}})
+
+	status := te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID:    user.ID,
+		AllOrNone: true,
+		Ops:       []BatchOrderOp{{Op: BatchPlace, Market: ETH, Type: MarketOrder, IsBid: true, Size: 1}},
+	}, nil)
+	assert(t, status, http.StatusBadRequest)
+
+	status = te.do(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID: user.ID,
+		Ops:    make([]BatchOrderOp, MaxBatchOrders+1),
+	}, nil)
+	assert(t, status, http.StatusBadRequest)
+}
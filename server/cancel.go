@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/order_book"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxCancelAfter = time.Hour
+
+type (
+	CancelAllRes struct {
+		Message   string   `json:"message"`
+		OrderIDs  []string `json:"order_ids"`
+		Cancelled int      `json:"cancelled"`
+	}
+
+	// CancelAfterReq arms the dead man's switch of a user. Unless it is sent
+	// again within TimeoutMs all orders of the user are cancelled, a zero
+	// timeout disarms the switch.
+	CancelAfterReq struct {
+		UserID    string `json:"user_id"`
+		TimeoutMs int64  `json:"timeout_ms"`
+	}
+
+	CancelAfterRes struct {
+		UserID string `json:"user_id"`
+		// Deadline is when the orders are cancelled, unset if disarmed.
+		Deadline *time.Time `json:"deadline,omitempty"`
+	}
+)
+
+func (req *CancelAfterReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserID)
+
+	if req.TimeoutMs < 0 || time.Duration(req.TimeoutMs)*time.Millisecond > maxCancelAfter {
+		fe.add("timeout_ms", fmt.Sprintf("must be between 0 and %d", maxCancelAfter.Milliseconds()))
+	}
+
+	return fe.err()
+}
+
+// cancelAll cancels the open orders of a user, optionally only in one market
+// or on one side, and records them with status. Orders in halted markets stay
+// in the book. It returns the IDs of the cancelled orders.
+func (ex *Exchange) cancelAll(ctx context.Context, actor, userID string, market Market, side string, status OrderStatus) []string {
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	orderIDs := make([]string, 0)
+
+	for name, orderBook := range ex.orderBooks {
+		if market != "" && name != market || !orderBook.Status().CanCancel() {
+			continue
+		}
+
+		userOrders := orderBook.GetUserOrders(userID)
+
+		var orders []*order_book.Order
+		if side != "ask" {
+			orders = append(orders, userOrders.Bids...)
+		}
+		if side != "bid" {
+			orders = append(orders, userOrders.Asks...)
+		}
+
+		for _, order := range orders {
+			ex.cancelOrder(ctx, actor, orderBook, order, status)
+			orderIDs = append(orderIDs, order.ID)
+		}
+	}
+
+	sort.Strings(orderIDs)
+
+	return orderIDs
+}
+
+func (ex *Exchange) handleCancelAll(c echo.Context) error {
+	userID := c.QueryParam("user_id")
+	market := Market(c.QueryParam("market"))
+	side := c.QueryParam("side")
+
+	fe := make(fieldErrors)
+	fe.required("user_id", userID)
+	if side != "" && side != "bid" && side != "ask" {
+		fe.add("side", "must be bid or ask")
+	}
+	if err := fe.err(); err != nil {
+		return err
+	}
+
+	if _, err := ex.Users.Get(userID); err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, userID); err != nil {
+		return err
+	}
+
+	if market != "" {
+		orderBook, ok := ex.orderBooks[market]
+		if !ok {
+			return errNotFound("market")
+		}
+
+		ex.bookMu.Lock()
+		err := checkCancelAllowed(market, orderBook)
+		ex.bookMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	orderIDs := ex.cancelAll(c.Request().Context(), actor(c, userID), userID, market, side, OrderCancelled)
+
+	return c.JSON(http.StatusOK, CancelAllRes{
+		Message:   "Orders deleted",
+		OrderIDs:  orderIDs,
+		Cancelled: len(orderIDs),
+	})
+}
+
+func (ex *Exchange) handleCancelAfter(c echo.Context) error {
+	var data CancelAfterReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	if _, err := ex.Users.Get(data.UserID); err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, data.UserID); err != nil {
+		return err
+	}
+
+	res := CancelAfterRes{UserID: data.UserID}
+
+	timeout := time.Duration(data.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		ex.deadMan.disarm(data.UserID)
+	} else {
+		deadline := ex.deadMan.arm(data.UserID, timeout)
+		res.Deadline = &deadline
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// deadManSwitch runs expire for a user whose timer wasn't refreshed in time.
+type deadManSwitch struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+	expire func(userID string)
+}
+
+func newDeadManSwitch(expire func(userID string)) *deadManSwitch {
+	return &deadManSwitch{
+		timers: make(map[string]*time.Timer),
+		expire: expire,
+	}
+}
+
+// arm starts or restarts the timer of a user and returns its deadline.
+func (d *deadManSwitch) arm(userID string, timeout time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if timer, ok := d.timers[userID]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		current := d.timers[userID] == timer
+		if current {
+			delete(d.timers, userID)
+		}
+		d.mu.Unlock()
+
+		// a timer rearmed while firing is no longer the user's timer
+		if current {
+			d.expire(userID)
+		}
+	})
+	d.timers[userID] = timer
+
+	return time.Now().Add(timeout)
+}
+
+func (d *deadManSwitch) disarm(userID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if timer, ok := d.timers[userID]; ok {
+		timer.Stop()
+		delete(d.timers, userID)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (te *testExchange) placeLimit(t *testing.T, userID string, isBid bool, size, price float64) string {
+	t.Helper()
+
+	var res PlaceOrderRes
+	status := te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    userID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		IsBid:     isBid,
+		Size:      size,
+		Price:     price,
+	}, &res)
+	assert(t, status, http.StatusOK)
+
+	return res.OrderID
+}
+
+// waitForStatus waits until the order reaches status.
+func (te *testExchange) waitForStatus(t *testing.T, orderID string, status OrderStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		order, err := te.Orders.Get(orderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("order %s never became %s", orderID, status)
+}
+
+func TestCancelAll(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	other := te.registerUser(t)
+
+	bid := te.placeLimit(t, user.ID, true, 1, 3400)
+	ask := te.placeLimit(t, user.ID, false, 1, 3600)
+	otherAsk := te.placeLimit(t, other.ID, false, 1, 3700)
+
+	var res CancelAllRes
+	status := te.do(t, http.MethodDelete, "/orders?user_id="+user.ID+"&side=bid", nil, &res)
+	assert(t, status, http.StatusOK)
+	assert(t, res.OrderIDs, []string{bid})
+
+	status = te.do(t, http.MethodDelete, "/orders?user_id="+user.ID+"&market=ETH", nil, &res)
+	assert(t, status, http.StatusOK)
+	assert(t, res.OrderIDs, []string{ask})
+
+	order, _ := te.Orders.Get(ask)
+	assert(t, order.Status, OrderCancelled)
+	order, _ = te.Orders.Get(otherAsk)
+	assert(t, order.Status, OrderNew)
+
+	status = te.do(t, http.MethodDelete, "/orders?user_id="+user.ID+"&side=both", nil, nil)
+	assert(t, status, http.StatusBadRequest)
+}
+
+func TestCancelAfter(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	orderID := te.placeLimit(t, user.ID, true, 1, 3400)
+
+	var res CancelAfterRes
+	status := te.do(t, http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: user.ID, TimeoutMs: 50}, &res)
+	assert(t, status, http.StatusOK)
+	if res.Deadline == nil {
+		t.Fatal("armed switch without deadline")
+	}
+
+	te.waitForStatus(t, orderID, OrderExpired)
+
+	// a disarmed switch leaves the orders alone
+	orderID = te.placeLimit(t, user.ID, true, 1, 3400)
+	te.do(t, http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: user.ID, TimeoutMs: 50}, nil)
+	var disarmed CancelAfterRes
+	te.do(t, http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: user.ID}, &disarmed)
+	assert(t, disarmed.Deadline, (*time.Time)(nil))
+
+	time.Sleep(100 * time.Millisecond)
+	order, _ := te.Orders.Get(orderID)
+	assert(t, order.Status, OrderNew)
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	orderID := te.placeLimit(t, user.ID, false, 1, 3600)
+
+	ts := httptest.NewServer(te.e)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?user_id=" + user.ID + "&cancel_on_disconnect=true"
+
+	// only the user can have its orders cancelled
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("session opened without an API key")
+	}
+	assert(t, resp.StatusCode, http.StatusUnauthorized)
+	_, resp, err = websocket.DefaultDialer.Dial(url, http.Header{HeaderAPIKey: {te.registerUser(t).APIKey}})
+	if err == nil {
+		t.Fatal("session opened with the API key of another user")
+	}
+	assert(t, resp.StatusCode, http.StatusForbidden)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{HeaderAPIKey: {user.APIKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, _ := te.Orders.Get(orderID)
+	assert(t, order.Status, OrderNew)
+
+	conn.Close()
+
+	te.waitForStatus(t, orderID, OrderCancelled)
+}
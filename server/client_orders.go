@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// marketClientOrderTTL is how long the client order ID of a market order
+// keeps returning the original result. Market orders never rest in the book
+// so their IDs can't be tied to the order being open.
+const marketClientOrderTTL = time.Minute
+
+type clientOrderKey struct {
+	userID        string
+	clientOrderID string
+}
+
+type clientOrder struct {
+	market Market
+	res    *PlaceOrderRes // nil while the order is being placed
+	limit  bool
+	placed time.Time
+}
+
+// clientOrderIndex maps the client order IDs of a user to their orders. An ID
+// is taken while its limit order is open and is free again once the order is
+// filled or cancelled. The IDs of market orders are dropped by a sweep once
+// their TTL is over.
+type clientOrderIndex struct {
+	mu        sync.Mutex
+	orders    map[clientOrderKey]*clientOrder
+	lastSweep time.Time
+}
+
+func newClientOrderIndex() *clientOrderIndex {
+	return &clientOrderIndex{
+		orders:    make(map[clientOrderKey]*clientOrder),
+		lastSweep: time.Now(),
+	}
+}
+
+// reserve claims key for a new order. If key is taken the order holding it
+// is returned and ok is false. isOpen reports whether an order is still in
+// the book of market.
+func (ci *clientOrderIndex) reserve(key clientOrderKey, market Market, isOpen func(market Market, orderID string) bool) (co *clientOrder, ok bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ci.sweep(isOpen)
+
+	if co, taken := ci.orders[key]; taken && ci.taken(co, isOpen) {
+		return co, false
+	}
+
+	ci.orders[key] = &clientOrder{market: market}
+
+	return nil, true
+}
+
+// sweep drops the placed orders whose IDs are free again, at most once per
+// marketClientOrderTTL. ci.mu must be held.
+func (ci *clientOrderIndex) sweep(isOpen func(market Market, orderID string) bool) {
+	now := time.Now()
+	if now.Sub(ci.lastSweep) < marketClientOrderTTL {
+		return
+	}
+
+	for key, co := range ci.orders {
+		if co.res != nil && !ci.taken(co, isOpen) {
+			delete(ci.orders, key)
+		}
+	}
+	ci.lastSweep = now
+}
+
+func (ci *clientOrderIndex) taken(co *clientOrder, isOpen func(market Market, orderID string) bool) bool {
+	switch {
+	case co.res == nil:
+		return true
+	case co.limit:
+		return isOpen(co.market, co.res.OrderID)
+	default:
+		return time.Since(co.placed) < marketClientOrderTTL
+	}
+}
+
+// inUse reports whether key is held by an order.
+func (ci *clientOrderIndex) inUse(key clientOrderKey, isOpen func(market Market, orderID string) bool) bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	co, ok := ci.orders[key]
+	return ok && ci.taken(co, isOpen)
+}
+
+// complete records the result of the order placed for key.
+func (ci *clientOrderIndex) complete(key clientOrderKey, res *PlaceOrderRes, limit bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if co, ok := ci.orders[key]; ok {
+		co.res = res
+		co.limit = limit
+		co.placed = time.Now()
+	}
+}
+
+func (ci *clientOrderIndex) release(key clientOrderKey) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	delete(ci.orders, key)
+}
+
+// releaseOrder frees key if it is held by the limit order with orderID,
+// which was filled or cancelled.
+func (ci *clientOrderIndex) releaseOrder(key clientOrderKey, orderID string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if co, ok := ci.orders[key]; ok && co.limit && co.res != nil && co.res.OrderID == orderID {
+		delete(ci.orders, key)
+	}
+}
+
+// get returns a copy of the placed limit order holding key, an order still
+// being placed isn't returned.
+func (ci *clientOrderIndex) get(key clientOrderKey) (clientOrder, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	co, ok := ci.orders[key]
+	if !ok || co.res == nil || !co.limit {
+		return clientOrder{}, false
+	}
+
+	return *co, true
+}
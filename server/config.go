@@ -0,0 +1,483 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// Config is the configuration of the exchange server. It is built from
+	// DefaultConfig, an optional JSON file, EXCHANGE_* environment variables
+	// and command line flags, each overriding the previous one.
+	Config struct {
+		HTTP        HTTPConfig        `json:"http"`
+		GRPC        GRPCConfig        `json:"grpc"`
+		FIX         FIXConfig         `json:"fix"`
+		Chain       ChainConfig       `json:"chain"`
+		Markets     []MarketConfig    `json:"markets"`
+		Assets      []AssetConfig     `json:"assets"`
+		Fees        FeeConfig         `json:"fees"`
+		Users       UsersConfig       `json:"users"`
+		Persistence PersistenceConfig `json:"persistence"`
+		Settlement  SettlementConfig  `json:"settlement"`
+		RateLimit   RateLimitConfig   `json:"rate_limit"`
+		Log         LogConfig         `json:"log"`
+		Admin       AdminConfig       `json:"admin"`
+	}
+
+	// HTTPConfig configures the REST API. TrustedProxies are the CIDRs of
+	// the proxies in front of it, whose X-Forwarded-For header is trusted
+	// to tell the IP of a client. Without them it is the address requests
+	// come from. AllowedOrigins are the origins of the web pages, other
+	// than those of the API's host, allowed to open WebSocket sessions.
+	HTTPConfig struct {
+		Addr           string   `json:"addr"`
+		TrustedProxies []string `json:"trusted_proxies,omitempty"`
+		AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	}
+
+	// GRPCConfig configures the gRPC API, which is served next to the REST
+	// API unless Addr is empty.
+	GRPCConfig struct {
+		Addr string `json:"addr"`
+	}
+
+	// ChainConfig configures the ethereum node settlement talks to. The
+	// operator key pays for transfers made on behalf of users, it is given
+	// hex encoded in OperatorKey, usually through EXCHANGE_OPERATOR_KEY, or
+	// in the file OperatorKeyFile. There is no default, assets settling on
+	// chain need one.
+	ChainConfig struct {
+		RPCURL          string `json:"rpc_url"`
+		OperatorKey     string `json:"operator_key,omitempty"`
+		OperatorKeyFile string `json:"operator_key_file,omitempty"`
+	}
+
+	// FeeConfig holds the fees charged on the quote amount of a trade in
+	// basis points. They are settled with the trade, to the user Account,
+	// markets without a quote asset trade free.
+	FeeConfig struct {
+		MakerBps int64  `json:"maker_bps"`
+		TakerBps int64  `json:"taker_bps"`
+		Account  string `json:"account,omitempty"`
+	}
+
+	// UsersConfig configures the user keystore, its passphrase is given
+	// directly or read from PassphraseFile.
+	UsersConfig struct {
+		KeystoreDir    string `json:"keystore_dir"`
+		Passphrase     string `json:"passphrase,omitempty"`
+		PassphraseFile string `json:"passphrase_file,omitempty"`
+	}
+
+	// PersistenceConfig locates the state of the exchange on disk. The
+	// balances of every asset settled on the internal ledger are kept in a
+	// file of LedgerDir named after the asset.
+	PersistenceConfig struct {
+		SettlementQueue string `json:"settlement_queue"`
+		AuditLog        string `json:"audit_log"`
+		LedgerDir       string `json:"ledger_dir"`
+	}
+)
+
+const (
+	defaultKeystoreDir         = "keystore"
+	defaultSettlementQueuePath = "data/settlements.json"
+	defaultAuditLogPath        = "data/audit.log"
+	defaultLedgerDir           = "data/ledger"
+
+	maxFeeBps = 10_000
+)
+
+func DefaultConfig() Config {
+	return Config{
+		HTTP: HTTPConfig{
+			Addr: ":3000",
+		},
+		GRPC: GRPCConfig{
+			Addr: ":3001",
+		},
+		FIX: DefaultFIXConfig,
+		Chain: ChainConfig{
+			RPCURL: "http://localhost:8545",
+		},
+		Markets: append([]MarketConfig(nil), DefaultMarkets...),
+		Assets:  append([]AssetConfig(nil), DefaultAssets...),
+		Users: UsersConfig{
+			KeystoreDir: defaultKeystoreDir,
+		},
+		Persistence: PersistenceConfig{
+			SettlementQueue: defaultSettlementQueuePath,
+			AuditLog:        defaultAuditLogPath,
+			LedgerDir:       defaultLedgerDir,
+		},
+		Settlement: DefaultSettlementConfig,
+		RateLimit:  DefaultRateLimitConfig,
+		Log:        DefaultLogConfig,
+	}
+}
+
+// charge returns the fee of bps basis points on amount.
+func (FeeConfig) charge(amount float64, bps int64) float64 {
+	return amount * float64(bps) / maxFeeBps
+}
+
+// chargeUnits returns the fee of bps basis points on amount units, rounded
+// down.
+func (FeeConfig) chargeUnits(amount *big.Int, bps int64) *big.Int {
+	fee := new(big.Int).Mul(amount, big.NewInt(bps))
+	return fee.Quo(fee, big.NewInt(maxFeeBps))
+}
+
+// passphrase reads the passphrase of the keystore, it is empty if none is
+// configured.
+func (cfg UsersConfig) passphrase() (string, error) {
+	if cfg.PassphraseFile == "" {
+		return cfg.Passphrase, nil
+	}
+	if cfg.Passphrase != "" {
+		return "", errors.New("both passphrase and passphrase_file are set")
+	}
+
+	data, err := os.ReadFile(cfg.PassphraseFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// operatorKey reads the operator key, it is nil if none is configured.
+func (cfg ChainConfig) operatorKey() (*ecdsa.PrivateKey, error) {
+	key := cfg.OperatorKey
+	if cfg.OperatorKeyFile != "" {
+		if key != "" {
+			return nil, errors.New("both operator_key and operator_key_file are set")
+		}
+
+		data, err := os.ReadFile(cfg.OperatorKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+	}
+
+	if key == "" {
+		return nil, nil
+	}
+
+	return crypto.HexToECDSA(key)
+}
+
+// LoadConfig builds the configuration from the command line arguments. The
+// -config flag, or EXCHANGE_CONFIG, names the JSON file read on top of the
+// defaults.
+func LoadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet("exchange", flag.ContinueOnError)
+	var (
+		path     = fs.String("config", os.Getenv("EXCHANGE_CONFIG"), "path of the JSON config file")
+		addr     = fs.String("http.addr", "", "address the HTTP server listens on")
+		grpcAddr = fs.String("grpc.addr", "", "address the gRPC server listens on, empty to disable it")
+		fixAddr  = fs.String("fix.addr", "", "address the FIX gateway listens on, empty to disable it")
+		rpcURL   = fs.String("chain.rpc-url", "", "URL of the ethereum node")
+		keystore = fs.String("users.keystore-dir", "", "directory of the user keystore")
+		queue    = fs.String("persistence.settlement-queue", "", "path of the settlement queue")
+		audit    = fs.String("persistence.audit-log", "", "path of the audit log")
+		ledger   = fs.String("persistence.ledger-dir", "", "directory of the balances of the internal ledger")
+		logLevel = fs.String("log.level", "", "level to log at: debug, info, warn or error")
+	)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	cfg.applyEnv(os.Getenv)
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "http.addr":
+			cfg.HTTP.Addr = *addr
+		case "grpc.addr":
+			cfg.GRPC.Addr = *grpcAddr
+		case "fix.addr":
+			cfg.FIX.Addr = *fixAddr
+		case "chain.rpc-url":
+			cfg.Chain.RPCURL = *rpcURL
+		case "users.keystore-dir":
+			cfg.Users.KeystoreDir = *keystore
+		case "persistence.settlement-queue":
+			cfg.Persistence.SettlementQueue = *queue
+		case "persistence.audit-log":
+			cfg.Persistence.AuditLog = *audit
+		case "persistence.ledger-dir":
+			cfg.Persistence.LedgerDir = *ledger
+		case "log.level":
+			cfg.Log.Level = *logLevel
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("decoding config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (cfg *Config) applyEnv(getenv func(string) string) {
+	overrides := map[string]*string{
+		"EXCHANGE_HTTP_ADDR":                &cfg.HTTP.Addr,
+		"EXCHANGE_GRPC_ADDR":                &cfg.GRPC.Addr,
+		"EXCHANGE_FIX_ADDR":                 &cfg.FIX.Addr,
+		"EXCHANGE_RPC_URL":                  &cfg.Chain.RPCURL,
+		"EXCHANGE_OPERATOR_KEY":             &cfg.Chain.OperatorKey,
+		"EXCHANGE_OPERATOR_KEY_FILE":        &cfg.Chain.OperatorKeyFile,
+		"EXCHANGE_KEYSTORE_DIR":             &cfg.Users.KeystoreDir,
+		"EXCHANGE_KEYSTORE_PASSPHRASE":      &cfg.Users.Passphrase,
+		"EXCHANGE_KEYSTORE_PASSPHRASE_FILE": &cfg.Users.PassphraseFile,
+		"EXCHANGE_SETTLEMENT_QUEUE":         &cfg.Persistence.SettlementQueue,
+		"EXCHANGE_AUDIT_LOG":                &cfg.Persistence.AuditLog,
+		"EXCHANGE_LEDGER_DIR":               &cfg.Persistence.LedgerDir,
+		"EXCHANGE_LOG_LEVEL":                &cfg.Log.Level,
+		"EXCHANGE_LOG_FORMAT":               &cfg.Log.Format,
+	}
+
+	for name, field := range overrides {
+		if value := getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	// EXCHANGE_ADMIN_TOKEN adds the token of an operator named admin
+	if token := getenv("EXCHANGE_ADMIN_TOKEN"); token != "" {
+		if cfg.Admin.Tokens == nil {
+			cfg.Admin.Tokens = make(map[string]string)
+		}
+		cfg.Admin.Tokens["admin"] = token
+	}
+}
+
+// Validate reports every problem of the configuration at once.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if cfg.HTTP.Addr == "" {
+		errs = append(errs, errors.New("http.addr is empty"))
+	}
+	if _, err := cfg.HTTP.ipExtractor(); err != nil {
+		errs = append(errs, err)
+	}
+
+	operator, keyErr := cfg.Chain.operatorKey()
+	if keyErr != nil {
+		errs = append(errs, fmt.Errorf("chain.operator_key: %w", keyErr))
+	}
+
+	onChain := false
+	assets := make(map[Asset]AssetConfig)
+	for _, asset := range cfg.Assets {
+		if _, ok := assets[asset.Asset]; ok {
+			errs = append(errs, fmt.Errorf("duplicate asset %s", asset.Asset))
+		}
+		assets[asset.Asset] = asset
+
+		switch asset.Settler {
+		case SettlerETH:
+		case SettlerERC20:
+			if !common.IsHexAddress(asset.Token) {
+				errs = append(errs, fmt.Errorf("invalid token address of %s: %q", asset.Asset, asset.Token))
+			}
+		case SettlerLedger, SettlerFake:
+		default:
+			errs = append(errs, fmt.Errorf("unknown settler kind of %s: %q", asset.Asset, asset.Settler))
+		}
+
+		if asset.Settler == SettlerETH || asset.Settler == SettlerERC20 {
+			onChain = true
+			if cfg.Chain.RPCURL == "" {
+				errs = append(errs, fmt.Errorf("asset %s settles on chain but chain.rpc_url is empty", asset.Asset))
+			}
+		}
+	}
+	if onChain && operator == nil && keyErr == nil {
+		errs = append(errs, errors.New("assets settle on chain but no operator key is set, set chain.operator_key_file or EXCHANGE_OPERATOR_KEY"))
+	}
+
+	if len(cfg.Markets) == 0 {
+		errs = append(errs, errors.New("no markets configured"))
+	}
+
+	markets := make(map[Market]bool)
+	for _, market := range cfg.Markets {
+		if markets[market.Name] {
+			errs = append(errs, fmt.Errorf("duplicate market %s", market.Name))
+		}
+		markets[market.Name] = true
+
+		if market.PriceBands != nil {
+			if err := market.PriceBands.validate(market.Name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if err := validateMarkets(cfg.Markets, assets); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.Fees.MakerBps < 0 || cfg.Fees.MakerBps > maxFeeBps {
+		errs = append(errs, fmt.Errorf("fees.maker_bps %d out of range", cfg.Fees.MakerBps))
+	}
+	if cfg.Fees.TakerBps < 0 || cfg.Fees.TakerBps > maxFeeBps {
+		errs = append(errs, fmt.Errorf("fees.taker_bps %d out of range", cfg.Fees.TakerBps))
+	}
+	if (cfg.Fees.MakerBps > 0 || cfg.Fees.TakerBps > 0) && cfg.Fees.Account == "" {
+		errs = append(errs, errors.New("fees are charged but fees.account, the user they are paid to, is empty"))
+	}
+
+	if cfg.Users.KeystoreDir == "" {
+		errs = append(errs, errors.New("users.keystore_dir is empty"))
+	}
+	if passphrase, err := cfg.Users.passphrase(); err != nil {
+		errs = append(errs, fmt.Errorf("users.passphrase: %w", err))
+	} else if passphrase == "" {
+		errs = append(errs, errors.New("users.passphrase is empty, set users.passphrase_file or EXCHANGE_KEYSTORE_PASSPHRASE"))
+	}
+
+	if cfg.Persistence.SettlementQueue == "" {
+		errs = append(errs, errors.New("persistence.settlement_queue is empty"))
+	}
+	if cfg.Persistence.AuditLog == "" {
+		errs = append(errs, errors.New("persistence.audit_log is empty"))
+	}
+	if cfg.Persistence.LedgerDir == "" {
+		errs = append(errs, errors.New("persistence.ledger_dir is empty"))
+	}
+
+	if cfg.Settlement.Workers < 1 {
+		errs = append(errs, errors.New("settlement.workers must be at least 1"))
+	}
+	if cfg.Settlement.MaxAttempts < 1 {
+		errs = append(errs, errors.New("settlement.max_attempts must be at least 1"))
+	}
+	if cfg.Settlement.Backoff <= 0 || cfg.Settlement.MaxBackoff < cfg.Settlement.Backoff {
+		errs = append(errs, errors.New("settlement.backoff must be positive and at most settlement.max_backoff"))
+	}
+	if cfg.Settlement.PollInterval <= 0 {
+		errs = append(errs, errors.New("settlement.poll_interval must be positive"))
+	}
+	if cfg.Settlement.ConfirmTimeout < cfg.Settlement.PollInterval {
+		errs = append(errs, errors.New("settlement.confirm_timeout must be at least settlement.poll_interval"))
+	}
+
+	if err := cfg.RateLimit.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.FIX.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cfg.Log.validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for name, token := range cfg.Admin.Tokens {
+		if len(token) < minAdminTokenLength {
+			errs = append(errs, fmt.Errorf("admin.tokens[%s] must be at least %d characters", name, minAdminTokenLength))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// settlementConfigJSON is SettlementConfig with durations written like
+// "1s" or "500ms".
+type settlementConfigJSON struct {
+	Workers        int    `json:"workers"`
+	Confirmations  uint64 `json:"confirmations"`
+	MaxAttempts    int    `json:"max_attempts"`
+	Backoff        string `json:"backoff"`
+	MaxBackoff     string `json:"max_backoff"`
+	PollInterval   string `json:"poll_interval"`
+	ConfirmTimeout string `json:"confirm_timeout"`
+}
+
+func (c SettlementConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(settlementConfigJSON{
+		Workers:        c.Workers,
+		Confirmations:  c.Confirmations,
+		MaxAttempts:    c.MaxAttempts,
+		Backoff:        c.Backoff.String(),
+		MaxBackoff:     c.MaxBackoff.String(),
+		PollInterval:   c.PollInterval.String(),
+		ConfirmTimeout: c.ConfirmTimeout.String(),
+	})
+}
+
+// UnmarshalJSON only overrides the fields present in data.
+func (c *SettlementConfig) UnmarshalJSON(data []byte) error {
+	raw := settlementConfigJSON{
+		Workers:       c.Workers,
+		Confirmations: c.Confirmations,
+		MaxAttempts:   c.MaxAttempts,
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	c.Workers = raw.Workers
+	c.Confirmations = raw.Confirmations
+	c.MaxAttempts = raw.MaxAttempts
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"backoff", raw.Backoff, &c.Backoff},
+		{"max_backoff", raw.MaxBackoff, &c.MaxBackoff},
+		{"poll_interval", raw.PollInterval, &c.PollInterval},
+		{"confirm_timeout", raw.ConfirmTimeout, &c.ConfirmTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("settlement.%s: %w", d.name, err)
+		}
+		*d.field = value
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOperatorKey is a key of the local development node.
+const testOperatorKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"http": {"addr": ":4000"},
+		"chain": {"rpc_url": "http://node:8545"},
+		"fees": {"maker_bps": 10, "taker_bps": 20, "account": "fees"},
+		"settlement": {"workers": 8, "poll_interval": "250ms"}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "operator.key")
+	if err := os.WriteFile(keyFile, []byte(testOperatorKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(t.TempDir(), "keystore.passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("secret passphrase\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("EXCHANGE_RPC_URL", "http://env:8545")
+	t.Setenv("EXCHANGE_OPERATOR_KEY_FILE", keyFile)
+	t.Setenv("EXCHANGE_KEYSTORE_DIR", "env-keystore")
+	t.Setenv("EXCHANGE_KEYSTORE_PASSPHRASE_FILE", passphraseFile)
+	t.Setenv("EXCHANGE_LOG_LEVEL", "debug")
+	t.Setenv("EXCHANGE_ADMIN_TOKEN", "0123456789abcdef")
+
+	cfg, err := LoadConfig([]string{"-config", path, "-users.keystore-dir", "flag-keystore"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert(t, cfg.HTTP.Addr, ":4000")
+	assert(t, cfg.Chain.RPCURL, "http://env:8545")
+	assert(t, cfg.Chain.OperatorKeyFile, keyFile)
+	assert(t, cfg.Users.KeystoreDir, "flag-keystore")
+	passphrase, err := cfg.Users.passphrase()
+	assert(t, passphrase, "secret passphrase")
+	assert(t, err, nil)
+	assert(t, cfg.Fees, FeeConfig{MakerBps: 10, TakerBps: 20, Account: "fees"})
+	assert(t, cfg.Settlement.Workers, 8)
+	assert(t, cfg.Settlement.PollInterval, 250*time.Millisecond)
+	assert(t, cfg.Settlement.Backoff, DefaultSettlementConfig.Backoff)
+	assert(t, cfg.Markets, DefaultMarkets)
+	assert(t, cfg.Log, LogConfig{Level: "debug", Format: LogFormatText})
+	assert(t, cfg.Admin.Tokens, map[string]string{"admin": "0123456789abcdef"})
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HTTP.Addr = ""
+	cfg.Fees.TakerBps = maxFeeBps + 1
+	cfg.Markets = append(cfg.Markets, MarketConfig{Name: "BTC", Base: "BTC"})
+	cfg.Markets[0].PriceBands = &PriceBandConfig{BandPct: 5, BreakerPct: 10}
+	cfg.Log.Level = "loud"
+	cfg.Admin.Tokens = map[string]string{"ops": "short"}
+	cfg.FIX.Addr = ":9878"
+	cfg.FIX.Sessions = []FIXSessionConfig{{CompID: "CLIENT", UserID: "user", Password: "short"}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected invalid config")
+	}
+
+	for _, problem := range []string{"http.addr", "fees.taker_bps", "fees.account", "users.passphrase", "BTC", "log.level", "admin.tokens[ops]", "window and cooldown", "fix.sessions[0]: password"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q doesn't mention %s", err, problem)
+		}
+	}
+
+	cfg = DefaultConfig()
+	err = cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "no operator key") {
+		t.Errorf("default config without an operator key: %v", err)
+	}
+
+	cfg.Chain.OperatorKey = testOperatorKey
+	cfg.Users.Passphrase = "test"
+	assert(t, cfg.Validate(), nil)
+
+	cfg.Chain.OperatorKeyFile = "operator.key"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Errorf("operator key given twice: %v", err)
+	}
+}
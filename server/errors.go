@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+)
+
+const (
+	CodeInvalidRequest        ErrorCode = "invalid_request"
+	CodeNotFound              ErrorCode = "not_found"
+	CodeUnauthorized          ErrorCode = "unauthorized"
+	CodeForbidden             ErrorCode = "forbidden"
+	CodeMethodNotAllowed      ErrorCode = "method_not_allowed"
+	CodeConflict              ErrorCode = "conflict"
+	CodeInsufficientLiquidity ErrorCode = "insufficient_liquidity"
+	CodeMarketUnavailable     ErrorCode = "market_unavailable"
+	CodePriceOutOfBand        ErrorCode = "price_out_of_band"
+	CodeRateLimited           ErrorCode = "rate_limited"
+	CodeInternal              ErrorCode = "internal"
+)
+
+type (
+	ErrorCode string
+
+	// APIError is the body of every error response. Details maps request
+	// fields to what is wrong with them.
+	APIError struct {
+		Status  int               `json:"-"`
+		Code    ErrorCode         `json:"code"`
+		Message string            `json:"message"`
+		Details map[string]string `json:"details,omitempty"`
+	}
+)
+
+func NewAPIError(status int, code ErrorCode, message string) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func errNotFound(what string) *APIError {
+	return NewAPIError(http.StatusNotFound, CodeNotFound, what+" not found")
+}
+
+// fieldErrors collects the invalid fields of a request.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) add(field, problem string) {
+	if _, ok := fe[field]; !ok {
+		fe[field] = problem
+	}
+}
+
+// positive checks that value is a positive finite number.
+func (fe fieldErrors) positive(field string, value float64) {
+	if value <= 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		fe.add(field, "must be a positive number")
+	}
+}
+
+func (fe fieldErrors) required(field, value string) {
+	if value == "" {
+		fe.add(field, "is required")
+	}
+}
+
+// err returns nil if no field is invalid.
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+
+	return &APIError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidRequest,
+		Message: "invalid request",
+		Details: fe,
+	}
+}
+
+type validator interface {
+	Validate() error
+}
+
+// bindRequest decodes the request body into req and validates it.
+func bindRequest(c echo.Context, req validator) error {
+	if err := c.Bind(req); err != nil {
+		return NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "malformed request body")
+	}
+
+	return req.Validate()
+}
+
+// handleError writes err as an APIError.
+func handleError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	logger := loggerFrom(c.Request().Context())
+
+	apiErr := toAPIError(err)
+	if apiErr.Code == CodeInternal {
+		logger.Error("internal error", "error", err)
+	}
+
+	if err := c.JSON(apiErr.Status, apiErr); err != nil {
+		logger.Warn("writing error response", "error", err)
+	}
+}
+
+// toAPIError converts the error returned by a handler. Errors raised by echo
+// keep their status, any other error is reported as an internal error.
+func toAPIError(err error) *APIError {
+	var (
+		apiErr  *APIError
+		httpErr *echo.HTTPError
+	)
+
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &httpErr):
+		return NewAPIError(httpErr.Code, httpErrorCode(httpErr.Code), fmt.Sprint(httpErr.Message))
+	default:
+		return NewAPIError(http.StatusInternalServerError, CodeInternal, "internal error")
+	}
+}
+
+// errorStatus returns the status of the response handleError writes for err.
+func errorStatus(err error) int {
+	return toAPIError(err).Status
+}
+
+func httpErrorCode(status int) ErrorCode {
+	switch {
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status == http.StatusUnauthorized:
+		return CodeUnauthorized
+	case status == http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case status == http.StatusTooManyRequests:
+		return CodeRateLimited
+	case status >= http.StatusInternalServerError:
+		return CodeInternal
+	default:
+		return CodeInvalidRequest
+	}
+}
@@ -1,15 +1,23 @@
 package server
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto_exchange/order_book"
+	"errors"
 	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"log/slog"
 	"math/big"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
 const (
@@ -18,32 +26,82 @@ const (
 	MarketOrder OrderType = "market"
 	LimitOrder  OrderType = "limit"
 
-	exchangePrivateKey = "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+	settlementWindow = 2 * time.Second
+
+	maxClientOrderIDLength = 64
 )
 
 type (
 	Market    string
 	OrderType string
 
+	// ChainClient is the part of the ethereum client used by the exchange,
+	// it is satisfied by *ethclient.Client and the simulated backend.
+	ChainClient interface {
+		bind.ContractBackend
+		ethereum.BlockNumberReader
+		ethereum.ChainIDReader
+		ethereum.ChainStateReader
+		ethereum.TransactionReader
+	}
+
 	Exchange struct {
+		// bookMu serializes changes to the order books. The status changes
+		// made while it is held are announced by unlockBooks.
+		bookMu     sync.Mutex
+		statuses   []statusChange
 		orderBooks map[Market]*order_book.OrderBook
-		Client     *ethclient.Client
+		markets    map[Market]MarketConfig
+		assets     map[Asset]AssetConfig
+		fees       FeeConfig
+		feeAccount *User
+		clientIDs  *clientOrderIndex
+		deadMan    *deadManSwitch
+		sessions   *wsSessions
+		limiter    *rateLimiter
+		clientIP   echo.IPExtractor
+		upgrader   websocket.Upgrader
+		metrics    *metrics
+		log        *slog.Logger
+		logLevel   *slog.LevelVar
+		audit      *AuditLog
+		admins     map[string]string
+		guards     map[Market]*priceGuard
+		feeds      map[Market]*marketFeed
+		settlers   map[Asset]Settler
 		PrivateKey *ecdsa.PrivateKey
-		Users      map[string]*User
+		Users      *UserStore
+		Orders     *OrderStore
+		Settlement *SettlementBatcher
+		Pipeline   *SettlementPipeline
 	}
 
 	User struct {
 		ID         string
+		Address    common.Address
 		PrivateKey *ecdsa.PrivateKey
 	}
 
+	RegisterUserReq struct {
+		PrivateKey string `json:"private_key,omitempty"`
+	}
+
+	// UserRes is a user, a newly registered one with its API key, which
+	// isn't shown again.
+	UserRes struct {
+		ID      string `json:"id"`
+		Address string `json:"address"`
+		APIKey  string `json:"api_key,omitempty"`
+	}
+
 	Order struct {
-		ID        string  `json:"id"`
-		UserID    string  `json:"user_id"`
-		IsBid     bool    `json:"is_bid"`
-		Size      float64 `json:"size"`
-		Price     float64 `json:"price"`
-		Timestamp int64   `json:"timestamp"`
+		ID            string  `json:"id"`
+		ClientOrderID string  `json:"client_order_id,omitempty"`
+		UserID        string  `json:"user_id"`
+		IsBid         bool    `json:"is_bid"`
+		Size          float64 `json:"size"`
+		Price         float64 `json:"price"`
+		Timestamp     int64   `json:"timestamp"`
 	}
 
 	OrderBookRes struct {
@@ -54,18 +112,23 @@ type (
 		Orders          map[string]*Order `json:"orders"`
 	}
 
+	// PlaceOrderReq places an order. A ClientOrderID makes the submission
+	// idempotent, resubmitting it while the order is open returns the
+	// original result.
 	PlaceOrderReq struct {
-		UserID    string `json:"user_id"`
-		Market    `json:"market"`
-		OrderType `json:"type"`
-		IsBid     bool    `json:"is_bid"`
-		Size      float64 `json:"size"`
-		Price     float64 `json:"price"`
+		UserID        string `json:"user_id"`
+		ClientOrderID string `json:"client_order_id,omitempty"`
+		Market        `json:"market"`
+		OrderType     `json:"type"`
+		IsBid         bool    `json:"is_bid"`
+		Size          float64 `json:"size"`
+		Price         float64 `json:"price"`
 	}
 
 	PlaceOrderRes struct {
-		Message string `json:"message"`
-		OrderID string `json:"order_id"`
+		Message       string `json:"message"`
+		OrderID       string `json:"order_id"`
+		ClientOrderID string `json:"client_order_id,omitempty"`
 	}
 
 	Match struct {
@@ -82,37 +145,198 @@ type (
 		Bids []*Order `json:"bids"`
 		Asks []*Order `json:"asks"`
 	}
+
+	Trade struct {
+		ID         string      `json:"id"`
+		IsBid      bool        `json:"is_bid"`
+		Price      float64     `json:"price"`
+		Size       float64     `json:"size"`
+		Timestamp  int64       `json:"timestamp"`
+		MakerFee   float64     `json:"maker_fee"`
+		TakerFee   float64     `json:"taker_fee"`
+		Settlement *Settlement `json:"settlement,omitempty"`
+	}
 )
 
-func NewExchange(client *ethclient.Client, privateKey string) (*Exchange, error) {
-	orderBooks := make(map[Market]*order_book.OrderBook)
-	orderBooks[ETH] = order_book.NewOrderBook()
+// Validate checks the fields of an order request, whether the market and
+// user exist is checked when placing the order.
+func (req *PlaceOrderReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserID)
+	fe.required("market", string(req.Market))
+	fe.positive("size", req.Size)
 
-	pk, err := crypto.HexToECDSA(privateKey)
+	if len(req.ClientOrderID) > maxClientOrderIDLength {
+		fe.add("client_order_id", fmt.Sprintf("must be at most %d characters", maxClientOrderIDLength))
+	}
+
+	switch req.OrderType {
+	case LimitOrder:
+		fe.positive("price", req.Price)
+	case MarketOrder:
+		if req.Price != 0 {
+			fe.add("price", "must be empty for market orders")
+		}
+	case "":
+		fe.add("type", "is required")
+	default:
+		fe.add("type", fmt.Sprintf("unknown order type %q", req.OrderType))
+	}
+
+	return fe.err()
+}
+
+func (req *RegisterUserReq) Validate() error {
+	fe := make(fieldErrors)
+	if req.PrivateKey != "" {
+		if _, err := crypto.HexToECDSA(req.PrivateKey); err != nil {
+			fe.add("private_key", "must be a hex encoded private key")
+		}
+	}
+
+	return fe.err()
+}
+
+func NewExchange(cfg Config, users *UserStore, settlements *SettlementQueue, audit *AuditLog, settlers map[Asset]Settler) (*Exchange, error) {
+	pk, err := cfg.Chain.operatorKey()
+	if err != nil {
+		return nil, err
+	}
+
+	assetsByName := make(map[Asset]AssetConfig)
+	for _, asset := range cfg.Assets {
+		if _, ok := settlers[asset.Asset]; !ok {
+			return nil, fmt.Errorf("no settler for asset %s", asset.Asset)
+		}
+		assetsByName[asset.Asset] = asset
+	}
+
+	if err := validateMarkets(cfg.Markets, assetsByName); err != nil {
+		return nil, err
+	}
+
+	clientIP, err := cfg.HTTP.ipExtractor()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Exchange{
+	var feeAccount *User
+	if cfg.Fees.Account != "" {
+		if feeAccount, err = users.Get(cfg.Fees.Account); err != nil {
+			return nil, fmt.Errorf("fee account %s: %w", cfg.Fees.Account, err)
+		}
+	}
+
+	metrics := newMetrics(settlements)
+	logger, logLevel := newLogger(cfg.Log, os.Stderr)
+	sessions := newWSSessions()
+
+	orderBooks := make(map[Market]*order_book.OrderBook)
+	marketsByName := make(map[Market]MarketConfig)
+	guards := make(map[Market]*priceGuard)
+	feeds := make(map[Market]*marketFeed)
+	for _, market := range cfg.Markets {
+		fees := cfg.Fees
+		if market.Quote == "" {
+			fees = FeeConfig{}
+		}
+		feeds[market.Name] = newMarketFeed(market.Name, sessions, fees)
+		orderBooks[market.Name] = order_book.NewOrderBook()
+		orderBooks[market.Name].SetHooks(bookHooks{metrics.bookHooks(market.Name), feeds[market.Name]})
+		if market.Status != "" {
+			orderBooks[market.Name].SetStatus(order_book.Status(market.Status))
+		}
+		marketsByName[market.Name] = market
+		if market.PriceBands != nil {
+			guards[market.Name] = newPriceGuard(*market.PriceBands)
+		}
+	}
+
+	ex := &Exchange{
 		orderBooks: orderBooks,
-		Client:     client,
+		markets:    marketsByName,
+		assets:     assetsByName,
+		fees:       cfg.Fees,
+		feeAccount: feeAccount,
+		clientIP:   clientIP,
+		upgrader:   websocket.Upgrader{CheckOrigin: cfg.HTTP.checkOrigin},
+		clientIDs:  newClientOrderIndex(),
+		sessions:   sessions,
+		metrics:    metrics,
+		log:        logger,
+		logLevel:   logLevel,
+		audit:      audit,
+		admins:     cfg.Admin.Tokens,
+		guards:     guards,
+		feeds:      feeds,
+		settlers:   settlers,
 		PrivateKey: pk,
-		Users:      make(map[string]*User),
-	}, nil
+		Users:      users,
+		Orders:     NewOrderStore(),
+	}
+	ex.Orders.SetObserver(ex.publishOrder)
+	if cfg.RateLimit.Enabled {
+		ex.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	ex.deadMan = newDeadManSwitch(func(userID string) {
+		ctx := withLogger(context.Background(), logger.With("user_id", userID))
+		loggerFrom(ctx).Info("cancel after deadline passed")
+		ex.cancelAll(ctx, ActorSystem, userID, "", "", OrderExpired)
+	})
+	ex.Pipeline = NewSettlementPipeline(cfg.Settlement, settlements, users, settlers)
+	ex.Pipeline.SetObserver(metrics.observeSettlement)
+	ex.Pipeline.SetLogger(logger)
+	ex.Settlement = NewSettlementBatcher(settlementWindow, ex.Pipeline)
+
+	return ex, nil
 }
 
-func NewUser(privateKey string) *User {
-	id := uuid.NewString()
+// RunSettlement runs the settlement batcher and pipeline until ctx is done.
+// It returns once the batcher has submitted the trades still pending.
+func (ex *Exchange) RunSettlement(ctx context.Context) {
+	flushed := make(chan struct{})
+	go func() {
+		ex.Settlement.Run(ctx)
+		close(flushed)
+	}()
+
+	ex.Pipeline.Run(ctx)
+	<-flushed
+}
 
-	pk, err := crypto.HexToECDSA(privateKey)
+func (ex *Exchange) handleRegisterUser(c echo.Context) error {
+	var data RegisterUserReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	if ex.limiter != nil {
+		if err := ex.limiter.allowRegistration(c); err != nil {
+			return err
+		}
+	}
+
+	user, apiKey, err := ex.Users.Register(data.PrivateKey)
+	if errors.Is(err, ErrUserExists) {
+		return NewAPIError(http.StatusConflict, CodeConflict, err.Error())
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	return &User{
-		ID:         id,
-		PrivateKey: pk,
+	res := toUserRes(user)
+	res.APIKey = apiKey
+
+	return c.JSON(http.StatusCreated, res)
+}
+
+func (ex *Exchange) handleGetUser(c echo.Context) error {
+	user, err := ex.Users.Get(c.Param("id"))
+	if err != nil {
+		return errNotFound("user")
 	}
+
+	return c.JSON(http.StatusOK, toUserRes(user))
 }
 
 func (ex *Exchange) handleGetOrderBook(c echo.Context) error {
@@ -120,12 +344,16 @@ func (ex *Exchange) handleGetOrderBook(c echo.Context) error {
 
 	orderBook, ok := ex.orderBooks[market]
 	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "market not found",
-		})
+		return errNotFound("market")
 	}
 
-	var orderBookRes OrderBookRes
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	orderBookRes := OrderBookRes{
+		Bids: make([]*Order, 0),
+		Asks: make([]*Order, 0),
+	}
 	for _, limit := range orderBook.BidLimitsList() {
 		for _, order := range limit.Orders {
 			bid := toOrder(order)
@@ -148,50 +376,324 @@ func (ex *Exchange) handleGetOrderBook(c echo.Context) error {
 		orderBookRes.Orders[id] = toOrder(order)
 	}
 
+	setSequence(c.Response().Header(), ex.sessions.seq(streamKey{channel: ChannelBook, key: string(market)}))
+
 	return c.JSON(http.StatusOK, orderBookRes)
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	var data PlaceOrderReq
-	if err := c.Bind(&data); err != nil {
+	if err := bindRequest(c, &data); err != nil {
 		return err
 	}
 
-	orderBook := ex.orderBooks[data.Market]
+	orderBook, err := ex.checkOrder(data)
+	if err != nil {
+		return err
+	}
+	if err := authorize(c, data.UserID); err != nil {
+		ex.metrics.order(data.Market, data.OrderType, orderRejected)
+		return err
+	}
+
+	if ex.limiter != nil {
+		if err := ex.limiter.allowOrder(c, data.UserID, data.Market); err != nil {
+			ex.metrics.order(data.Market, data.OrderType, orderRejected)
+			return err
+		}
+	}
+
+	res, err := ex.placeOrder(c.Request().Context(), orderBook, data)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// checkOrder returns the book of the market of a validated order once its
+// user is known.
+func (ex *Exchange) checkOrder(data PlaceOrderReq) (*order_book.OrderBook, error) {
+	orderBook, ok := ex.orderBooks[data.Market]
+	if !ok {
+		return nil, errNotFound("market")
+	}
+
+	if _, err := ex.Users.Get(data.UserID); err != nil {
+		ex.metrics.order(data.Market, data.OrderType, orderRejected)
+		return nil, errNotFound("user")
+	}
+
+	return orderBook, nil
+}
+
+// placeOrder places an order in orderBook, the book of its market, and
+// returns the result the API replies with. It is shared by every API of the
+// exchange, which check the order with checkOrder first.
+func (ex *Exchange) placeOrder(ctx context.Context, orderBook *order_book.OrderBook, data PlaceOrderReq) (*PlaceOrderRes, error) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	return ex.placeOrderLocked(ctx, orderBook, data)
+}
+
+func (ex *Exchange) placeOrderLocked(ctx context.Context, orderBook *order_book.OrderBook, data PlaceOrderReq) (*PlaceOrderRes, error) {
 	order := order_book.NewOrder(data.UserID, data.Size, data.IsBid)
+	order.ClientOrderID = data.ClientOrderID
+
+	record := OrderRecord{
+		ID:            order.ID,
+		ClientOrderID: order.ClientOrderID,
+		UserID:        order.UserID,
+		Market:        data.Market,
+		Type:          data.OrderType,
+		IsBid:         order.IsBid,
+		Price:         data.Price,
+		Size:          order.Size,
+	}
 
+	key := clientOrderKey{userID: data.UserID, clientOrderID: data.ClientOrderID}
+	if data.ClientOrderID != "" {
+		co, ok := ex.clientIDs.reserve(key, data.Market, ex.isOpen)
+		if !ok {
+			if co.res == nil {
+				return nil, NewAPIError(http.StatusConflict, CodeConflict, "order with this client order id is being placed")
+			}
+			return co.res, nil
+		}
+	}
+
+	if err := checkOrderAllowed(data.Market, orderBook, data.OrderType); err != nil {
+		return nil, ex.rejectOrder(ctx, record, key, err)
+	}
+
+	guard := ex.guards[data.Market]
 	if data.OrderType == LimitOrder {
+		if err := guard.checkLimit(orderBook, data.Price); err != nil {
+			return nil, ex.rejectOrder(ctx, record, key, err)
+		}
+	}
+
+	bound, bounded := guard.marketBound(orderBook, data.IsBid)
+	if data.OrderType == MarketOrder && bounded {
+		if orderBook.VolumeWithin(data.IsBid, bound) == 0 {
+			message := fmt.Sprintf("no volume within the price band for market order, bound at %.2f", bound)
+			return nil, ex.rejectOrder(ctx, record, key, NewAPIError(http.StatusUnprocessableEntity, CodePriceOutOfBand, message))
+		}
+	} else if data.OrderType == MarketOrder {
+		available := orderBook.BidsTotalVolume()
+		if data.IsBid {
+			available = orderBook.AsksTotalVolume()
+		}
+		if data.Size > available {
+			message := fmt.Sprintf("not enough volume [size: %.2f] for market order [size: %.2f]", available, data.Size)
+			return nil, ex.rejectOrder(ctx, record, key, NewAPIError(http.StatusUnprocessableEntity, CodeInsufficientLiquidity, message))
+		}
+	}
+
+	ex.Orders.Add(record)
+	ex.auditOrder(ctx, AuditOrderPlaced, record)
+	loggerFrom(ctx).Info("order placed", "order_id", order.ID, "user_id", order.UserID, "market", data.Market, "type", data.OrderType, "is_bid", order.IsBid, "size", data.Size, "price", data.Price)
+
+	message := "Order placed"
+
+	switch data.OrderType {
+	case LimitOrder:
 		if err := ex.handlePlaceLimitOrder(orderBook, order, data.Price); err != nil {
-			return err
+			ex.clientIDs.release(key)
+			return nil, err
+		}
+	case MarketOrder:
+		matches, _ := ex.handlePlaceMarketOrder(ctx, orderBook, order, bound, bounded)
+		ex.recordFills(ctx, data.Market, order, matches)
+
+		if !order.IsFilled() {
+			// the rest of the order would fill outside the price band
+			message = "Order stopped at price band"
+			ex.Orders.Close(order.ID, OrderCancelled, fmt.Sprintf("stopped at price band %.2f", bound))
 		}
+
+		if err := ex.handleMatches(ctx, data.Market, order, matches); err != nil {
+			ex.clientIDs.release(key)
+			return nil, err
+		}
+
+		ex.observeTrades(ctx, data.Market, matches)
 	}
 
-	if data.OrderType == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(orderBook, order)
+	res := &PlaceOrderRes{
+		Message:       message,
+		OrderID:       order.ID,
+		ClientOrderID: order.ClientOrderID,
+	}
 
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+	if data.ClientOrderID != "" {
+		ex.clientIDs.complete(key, res, data.OrderType == LimitOrder)
+	}
+
+	ex.metrics.order(data.Market, data.OrderType, orderAccepted)
+
+	return res, nil
+}
+
+// rejectOrder records an order the exchange turned away with err and frees
+// its client order ID.
+func (ex *Exchange) rejectOrder(ctx context.Context, record OrderRecord, key clientOrderKey, err *APIError) error {
+	record.Status = OrderRejected
+	record.Reason = err.Message
+	ex.Orders.Add(record)
+	ex.clientIDs.release(key)
+	ex.metrics.order(record.Market, record.Type, orderRejected)
+	ex.auditOrder(ctx, AuditOrderRejected, record)
+
+	return err
+}
+
+// recordFills updates the orders on both sides of the matches and audits
+// them as fills of the taker's order.
+func (ex *Exchange) recordFills(ctx context.Context, market Market, taker *order_book.Order, matches []order_book.Match) {
+	for _, match := range matches {
+		ex.Orders.Fill(match.Bid.ID, match.SizeFilled, match.Price, match.Bid.IsFilled())
+		ex.Orders.Fill(match.Ask.ID, match.SizeFilled, match.Price, match.Ask.IsFilled())
+		ex.releaseFilled(match)
+
+		maker := match.Bid
+		if taker.IsBid {
+			maker = match.Ask
+		}
+
+		ex.audit.Record(ctx, AuditEntry{
+			Actor:   actorFrom(ctx, taker.UserID),
+			Action:  AuditOrderFilled,
+			Market:  market,
+			OrderID: taker.ID,
+			Details: map[string]any{
+				"trade_id":       match.TradeID,
+				"maker_order_id": maker.ID,
+				"maker_user_id":  maker.UserID,
+				"size":           match.SizeFilled,
+				"price":          match.Price,
+			},
+		})
+	}
+}
+
+// releaseFilled frees the client order IDs of the orders a match filled.
+func (ex *Exchange) releaseFilled(match order_book.Match) {
+	for _, order := range []*order_book.Order{match.Bid, match.Ask} {
+		if order.IsFilled() {
+			ex.releaseClientOrder(order)
 		}
 	}
+}
+
+// releaseClientOrder frees the client order ID of a limit order that was
+// filled or cancelled.
+func (ex *Exchange) releaseClientOrder(order *order_book.Order) {
+	if order.ClientOrderID != "" {
+		ex.clientIDs.releaseOrder(clientOrderKey{userID: order.UserID, clientOrderID: order.ClientOrderID}, order.ID)
+	}
+}
+
+// cancelOrder removes the order from the book and records it with status,
+// actor is the user or operator cancelling it.
+func (ex *Exchange) cancelOrder(ctx context.Context, actor string, orderBook *order_book.OrderBook, order *order_book.Order, status OrderStatus) {
+	ex.closeOrder(ctx, actor, orderBook, order, status, "")
+}
 
-	return c.JSON(http.StatusOK, PlaceOrderRes{
-		Message: "Order placed",
+// closeOrder is cancelOrder keeping reason with the order if not empty.
+func (ex *Exchange) closeOrder(ctx context.Context, actor string, orderBook *order_book.OrderBook, order *order_book.Order, status OrderStatus, reason string) {
+	orderBook.CancelOrder(order)
+	ex.Orders.Close(order.ID, status, reason)
+	ex.releaseClientOrder(order)
+
+	record, _ := ex.Orders.Get(order.ID)
+	loggerFrom(ctx).Info("order cancelled", "order_id", order.ID, "user_id", order.UserID, "market", record.Market, "status", status)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:   actor,
+		Action:  AuditOrderCancelled,
+		Market:  record.Market,
 		OrderID: order.ID,
+		Details: map[string]any{
+			"user_id": order.UserID,
+			"status":  status,
+			"size":    order.Size,
+		},
+	})
+}
+
+func (ex *Exchange) auditOrder(ctx context.Context, action AuditAction, record OrderRecord) {
+	details := map[string]any{
+		"type":   record.Type,
+		"is_bid": record.IsBid,
+		"size":   record.Size,
+		"price":  record.Price,
+	}
+	if record.ClientOrderID != "" {
+		details["client_order_id"] = record.ClientOrderID
+	}
+	if record.Reason != "" {
+		details["reason"] = record.Reason
+	}
+
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:   actorFrom(ctx, record.UserID),
+		Action:  action,
+		Market:  record.Market,
+		OrderID: record.ID,
+		Details: details,
 	})
 }
 
+// actor returns who makes a request on behalf of owner: the owner or an
+// operator.
+func actor(c echo.Context, owner string) string {
+	return actorFrom(c.Request().Context(), owner)
+}
+
+// actorFrom returns who acts on behalf of owner in ctx: the principal of
+// the request it serves, or the owner outside of one.
+func actorFrom(ctx context.Context, owner string) string {
+	if p := principalFrom(ctx); p != "" {
+		return p
+	}
+
+	return owner
+}
+
+// isOpen reports whether the order is resting in the book of market.
+func (ex *Exchange) isOpen(market Market, orderID string) bool {
+	orderBook, ok := ex.orderBooks[market]
+	if !ok {
+		return false
+	}
+
+	orderBook.OrdersMu.RLock()
+	defer orderBook.OrdersMu.RUnlock()
+
+	_, ok = orderBook.Orders[orderID]
+	return ok
+}
+
 func (ex *Exchange) handlePlaceLimitOrder(orderBook *order_book.OrderBook, order *order_book.Order, price float64) error {
 	orderBook.PlaceLimitOrder(order, price)
 	return nil
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(orderBook *order_book.OrderBook, order *order_book.Order) ([]order_book.Match, []*Match) {
+// handlePlaceMarketOrder fills the order, if bounded only at prices no worse
+// than bound.
+func (ex *Exchange) handlePlaceMarketOrder(ctx context.Context, orderBook *order_book.OrderBook, order *order_book.Order, bound float64, bounded bool) ([]order_book.Match, []*Match) {
 	var isBid bool
 	if order.IsBid {
 		isBid = true
 	}
 
-	matches := orderBook.PlaceMarketOrder(order)
+	var matches []order_book.Match
+	if bounded {
+		matches = orderBook.PlaceMarketOrderWithin(order, bound)
+	} else {
+		matches = orderBook.PlaceMarketOrder(order)
+	}
 	matchesRes := make([]*Match, len(matches))
 
 	var totalSizeFilled float64
@@ -212,82 +714,264 @@ func (ex *Exchange) handlePlaceMarketOrder(orderBook *order_book.OrderBook, orde
 
 	averagePrice := sumPrice / float64(len(matches))
 
-	fmt.Printf("Filled market order => ID: %s | size: %.2f | price: %.2f \n", order.ID, totalSizeFilled, averagePrice)
+	loggerFrom(ctx).Info("market order filled", "order_id", order.ID, "size", totalSizeFilled, "average_price", averagePrice, "matches", len(matches))
 
 	return matches, matchesRes
 }
 
-func (ex *Exchange) handleMatches(matches []order_book.Match) error {
+// handleMatches settles the matches of a market order. The base asset moves
+// from the seller to the buyer and, if the market has a quote asset, price
+// times size of the quote asset moves back from the buyer to the seller,
+// less the fees, which both pay to the fee account. The taker pays the
+// taker fee, the other side, and both sides of an auction without a taker,
+// the maker fee. If one of the legs fails to settle the others are moved
+// back.
+func (ex *Exchange) handleMatches(ctx context.Context, market Market, taker *order_book.Order, matches []order_book.Match) error {
+	cfg := ex.markets[market]
+
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("from user not found: %s", match.Ask.UserID)
+		seller, err := ex.Users.Get(match.Ask.UserID)
+		if err != nil {
+			return fmt.Errorf("seller not found: %s", match.Ask.UserID)
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("to user not found: %s", match.Bid.UserID)
+		buyer, err := ex.Users.Get(match.Bid.UserID)
+		if err != nil {
+			return fmt.Errorf("buyer not found: %s", match.Bid.UserID)
 		}
 
-		amount := big.NewInt(int64(match.SizeFilled))
+		legs := []TradeLeg{{
+			Asset:  cfg.Base,
+			From:   seller,
+			To:     buyer,
+			Amount: toUnits(match.SizeFilled, ex.assets[cfg.Base].Decimals),
+		}}
+		if cfg.Quote != "" {
+			legs = append(legs, ex.quoteLegs(cfg.Quote, taker, match, buyer, seller)...)
+		}
 
-		err := transferETH(ex.Client, fromUser.PrivateKey, toUser.PrivateKey, amount)
-		if err != nil {
-			fmt.Println("transferETH:", err)
+		if err := ex.Settlement.Add(ctx, match.TradeID, legs...); err != nil {
+			loggerFrom(ctx).Error("storing settlement transfers", "trade_id", match.TradeID, "error", err)
 		}
 	}
 
 	return nil
 }
 
+// quoteLegs returns the transfers of the quote asset of a match: the buyer
+// pays the seller less the seller's fee, and the fees of both to the fee
+// account.
+func (ex *Exchange) quoteLegs(quote Asset, taker *order_book.Order, match order_book.Match, buyer, seller *User) []TradeLeg {
+	amount := toUnits(match.SizeFilled*match.Price, ex.assets[quote].Decimals)
+
+	buyerBps, sellerBps := ex.fees.MakerBps, ex.fees.MakerBps
+	if taker != nil && taker.IsBid {
+		buyerBps = ex.fees.TakerBps
+	} else if taker != nil {
+		sellerBps = ex.fees.TakerBps
+	}
+
+	var fee, sellerFee *big.Int
+	if ex.feeAccount != nil {
+		sellerFee = ex.fees.chargeUnits(amount, sellerBps)
+		fee = new(big.Int).Add(ex.fees.chargeUnits(amount, buyerBps), sellerFee)
+	}
+
+	if fee == nil || fee.Sign() == 0 {
+		return []TradeLeg{{Asset: quote, From: buyer, To: seller, Amount: amount}}
+	}
+
+	return []TradeLeg{
+		{Asset: quote, From: buyer, To: seller, Amount: amount.Sub(amount, sellerFee)},
+		{Asset: quote, From: buyer, To: ex.feeAccount, Amount: fee},
+	}
+}
+
 func (ex *Exchange) handleCancelOrder(c echo.Context) error {
 	orderID := c.Param("id")
+	if err := ex.authorizeOrder(c, orderID); err != nil {
+		return err
+	}
 
-	orderBook := ex.orderBooks[ETH]
+	if err := ex.cancelOrderByID(c.Request().Context(), principal(c), orderID); err != nil {
+		return err
+	}
 
-	order, ok := orderBook.Orders[orderID]
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":  "Order deleted",
+		"order_id": orderID,
+	})
+}
+
+// cancelOrderByID cancels an open order, requester is the user asking for
+// it or empty if the request didn't name one.
+func (ex *Exchange) cancelOrderByID(ctx context.Context, requester, orderID string) error {
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	market, orderBook, order, ok := ex.findOrder(orderID)
 	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "Order not found",
-		})
+		return errNotFound("order")
 	}
 
-	orderBook.CancelOrder(order)
+	if err := checkCancelAllowed(market, orderBook); err != nil {
+		return err
+	}
+
+	if requester == "" {
+		requester = order.UserID
+	}
+	ex.cancelOrder(ctx, requester, orderBook, order, OrderCancelled)
+
+	return nil
+}
+
+// findOrder returns an order resting in one of the books with its market.
+// The book lock must be held.
+func (ex *Exchange) findOrder(orderID string) (Market, *order_book.OrderBook, *order_book.Order, bool) {
+	for market, orderBook := range ex.orderBooks {
+		if order, ok := orderBook.Orders[orderID]; ok {
+			return market, orderBook, order, true
+		}
+	}
+
+	return "", nil, nil, false
+}
+
+// clientOrder returns the open order of the user holding a client order
+// ID. The book lock must be held.
+func (ex *Exchange) clientOrder(c echo.Context) (*order_book.OrderBook, *order_book.Order, error) {
+	key := clientOrderKey{userID: c.Param("userID"), clientOrderID: c.Param("clientOrderID")}
+
+	co, ok := ex.clientIDs.get(key)
+	if !ok {
+		return nil, nil, errNotFound("order")
+	}
+
+	orderBook := ex.orderBooks[co.market]
+
+	orderBook.OrdersMu.RLock()
+	order, ok := orderBook.Orders[co.res.OrderID]
+	orderBook.OrdersMu.RUnlock()
+	if !ok {
+		return nil, nil, errNotFound("order")
+	}
+
+	return orderBook, order, nil
+}
+
+func (ex *Exchange) handleGetClientOrder(c echo.Context) error {
+	if err := authorize(c, c.Param("userID")); err != nil {
+		return err
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	_, order, err := ex.clientOrder(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, toOrder(order))
+}
+
+func (ex *Exchange) handleCancelClientOrder(c echo.Context) error {
+	if err := authorize(c, c.Param("userID")); err != nil {
+		return err
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	orderBook, order, err := ex.clientOrder(c)
+	if err != nil {
+		return err
+	}
+
+	record, _ := ex.Orders.Get(order.ID)
+	if err := checkCancelAllowed(record.Market, orderBook); err != nil {
+		return err
+	}
+
+	ex.cancelOrder(c.Request().Context(), actor(c, order.UserID), orderBook, order, OrderCancelled)
+	ex.clientIDs.release(clientOrderKey{userID: order.UserID, clientOrderID: order.ClientOrderID})
 
 	return c.JSON(http.StatusOK, map[string]any{
-		"message":  "Order deleted",
-		"order_id": order.ID,
+		"message":         "Order deleted",
+		"order_id":        order.ID,
+		"client_order_id": order.ClientOrderID,
 	})
 }
 
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	if err := ex.authorizeOrder(c, c.Param("id")); err != nil {
+		return err
+	}
+
+	order, err := ex.Orders.Get(c.Param("id"))
+	if err != nil {
+		return errNotFound("order")
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (ex *Exchange) handleGetOrderHistory(c echo.Context) error {
+	userID := c.Param("userID")
+	status := OrderStatus(c.QueryParam("status"))
+
+	if status != "" && !status.IsValid() {
+		fe := make(fieldErrors)
+		fe.add("status", fmt.Sprintf("unknown order status %q", status))
+		return fe.err()
+	}
+
+	if _, err := ex.Users.Get(userID); err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, userID); err != nil {
+		return err
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	setSequence(c.Response().Header(), ex.sessions.seq(streamKey{channel: ChannelOrders, key: userID}))
+
+	return c.JSON(http.StatusOK, ex.Orders.UserOrders(userID, status))
+}
+
 func (ex *Exchange) handleGetBestPrice(c echo.Context) error {
 	market := Market(c.Param("market"))
 	limitType := c.QueryParam("type")
 
 	orderBook, ok := ex.orderBooks[market]
 	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "market not found",
-		})
+		return errNotFound("market")
 	}
 
-	var bestPrice float64
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
 
-	if limitType == "bid" {
-		if len(orderBook.BidLimitsList()) == 0 {
-			return fmt.Errorf("no bids in the order book")
-		}
-		bestPrice = orderBook.BidLimitsList()[0].Price
-	} else if limitType == "ask" {
-		if len(orderBook.AskLimitsList()) == 0 {
-			return fmt.Errorf("no asks in the order book")
-		}
-		bestPrice = orderBook.AskLimitsList()[0].Price
-	} else {
-		return fmt.Errorf("wrong type of limit")
+	var limits []*order_book.Limit
+
+	switch limitType {
+	case "bid":
+		limits = orderBook.BidLimitsList()
+	case "ask":
+		limits = orderBook.AskLimitsList()
+	default:
+		fe := make(fieldErrors)
+		fe.add("type", "must be bid or ask")
+		return fe.err()
 	}
 
-	return c.JSON(http.StatusOK, BestPrice{Price: bestPrice})
+	if len(limits) == 0 {
+		return NewAPIError(http.StatusNotFound, CodeNotFound, fmt.Sprintf("no %ss in the order book", limitType))
+	}
+
+	return c.JSON(http.StatusOK, BestPrice{Price: limits[0].Price})
 }
 
 func (ex *Exchange) handleGetUserOrders(c echo.Context) error {
@@ -296,18 +980,21 @@ func (ex *Exchange) handleGetUserOrders(c echo.Context) error {
 
 	orderBook, ok := ex.orderBooks[market]
 	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "market not found",
-		})
+		return errNotFound("market")
 	}
 
-	userOrders := orderBook.GetUserOrders(userID)
-	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "userID not found",
-		})
+	if _, err := ex.Users.Get(userID); err != nil {
+		return errNotFound("user")
+	}
+	if err := authorize(c, userID); err != nil {
+		return err
 	}
 
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	userOrders := orderBook.GetUserOrders(userID)
+
 	userOrdersRes := &UserOrders{
 		Bids: make([]*Order, len(userOrders.Bids)),
 		Asks: make([]*Order, len(userOrders.Asks)),
@@ -329,9 +1016,54 @@ func (ex *Exchange) handleGetTrades(c echo.Context) error {
 
 	orderBook, ok := ex.orderBooks[market]
 	if !ok {
-		return c.JSON(http.StatusNotFound, map[string]string{
-			"message": "market not found",
-		})
+		return errNotFound("market")
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	setSequence(c.Response().Header(), ex.sessions.seq(streamKey{channel: ChannelTrades, key: string(market)}))
+
+	return c.JSON(http.StatusOK, ex.trades(market, orderBook))
+}
+
+// trades returns the trades of the book of market, oldest first, with their
+// fees and settlement. The book lock must be held.
+func (ex *Exchange) trades(market Market, orderBook *order_book.OrderBook) []*Trade {
+	trades := make([]*Trade, len(orderBook.Trades))
+	for i, trade := range orderBook.Trades {
+		trades[i] = ex.feeds[market].fees.tradeRes(trade)
+		trades[i].Settlement = ex.tradeSettlement(trade.ID)
+	}
+
+	return trades
+}
+
+func (ex *Exchange) tradeSettlement(tradeID string) *Settlement {
+	if settlement, ok := ex.Pipeline.Queue().TradeSettlement(tradeID); ok {
+		return &settlement
+	}
+
+	if ex.Settlement.IsPending(tradeID) {
+		return &Settlement{
+			TradeID: tradeID,
+			Status:  SettlementPending,
+		}
 	}
-	return c.JSON(http.StatusOK, orderBook.Trades)
+
+	return nil
+}
+
+func (ex *Exchange) handleGetSettlements(c echo.Context) error {
+	status := SettlementStatus(c.QueryParam("status"))
+
+	switch status {
+	case "", SettlementPending, SettlementSubmitted, SettlementConfirmed, SettlementNetted, SettlementFailed:
+	default:
+		fe := make(fieldErrors)
+		fe.add("status", fmt.Sprintf("unknown settlement status %q", status))
+		return fe.err()
+	}
+
+	return c.JSON(http.StatusOK, ex.Pipeline.Queue().List(status))
 }
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testExchange struct {
+	*Exchange
+	e       *echo.Echo
+	settler *FakeSettler
+	// apiKeys are the API keys of the registered users by user ID
+	apiKeys map[string]string
+}
+
+func newTestExchange(t *testing.T) *testExchange {
+	t.Helper()
+
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{
+		{Asset: "ETH", Settler: SettlerFake},
+	}
+
+	settler := NewFakeSettler()
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": settler})
+	te.settler = settler
+
+	return te
+}
+
+// testConfig returns the default config with settlement tuned for tests and
+// an ETH market settling only its base asset.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Markets = []MarketConfig{{Name: ETH, Base: "ETH"}}
+	cfg.Settlement = testSettlementConfig
+	cfg.Log.Level = "warn"
+	return cfg
+}
+
+// startExchange starts an exchange whose settlement runs until the test
+// ends.
+func startExchange(t *testing.T, users *UserStore, cfg Config, settlers map[Asset]Settler) *testExchange {
+	t.Helper()
+
+	settlements, err := NewSettlementQueue(filepath.Join(t.TempDir(), "settlements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	ex, err := NewExchange(cfg, users, settlements, audit, settlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ex.RunSettlement(ctx)
+
+	e := echo.New()
+	ex.Routes(e)
+
+	return &testExchange{
+		Exchange: ex,
+		e:        e,
+		apiKeys:  make(map[string]string),
+	}
+}
+
+// do sends a request to the exchange as the user it is made for and
+// decodes the response into res if it isn't nil.
+func (te *testExchange) do(t *testing.T, method, path string, body, res any) int {
+	t.Helper()
+
+	rec := te.send(t, method, path, body, nil)
+
+	if res != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+			t.Fatalf("decoding %s %s response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+
+	return rec.Code
+}
+
+func (te *testExchange) registerUser(t *testing.T) *UserRes {
+	t.Helper()
+
+	user := &UserRes{}
+	status := te.do(t, http.MethodPost, "/users", &RegisterUserReq{}, user)
+	assert(t, status, http.StatusCreated)
+	te.apiKeys[user.ID] = user.APIKey
+
+	return user
+}
+
+// apiKey returns the API key of the user a request is made for: the user
+// of its body, one named by its path or query or the owner of an order
+// named by its path. Users registered without the API get a new key.
+func (te *testExchange) apiKey(path string, body []byte) string {
+	var req struct {
+		UserID string `json:"user_id"`
+	}
+	if json.Unmarshal(body, &req) == nil && req.UserID != "" {
+		return te.userAPIKey(req.UserID)
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return ""
+	}
+	if userID := u.Query().Get("user_id"); userID != "" {
+		return te.userAPIKey(userID)
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if order, err := te.Orders.Get(segment); err == nil {
+			return te.userAPIKey(order.UserID)
+		}
+		if apiKey := te.userAPIKey(segment); apiKey != "" {
+			return apiKey
+		}
+	}
+
+	return ""
+}
+
+func (te *testExchange) userAPIKey(userID string) string {
+	if apiKey, ok := te.apiKeys[userID]; ok {
+		return apiKey
+	}
+
+	apiKey, err := te.Users.IssueAPIKey(userID)
+	if err != nil {
+		return ""
+	}
+	te.apiKeys[userID] = apiKey
+
+	return apiKey
+}
+
+// waitForTrades polls the trades of market until n trades are settled.
+func (te *testExchange) waitForTrades(t *testing.T, market Market, n int) []*Trade {
+	t.Helper()
+
+	var trades []*Trade
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		te.do(t, http.MethodGet, "/trades/"+string(market), nil, &trades)
+		if len(trades) == n && allSettled(trades) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return trades
+}
+
+func allSettled(trades []*Trade) bool {
+	for _, trade := range trades {
+		if trade.Settlement == nil || !trade.Settlement.Status.IsFinal() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestMarketOrderSettles(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	status := te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      10,
+		Price:     3500,
+	}, nil)
+	assert(t, status, http.StatusOK)
+
+	status = te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, nil)
+	assert(t, status, http.StatusOK)
+
+	te.Settlement.Flush()
+
+	trades := te.waitForTrades(t, ETH, 1)
+	assert(t, len(trades), 1)
+	assert(t, trades[0].Settlement.Status, SettlementConfirmed)
+
+	transfers := te.settler.Transfers()
+	assert(t, len(transfers), 1)
+	assert(t, transfers[0].From, seller.ID)
+	assert(t, transfers[0].To, buyer.ID)
+	assert(t, transfers[0].Amount, big.NewInt(4))
+	assert(t, len(trades[0].Settlement.Legs), 1)
+	assert(t, trades[0].Settlement.Legs[0].Ref, transfers[0].Ref)
+}
+
+func TestPlaceOrderErrors(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+
+	tests := []struct {
+		name   string
+		req    *PlaceOrderReq
+		status int
+		code   ErrorCode
+		field  string
+	}{
+		{"unknown market", &PlaceOrderReq{UserID: user.ID, Market: "DOGE", OrderType: LimitOrder, Size: 1, Price: 1}, http.StatusNotFound, CodeNotFound, ""},
+		{"unknown user", &PlaceOrderReq{UserID: "nobody", Market: ETH, OrderType: LimitOrder, Size: 1, Price: 1}, http.StatusNotFound, CodeNotFound, ""},
+		{"unknown type", &PlaceOrderReq{UserID: user.ID, Market: ETH, OrderType: "stop", Size: 1, Price: 1}, http.StatusBadRequest, CodeInvalidRequest, "type"},
+		{"zero size", &PlaceOrderReq{UserID: user.ID, Market: ETH, OrderType: LimitOrder, Price: 1}, http.StatusBadRequest, CodeInvalidRequest, "size"},
+		{"negative price", &PlaceOrderReq{UserID: user.ID, Market: ETH, OrderType: LimitOrder, Size: 1, Price: -1}, http.StatusBadRequest, CodeInvalidRequest, "price"},
+		{"no liquidity", &PlaceOrderReq{UserID: user.ID, Market: ETH, OrderType: MarketOrder, Size: 1}, http.StatusUnprocessableEntity, CodeInsufficientLiquidity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var apiErr APIError
+			status := te.do(t, http.MethodPost, "/order", tt.req, &apiErr)
+			assert(t, status, tt.status)
+			assert(t, apiErr.Code, tt.code)
+			if tt.field != "" && apiErr.Details[tt.field] == "" {
+				t.Errorf("no details for %s in %+v", tt.field, apiErr)
+			}
+		})
+	}
+}
+
+func TestBestPriceErrors(t *testing.T) {
+	te := newTestExchange(t)
+
+	var apiErr APIError
+	status := te.do(t, http.MethodGet, "/book/ETH/best-price?type=mid", nil, &apiErr)
+	assert(t, status, http.StatusBadRequest)
+	assert(t, apiErr.Code, CodeInvalidRequest)
+
+	status = te.do(t, http.MethodGet, "/book/ETH/best-price?type=bid", nil, &apiErr)
+	assert(t, status, http.StatusNotFound)
+	assert(t, apiErr.Code, CodeNotFound)
+}
+
+func TestClientOrderID(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+
+	req := &PlaceOrderReq{
+		UserID:        user.ID,
+		ClientOrderID: "order-1",
+		Market:        ETH,
+		OrderType:     LimitOrder,
+		Size:          10,
+		Price:         3500,
+	}
+
+	var first, second PlaceOrderRes
+	assert(t, te.do(t, http.MethodPost, "/order", req, &first), http.StatusOK)
+	assert(t, te.do(t, http.MethodPost, "/order", req, &second), http.StatusOK)
+	assert(t, second, first)
+	assert(t, len(te.orderBooks[ETH].Orders), 1)
+
+	var order Order
+	status := te.do(t, http.MethodGet, "/order/client/"+user.ID+"/order-1", nil, &order)
+	assert(t, status, http.StatusOK)
+	assert(t, order.ID, first.OrderID)
+	assert(t, order.ClientOrderID, "order-1")
+
+	status = te.do(t, http.MethodDelete, "/order/client/"+user.ID+"/order-1", nil, nil)
+	assert(t, status, http.StatusOK)
+	assert(t, len(te.orderBooks[ETH].Orders), 0)
+
+	status = te.do(t, http.MethodGet, "/order/client/"+user.ID+"/order-1", nil, nil)
+	assert(t, status, http.StatusNotFound)
+
+	// the ID is free again once the order is closed
+	var third PlaceOrderRes
+	assert(t, te.do(t, http.MethodPost, "/order", req, &third), http.StatusOK)
+	if third.OrderID == first.OrderID {
+		t.Error("closed client order ID placed no new order")
+	}
+
+	// an order still being placed isn't found
+	te.clientIDs.reserve(clientOrderKey{userID: user.ID, clientOrderID: "order-2"}, ETH, te.isOpen)
+	status = te.do(t, http.MethodGet, "/order/client/"+user.ID+"/order-2", nil, nil)
+	assert(t, status, http.StatusNotFound)
+}
+
+func TestClientOrderIDReleased(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	held := func(userID, clientOrderID string) bool {
+		te.clientIDs.mu.Lock()
+		defer te.clientIDs.mu.Unlock()
+
+		_, ok := te.clientIDs.orders[clientOrderKey{userID: userID, clientOrderID: clientOrderID}]
+		return ok
+	}
+	place := func(userID, clientOrderID string, orderType OrderType, isBid bool) PlaceOrderRes {
+		t.Helper()
+
+		req := &PlaceOrderReq{
+			UserID:        userID,
+			ClientOrderID: clientOrderID,
+			Market:        ETH,
+			OrderType:     orderType,
+			IsBid:         isBid,
+			Size:          1,
+		}
+		if orderType == LimitOrder {
+			req.Price = 3500
+		}
+
+		var res PlaceOrderRes
+		assert(t, te.do(t, http.MethodPost, "/order", req, &res), http.StatusOK)
+
+		return res
+	}
+
+	// filled
+	place(seller.ID, "filled", LimitOrder, false)
+	place(buyer.ID, "taker", MarketOrder, true)
+	assert(t, held(seller.ID, "filled"), false)
+
+	// cancelled by order ID
+	res := place(seller.ID, "cancelled", LimitOrder, false)
+	assert(t, te.do(t, http.MethodDelete, "/order/"+res.OrderID, nil, nil), http.StatusOK)
+	assert(t, held(seller.ID, "cancelled"), false)
+
+	// the market order keeps its ID until its TTL is over and a sweep runs
+	assert(t, held(buyer.ID, "taker"), true)
+	te.clientIDs.mu.Lock()
+	te.clientIDs.orders[clientOrderKey{userID: buyer.ID, clientOrderID: "taker"}].placed = time.Now().Add(-marketClientOrderTTL)
+	te.clientIDs.lastSweep = time.Time{}
+	te.clientIDs.mu.Unlock()
+	place(seller.ID, "resting", LimitOrder, false)
+	assert(t, held(buyer.ID, "taker"), false)
+	assert(t, held(seller.ID, "resting"), true)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	var ask, cancelled, market PlaceOrderRes
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      10,
+		Price:     3500,
+	}, &ask)
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      5,
+		Price:     3600,
+	}, &cancelled)
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, &market)
+
+	status := te.do(t, http.MethodDelete, "/order/"+cancelled.OrderID, nil, nil)
+	assert(t, status, http.StatusOK)
+
+	status = te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      100,
+	}, nil)
+	assert(t, status, http.StatusUnprocessableEntity)
+
+	var order OrderRecord
+	te.do(t, http.MethodGet, "/order/"+ask.OrderID, nil, &order)
+	assert(t, order.Status, OrderPartiallyFilled)
+	assert(t, order.Size, 10.0)
+	assert(t, order.ExecutedSize, 4.0)
+	assert(t, order.AvgFillPrice, 3500.0)
+
+	te.do(t, http.MethodGet, "/order/"+market.OrderID, nil, &order)
+	assert(t, order.Status, OrderFilled)
+	assert(t, order.Type, MarketOrder)
+
+	var history []OrderRecord
+	te.do(t, http.MethodGet, "/users/"+seller.ID+"/orders", nil, &history)
+	assert(t, len(history), 2)
+
+	te.do(t, http.MethodGet, "/users/"+seller.ID+"/orders?status=cancelled", nil, &history)
+	assert(t, len(history), 1)
+	assert(t, history[0].ID, cancelled.OrderID)
+
+	te.do(t, http.MethodGet, "/users/"+buyer.ID+"/orders?status=rejected", nil, &history)
+	assert(t, len(history), 1)
+	assert(t, history[0].Size, 100.0)
+
+	status = te.do(t, http.MethodGet, "/users/"+buyer.ID+"/orders?status=lost", nil, nil)
+	assert(t, status, http.StatusBadRequest)
+}
+
+func TestAmendOrder(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	other := te.registerUser(t)
+	orderID := te.placeLimit(t, user.ID, true, 10, 3400)
+
+	status := te.do(t, http.MethodPut, "/order/"+orderID, &AmendOrderReq{UserID: other.ID, Price: 3450}, nil)
+	assert(t, status, http.StatusNotFound)
+
+	var apiErr APIError
+	status = te.do(t, http.MethodPut, "/order/"+orderID, &AmendOrderReq{UserID: user.ID}, &apiErr)
+	assert(t, status, http.StatusBadRequest)
+	assert(t, apiErr.Code, CodeInvalidRequest)
+
+	var res AmendOrderRes
+	status = te.do(t, http.MethodPut, "/order/"+orderID, &AmendOrderReq{UserID: user.ID, Price: 3450, Size: 6}, &res)
+	assert(t, status, http.StatusOK)
+	assert(t, res.ReplacedOrderID, orderID)
+
+	var order OrderRecord
+	te.do(t, http.MethodGet, "/order/"+orderID, nil, &order)
+	assert(t, order.Status, OrderReplaced)
+
+	te.do(t, http.MethodGet, "/order/"+res.OrderID, nil, &order)
+	assert(t, order.Status, OrderNew)
+	assert(t, order.Price, 3450.0)
+	assert(t, order.Size, 6.0)
+	assert(t, len(te.orderBooks[ETH].Orders), 1)
+
+	status = te.do(t, http.MethodPut, "/order/"+orderID, &AmendOrderReq{UserID: user.ID, Price: 3500}, nil)
+	assert(t, status, http.StatusNotFound)
+}
@@ -0,0 +1,658 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/fix"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// FIXConfig configures the FIX 4.4 order entry gateway, which is served
+	// unless Addr is empty. Each session binds the CompID of a counterparty
+	// to the user its orders are placed for, the counterparty logs on with
+	// the Password of its session.
+	FIXConfig struct {
+		Addr     string             `json:"addr"`
+		CompID   string             `json:"comp_id"`
+		StoreDir string             `json:"store_dir"`
+		Sessions []FIXSessionConfig `json:"sessions,omitempty"`
+	}
+
+	FIXSessionConfig struct {
+		CompID   string `json:"comp_id"`
+		UserID   string `json:"user_id"`
+		Password string `json:"password"`
+	}
+)
+
+var DefaultFIXConfig = FIXConfig{
+	CompID:   "EXCHANGE",
+	StoreDir: "data/fix",
+}
+
+func (cfg FIXConfig) validate() error {
+	if cfg.Addr == "" {
+		return nil
+	}
+
+	var errs []error
+	if cfg.CompID == "" {
+		errs = append(errs, errors.New("fix.comp_id is empty"))
+	}
+	if cfg.StoreDir == "" {
+		errs = append(errs, errors.New("fix.store_dir is empty"))
+	}
+
+	compIDs := make(map[string]bool)
+	for i, session := range cfg.Sessions {
+		switch {
+		case session.CompID == "" || session.CompID == cfg.CompID:
+			errs = append(errs, fmt.Errorf("fix.sessions[%d]: invalid comp_id %q", i, session.CompID))
+		case compIDs[session.CompID]:
+			errs = append(errs, fmt.Errorf("fix.sessions[%d]: duplicate comp_id %s", i, session.CompID))
+		}
+		compIDs[session.CompID] = true
+
+		if session.UserID == "" {
+			errs = append(errs, fmt.Errorf("fix.sessions[%d]: user_id is empty", i))
+		}
+		if len(session.Password) < minFIXPasswordLength {
+			errs = append(errs, fmt.Errorf("fix.sessions[%d]: password must be at least %d characters", i, minFIXPasswordLength))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ExecType, OrdStatus and reject reason values of the order entry messages.
+const (
+	fixExecNew      = "0"
+	fixExecCanceled = "4"
+	fixExecReplaced = "5"
+	fixExecRejected = "8"
+	fixExecExpired  = "C"
+	fixExecTrade    = "F"
+
+	fixOrdRejUnknownSymbol = 1
+	fixOrdRejDuplicate     = 6
+	fixOrdRejOther         = 99
+
+	fixCxlRejTooLate      = 0
+	fixCxlRejUnknownOrder = 1
+	fixCxlRejDuplicate    = 6
+	fixCxlRejOther        = 99
+
+	fixCxlRejToCancel  = "1"
+	fixCxlRejToReplace = "2"
+
+	// fixBusinessRejUnsupported is the BusinessRejectReason of message types
+	// the gateway doesn't handle.
+	fixBusinessRejUnsupported = 3
+
+	// fixQueueSize is the number of requests a session can have waiting.
+	fixQueueSize = 64
+
+	minFIXPasswordLength = 16
+)
+
+// FIXAcceptor returns the FIX order entry gateway of the exchange. Its
+// sessions place, cancel and replace orders of their users with
+// NewOrderSingle, OrderCancelRequest and OrderCancelReplaceRequest and are
+// told about every change to the orders of their users with
+// ExecutionReports, including the orders placed over the other APIs.
+func (ex *Exchange) FIXAcceptor(cfg FIXConfig) *fix.Acceptor {
+	gw := &fixGateway{
+		ex:       ex,
+		users:    make(map[string]string),
+		sessions: make(map[*fix.Session]*fixSession),
+	}
+
+	counterparties := make(map[string]string, len(cfg.Sessions))
+	for _, session := range cfg.Sessions {
+		gw.users[session.CompID] = session.UserID
+		counterparties[session.CompID] = session.Password
+	}
+
+	return fix.NewAcceptor(fix.AcceptorConfig{
+		CompID:         cfg.CompID,
+		StoreDir:       cfg.StoreDir,
+		Counterparties: counterparties,
+		Logger:         ex.log,
+	}, gw)
+}
+
+// fixGateway is the application of the FIX sessions.
+type fixGateway struct {
+	ex    *Exchange
+	users map[string]string
+
+	mu       sync.Mutex
+	sessions map[*fix.Session]*fixSession
+}
+
+// fixSession runs the orders of a logged on FIX session. A single goroutine
+// handles the requests of the session and the changes to the orders of its
+// user, so the ExecutionReports go out in the order of the changes and the
+// changes a request made are told apart from the others.
+type fixSession struct {
+	ex       *Exchange
+	s        *fix.Session
+	userID   string
+	log      *slog.Logger
+	sub      *wsClient
+	requests chan *fix.Message
+	dropped  chan struct{}
+	stop     chan struct{}
+	// orders holds the last state of the open orders of the user, to tell
+	// the size and price of their fills
+	orders map[string]OrderRecord
+}
+
+// fixRequest is the cancel or replace request whose changes are being
+// reported.
+type fixRequest struct {
+	msgType     string
+	clOrdID     string
+	origClOrdID string
+	orderID     string
+}
+
+func (gw *fixGateway) OnLogon(s *fix.Session) {
+	userID := gw.users[s.TargetCompID()]
+	fs := &fixSession{
+		ex:       gw.ex,
+		s:        s,
+		userID:   userID,
+		log:      gw.ex.log.With("fix_comp_id", s.TargetCompID(), "user_id", userID),
+		requests: make(chan *fix.Message, fixQueueSize),
+		dropped:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		orders:   make(map[string]OrderRecord),
+	}
+	var once sync.Once
+	fs.sub = newStreamClient(userID, func() { once.Do(func() { close(fs.dropped) }) })
+
+	gw.ex.bookMu.Lock()
+	gw.ex.sessions.subscribe(fs.sub, streamKey{channel: ChannelOrders, key: userID})
+	for _, order := range gw.ex.Orders.UserOrders(userID, "") {
+		if order.Status.IsOpen() {
+			fs.orders[order.ID] = order
+		}
+	}
+	gw.ex.bookMu.Unlock()
+
+	gw.mu.Lock()
+	gw.sessions[s] = fs
+	gw.mu.Unlock()
+
+	go fs.run()
+}
+
+func (gw *fixGateway) OnLogout(s *fix.Session) {
+	gw.mu.Lock()
+	fs, ok := gw.sessions[s]
+	delete(gw.sessions, s)
+	gw.mu.Unlock()
+
+	if ok {
+		close(fs.stop)
+	}
+}
+
+func (gw *fixGateway) FromApp(s *fix.Session, msg *fix.Message) {
+	gw.mu.Lock()
+	fs, ok := gw.sessions[s]
+	gw.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	select {
+	case fs.requests <- msg:
+	case <-fs.stop:
+	}
+}
+
+func (fs *fixSession) run() {
+	defer fs.ex.sessions.remove(fs.sub)
+
+	for {
+		select {
+		case <-fs.stop:
+			return
+		case <-fs.dropped:
+			fs.log.Warn("fix session can't keep up with its order updates")
+			fs.s.Logout("order updates can't keep up")
+			return
+		case msg := <-fs.requests:
+			fs.handle(msg)
+		case v := <-fs.sub.out:
+			fs.report(v.(WSEvent).Data.(OrderRecord), nil)
+		}
+	}
+}
+
+// drain reports the changes queued for the session, which include every
+// change req made once it returned. It tells whether one of them was to the
+// order req names by its ClOrdID.
+func (fs *fixSession) drain(req *fixRequest) bool {
+	var seen bool
+	for {
+		select {
+		case v := <-fs.sub.out:
+			order := v.(WSEvent).Data.(OrderRecord)
+			if order.ClientOrderID == req.clOrdID || order.ID == req.orderID {
+				seen = true
+			}
+			fs.report(order, req)
+		default:
+			return seen
+		}
+	}
+}
+
+func (fs *fixSession) handle(msg *fix.Message) {
+	ctx := withPrincipal(withRequest(context.Background(), uuid.NewString(), fs.log), fs.userID)
+
+	switch msg.Type() {
+	case fix.MsgNewOrderSingle:
+		fs.newOrder(ctx, msg)
+	case fix.MsgOrderCancelRequest:
+		fs.cancelOrder(ctx, msg)
+	case fix.MsgOrderCancelReplaceRequest:
+		fs.replaceOrder(ctx, msg)
+	default:
+		fs.send(fix.NewMessage(fix.MsgBusinessMessageReject).
+			SetInt(fix.TagRefSeqNum, msg.SeqNum()).
+			Set(fix.TagRefMsgType, msg.Type()).
+			SetInt(fix.TagBusinessRejectReason, fixBusinessRejUnsupported).
+			Set(fix.TagText, "unsupported message type"))
+	}
+}
+
+func (fs *fixSession) send(msg *fix.Message) {
+	if err := fs.s.Send(msg); err != nil {
+		fs.log.Warn("sending fix message", "msg_type", msg.Type(), "error", err)
+	}
+}
+
+// reject answers a message that can't be parsed with a session level
+// Reject.
+func (fs *fixSession) reject(msg *fix.Message, err error) {
+	if err := fs.s.Reject(msg, err); err != nil {
+		fs.log.Warn("sending fix reject", "error", err)
+	}
+}
+
+func (fs *fixSession) newOrder(ctx context.Context, msg *fix.Message) {
+	data, err := fixPlaceOrderReq(msg, fs.userID)
+	if err != nil {
+		fs.reject(msg, err)
+		return
+	}
+
+	if err := data.Validate(); err != nil {
+		fs.rejectOrder(data, fixOrdRejOther, fs.text(err))
+		return
+	}
+
+	orderBook, err := fs.ex.checkOrder(data)
+	if err != nil {
+		reason := fixOrdRejOther
+		if _, ok := fs.ex.orderBooks[data.Market]; !ok {
+			reason = fixOrdRejUnknownSymbol
+		}
+		fs.rejectOrder(data, reason, fs.text(err))
+		return
+	}
+
+	if fs.ex.limiter != nil && !fs.ex.limiter.takeOrder(data.UserID, data.Market).allowed {
+		fs.ex.metrics.order(data.Market, data.OrderType, orderRejected)
+		fs.rejectOrder(data, fixOrdRejOther, errRateLimit().Message)
+		return
+	}
+
+	// a ClOrdID in use would return the order holding it
+	key := clientOrderKey{userID: data.UserID, clientOrderID: data.ClientOrderID}
+	if fs.ex.clientIDs.inUse(key, fs.ex.isOpen) {
+		fs.rejectOrder(data, fixOrdRejDuplicate, "duplicate ClOrdID")
+		return
+	}
+
+	_, err = fs.ex.placeOrder(ctx, orderBook, data)
+	if reported := fs.drain(&fixRequest{msgType: fix.MsgNewOrderSingle, clOrdID: data.ClientOrderID}); err != nil && !reported {
+		fs.rejectOrder(data, fixOrdRejOther, fs.text(err))
+	}
+}
+
+// rejectOrder answers a NewOrderSingle the exchange turned away before
+// recording it.
+func (fs *fixSession) rejectOrder(data PlaceOrderReq, reason int, text string) {
+	report := fixExecutionReport(OrderRecord{
+		ClientOrderID: data.ClientOrderID,
+		Market:        data.Market,
+		Type:          data.OrderType,
+		IsBid:         data.IsBid,
+		Price:         data.Price,
+		Size:          data.Size,
+		Status:        OrderRejected,
+		Reason:        text,
+	}, fixExecRejected)
+	report.Set(fix.TagOrderID, "NONE").SetInt(fix.TagOrdRejReason, reason)
+
+	fs.send(report)
+}
+
+func (fs *fixSession) cancelOrder(ctx context.Context, msg *fix.Message) {
+	req, record, err := fs.request(msg)
+	if err != nil {
+		fs.reject(msg, err)
+		return
+	}
+	if record == nil {
+		fs.cancelReject(req, nil, fixCxlRejUnknownOrder, "unknown order")
+		return
+	}
+	if !record.Status.IsOpen() {
+		fs.cancelReject(req, record, fixCxlRejTooLate, "order is "+string(record.Status))
+		return
+	}
+
+	err = fs.ex.cancelOrderByID(ctx, fs.userID, record.ID)
+	if reported := fs.drain(req); err != nil && !reported {
+		fs.cancelReject(req, record, fixCxlRejTooLate, fs.text(err))
+	}
+}
+
+// replaceOrder amends the price or quantity of an open limit order. The
+// replacement is a new order with the ClOrdID of the request, OrderQty is
+// its size plus what the order it replaces already executed.
+func (fs *fixSession) replaceOrder(ctx context.Context, msg *fix.Message) {
+	req, record, err := fs.request(msg)
+	if err != nil {
+		fs.reject(msg, err)
+		return
+	}
+	qty, err := msg.Float(fix.TagOrderQty)
+	if err != nil {
+		fs.reject(msg, err)
+		return
+	}
+	var price float64
+	if msg.Has(fix.TagPrice) {
+		if price, err = msg.Float(fix.TagPrice); err != nil {
+			fs.reject(msg, err)
+			return
+		}
+	}
+
+	if record == nil {
+		fs.cancelReject(req, nil, fixCxlRejUnknownOrder, "unknown order")
+		return
+	}
+	if !record.Status.IsOpen() {
+		fs.cancelReject(req, record, fixCxlRejTooLate, "order is "+string(record.Status))
+		return
+	}
+	if req.clOrdID != req.origClOrdID && fs.ex.clientIDs.inUse(clientOrderKey{userID: fs.userID, clientOrderID: req.clOrdID}, fs.ex.isOpen) {
+		fs.cancelReject(req, record, fixCxlRejDuplicate, "duplicate ClOrdID")
+		return
+	}
+
+	data := AmendOrderReq{
+		UserID:        fs.userID,
+		ClientOrderID: req.clOrdID,
+		Price:         price,
+		Size:          qty - record.ExecutedSize,
+	}
+	if err := data.Validate(); err != nil {
+		fs.cancelReject(req, record, fixCxlRejOther, fs.text(err))
+		return
+	}
+
+	_, err = fs.ex.amendOrder(ctx, fs.userID, record.ID, data)
+	fs.drain(req)
+	if err != nil {
+		fs.cancelReject(req, record, fixCxlRejOther, fs.text(err))
+	}
+}
+
+// request reads the ClOrdID and OrigClOrdID of a cancel or replace request
+// and finds the order of the user it is for, by its OrderID if given.
+// record is nil if there is no such order.
+func (fs *fixSession) request(msg *fix.Message) (*fixRequest, *OrderRecord, error) {
+	clOrdID, err := msg.Required(fix.TagClOrdID)
+	if err != nil {
+		return nil, nil, err
+	}
+	origClOrdID, err := msg.Required(fix.TagOrigClOrdID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &fixRequest{
+		msgType:     msg.Type(),
+		clOrdID:     clOrdID,
+		origClOrdID: origClOrdID,
+		orderID:     msg.Get(fix.TagOrderID),
+	}
+
+	if req.orderID == "" {
+		co, ok := fs.ex.clientIDs.get(clientOrderKey{userID: fs.userID, clientOrderID: origClOrdID})
+		if !ok {
+			return req, nil, nil
+		}
+		req.orderID = co.res.OrderID
+	}
+
+	record, err := fs.ex.Orders.Get(req.orderID)
+	if err != nil || record.UserID != fs.userID {
+		return req, nil, nil
+	}
+
+	return req, &record, nil
+}
+
+// text describes err for the Text of a reject, with the invalid fields of
+// the request.
+func (fs *fixSession) text(err error) string {
+	apiErr := toAPIError(err)
+	if apiErr.Code == CodeInternal {
+		fs.log.Error("internal error", "error", err)
+	}
+
+	fields := make([]string, 0, len(apiErr.Details))
+	for field, problem := range apiErr.Details {
+		fields = append(fields, field+" "+problem)
+	}
+	if len(fields) == 0 {
+		return apiErr.Message
+	}
+	sort.Strings(fields)
+
+	return apiErr.Message + ": " + strings.Join(fields, ", ")
+}
+
+func (fs *fixSession) cancelReject(req *fixRequest, record *OrderRecord, reason int, text string) {
+	msg := fix.NewMessage(fix.MsgOrderCancelReject).
+		Set(fix.TagOrderID, "NONE").
+		Set(fix.TagClOrdID, req.clOrdID).
+		Set(fix.TagOrigClOrdID, req.origClOrdID).
+		Set(fix.TagOrdStatus, fixOrdStatus(OrderRejected)).
+		SetInt(fix.TagCxlRejReason, reason).
+		Set(fix.TagText, text)
+	if record != nil {
+		msg.Set(fix.TagOrderID, record.ID).Set(fix.TagOrdStatus, fixOrdStatus(record.Status))
+	}
+
+	if req.msgType == fix.MsgOrderCancelReplaceRequest {
+		msg.Set(fix.TagCxlRejResponseTo, fixCxlRejToReplace)
+	} else {
+		msg.Set(fix.TagCxlRejResponseTo, fixCxlRejToCancel)
+	}
+
+	fs.send(msg)
+}
+
+// report sends the ExecutionReport of a change to an order of the user. req
+// is the cancel or replace request being handled, if any, whose ClOrdID the
+// change it made is reported with.
+func (fs *fixSession) report(order OrderRecord, req *fixRequest) {
+	prev, known := fs.orders[order.ID]
+	if order.Status.IsOpen() {
+		fs.orders[order.ID] = order
+	} else {
+		delete(fs.orders, order.ID)
+	}
+
+	var report *fix.Message
+	switch {
+	case order.Status == OrderReplaced:
+		// told with the replacement
+		return
+	case order.Status == OrderRejected:
+		report = fixExecutionReport(order, fixExecRejected).SetInt(fix.TagOrdRejReason, fixOrdRejOther)
+	case !known:
+		report = fixExecutionReport(order, fixExecNew)
+		if req != nil && req.msgType == fix.MsgOrderCancelReplaceRequest && order.ClientOrderID == req.clOrdID && order.ID != req.orderID {
+			report = fixExecutionReport(order, fixExecReplaced).Set(fix.TagOrigClOrdID, req.origClOrdID)
+		}
+	case order.ExecutedSize > prev.ExecutedSize:
+		lastQty := order.ExecutedSize - prev.ExecutedSize
+		lastPx := (order.AvgFillPrice*order.ExecutedSize - prev.AvgFillPrice*prev.ExecutedSize) / lastQty
+		report = fixExecutionReport(order, fixExecTrade).
+			SetFloat(fix.TagLastQty, lastQty).
+			SetFloat(fix.TagLastPx, lastPx)
+	case order.Status == OrderCancelled:
+		report = fixExecutionReport(order, fixExecCanceled)
+		if req != nil && req.msgType == fix.MsgOrderCancelRequest && order.ID == req.orderID {
+			report.Set(fix.TagClOrdID, req.clOrdID).Set(fix.TagOrigClOrdID, order.ClientOrderID)
+		}
+	case order.Status == OrderExpired:
+		report = fixExecutionReport(order, fixExecExpired)
+	default:
+		return
+	}
+
+	fs.send(report)
+}
+
+func fixExecutionReport(order OrderRecord, execType string) *fix.Message {
+	var leaves float64
+	if order.Status.IsOpen() {
+		leaves = order.Size - order.ExecutedSize
+	}
+
+	msg := fix.NewMessage(fix.MsgExecutionReport).
+		Set(fix.TagOrderID, order.ID).
+		Set(fix.TagExecID, uuid.NewString()).
+		Set(fix.TagExecType, execType).
+		Set(fix.TagOrdStatus, fixOrdStatus(order.Status)).
+		Set(fix.TagSymbol, string(order.Market)).
+		Set(fix.TagSide, fixSide(order.IsBid)).
+		SetFloat(fix.TagOrderQty, order.Size).
+		SetFloat(fix.TagLeavesQty, leaves).
+		SetFloat(fix.TagCumQty, order.ExecutedSize).
+		SetFloat(fix.TagAvgPx, order.AvgFillPrice).
+		SetTime(fix.TagTransactTime, order.UpdatedAt)
+
+	if order.ClientOrderID != "" {
+		msg.Set(fix.TagClOrdID, order.ClientOrderID)
+	}
+	switch order.Type {
+	case LimitOrder:
+		msg.Set(fix.TagOrdType, "2").SetFloat(fix.TagPrice, order.Price)
+	case MarketOrder:
+		msg.Set(fix.TagOrdType, "1")
+	}
+	if order.Reason != "" {
+		msg.Set(fix.TagText, order.Reason)
+	}
+
+	return msg
+}
+
+func fixOrdStatus(status OrderStatus) string {
+	switch status {
+	case OrderNew:
+		return "0"
+	case OrderPartiallyFilled:
+		return "1"
+	case OrderFilled:
+		return "2"
+	case OrderCancelled:
+		return "4"
+	case OrderReplaced:
+		return "5"
+	case OrderExpired:
+		return "C"
+	default:
+		return "8"
+	}
+}
+
+func fixSide(isBid bool) string {
+	if isBid {
+		return "1"
+	}
+	return "2"
+}
+
+// fixPlaceOrderReq reads a NewOrderSingle. Only good-till-cancel limit and
+// market orders are supported.
+func fixPlaceOrderReq(msg *fix.Message, userID string) (PlaceOrderReq, error) {
+	data := PlaceOrderReq{UserID: userID}
+
+	var err error
+	if data.ClientOrderID, err = msg.Required(fix.TagClOrdID); err != nil {
+		return data, err
+	}
+
+	symbol, err := msg.Required(fix.TagSymbol)
+	if err != nil {
+		return data, err
+	}
+	data.Market = Market(symbol)
+
+	switch side := msg.Get(fix.TagSide); side {
+	case "1":
+		data.IsBid = true
+	case "2":
+	case "":
+		return data, &fix.FieldError{Tag: fix.TagSide, Reason: fix.RejectRequiredTagMissing}
+	default:
+		return data, &fix.FieldError{Tag: fix.TagSide, Reason: fix.RejectValueIncorrect}
+	}
+
+	if data.Size, err = msg.Float(fix.TagOrderQty); err != nil {
+		return data, err
+	}
+
+	switch ordType := msg.Get(fix.TagOrdType); ordType {
+	case "1":
+		data.OrderType = MarketOrder
+	case "2":
+		data.OrderType = LimitOrder
+		if data.Price, err = msg.Float(fix.TagPrice); err != nil {
+			return data, err
+		}
+	case "":
+		return data, &fix.FieldError{Tag: fix.TagOrdType, Reason: fix.RejectRequiredTagMissing}
+	default:
+		return data, &fix.FieldError{Tag: fix.TagOrdType, Reason: fix.RejectValueIncorrect}
+	}
+
+	// day orders rest until cancelled like the rest
+	if tif := msg.Get(fix.TagTimeInForce); tif != "" && tif != "0" && tif != "1" {
+		return data, &fix.FieldError{Tag: fix.TagTimeInForce, Reason: fix.RejectValueIncorrect}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto_exchange/fix"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fixClient is the local initiator of the tests, it hands the messages it
+// gets to the test.
+type fixClient struct {
+	*fix.Session
+	msgs chan *fix.Message
+}
+
+func (c *fixClient) OnLogon(*fix.Session)                     {}
+func (c *fixClient) OnLogout(*fix.Session)                    {}
+func (c *fixClient) FromApp(_ *fix.Session, msg *fix.Message) { c.msgs <- msg }
+
+func (c *fixClient) next(t *testing.T) *fix.Message {
+	t.Helper()
+
+	select {
+	case msg := <-c.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+func dialFIX(t *testing.T, te *testExchange, userID string) *fixClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptor := te.FIXAcceptor(FIXConfig{
+		CompID:   "EXCHANGE",
+		StoreDir: t.TempDir(),
+		Sessions: []FIXSessionConfig{{CompID: "CLIENT", UserID: userID, Password: "client-password"}},
+	})
+	go acceptor.Serve(lis)
+	t.Cleanup(func() { acceptor.Close() })
+
+	store, err := fix.OpenStore(t.TempDir(), "CLIENT-EXCHANGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	c := &fixClient{msgs: make(chan *fix.Message, 100)}
+	c.Session, err = fix.Dial(lis.Addr().String(), fix.SessionConfig{
+		SenderCompID: "CLIENT",
+		TargetCompID: "EXCHANGE",
+		HeartBtInt:   time.Second,
+		Password:     "client-password",
+	}, store, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout("") })
+
+	return c
+}
+
+func fixFloat(t *testing.T, msg *fix.Message, tag fix.Tag) float64 {
+	t.Helper()
+
+	v, err := msg.Float(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestFIXOrders(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	buyer := te.registerUser(t)
+	c := dialFIX(t, te, user.ID)
+
+	assert(t, c.Send(fix.NewMessage(fix.MsgNewOrderSingle).
+		Set(fix.TagClOrdID, "order-1").
+		Set(fix.TagSymbol, string(ETH)).
+		Set(fix.TagSide, "2").
+		SetFloat(fix.TagOrderQty, 10).
+		Set(fix.TagOrdType, "2").
+		SetFloat(fix.TagPrice, 3500).
+		SetTime(fix.TagTransactTime, time.Now())), nil)
+
+	ack := c.next(t)
+	assert(t, ack.Type(), fix.MsgExecutionReport)
+	assert(t, ack.Get(fix.TagExecType), "0")
+	assert(t, ack.Get(fix.TagOrdStatus), "0")
+	assert(t, ack.Get(fix.TagClOrdID), "order-1")
+	assert(t, fixFloat(t, ack, fix.TagLeavesQty), 10.0)
+	orderID := ack.Get(fix.TagOrderID)
+
+	// fills of orders placed over the other APIs are reported too
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, nil)
+
+	fill := c.next(t)
+	assert(t, fill.Get(fix.TagExecType), "F")
+	assert(t, fill.Get(fix.TagOrdStatus), "1")
+	assert(t, fill.Get(fix.TagOrderID), orderID)
+	assert(t, fixFloat(t, fill, fix.TagLastQty), 4.0)
+	assert(t, fixFloat(t, fill, fix.TagLastPx), 3500.0)
+	assert(t, fixFloat(t, fill, fix.TagCumQty), 4.0)
+	assert(t, fixFloat(t, fill, fix.TagLeavesQty), 6.0)
+
+	assert(t, c.Send(fix.NewMessage(fix.MsgOrderCancelReplaceRequest).
+		Set(fix.TagClOrdID, "order-2").
+		Set(fix.TagOrigClOrdID, "order-1").
+		Set(fix.TagSymbol, string(ETH)).
+		Set(fix.TagSide, "2").
+		SetFloat(fix.TagOrderQty, 12).
+		Set(fix.TagOrdType, "2").
+		SetFloat(fix.TagPrice, 3600)), nil)
+
+	replaced := c.next(t)
+	assert(t, replaced.Get(fix.TagExecType), "5")
+	assert(t, replaced.Get(fix.TagClOrdID), "order-2")
+	assert(t, replaced.Get(fix.TagOrigClOrdID), "order-1")
+	assert(t, fixFloat(t, replaced, fix.TagPrice), 3600.0)
+	assert(t, fixFloat(t, replaced, fix.TagLeavesQty), 8.0)
+	replacementID := replaced.Get(fix.TagOrderID)
+
+	assert(t, c.Send(fix.NewMessage(fix.MsgOrderCancelRequest).
+		Set(fix.TagClOrdID, "cancel-1").
+		Set(fix.TagOrigClOrdID, "order-2")), nil)
+
+	cancelled := c.next(t)
+	assert(t, cancelled.Get(fix.TagExecType), "4")
+	assert(t, cancelled.Get(fix.TagOrderID), replacementID)
+	assert(t, cancelled.Get(fix.TagClOrdID), "cancel-1")
+	assert(t, cancelled.Get(fix.TagOrigClOrdID), "order-2")
+	assert(t, fixFloat(t, cancelled, fix.TagLeavesQty), 0.0)
+
+	record, err := te.Orders.Get(replacementID)
+	assert(t, err, nil)
+	assert(t, record.Status, OrderCancelled)
+}
+
+func TestFIXRejects(t *testing.T) {
+	te := newTestExchange(t)
+	user := te.registerUser(t)
+	c := dialFIX(t, te, user.ID)
+
+	order := func(clOrdID, symbol string) *fix.Message {
+		return fix.NewMessage(fix.MsgNewOrderSingle).
+			Set(fix.TagClOrdID, clOrdID).
+			Set(fix.TagSymbol, symbol).
+			Set(fix.TagSide, "1").
+			SetFloat(fix.TagOrderQty, 1).
+			Set(fix.TagOrdType, "2").
+			SetFloat(fix.TagPrice, 3000)
+	}
+
+	assert(t, c.Send(order("order-1", "DOGE")), nil)
+	rejected := c.next(t)
+	assert(t, rejected.Get(fix.TagExecType), "8")
+	assert(t, rejected.Get(fix.TagOrderID), "NONE")
+	assert(t, rejected.Get(fix.TagOrdRejReason), "1")
+
+	assert(t, c.Send(order("order-1", string(ETH))), nil)
+	assert(t, c.next(t).Get(fix.TagExecType), "0")
+
+	// the ClOrdID of an open order can't be reused
+	assert(t, c.Send(order("order-1", string(ETH))), nil)
+	rejected = c.next(t)
+	assert(t, rejected.Get(fix.TagExecType), "8")
+	assert(t, rejected.Get(fix.TagOrdRejReason), "6")
+
+	assert(t, c.Send(fix.NewMessage(fix.MsgOrderCancelRequest).
+		Set(fix.TagClOrdID, "cancel-1").
+		Set(fix.TagOrigClOrdID, "unknown")), nil)
+	cancelRejected := c.next(t)
+	assert(t, cancelRejected.Type(), fix.MsgOrderCancelReject)
+	assert(t, cancelRejected.Get(fix.TagCxlRejReason), "1")
+	assert(t, cancelRejected.Get(fix.TagCxlRejResponseTo), "1")
+
+	assert(t, c.Send(fix.NewMessage("AE")), nil)
+	businessRejected := c.next(t)
+	assert(t, businessRejected.Type(), fix.MsgBusinessMessageReject)
+	assert(t, businessRejected.Get(fix.TagRefMsgType), "AE")
+}
@@ -0,0 +1,614 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/exchangepb"
+	"fmt"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MetadataUserID names the user a gRPC call says it is made for, like
+	// the X-User-ID header of the REST API.
+	MetadataUserID = "x-user-id"
+	// MetadataAPIKey carries the API key of the user a gRPC call is made
+	// for, like the X-API-Key header of the REST API.
+	MetadataAPIKey = "x-api-key"
+	// MetadataRequestID carries the ID of a gRPC call, like the X-Request-ID
+	// header of the REST API.
+	MetadataRequestID = "x-request-id"
+	// MetadataRetryAfter tells a rate limited call how many seconds to wait
+	// before trying again.
+	MetadataRetryAfter = "retry-after"
+	// MetadataSubscribed is set in the header of a stream once it is
+	// subscribed, a stream whose header lacks it was rejected.
+	MetadataSubscribed = "x-subscribed"
+
+	// ErrorDomain is the domain of the google.rpc.ErrorInfo of gRPC errors,
+	// its metadata holds the HTTP status of the error under
+	// ErrorMetadataStatus.
+	ErrorDomain         = "crypto_exchange"
+	ErrorMetadataStatus = "http_status"
+)
+
+// grpcServer serves the gRPC API, sharing the books, order store and
+// streams of the exchange with the REST API.
+type grpcServer struct {
+	exchangepb.UnimplementedExchangeServer
+	ex *Exchange
+}
+
+// GRPCServer returns a gRPC server of the exchange API. Calls are logged
+// like REST requests, authenticated by their API key and errors are
+// converted to gRPC statuses.
+func (ex *Exchange) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(ex.grpcUnaryLogger),
+		grpc.ChainStreamInterceptor(ex.grpcStreamLogger),
+	)
+
+	s := grpc.NewServer(opts...)
+	exchangepb.RegisterExchangeServer(s, &grpcServer{ex: ex})
+
+	return s
+}
+
+// grpcCall tags a call with an ID, taken from the x-request-id metadata if
+// the client sent one, authenticates it and returns the context carrying
+// both. done logs the call and converts its error, the error of the
+// authentication if it failed.
+func (ex *Exchange) grpcCall(ctx context.Context, method string) (context.Context, func(err error) error, error) {
+	id := metadataValue(ctx, MetadataRequestID)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(MetadataRequestID, id))
+
+	logger := ex.log.With("request_id", id)
+	ctx = withClaimedUser(withRequest(ctx, id, logger), metadataValue(ctx, MetadataUserID))
+	ctx, authErr := ex.grpcAuthenticate(ctx)
+	start := time.Now()
+
+	return ctx, func(err error) error {
+		err = grpcError(ctx, err)
+		code := status.Code(err)
+
+		level := slog.LevelInfo
+		if code == codes.Internal {
+			level = slog.LevelError
+		}
+
+		logger.LogAttrs(ctx, level, "grpc call",
+			slog.String("method", method),
+			slog.String("code", code.String()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user_id", principalFrom(ctx)),
+			slog.String("claimed_user_id", claimedUser(ctx)),
+		)
+
+		return err
+	}, authErr
+}
+
+func (ex *Exchange) grpcUnaryLogger(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, done, err := ex.grpcCall(ctx, info.FullMethod)
+	if err != nil {
+		return nil, done(err)
+	}
+	res, err := handler(ctx, req)
+
+	return res, done(err)
+}
+
+func (ex *Exchange) grpcStreamLogger(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, done, err := ex.grpcCall(ss.Context(), info.FullMethod)
+	if err != nil {
+		return done(err)
+	}
+
+	return done(handler(srv, &serverStream{ServerStream: ss, ctx: ctx}))
+}
+
+// grpcAuthenticate returns ctx carrying the user of the API key of a call.
+// A call with an invalid key is rejected, one without goes on
+// unauthenticated.
+func (ex *Exchange) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	apiKey := metadataValue(ctx, MetadataAPIKey)
+	if apiKey == "" {
+		return ctx, nil
+	}
+
+	user, err := ex.Users.Authenticate(apiKey)
+	if err != nil {
+		return ctx, NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "invalid API key")
+	}
+
+	return withPrincipal(ctx, user.ID), nil
+}
+
+// serverStream is a stream with the context of its call.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// grpcError converts an error of the exchange to a gRPC status. The status
+// carries the code and HTTP status of the error in a google.rpc.ErrorInfo
+// and the invalid fields of the request in a google.rpc.BadRequest.
+func grpcError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	apiErr := toAPIError(err)
+	if apiErr.Code == CodeInternal {
+		loggerFrom(ctx).Error("internal error", "error", err)
+	}
+
+	st := status.New(grpcCode(apiErr.Status), apiErr.Message)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{
+		Reason:   string(apiErr.Code),
+		Domain:   ErrorDomain,
+		Metadata: map[string]string{ErrorMetadataStatus: strconv.Itoa(apiErr.Status)},
+	}}
+	if len(apiErr.Details) > 0 {
+		badRequest := &errdetails.BadRequest{}
+		for field, problem := range apiErr.Details {
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       field,
+				Description: problem,
+			})
+		}
+		details = append(details, badRequest)
+	}
+
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+
+	return st.Err()
+}
+
+func grpcCode(httpStatus int) codes.Code {
+	switch {
+	case httpStatus == http.StatusBadRequest:
+		return codes.InvalidArgument
+	case httpStatus == http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case httpStatus == http.StatusForbidden:
+		return codes.PermissionDenied
+	case httpStatus == http.StatusNotFound:
+		return codes.NotFound
+	case httpStatus == http.StatusConflict, httpStatus == http.StatusUnprocessableEntity:
+		return codes.FailedPrecondition
+	case httpStatus == http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case httpStatus >= http.StatusInternalServerError:
+		return codes.Internal
+	default:
+		return codes.Unknown
+	}
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// allowOrder takes a token from the order bucket of the user in market.
+func (s *grpcServer) allowOrder(ctx context.Context, userID string, market Market) error {
+	if s.ex.limiter == nil {
+		return nil
+	}
+
+	result := s.ex.limiter.takeOrder(userID, market)
+	if result.allowed {
+		return nil
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(MetadataRetryAfter, strconv.Itoa(retrySeconds(result.retryAfter))))
+
+	return errRateLimit()
+}
+
+func (s *grpcServer) PlaceOrder(ctx context.Context, req *exchangepb.PlaceOrderRequest) (*exchangepb.PlaceOrderResponse, error) {
+	data := PlaceOrderReq{
+		UserID:        req.UserId,
+		ClientOrderID: req.ClientOrderId,
+		Market:        Market(req.Market),
+		OrderType:     OrderType(req.Type),
+		IsBid:         req.IsBid,
+		Size:          req.Size,
+		Price:         req.Price,
+	}
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+
+	orderBook, err := s.ex.checkOrder(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUser(principalFrom(ctx), false, data.UserID); err != nil {
+		s.ex.metrics.order(data.Market, data.OrderType, orderRejected)
+		return nil, err
+	}
+
+	if err := s.allowOrder(ctx, data.UserID, data.Market); err != nil {
+		s.ex.metrics.order(data.Market, data.OrderType, orderRejected)
+		return nil, err
+	}
+
+	res, err := s.ex.placeOrder(ctx, orderBook, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exchangepb.PlaceOrderResponse{
+		Message:       res.Message,
+		OrderId:       res.OrderID,
+		ClientOrderId: res.ClientOrderID,
+	}, nil
+}
+
+func (s *grpcServer) CancelOrder(ctx context.Context, req *exchangepb.CancelOrderRequest) (*exchangepb.CancelOrderResponse, error) {
+	fe := make(fieldErrors)
+	fe.required("order_id", req.OrderId)
+	if err := fe.err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.ex.checkOrderUser(principalFrom(ctx), false, req.OrderId); err != nil {
+		return nil, err
+	}
+
+	if err := s.ex.cancelOrderByID(ctx, principalFrom(ctx), req.OrderId); err != nil {
+		return nil, err
+	}
+
+	return &exchangepb.CancelOrderResponse{
+		Message: "Order deleted",
+		OrderId: req.OrderId,
+	}, nil
+}
+
+func (s *grpcServer) AmendOrder(ctx context.Context, req *exchangepb.AmendOrderRequest) (*exchangepb.AmendOrderResponse, error) {
+	data := AmendOrderReq{
+		UserID:        req.UserId,
+		ClientOrderID: req.ClientOrderId,
+		Price:         req.Price,
+		Size:          req.Size,
+	}
+	if err := data.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkUser(principalFrom(ctx), false, data.UserID); err != nil {
+		return nil, err
+	}
+
+	res, err := s.ex.amendOrder(ctx, principalFrom(ctx), req.OrderId, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exchangepb.AmendOrderResponse{
+		Message:         res.Message,
+		OrderId:         res.OrderID,
+		ReplacedOrderId: res.ReplacedOrderID,
+		ClientOrderId:   res.ClientOrderID,
+	}, nil
+}
+
+func (s *grpcServer) GetBook(ctx context.Context, req *exchangepb.GetBookRequest) (*exchangepb.Book, error) {
+	market := Market(req.Market)
+
+	orderBook, ok := s.ex.orderBooks[market]
+	if !ok {
+		return nil, errNotFound("market")
+	}
+
+	if req.Depth < 0 {
+		fe := make(fieldErrors)
+		fe.add("depth", "must be a non-negative integer")
+		return nil, fe.err()
+	}
+
+	s.ex.bookMu.Lock()
+	defer s.ex.bookMu.Unlock()
+
+	seq := s.ex.sessions.seq(streamKey{channel: ChannelBook, key: string(market)})
+
+	return toPBBook(market, bookDepth(orderBook, int(req.Depth)), seq), nil
+}
+
+func (s *grpcServer) GetTrades(ctx context.Context, req *exchangepb.GetTradesRequest) (*exchangepb.GetTradesResponse, error) {
+	market := Market(req.Market)
+
+	orderBook, ok := s.ex.orderBooks[market]
+	if !ok {
+		return nil, errNotFound("market")
+	}
+
+	s.ex.bookMu.Lock()
+	defer s.ex.bookMu.Unlock()
+
+	res := &exchangepb.GetTradesResponse{
+		Seq: s.ex.sessions.seq(streamKey{channel: ChannelTrades, key: string(market)}),
+	}
+	for _, trade := range s.ex.trades(market, orderBook) {
+		res.Trades = append(res.Trades, toPBTrade(trade))
+	}
+
+	return res, nil
+}
+
+func (s *grpcServer) GetUserOrders(ctx context.Context, req *exchangepb.GetUserOrdersRequest) (*exchangepb.GetUserOrdersResponse, error) {
+	orderStatus := OrderStatus(req.Status)
+
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserId)
+	if orderStatus != "" && !orderStatus.IsValid() {
+		fe.add("status", fmt.Sprintf("unknown order status %q", orderStatus))
+	}
+	if err := fe.err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.ex.Users.Get(req.UserId); err != nil {
+		return nil, errNotFound("user")
+	}
+	if err := checkUser(principalFrom(ctx), false, req.UserId); err != nil {
+		return nil, err
+	}
+
+	s.ex.bookMu.Lock()
+	defer s.ex.bookMu.Unlock()
+
+	return s.ex.pbUserOrders(req.UserId, orderStatus), nil
+}
+
+// pbUserOrders returns the orders of a user with the sequence number of
+// their stream. The book lock must be held.
+func (ex *Exchange) pbUserOrders(userID string, orderStatus OrderStatus) *exchangepb.GetUserOrdersResponse {
+	res := &exchangepb.GetUserOrdersResponse{
+		Seq: ex.sessions.seq(streamKey{channel: ChannelOrders, key: userID}),
+	}
+	for _, order := range ex.Orders.UserOrders(userID, orderStatus) {
+		res.Orders = append(res.Orders, toPBOrder(order))
+	}
+
+	return res
+}
+
+func (s *grpcServer) StreamMarketData(req *exchangepb.StreamMarketDataRequest, stream exchangepb.Exchange_StreamMarketDataServer) error {
+	market := Market(req.Market)
+	channels := req.Channels
+	if len(channels) == 0 {
+		channels = []string{ChannelBook, ChannelTrades, ChannelTicker}
+	}
+
+	fe := make(fieldErrors)
+	orderBook, ok := s.ex.orderBooks[market]
+	if !ok {
+		fe.add("market", fmt.Sprintf("unknown market %q", market))
+	}
+	for _, channel := range channels {
+		if channel != ChannelBook && channel != ChannelTrades && channel != ChannelTicker {
+			fe.add("channels", "must be book, trades or ticker")
+		}
+	}
+	if err := fe.err(); err != nil {
+		return err
+	}
+
+	subscribe := func(sub *wsClient) []*exchangepb.MarketData {
+		var snapshots []*exchangepb.MarketData
+		for _, channel := range channels {
+			seq := s.ex.sessions.subscribe(sub, streamKey{channel: channel, key: string(market)})
+
+			switch channel {
+			case ChannelBook:
+				snapshots = append(snapshots, &exchangepb.MarketData{
+					Market:  string(market),
+					Channel: ChannelBook,
+					Seq:     seq,
+					Data:    &exchangepb.MarketData_Book{Book: toPBBook(market, bookDepth(orderBook, 0), seq)},
+				})
+			case ChannelTicker:
+				snapshots = append(snapshots, &exchangepb.MarketData{
+					Market:  string(market),
+					Channel: ChannelTicker,
+					Seq:     seq,
+					Data:    &exchangepb.MarketData_Ticker{Ticker: toPBTicker(s.ex.feeds[market].ticker)},
+				})
+			}
+		}
+
+		return snapshots
+	}
+
+	return serveStream(stream, s.ex, "", subscribe, toPBMarketData, stream.Send)
+}
+
+func (s *grpcServer) StreamOrders(req *exchangepb.StreamOrdersRequest, stream exchangepb.Exchange_StreamOrdersServer) error {
+	fe := make(fieldErrors)
+	fe.required("user_id", req.UserId)
+	if err := fe.err(); err != nil {
+		return err
+	}
+
+	if _, err := s.ex.Users.Get(req.UserId); err != nil {
+		return errNotFound("user")
+	}
+	if err := checkUser(principalFrom(stream.Context()), false, req.UserId); err != nil {
+		return err
+	}
+
+	subscribe := func(sub *wsClient) []*exchangepb.OrderUpdate {
+		seq := s.ex.sessions.subscribe(sub, streamKey{channel: ChannelOrders, key: req.UserId})
+
+		return []*exchangepb.OrderUpdate{{
+			Seq:  seq,
+			Data: &exchangepb.OrderUpdate_Snapshot{Snapshot: s.ex.pbUserOrders(req.UserId, "")},
+		}}
+	}
+
+	return serveStream(stream, s.ex, req.UserId, subscribe, toPBOrderUpdate, stream.Send)
+}
+
+// serveStream runs a stream until its client goes away. subscribe subscribes
+// the session of the stream under the book lock, so no event is published
+// between the subscription and the snapshots it returns. The header is sent
+// once subscribed, followed by the snapshots and the events, converted with
+// convert, sent with send. A stream that can't keep up ends.
+func serveStream[T any](stream grpc.ServerStream, ex *Exchange, userID string, subscribe func(sub *wsClient) []T, convert func(event WSEvent) T, send func(T) error) error {
+	ctx := stream.Context()
+	dropped := make(chan struct{})
+	var once sync.Once
+
+	sub := newStreamClient(userID, func() { once.Do(func() { close(dropped) }) })
+	defer ex.sessions.remove(sub)
+
+	ex.bookMu.Lock()
+	snapshots := subscribe(sub)
+	ex.bookMu.Unlock()
+
+	if err := stream.SendHeader(metadata.Pairs(MetadataSubscribed, "true")); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if err := send(snapshot); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-dropped:
+			return status.Error(codes.ResourceExhausted, "stream dropped, the client can't keep up")
+		case v := <-sub.out:
+			if err := send(convert(v.(WSEvent))); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toPBMarketData(event WSEvent) *exchangepb.MarketData {
+	data := &exchangepb.MarketData{
+		Market:  string(event.Market),
+		Channel: event.Channel,
+		Seq:     event.Seq,
+	}
+
+	switch v := event.Data.(type) {
+	case BookUpdate:
+		data.Data = &exchangepb.MarketData_BookUpdate{BookUpdate: &exchangepb.BookUpdate{
+			Bids:     toPBLevels(v.Bids),
+			Asks:     toPBLevels(v.Asks),
+			Checksum: v.Checksum,
+		}}
+	case *Trade:
+		data.Data = &exchangepb.MarketData_Trade{Trade: toPBTrade(v)}
+	case Ticker:
+		data.Data = &exchangepb.MarketData_Ticker{Ticker: toPBTicker(v)}
+	}
+
+	return data
+}
+
+func toPBOrderUpdate(event WSEvent) *exchangepb.OrderUpdate {
+	update := &exchangepb.OrderUpdate{Seq: event.Seq}
+	if order, ok := event.Data.(OrderRecord); ok {
+		update.Data = &exchangepb.OrderUpdate_Order{Order: toPBOrder(order)}
+	}
+
+	return update
+}
+
+func toPBBook(market Market, depth BookDepthRes, seq uint64) *exchangepb.Book {
+	return &exchangepb.Book{
+		Market:   string(market),
+		Bids:     toPBLevels(depth.Bids),
+		Asks:     toPBLevels(depth.Asks),
+		Checksum: depth.Checksum,
+		Seq:      seq,
+	}
+}
+
+func toPBLevels(levels []BookLevel) []*exchangepb.BookLevel {
+	res := make([]*exchangepb.BookLevel, len(levels))
+	for i, level := range levels {
+		res[i] = &exchangepb.BookLevel{Price: level.Price, Size: level.Size}
+	}
+
+	return res
+}
+
+func toPBTicker(ticker Ticker) *exchangepb.Ticker {
+	return &exchangepb.Ticker{
+		BidPrice: ticker.BidPrice,
+		BidSize:  ticker.BidSize,
+		AskPrice: ticker.AskPrice,
+		AskSize:  ticker.AskSize,
+	}
+}
+
+func toPBTrade(trade *Trade) *exchangepb.Trade {
+	res := &exchangepb.Trade{
+		Id:        trade.ID,
+		IsBid:     trade.IsBid,
+		Price:     trade.Price,
+		Size:      trade.Size,
+		Timestamp: trade.Timestamp,
+		MakerFee:  trade.MakerFee,
+		TakerFee:  trade.TakerFee,
+	}
+	if trade.Settlement != nil {
+		res.SettlementStatus = string(trade.Settlement.Status)
+	}
+
+	return res
+}
+
+func toPBOrder(order OrderRecord) *exchangepb.Order {
+	return &exchangepb.Order{
+		Id:            order.ID,
+		ClientOrderId: order.ClientOrderID,
+		UserId:        order.UserID,
+		Market:        string(order.Market),
+		Type:          string(order.Type),
+		IsBid:         order.IsBid,
+		Price:         order.Price,
+		Size:          order.Size,
+		ExecutedSize:  order.ExecutedSize,
+		AvgFillPrice:  order.AvgFillPrice,
+		Status:        string(order.Status),
+		Reason:        order.Reason,
+		CreatedAt:     timestamppb.New(order.CreatedAt),
+		UpdatedAt:     timestamppb.New(order.UpdatedAt),
+	}
+}
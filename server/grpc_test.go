@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/exchangepb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func dialGRPC(t *testing.T, te *testExchange) exchangepb.ExchangeClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := te.GRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return exchangepb.NewExchangeClient(conn)
+}
+
+// grpcContext returns the context of calls made for user with its API key.
+func grpcContext(t *testing.T, user *UserRes) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	return metadata.AppendToOutgoingContext(ctx, MetadataUserID, user.ID, MetadataAPIKey, user.APIKey)
+}
+
+func TestGRPCOrders(t *testing.T) {
+	te := newTestExchange(t)
+	api := dialGRPC(t, te)
+	user := te.registerUser(t)
+	ctx := grpcContext(t, user)
+
+	placed, err := api.PlaceOrder(ctx, &exchangepb.PlaceOrderRequest{
+		UserId:        user.ID,
+		ClientOrderId: "order-1",
+		Market:        string(ETH),
+		Type:          string(LimitOrder),
+		Size:          10,
+		Price:         3500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := api.GetBook(ctx, &exchangepb.GetBookRequest{Market: string(ETH)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(book.Asks), 1)
+	assert(t, book.Asks[0].Size, 10.0)
+
+	amended, err := api.AmendOrder(ctx, &exchangepb.AmendOrderRequest{OrderId: placed.OrderId, UserId: user.ID, Price: 3400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, amended.ReplacedOrderId, placed.OrderId)
+	assert(t, amended.ClientOrderId, "order-1")
+
+	record, err := te.Orders.Get(placed.OrderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, record.Status, OrderReplaced)
+	assert(t, record.Reason, "replaced by "+amended.OrderId)
+
+	_, err = api.CancelOrder(ctx, &exchangepb.CancelOrderRequest{OrderId: amended.OrderId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := api.GetUserOrders(ctx, &exchangepb.GetUserOrdersRequest{UserId: user.ID, Status: string(OrderCancelled)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(orders.Orders), 1)
+	assert(t, orders.Orders[0].Id, amended.OrderId)
+	assert(t, orders.Orders[0].Price, 3400.0)
+}
+
+func TestGRPCErrors(t *testing.T) {
+	te := newTestExchange(t)
+	api := dialGRPC(t, te)
+	user := te.registerUser(t)
+	ctx := grpcContext(t, user)
+
+	_, err := api.PlaceOrder(ctx, &exchangepb.PlaceOrderRequest{UserId: user.ID, Market: string(ETH), Type: string(LimitOrder), Price: 3500})
+	st := status.Convert(err)
+	assert(t, st.Code(), codes.InvalidArgument)
+
+	var info *errdetails.ErrorInfo
+	var badRequest *errdetails.BadRequest
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			info = detail
+		case *errdetails.BadRequest:
+			badRequest = detail
+		}
+	}
+	if info == nil || badRequest == nil {
+		t.Fatalf("missing details in %v", st.Details())
+	}
+	assert(t, info.Reason, string(CodeInvalidRequest))
+	assert(t, info.Metadata[ErrorMetadataStatus], "400")
+	assert(t, badRequest.FieldViolations[0].Field, "size")
+
+	_, err = api.CancelOrder(ctx, &exchangepb.CancelOrderRequest{OrderId: "missing"})
+	assert(t, status.Code(err), codes.NotFound)
+
+	_, err = api.PlaceOrder(ctx, &exchangepb.PlaceOrderRequest{UserId: user.ID, Market: string(ETH), Type: string(MarketOrder), Size: 1})
+	assert(t, status.Code(err), codes.FailedPrecondition)
+
+	// calls for a user need its API key
+	other := te.registerUser(t)
+	orderID := te.placeLimit(t, other.ID, false, 1, 3600)
+	order := &exchangepb.PlaceOrderRequest{UserId: other.ID, Market: string(ETH), Type: string(LimitOrder), Size: 1, Price: 3600}
+	_, err = api.PlaceOrder(ctx, order)
+	assert(t, status.Code(err), codes.PermissionDenied)
+	_, err = api.CancelOrder(ctx, &exchangepb.CancelOrderRequest{OrderId: orderID})
+	assert(t, status.Code(err), codes.NotFound)
+	_, err = api.GetUserOrders(ctx, &exchangepb.GetUserOrdersRequest{UserId: other.ID})
+	assert(t, status.Code(err), codes.PermissionDenied)
+	_, err = api.PlaceOrder(metadata.AppendToOutgoingContext(context.Background(), MetadataUserID, other.ID), order)
+	assert(t, status.Code(err), codes.Unauthenticated)
+	_, err = api.PlaceOrder(metadata.AppendToOutgoingContext(context.Background(), MetadataAPIKey, "unknown"), order)
+	assert(t, status.Code(err), codes.Unauthenticated)
+}
+
+func TestGRPCStreams(t *testing.T) {
+	te := newTestExchange(t)
+	api := dialGRPC(t, te)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+	ctx := grpcContext(t, buyer)
+
+	te.placeLimit(t, seller.ID, false, 10, 3500)
+
+	market, err := api.StreamMarketData(ctx, &exchangepb.StreamMarketDataRequest{Market: string(ETH), Channels: []string{ChannelBook, ChannelTrades}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := market.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, data.Channel, ChannelBook)
+	assert(t, len(data.GetBook().Asks), 1)
+
+	orders, err := api.StreamOrders(ctx, &exchangepb.StreamOrdersRequest{UserId: buyer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := orders.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(update.GetSnapshot().Orders), 0)
+
+	status := te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, nil)
+	assert(t, status, http.StatusOK)
+
+	trades := 0
+	for trades == 0 {
+		data, err := market.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Channel == ChannelTrades {
+			trades++
+			assert(t, data.GetTrade().Size, 4.0)
+			assert(t, data.GetTrade().Price, 3500.0)
+		}
+	}
+
+	update, err = orders.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, update.GetOrder().UserId, buyer.ID)
+	assert(t, update.GetOrder().Type, string(MarketOrder))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	maxRequestIDLength = 128
+)
+
+type (
+	// LogConfig configures the logger of the exchange. Level is the level it
+	// starts with, it can be changed at runtime through the admin API.
+	LogConfig struct {
+		Level  string `json:"level"`
+		Format string `json:"format"`
+	}
+
+	LogLevelReq struct {
+		Level string `json:"level"`
+	}
+
+	LogLevelRes struct {
+		Level string `json:"level"`
+	}
+)
+
+var DefaultLogConfig = LogConfig{
+	Level:  "info",
+	Format: LogFormatText,
+}
+
+func (cfg LogConfig) validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("log.level: unknown level %q", cfg.Level)
+	}
+
+	if cfg.Format != LogFormatText && cfg.Format != LogFormatJSON {
+		return fmt.Errorf("log.format must be %s or %s", LogFormatText, LogFormatJSON)
+	}
+
+	return nil
+}
+
+func (req *LogLevelReq) Validate() error {
+	fe := make(fieldErrors)
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		fe.add("level", "must be debug, info, warn or error")
+	}
+
+	return fe.err()
+}
+
+// newLogger returns a logger writing to w and the variable holding its
+// level.
+func newLogger(cfg LogConfig, w io.Writer) (*slog.Logger, *slog.LevelVar) {
+	level := new(slog.LevelVar)
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts)), level
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts)), level
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	loggerKey
+	principalKey
+	claimedUserKey
+)
+
+// withRequest returns ctx carrying the ID of the request it serves and the
+// logger tagged with it.
+func withRequest(ctx context.Context, requestID string, logger *slog.Logger) context.Context {
+	return withLogger(context.WithValue(ctx, requestIDKey, requestID), logger)
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// requestID returns the ID of the request ctx serves, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withPrincipal returns ctx carrying who makes the request it serves: the
+// user of its API key or "admin:" and the name of an operator.
+func withPrincipal(ctx context.Context, p string) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// principalFrom returns who makes the request ctx serves, or empty if it
+// is unauthenticated.
+func principalFrom(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey).(string)
+	return p
+}
+
+// withClaimedUser returns ctx carrying the user the request it serves says
+// it is made for. The claim is only recorded, it's the principal who acts.
+func withClaimedUser(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, claimedUserKey, userID)
+}
+
+// claimedUser returns the user the request ctx serves says it is made for,
+// if any.
+func claimedUser(ctx context.Context) string {
+	userID, _ := ctx.Value(claimedUserKey).(string)
+	return userID
+}
+
+// loggerFrom returns the logger of the request ctx serves, or the default
+// logger outside of a request.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	return slog.Default()
+}
+
+// requestLogger tags every request with an ID, taken from the X-Request-ID
+// header if the client sent one, and logs it once handled. The ID is echoed
+// in the response and carried by the request context into the engine,
+// settlement and audit log.
+func (ex *Exchange) requestLogger(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+		logger := ex.log.With("request_id", id)
+		ctx := withRequest(req.Context(), id, logger)
+		c.SetRequest(req.WithContext(withClaimedUser(ctx, requestUser(c))))
+
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = errorStatus(err)
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		logger.LogAttrs(req.Context(), level, "request",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user_id", principal(c)),
+			slog.String("claimed_user_id", claimedUser(c.Request().Context())),
+			slog.String("ip", c.RealIP()),
+		)
+
+		return err
+	}
+}
+
+func (ex *Exchange) handleGetLogLevel(c echo.Context) error {
+	return c.JSON(http.StatusOK, LogLevelRes{Level: ex.logLevel.Level().String()})
+}
+
+func (ex *Exchange) handleSetLogLevel(c echo.Context) error {
+	var data LogLevelReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	previous := ex.logLevel.Level()
+	if err := ex.logLevel.UnmarshalText([]byte(data.Level)); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	loggerFrom(ctx).Info("log level changed", "from", previous, "to", ex.logLevel.Level())
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  adminName(c),
+		Action: AuditLogLevelChanged,
+		Details: map[string]any{
+			"from": previous.String(),
+			"to":   ex.logLevel.Level().String(),
+		},
+	})
+
+	return c.JSON(http.StatusOK, LogLevelRes{Level: ex.logLevel.Level().String()})
+}
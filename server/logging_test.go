@@ -0,0 +1,44 @@
+package server
+
+import (
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminLogLevel(t *testing.T) {
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const token = "0123456789abcdef"
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{{Asset: "ETH", Settler: SettlerFake}}
+	cfg.Admin.Tokens = map[string]string{"ops": token}
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": NewFakeSettler()})
+
+	auth := map[string]string{echo.HeaderAuthorization: "Bearer " + token}
+
+	rec := te.send(t, http.MethodGet, "/admin/log-level", nil, nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = te.send(t, http.MethodGet, "/admin/log-level", nil, map[string]string{echo.HeaderAuthorization: "Bearer wrong"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = te.send(t, http.MethodPut, "/admin/log-level", &LogLevelReq{Level: "loud"}, auth)
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = te.send(t, http.MethodPut, "/admin/log-level", &LogLevelReq{Level: "debug"}, auth)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Body.String(), `{"level":"DEBUG"}`+"\n")
+
+	entries := te.auditEntries(t)
+	assert(t, len(entries), 1)
+	assert(t, entries[0].Actor, "admin:ops")
+	assert(t, entries[0].Action, AuditLogLevelChanged)
+	assert(t, entries[0].Details, map[string]any{"from": "WARN", "to": "DEBUG"})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto_exchange/order_book"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+const (
+	MarketOpen       MarketStatus = MarketStatus(order_book.StatusOpen)
+	MarketHalted     MarketStatus = MarketStatus(order_book.StatusHalted)
+	MarketCancelOnly MarketStatus = MarketStatus(order_book.StatusCancelOnly)
+	MarketPostOnly   MarketStatus = MarketStatus(order_book.StatusPostOnly)
+)
+
+type (
+	Asset string
+
+	// MarketStatus is the trading status of a market. Halted markets accept
+	// no orders and no cancels, cancel-only markets only cancels and
+	// post-only markets no market orders.
+	MarketStatus string
+
+	// AssetConfig describes an asset and how it is settled. Amounts traded on
+	// the exchange are converted to the asset's smallest unit with Decimals.
+	AssetConfig struct {
+		Asset        Asset       `json:"asset"`
+		Decimals     uint8       `json:"decimals"`
+		Settler      SettlerKind `json:"settler"`
+		Token        string      `json:"token,omitempty"`
+		TransferFrom bool        `json:"transfer_from,omitempty"`
+	}
+
+	// MarketConfig describes a market trading Base against Quote. Sizes are
+	// in units of the base asset and prices in units of the quote asset. A
+	// market without a quote asset only settles the base asset. Status is
+	// the status the market starts with, open if empty.
+	MarketConfig struct {
+		Name       Market           `json:"name"`
+		Base       Asset            `json:"base"`
+		Quote      Asset            `json:"quote,omitempty"`
+		Status     MarketStatus     `json:"status,omitempty"`
+		PriceBands *PriceBandConfig `json:"price_bands,omitempty"`
+	}
+)
+
+var (
+	// DefaultAssets settles sizes of the ETH market in wei and its prices in
+	// USD cents kept on the internal ledger, which users are credited with
+	// through the admin API.
+	DefaultAssets = []AssetConfig{
+		{Asset: "ETH", Decimals: 0, Settler: SettlerETH},
+		{Asset: "USD", Decimals: 2, Settler: SettlerLedger},
+	}
+
+	DefaultMarkets = []MarketConfig{
+		{Name: ETH, Base: "ETH", Quote: "USD"},
+	}
+)
+
+// toUnits converts an amount to the smallest unit of an asset with the given
+// decimals, fractions of the smallest unit are truncated. The amount is taken
+// by its shortest decimal representation so 0.3 becomes exactly 3 * 10^17
+// with 18 decimals.
+func toUnits(amount float64, decimals uint8) *big.Int {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(amount, 'f', -1, 64))
+	if !ok {
+		return new(big.Int)
+	}
+
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+func validateMarkets(markets []MarketConfig, assets map[Asset]AssetConfig) error {
+	for _, market := range markets {
+		if market.Name == "" {
+			return fmt.Errorf("market without name")
+		}
+		if _, ok := assets[market.Base]; !ok {
+			return fmt.Errorf("unknown base asset %q of market %s", market.Base, market.Name)
+		}
+		if _, ok := assets[market.Quote]; market.Quote != "" && !ok {
+			return fmt.Errorf("unknown quote asset %q of market %s", market.Quote, market.Name)
+		}
+		if market.Status != "" && !market.Status.IsValid() {
+			return fmt.Errorf("unknown status %q of market %s", market.Status, market.Name)
+		}
+	}
+
+	return nil
+}
+
+func (s MarketStatus) IsValid() bool {
+	return order_book.Status(s).IsValid()
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto_exchange/order_book"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+)
+
+const WSEventMarketStatus = "market_status"
+
+type (
+	// MarketRes describes a market, PriceBand is set while the market has a
+	// price band.
+	MarketRes struct {
+		Name      Market        `json:"name"`
+		Base      Asset         `json:"base"`
+		Quote     Asset         `json:"quote,omitempty"`
+		Status    MarketStatus  `json:"status"`
+		PriceBand *PriceBandRes `json:"price_band,omitempty"`
+	}
+
+	// MarketStatusReq changes the trading status of a market, Reason is
+	// kept in the audit log and passed on to clients.
+	MarketStatusReq struct {
+		Status MarketStatus `json:"status"`
+		Reason string       `json:"reason,omitempty"`
+	}
+
+	// MarketStatusEvent is pushed to WebSocket clients when the status of a
+	// market changes.
+	MarketStatusEvent struct {
+		Market Market       `json:"market"`
+		Status MarketStatus `json:"status"`
+		Reason string       `json:"reason,omitempty"`
+	}
+)
+
+func (req *MarketStatusReq) Validate() error {
+	fe := make(fieldErrors)
+	if !req.Status.IsValid() {
+		fe.add("status", "must be open, halted, cancel_only or post_only")
+	}
+
+	return fe.err()
+}
+
+// errMarketStatus rejects what the status of market doesn't allow.
+func errMarketStatus(market Market, status order_book.Status, what string) *APIError {
+	return NewAPIError(http.StatusConflict, CodeMarketUnavailable, fmt.Sprintf("%s are not accepted while market %s is %s", what, market, status))
+}
+
+// checkOrderAllowed returns an error if the status of the book doesn't allow
+// orders of orderType.
+func checkOrderAllowed(market Market, orderBook *order_book.OrderBook, orderType OrderType) *APIError {
+	status := orderBook.Status()
+
+	switch {
+	case orderType == LimitOrder && !status.CanPlaceLimit():
+		return errMarketStatus(market, status, "limit orders")
+	case orderType == MarketOrder && !status.CanMatch():
+		return errMarketStatus(market, status, "market orders")
+	}
+
+	return nil
+}
+
+func checkCancelAllowed(market Market, orderBook *order_book.OrderBook) error {
+	if status := orderBook.Status(); !status.CanCancel() {
+		return errMarketStatus(market, status, "cancels")
+	}
+
+	return nil
+}
+
+func (ex *Exchange) marketRes(name Market) MarketRes {
+	cfg := ex.markets[name]
+
+	res := MarketRes{
+		Name:   cfg.Name,
+		Base:   cfg.Base,
+		Quote:  cfg.Quote,
+		Status: MarketStatus(ex.orderBooks[name].Status()),
+	}
+	if band, ok := ex.guards[name].band(ex.orderBooks[name]); ok {
+		res.PriceBand = &band
+	}
+
+	return res
+}
+
+func (ex *Exchange) handleGetMarkets(c echo.Context) error {
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	markets := make([]MarketRes, 0, len(ex.markets))
+	for name := range ex.markets {
+		markets = append(markets, ex.marketRes(name))
+	}
+
+	sort.Slice(markets, func(i, j int) bool {
+		return markets[i].Name < markets[j].Name
+	})
+
+	return c.JSON(http.StatusOK, markets)
+}
+
+// handleSetMarketStatus changes the status of a market and tells every
+// WebSocket client about it.
+func (ex *Exchange) handleSetMarketStatus(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	var data MarketStatusReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	orderBook, ok := ex.orderBooks[market]
+	if !ok {
+		return errNotFound("market")
+	}
+
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	previous := MarketStatus(orderBook.Status())
+	orderBook.SetStatus(order_book.Status(data.Status))
+	if guard, ok := ex.guards[market]; ok {
+		// the operator takes over from a circuit breaker
+		guard.phase++
+		guard.window = nil
+	}
+
+	ctx := c.Request().Context()
+	loggerFrom(ctx).Warn("market status changed", "market", market, "from", previous, "to", data.Status, "reason", data.Reason)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  adminName(c),
+		Action: AuditMarketStatusChanged,
+		Market: market,
+		Details: map[string]any{
+			"from":   previous,
+			"to":     data.Status,
+			"reason": data.Reason,
+		},
+	})
+	ex.announceStatus(ctx, market, data.Status, data.Reason)
+
+	return c.JSON(http.StatusOK, ex.marketRes(market))
+}
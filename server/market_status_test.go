@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarketStatus(t *testing.T) {
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const token = "0123456789abcdef"
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{{Asset: "ETH", Settler: SettlerFake}}
+	cfg.Admin.Tokens = map[string]string{"ops": token}
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": NewFakeSettler()})
+
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+	askID := te.placeLimit(t, seller.ID, false, 10, 3500)
+
+	ts := httptest.NewServer(te.e)
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	setStatus := func(status MarketStatus) {
+		t.Helper()
+
+		rec := te.send(t, http.MethodPut, "/admin/markets/ETH/status", &MarketStatusReq{Status: status, Reason: "test"},
+			map[string]string{echo.HeaderAuthorization: "Bearer " + token})
+		assert(t, rec.Code, http.StatusOK)
+
+		var event struct {
+			Type string            `json:"type"`
+			Data MarketStatusEvent `json:"data"`
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		assert(t, event.Type, WSEventMarketStatus)
+		assert(t, event.Data, MarketStatusEvent{Market: ETH, Status: status, Reason: "test"})
+	}
+
+	placeOrder := func(orderType OrderType) int {
+		t.Helper()
+
+		req := &PlaceOrderReq{UserID: buyer.ID, Market: ETH, OrderType: orderType, IsBid: true, Size: 1}
+		if orderType == LimitOrder {
+			req.Price = 3000
+		}
+
+		var apiErr APIError
+		status := te.do(t, http.MethodPost, "/order", req, &apiErr)
+		if status != http.StatusOK {
+			assert(t, apiErr.Code, CodeMarketUnavailable)
+		}
+
+		return status
+	}
+
+	rec := te.send(t, http.MethodPut, "/admin/markets/ETH/status", &MarketStatusReq{Status: MarketHalted}, nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	setStatus(MarketHalted)
+	assert(t, placeOrder(LimitOrder), http.StatusConflict)
+	assert(t, placeOrder(MarketOrder), http.StatusConflict)
+	assert(t, te.do(t, http.MethodDelete, "/order/"+askID, nil, nil), http.StatusConflict)
+
+	var markets []MarketRes
+	te.do(t, http.MethodGet, "/markets", nil, &markets)
+	assert(t, markets, []MarketRes{{Name: ETH, Base: "ETH", Status: MarketHalted}})
+
+	setStatus(MarketPostOnly)
+	assert(t, placeOrder(LimitOrder), http.StatusOK)
+	assert(t, placeOrder(MarketOrder), http.StatusConflict)
+
+	setStatus(MarketCancelOnly)
+	assert(t, placeOrder(LimitOrder), http.StatusConflict)
+	assert(t, te.do(t, http.MethodDelete, "/order/"+askID, nil, nil), http.StatusOK)
+
+	setStatus(MarketOpen)
+	te.placeLimit(t, seller.ID, false, 10, 3500)
+	assert(t, placeOrder(MarketOrder), http.StatusOK)
+
+	var changes int
+	for _, entry := range te.auditEntries(t) {
+		if entry.Action == AuditMarketStatusChanged {
+			assert(t, entry.Actor, "admin:ops")
+			changes++
+		}
+	}
+	assert(t, changes, 4)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto_exchange/order_book"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+	"time"
+)
+
+const (
+	orderAccepted = "accepted"
+	orderRejected = "rejected"
+)
+
+// metrics holds the Prometheus collectors of an exchange. Every exchange has
+// its own registry so several can run in one process, as they do in tests.
+type metrics struct {
+	registry *prometheus.Registry
+
+	orders        *prometheus.CounterVec
+	matchDuration *prometheus.HistogramVec
+	depth         *prometheus.GaugeVec
+	spread        *prometheus.GaugeVec
+	trades        *prometheus.CounterVec
+	volume        *prometheus.CounterVec
+	httpDuration  *prometheus.HistogramVec
+	settlements   *prometheus.CounterVec
+}
+
+func newMetrics(queue *SettlementQueue) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		orders: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_orders_total",
+			Help: "Orders received by market, type and whether they were accepted or rejected.",
+		}, []string{"market", "type", "result"}),
+		matchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_match_duration_seconds",
+			Help:    "Time spent matching market orders.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"market"}),
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "exchange_book_depth",
+			Help: "Total volume resting in the book by side.",
+		}, []string{"market", "side"}),
+		spread: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "exchange_book_spread",
+			Help: "Difference between the best ask and the best bid.",
+		}, []string{"market"}),
+		trades: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_trades_total",
+			Help: "Trades executed.",
+		}, []string{"market"}),
+		volume: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_traded_volume_total",
+			Help: "Size traded in units of the base asset.",
+		}, []string{"market"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "exchange_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		settlements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "exchange_settlements_total",
+			Help: "Settlement jobs that reached a final status.",
+		}, []string{"asset", "status"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.orders,
+		m.matchDuration,
+		m.depth,
+		m.spread,
+		m.trades,
+		m.volume,
+		m.httpDuration,
+		m.settlements,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "exchange_settlements_pending",
+			Help: "Settlement jobs not yet confirmed or failed.",
+		}, func() float64 {
+			return float64(len(queue.Unfinished()))
+		}),
+	)
+
+	return m
+}
+
+func (m *metrics) handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+func (m *metrics) order(market Market, orderType OrderType, result string) {
+	m.orders.WithLabelValues(string(market), string(orderType), result).Inc()
+}
+
+// middleware records the latency of every request under its route pattern so
+// the number of series doesn't grow with IDs in the path.
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := c.Response().Status
+		if err != nil {
+			status = errorStatus(err)
+		}
+
+		m.httpDuration.WithLabelValues(c.Request().Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+func (m *metrics) observeSettlement(job *SettlementJob) {
+	if job.Status.IsFinal() {
+		m.settlements.WithLabelValues(string(job.Asset), string(job.Status)).Inc()
+	}
+}
+
+// bookHooks returns the hooks recording the metrics of a market's book.
+func (m *metrics) bookHooks(market Market) order_book.Hooks {
+	return &bookMetrics{market: string(market), m: m}
+}
+
+type bookMetrics struct {
+	market string
+	m      *metrics
+}
+
+func (bm *bookMetrics) LimitOrderPlaced(ob *order_book.OrderBook, order *order_book.Order) {
+	bm.updateBook(ob)
+}
+
+func (bm *bookMetrics) MarketOrderFilled(ob *order_book.OrderBook, order *order_book.Order, matches []order_book.Match, took time.Duration) {
+	bm.m.matchDuration.WithLabelValues(bm.market).Observe(took.Seconds())
+
+	for _, match := range matches {
+		bm.m.trades.WithLabelValues(bm.market).Inc()
+		bm.m.volume.WithLabelValues(bm.market).Add(match.SizeFilled)
+	}
+
+	bm.updateBook(ob)
+}
+
+func (bm *bookMetrics) OrderCancelled(ob *order_book.OrderBook, order *order_book.Order) {
+	bm.updateBook(ob)
+}
+
+func (bm *bookMetrics) AuctionUncrossed(ob *order_book.OrderBook, price float64, matches []order_book.Match, took time.Duration) {
+	for _, match := range matches {
+		bm.m.trades.WithLabelValues(bm.market).Inc()
+		bm.m.volume.WithLabelValues(bm.market).Add(match.SizeFilled)
+	}
+
+	bm.updateBook(ob)
+}
+
+func (bm *bookMetrics) updateBook(ob *order_book.OrderBook) {
+	bm.m.depth.WithLabelValues(bm.market, "bid").Set(ob.BidsTotalVolume())
+	bm.m.depth.WithLabelValues(bm.market, "ask").Set(ob.AsksTotalVolume())
+
+	bids, asks := ob.BidLimitsList(), ob.AskLimitsList()
+	if len(bids) == 0 || len(asks) == 0 {
+		bm.m.spread.DeleteLabelValues(bm.market)
+		return
+	}
+
+	bm.m.spread.WithLabelValues(bm.market).Set(asks[0].Price - bids[0].Price)
+}
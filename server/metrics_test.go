@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	te.placeLimit(t, seller.ID, false, 10, 3600)
+	te.placeLimit(t, buyer.ID, true, 5, 3500)
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, nil)
+	te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      100,
+	}, nil)
+
+	rec := httptest.NewRecorder()
+	te.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert(t, rec.Code, http.StatusOK)
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`exchange_orders_total{market="ETH",result="accepted",type="limit"} 2`,
+		`exchange_orders_total{market="ETH",result="accepted",type="market"} 1`,
+		`exchange_orders_total{market="ETH",result="rejected",type="market"} 1`,
+		`exchange_trades_total{market="ETH"} 1`,
+		`exchange_traded_volume_total{market="ETH"} 4`,
+		`exchange_book_depth{market="ETH",side="ask"} 6`,
+		`exchange_book_spread{market="ETH"} 100`,
+		`exchange_match_duration_seconds_count{market="ETH"} 1`,
+		`exchange_http_request_duration_seconds_count{method="POST",route="/order",status="422"} 1`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics miss %s", line)
+		}
+	}
+}
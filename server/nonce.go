@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"github.com/ethereum/go-ethereum/common"
+	"sync"
+)
+
+type nonceSource interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+type accountNonce struct {
+	mu     sync.Mutex
+	nonce  uint64
+	synced bool
+}
+
+// NonceManager hands out transaction nonces per account. The pending nonce is
+// fetched from the node once and tracked locally afterwards, sends from the
+// same account are serialized so two transactions never share a nonce.
+type NonceManager struct {
+	mu       sync.Mutex
+	source   nonceSource
+	accounts map[common.Address]*accountNonce
+}
+
+func NewNonceManager(source nonceSource) *NonceManager {
+	return &NonceManager{
+		source:   source,
+		accounts: make(map[common.Address]*accountNonce),
+	}
+}
+
+func (nm *NonceManager) account(address common.Address) *accountNonce {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	account, ok := nm.accounts[address]
+	if !ok {
+		account = &accountNonce{}
+		nm.accounts[address] = account
+	}
+
+	return account
+}
+
+// Send calls send with the next nonce of address. The nonce is consumed only
+// if send succeeds, on failure it is re-synced from the node on next use.
+func (nm *NonceManager) Send(ctx context.Context, address common.Address, send func(nonce uint64) error) error {
+	account := nm.account(address)
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	if !account.synced {
+		nonce, err := nm.source.PendingNonceAt(ctx, address)
+		if err != nil {
+			return err
+		}
+		account.nonce = nonce
+		account.synced = true
+	}
+
+	if err := send(account.nonce); err != nil {
+		account.synced = false
+		return err
+	}
+
+	account.nonce++
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"sync"
+	"testing"
+)
+
+// testNonceSource hands out a pending nonce set by the test and counts how
+// often it is asked.
+type testNonceSource struct {
+	mu    sync.Mutex
+	nonce uint64
+	err   error
+	calls int
+}
+
+func (s *testNonceSource) PendingNonceAt(context.Context, common.Address) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	return s.nonce, s.err
+}
+
+func (s *testNonceSource) set(nonce uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nonce, s.err = nonce, err
+}
+
+func sendNonce(t *testing.T, nm *NonceManager, address common.Address, err error) uint64 {
+	t.Helper()
+
+	var sent uint64
+	got := nm.Send(context.Background(), address, func(nonce uint64) error {
+		sent = nonce
+		return err
+	})
+	assert(t, got, err)
+
+	return sent
+}
+
+func TestNonceManager(t *testing.T) {
+	source := &testNonceSource{nonce: 7}
+	nm := NewNonceManager(source)
+	a, b := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+
+	// the node is asked once, later nonces are counted locally
+	assert(t, sendNonce(t, nm, a, nil), uint64(7))
+	assert(t, sendNonce(t, nm, a, nil), uint64(8))
+	assert(t, source.calls, 1)
+
+	// accounts have their own nonces
+	source.set(3, nil)
+	assert(t, sendNonce(t, nm, b, nil), uint64(3))
+	assert(t, sendNonce(t, nm, a, nil), uint64(9))
+
+	// a failed send doesn't consume the nonce and resyncs from the node
+	errSend := errors.New("nonce too low")
+	assert(t, sendNonce(t, nm, a, errSend), uint64(10))
+	source.set(12, nil)
+	assert(t, sendNonce(t, nm, a, nil), uint64(12))
+	assert(t, sendNonce(t, nm, a, nil), uint64(13))
+
+	// nothing is sent while the node can't be asked
+	source.set(0, errors.New("node down"))
+	nm = NewNonceManager(source)
+	err := nm.Send(context.Background(), a, func(uint64) error {
+		t.Error("sent without a nonce")
+		return nil
+	})
+	assert(t, err, source.err)
+}
+
+func TestNonceManagerConcurrentSends(t *testing.T) {
+	nm := NewNonceManager(&testNonceSource{})
+	address := common.HexToAddress("0x1")
+
+	var (
+		mu   sync.Mutex
+		used = make(map[uint64]bool)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nm.Send(context.Background(), address, func(nonce uint64) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if used[nonce] {
+					t.Errorf("nonce %d used twice", nonce)
+				}
+				used[nonce] = true
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	assert(t, len(used), 50)
+	for nonce := uint64(0); nonce < 50; nonce++ {
+		assert(t, used[nonce], true)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	_ "embed"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// OpenAPISpec is the OpenAPI 3 document of the REST API, served at
+// /openapi.json.
+//
+//go:embed openapi.json
+var OpenAPISpec []byte
+
+func handleGetOpenAPI(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, OpenAPISpec)
+}
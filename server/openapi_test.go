@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+const contractAdminToken = "0123456789abcdef"
+
+// contractServer serves an exchange over HTTP and checks every request made
+// to it and every response against the OpenAPI document.
+type contractServer struct {
+	*testExchange
+	url    string
+	router routers.Router
+}
+
+func loadOpenAPISpec(t *testing.T) *openapi3.T {
+	t.Helper()
+
+	doc, err := openapi3.NewLoader().LoadFromData(OpenAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return doc
+}
+
+func startContractServer(t *testing.T) *contractServer {
+	t.Helper()
+
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{{Asset: "ETH", Settler: SettlerFake}}
+	cfg.Admin.Tokens = map[string]string{"ops": contractAdminToken}
+	// waiting for settlement polls the trades
+	cfg.RateLimit.Enabled = false
+	te := startExchange(t, users, cfg, map[Asset]Settler{"ETH": NewFakeSettler()})
+
+	srv := httptest.NewServer(te.e)
+	t.Cleanup(srv.Close)
+
+	doc := loadOpenAPISpec(t)
+	doc.Servers = openapi3.Servers{{URL: srv.URL}}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &contractServer{testExchange: te, url: srv.URL, router: router}
+}
+
+// call sends a request, fails the test unless both the request and the
+// response conform to the document and decodes the response into res if it
+// isn't nil.
+func (cs *contractServer) call(t *testing.T, method, path string, body any, header map[string]string, res any) int {
+	t.Helper()
+	return cs.send(t, method, path, body, header, res, true)
+}
+
+// callInvalid sends a request the document doesn't allow, only its response
+// is checked.
+func (cs *contractServer) callInvalid(t *testing.T, method, path string, body any, header map[string]string) int {
+	t.Helper()
+	return cs.send(t, method, path, body, header, nil, false)
+}
+
+func (cs *contractServer) send(t *testing.T, method, path string, body any, header map[string]string, res any, checkRequest bool) int {
+	t.Helper()
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, cs.url+path, bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+
+	route, pathParams, err := cs.router.FindRoute(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+	}
+	if err := openapi3filter.ValidateRequest(context.Background(), input); err != nil && checkRequest {
+		t.Fatalf("%s %s: request doesn't conform: %v", method, path, err)
+	}
+	// the body was read by the validation
+	req.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	resBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 resp.StatusCode,
+		Header:                 resp.Header,
+		Body:                   io.NopCloser(bytes.NewReader(resBody)),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	if err != nil {
+		t.Errorf("%s %s: %d response %s doesn't conform: %v", method, path, resp.StatusCode, resBody, err)
+	}
+
+	if res != nil {
+		if err := json.Unmarshal(resBody, res); err != nil {
+			t.Fatalf("decoding %s %s response %q: %v", method, path, resBody, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	te := newTestExchange(t)
+	doc := loadOpenAPISpec(t)
+
+	rec := te.send(t, http.MethodGet, "/openapi.json", nil, nil)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Body.Bytes(), OpenAPISpec)
+
+	// every route is documented and every documented operation is routed
+	param := regexp.MustCompile(`:(\w+)`)
+	routes := make(map[string]bool)
+	for _, route := range te.e.Routes() {
+		if route.Method == echo.RouteNotFound {
+			continue
+		}
+		path := param.ReplaceAllString(route.Path, "{$1}")
+		routes[route.Method+" "+path] = true
+
+		item := doc.Paths.Find(path)
+		if item == nil || item.GetOperation(route.Method) == nil {
+			t.Errorf("%s %s is not documented", route.Method, path)
+		}
+	}
+
+	for path, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			if !routes[method+" "+path] {
+				t.Errorf("%s %s is documented but not routed", method, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	cs := startContractServer(t)
+	admin := map[string]string{echo.HeaderAuthorization: "Bearer " + contractAdminToken}
+
+	var seller, buyer UserRes
+	assert(t, cs.call(t, http.MethodPost, "/users", &RegisterUserReq{}, nil, &seller), http.StatusCreated)
+	assert(t, cs.call(t, http.MethodPost, "/users", &RegisterUserReq{}, nil, &buyer), http.StatusCreated)
+	assert(t, cs.call(t, http.MethodGet, "/users/"+seller.ID, nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/users/unknown", nil, nil, nil), http.StatusNotFound)
+
+	// the empty book
+	assert(t, cs.call(t, http.MethodGet, "/markets", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/book/ETH", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/book/DOGE", nil, nil, nil), http.StatusNotFound)
+	assert(t, cs.call(t, http.MethodGet, "/book/ETH/best-price?type=ask", nil, nil, nil), http.StatusNotFound)
+
+	sellerHeader := map[string]string{HeaderAPIKey: seller.APIKey}
+	buyerHeader := map[string]string{HeaderAPIKey: buyer.APIKey}
+	var ask, other PlaceOrderRes
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:        seller.ID,
+		ClientOrderID: "ask-1",
+		Market:        ETH,
+		OrderType:     LimitOrder,
+		Size:          10,
+		Price:         3500,
+	}, sellerHeader, &ask), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      5,
+		Price:     3600,
+	}, sellerHeader, &other), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      -1,
+	}, sellerHeader, nil), http.StatusBadRequest)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      1,
+		Price:     3500,
+	}, nil, nil), http.StatusUnauthorized)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      1,
+		Price:     3500,
+	}, buyerHeader, nil), http.StatusForbidden)
+
+	assert(t, cs.call(t, http.MethodGet, "/book/ETH", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/book/ETH/best-price?type=ask", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/book/ETH/depth?depth=1", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/users/ETH/"+seller.ID+"/orders", nil, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/order/client/"+seller.ID+"/ask-1", nil, sellerHeader, nil), http.StatusOK)
+
+	var amended AmendOrderRes
+	assert(t, cs.call(t, http.MethodPut, "/order/"+other.OrderID, &AmendOrderReq{UserID: seller.ID, Price: 3700}, sellerHeader, &amended), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPut, "/order/"+other.OrderID, &AmendOrderReq{UserID: seller.ID, Price: 3700}, sellerHeader, nil), http.StatusNotFound)
+	assert(t, cs.call(t, http.MethodGet, "/order/"+amended.ReplacedOrderID, nil, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/order/"+amended.ReplacedOrderID, nil, buyerHeader, nil), http.StatusNotFound)
+
+	// a trade with its settlement
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      4,
+	}, buyerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     true,
+		Size:      100,
+	}, buyerHeader, nil), http.StatusUnprocessableEntity)
+	cs.waitForTrades(t, ETH, 1)
+	assert(t, cs.call(t, http.MethodGet, "/trades/ETH", nil, nil, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/users/"+buyer.ID+"/balances", nil, buyerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/users/"+buyer.ID+"/orders?status=rejected", nil, buyerHeader, nil), http.StatusOK)
+
+	assert(t, cs.call(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID:    seller.ID,
+		AllOrNone: true,
+		Ops: []BatchOrderOp{
+			{Op: BatchPlace, Market: ETH, Type: LimitOrder, Size: 1, Price: 3800},
+			{Op: BatchCancel, OrderID: "unknown"},
+		},
+	}, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/orders/batch", &BatchOrdersReq{
+		UserID: seller.ID,
+		Ops:    []BatchOrderOp{{Op: BatchPlace, Market: ETH, Type: LimitOrder, Size: 1, Price: 3800}},
+	}, sellerHeader, nil), http.StatusOK)
+
+	assert(t, cs.call(t, http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: seller.ID, TimeoutMs: 60_000}, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/orders/cancel-after", &CancelAfterReq{UserID: seller.ID}, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodDelete, "/order/client/"+seller.ID+"/ask-1", nil, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodDelete, "/order/"+amended.OrderID, nil, sellerHeader, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodDelete, "/orders?user_id="+seller.ID+"&side=ask", nil, sellerHeader, nil), http.StatusOK)
+
+	// administration
+	assert(t, cs.call(t, http.MethodGet, "/admin/log-level", nil, nil, nil), http.StatusUnauthorized)
+	assert(t, cs.call(t, http.MethodGet, "/admin/log-level", nil, admin, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPut, "/admin/log-level", &LogLevelReq{Level: "warn"}, admin, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPut, "/admin/markets/ETH/index-price", &IndexPriceReq{Price: 3500}, admin, nil), http.StatusConflict)
+	assert(t, cs.call(t, http.MethodPut, "/admin/markets/ETH/status", &MarketStatusReq{Status: MarketHalted, Reason: "maintenance"}, admin, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodPost, "/admin/users/"+buyer.ID+"/api-key", nil, admin, nil), http.StatusOK)
+	assert(t, cs.call(t, http.MethodGet, "/admin/settlements", nil, nil, nil), http.StatusUnauthorized)
+	assert(t, cs.call(t, http.MethodGet, "/admin/settlements", nil, sellerHeader, nil), http.StatusUnauthorized)
+	assert(t, cs.call(t, http.MethodGet, "/admin/settlements", nil, admin, nil), http.StatusOK)
+	assert(t, cs.callInvalid(t, http.MethodGet, "/admin/settlements?status=lost", nil, admin), http.StatusBadRequest)
+	assert(t, cs.call(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    seller.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		Size:      1,
+		Price:     3500,
+	}, sellerHeader, nil), http.StatusConflict)
+
+	assert(t, cs.call(t, http.MethodGet, "/openapi.json", nil, nil, nil), http.StatusOK)
+	if status := cs.call(t, http.MethodGet, "/metrics", nil, nil, nil); status != http.StatusOK {
+		t.Errorf("metrics returned %d", status)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OrderNew             OrderStatus = "new"
+	OrderPartiallyFilled OrderStatus = "partially_filled"
+	OrderFilled          OrderStatus = "filled"
+	OrderCancelled       OrderStatus = "cancelled"
+	OrderRejected        OrderStatus = "rejected"
+	OrderExpired         OrderStatus = "expired"
+	// OrderReplaced is the status of an order an amendment replaced with a
+	// new one, its reason names the replacement.
+	OrderReplaced OrderStatus = "replaced"
+)
+
+var ErrOrderNotFound = errors.New("order not found")
+
+type OrderStatus string
+
+func (s OrderStatus) IsValid() bool {
+	switch s {
+	case OrderNew, OrderPartiallyFilled, OrderFilled, OrderCancelled, OrderRejected, OrderExpired, OrderReplaced:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsOpen reports whether an order in this status can still be filled.
+func (s OrderStatus) IsOpen() bool {
+	return s == OrderNew || s == OrderPartiallyFilled
+}
+
+// OrderRecord is the history of an order. Size is the original size of the
+// order and Price is zero for market orders.
+type OrderRecord struct {
+	ID            string      `json:"id"`
+	ClientOrderID string      `json:"client_order_id,omitempty"`
+	UserID        string      `json:"user_id"`
+	Market        Market      `json:"market"`
+	Type          OrderType   `json:"type"`
+	IsBid         bool        `json:"is_bid"`
+	Price         float64     `json:"price,omitempty"`
+	Size          float64     `json:"size"`
+	ExecutedSize  float64     `json:"executed_size"`
+	AvgFillPrice  float64     `json:"avg_fill_price"`
+	Status        OrderStatus `json:"status"`
+	Reason        string      `json:"reason,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// OrderStore keeps every order placed on the exchange, including the ones
+// that already left the book.
+type OrderStore struct {
+	mu      sync.RWMutex
+	orders  map[string]*OrderRecord
+	byUser  map[string][]*OrderRecord
+	observe func(order OrderRecord)
+}
+
+func NewOrderStore() *OrderStore {
+	return &OrderStore{
+		orders: make(map[string]*OrderRecord),
+		byUser: make(map[string][]*OrderRecord),
+	}
+}
+
+// SetObserver registers fn to be called with every order added or changed.
+// It must be set before orders are added.
+func (s *OrderStore) SetObserver(fn func(order OrderRecord)) {
+	s.observe = fn
+}
+
+// Add stores a new order, its status defaults to new.
+func (s *OrderStore) Add(order OrderRecord) {
+	s.mu.Lock()
+
+	if order.Status == "" {
+		order.Status = OrderNew
+	}
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = order.CreatedAt
+
+	s.orders[order.ID] = &order
+	s.byUser[order.UserID] = append(s.byUser[order.UserID], &order)
+	s.mu.Unlock()
+
+	if s.observe != nil {
+		s.observe(order)
+	}
+}
+
+// Fill records an execution of size at price. filled tells whether nothing
+// of the order is left in the book.
+func (s *OrderStore) Fill(id string, size, price float64, filled bool) {
+	s.update(id, func(order *OrderRecord) bool {
+		executed := order.ExecutedSize + size
+		order.AvgFillPrice = (order.AvgFillPrice*order.ExecutedSize + price*size) / executed
+		order.ExecutedSize = executed
+
+		if filled {
+			order.Status = OrderFilled
+		} else {
+			order.Status = OrderPartiallyFilled
+		}
+
+		return true
+	})
+}
+
+// Close moves an open order to a final status like cancelled or expired,
+// reason is kept if not empty.
+func (s *OrderStore) Close(id string, status OrderStatus, reason string) {
+	s.update(id, func(order *OrderRecord) bool {
+		if !order.Status.IsOpen() {
+			return false
+		}
+
+		order.Status = status
+		if reason != "" {
+			order.Reason = reason
+		}
+
+		return true
+	})
+}
+
+// update changes an order with fn, which reports whether it changed
+// anything.
+func (s *OrderStore) update(id string, fn func(order *OrderRecord) bool) {
+	s.mu.Lock()
+
+	order, ok := s.orders[id]
+	if !ok || !fn(order) {
+		s.mu.Unlock()
+		return
+	}
+
+	order.UpdatedAt = time.Now()
+	updated := *order
+	s.mu.Unlock()
+
+	if s.observe != nil {
+		s.observe(updated)
+	}
+}
+
+func (s *OrderStore) Get(id string) (OrderRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return OrderRecord{}, ErrOrderNotFound
+	}
+
+	return *order, nil
+}
+
+// UserOrders returns the orders of a user, newest first. An empty status
+// returns orders in every status.
+func (s *OrderStore) UserOrders(userID string, status OrderStatus) []OrderRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := make([]OrderRecord, 0)
+	for _, order := range s.byUser[userID] {
+		if status == "" || order.Status == status {
+			orders = append(orders, *order)
+		}
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+
+	return orders
+}
@@ -0,0 +1,507 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/order_book"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	ReferenceLastTrade PriceReference = "last_trade"
+	ReferenceIndex     PriceReference = "index"
+
+	ResumeAfterCooldown ResumeMode = "cooldown"
+	ResumeByAuction     ResumeMode = "auction"
+)
+
+type (
+	// PriceReference is the price bands are centered on. Markets referenced
+	// to an index fall back to the last trade until an index price is set.
+	PriceReference string
+
+	// ResumeMode is how a market halted by its circuit breaker reopens.
+	ResumeMode string
+
+	// PriceBandConfig protects a market from trading far from its reference
+	// price. Limit orders priced more than BandPct percent away from it are
+	// rejected and market orders stop filling at the edge of the band. A
+	// move of more than BreakerPct percent within Window halts the market
+	// for Cooldown, after which it reopens or, resuming by auction, only
+	// collects limit orders for Auction and reopens at the price uncrossing
+	// them. A zero BandPct or BreakerPct disables bands or the breaker.
+	PriceBandConfig struct {
+		BandPct    float64
+		Reference  PriceReference
+		BreakerPct float64
+		Window     time.Duration
+		Cooldown   time.Duration
+		Resume     ResumeMode
+		Auction    time.Duration
+	}
+
+	PriceBandRes struct {
+		Reference float64 `json:"reference"`
+		Low       float64 `json:"low"`
+		High      float64 `json:"high"`
+	}
+
+	IndexPriceReq struct {
+		Price float64 `json:"price"`
+	}
+)
+
+func (req *IndexPriceReq) Validate() error {
+	fe := make(fieldErrors)
+	fe.positive("price", req.Price)
+
+	return fe.err()
+}
+
+func (cfg PriceBandConfig) validate(market Market) error {
+	var errs []error
+
+	if cfg.BandPct < 0 || cfg.BandPct >= 100 {
+		errs = append(errs, fmt.Errorf("price_bands.band_pct of market %s must be between 0 and 100", market))
+	}
+
+	switch cfg.Reference {
+	case "", ReferenceLastTrade, ReferenceIndex:
+	default:
+		errs = append(errs, fmt.Errorf("unknown price_bands.reference of market %s: %q", market, cfg.Reference))
+	}
+
+	if cfg.BreakerPct < 0 {
+		errs = append(errs, fmt.Errorf("price_bands.breaker_pct of market %s is negative", market))
+	}
+
+	if cfg.BreakerPct > 0 {
+		if cfg.Window <= 0 || cfg.Cooldown <= 0 {
+			errs = append(errs, fmt.Errorf("price_bands of market %s need a positive window and cooldown", market))
+		}
+
+		switch cfg.Resume {
+		case "", ResumeAfterCooldown:
+		case ResumeByAuction:
+			if cfg.Auction <= 0 {
+				errs = append(errs, fmt.Errorf("price_bands.auction of market %s must be positive", market))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown price_bands.resume of market %s: %q", market, cfg.Resume))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// priceBandConfigJSON is PriceBandConfig with durations written like "1m".
+type priceBandConfigJSON struct {
+	BandPct    float64        `json:"band_pct"`
+	Reference  PriceReference `json:"reference,omitempty"`
+	BreakerPct float64        `json:"breaker_pct,omitempty"`
+	Window     string         `json:"window,omitempty"`
+	Cooldown   string         `json:"cooldown,omitempty"`
+	Resume     ResumeMode     `json:"resume,omitempty"`
+	Auction    string         `json:"auction,omitempty"`
+}
+
+func (c PriceBandConfig) MarshalJSON() ([]byte, error) {
+	raw := priceBandConfigJSON{
+		BandPct:    c.BandPct,
+		Reference:  c.Reference,
+		BreakerPct: c.BreakerPct,
+		Resume:     c.Resume,
+	}
+
+	for _, d := range []struct {
+		value time.Duration
+		field *string
+	}{
+		{c.Window, &raw.Window},
+		{c.Cooldown, &raw.Cooldown},
+		{c.Auction, &raw.Auction},
+	} {
+		if d.value != 0 {
+			*d.field = d.value.String()
+		}
+	}
+
+	return json.Marshal(raw)
+}
+
+func (c *PriceBandConfig) UnmarshalJSON(data []byte) error {
+	var raw priceBandConfigJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*c = PriceBandConfig{
+		BandPct:    raw.BandPct,
+		Reference:  raw.Reference,
+		BreakerPct: raw.BreakerPct,
+		Resume:     raw.Resume,
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"window", raw.Window, &c.Window},
+		{"cooldown", raw.Cooldown, &c.Cooldown},
+		{"auction", raw.Auction, &c.Auction},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("price_bands.%s: %w", d.name, err)
+		}
+		*d.field = value
+	}
+
+	return nil
+}
+
+type pricePoint struct {
+	at    time.Time
+	price float64
+}
+
+// priceGuard holds the price band and circuit breaker state of a market. It
+// is guarded by the book lock of the exchange.
+type priceGuard struct {
+	cfg    PriceBandConfig
+	index  float64
+	window []pricePoint
+	// phase changes whenever a pending resume of the market is scheduled or
+	// called off, timers of an older phase do nothing.
+	phase int
+}
+
+func newPriceGuard(cfg PriceBandConfig) *priceGuard {
+	return &priceGuard{cfg: cfg}
+}
+
+// reference returns the price the band of the book is centered on, ok is
+// false while there is none.
+func (pg *priceGuard) reference(orderBook *order_book.OrderBook) (price float64, ok bool) {
+	if pg.cfg.Reference == ReferenceIndex && pg.index > 0 {
+		return pg.index, true
+	}
+
+	if len(orderBook.Trades) == 0 {
+		return 0, false
+	}
+
+	return orderBook.Trades[len(orderBook.Trades)-1].Price, true
+}
+
+// band returns the band of the book, ok is false if the market has no band
+// or no reference price yet.
+func (pg *priceGuard) band(orderBook *order_book.OrderBook) (band PriceBandRes, ok bool) {
+	if pg == nil || pg.cfg.BandPct == 0 {
+		return PriceBandRes{}, false
+	}
+
+	reference, ok := pg.reference(orderBook)
+	if !ok {
+		return PriceBandRes{}, false
+	}
+
+	return PriceBandRes{
+		Reference: reference,
+		Low:       reference * (1 - pg.cfg.BandPct/100),
+		High:      reference * (1 + pg.cfg.BandPct/100),
+	}, true
+}
+
+// checkLimit rejects limit orders priced outside the band.
+func (pg *priceGuard) checkLimit(orderBook *order_book.OrderBook, price float64) *APIError {
+	band, ok := pg.band(orderBook)
+	if !ok || price >= band.Low && price <= band.High {
+		return nil
+	}
+
+	return NewAPIError(http.StatusUnprocessableEntity, CodePriceOutOfBand,
+		fmt.Sprintf("price %.2f is outside the price band [%.2f, %.2f]", price, band.Low, band.High))
+}
+
+// marketBound returns the worst price a market order on the given side may
+// fill at, ok is false if it isn't bounded.
+func (pg *priceGuard) marketBound(orderBook *order_book.OrderBook, isBid bool) (bound float64, ok bool) {
+	band, ok := pg.band(orderBook)
+	if !ok {
+		return 0, false
+	}
+
+	if isBid {
+		return band.High, true
+	}
+
+	return band.Low, true
+}
+
+// observe adds a trade price to the window of the breaker and returns the
+// largest move in percent it makes against the prices in the window.
+func (pg *priceGuard) observe(now time.Time, price float64) (move float64, tripped bool) {
+	if pg == nil || pg.cfg.BreakerPct == 0 {
+		return 0, false
+	}
+
+	expired := 0
+	for expired < len(pg.window) && now.Sub(pg.window[expired].at) > pg.cfg.Window {
+		expired++
+	}
+	pg.window = append(pg.window[expired:], pricePoint{at: now, price: price})
+
+	for _, p := range pg.window {
+		move = math.Max(move, math.Abs(price-p.price)/p.price*100)
+	}
+
+	return move, move > pg.cfg.BreakerPct
+}
+
+// observeTrades runs the circuit breaker of market over the prices of
+// matches, the book lock must be held.
+func (ex *Exchange) observeTrades(ctx context.Context, market Market, matches []order_book.Match) {
+	guard := ex.guards[market]
+	now := time.Now()
+
+	for _, match := range matches {
+		if move, tripped := guard.observe(now, match.Price); tripped {
+			ex.tripBreaker(ctx, market, move)
+			return
+		}
+	}
+}
+
+// tripBreaker halts market and schedules it to resume, the book lock must be
+// held.
+func (ex *Exchange) tripBreaker(ctx context.Context, market Market, move float64) {
+	guard := ex.guards[market]
+	guard.window = nil
+	guard.phase++
+	phase := guard.phase
+
+	ex.orderBooks[market].SetStatus(order_book.StatusHalted)
+
+	reason := fmt.Sprintf("circuit breaker: price moved %.2f%% within %s", move, guard.cfg.Window)
+	loggerFrom(ctx).Warn("circuit breaker tripped", "market", market, "move_pct", move, "cooldown", guard.cfg.Cooldown)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  ActorSystem,
+		Action: AuditCircuitBreaker,
+		Market: market,
+		Details: map[string]any{
+			"move_pct": move,
+			"window":   guard.cfg.Window.String(),
+			"cooldown": guard.cfg.Cooldown.String(),
+			"resume":   guard.resumeMode(),
+		},
+	})
+	ex.announceStatus(ctx, market, MarketHalted, reason)
+
+	time.AfterFunc(guard.cfg.Cooldown, func() {
+		ex.resumeMarket(market, phase)
+	})
+}
+
+func (pg *priceGuard) resumeMode() ResumeMode {
+	if pg.cfg.Resume == "" {
+		return ResumeAfterCooldown
+	}
+
+	return pg.cfg.Resume
+}
+
+// resumeMarket ends the halt of a market once its cooldown is over, unless
+// the status was changed by an operator in the meantime.
+func (ex *Exchange) resumeMarket(market Market, phase int) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	guard := ex.guards[market]
+	if guard.phase != phase {
+		return
+	}
+
+	ctx := withLogger(context.Background(), ex.log)
+
+	if guard.resumeMode() == ResumeAfterCooldown {
+		ex.orderBooks[market].SetStatus(order_book.StatusOpen)
+		ex.log.Info("market reopened after circuit breaker", "market", market)
+		ex.announceStatus(ctx, market, MarketOpen, "circuit breaker cooldown over")
+		return
+	}
+
+	guard.phase++
+	phase = guard.phase
+
+	ex.orderBooks[market].SetStatus(order_book.StatusPostOnly)
+	ex.log.Info("reopening auction started", "market", market, "duration", guard.cfg.Auction)
+	ex.announceStatus(ctx, market, MarketPostOnly, fmt.Sprintf("reopening auction until %s", time.Now().Add(guard.cfg.Auction).UTC().Format(time.RFC3339)))
+
+	time.AfterFunc(guard.cfg.Auction, func() {
+		ex.endAuction(market, phase)
+	})
+}
+
+// endAuction reopens a market by uncrossing the orders collected during the
+// reopening auction at a single price. If the trades can't be settled the
+// market is halted again for an operator to step in.
+func (ex *Exchange) endAuction(market Market, phase int) {
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	guard := ex.guards[market]
+	if guard.phase != phase {
+		return
+	}
+
+	ctx := withLogger(context.Background(), ex.log)
+	orderBook := ex.orderBooks[market]
+	orderBook.SetStatus(order_book.StatusOpen)
+
+	reference, _ := guard.reference(orderBook)
+	price, matches := orderBook.Uncross(reference)
+
+	reason := "reopening auction ended without trades"
+	if len(matches) > 0 {
+		reason = fmt.Sprintf("reopening auction uncrossed at %.2f", price)
+		ex.recordAuctionFills(ctx, market, matches)
+		if err := ex.handleMatches(ctx, market, nil, matches); err != nil {
+			ex.haltAuction(ctx, market, matches, err)
+			return
+		}
+		guard.window = []pricePoint{{at: time.Now(), price: price}}
+	}
+
+	ex.log.Info("reopening auction ended", "market", market, "price", price, "matches", len(matches))
+	ex.announceStatus(ctx, market, MarketOpen, reason)
+}
+
+// haltAuction halts market after the trades of its reopening auction failed
+// to settle, the book lock must be held.
+func (ex *Exchange) haltAuction(ctx context.Context, market Market, matches []order_book.Match, err error) {
+	ex.orderBooks[market].SetStatus(order_book.StatusHalted)
+
+	tradeIDs := make([]string, len(matches))
+	for i, match := range matches {
+		tradeIDs[i] = match.TradeID
+	}
+
+	loggerFrom(ctx).Error("settling auction trades", "market", market, "trade_ids", tradeIDs, "error", err)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  ActorSystem,
+		Action: AuditAuctionFailed,
+		Market: market,
+		Details: map[string]any{
+			"trade_ids": tradeIDs,
+			"error":     err.Error(),
+		},
+	})
+	ex.announceStatus(ctx, market, MarketHalted, "reopening auction trades failed to settle")
+}
+
+// recordAuctionFills updates the orders on both sides of the matches of an
+// auction and audits them, the exchange acting for both sides.
+func (ex *Exchange) recordAuctionFills(ctx context.Context, market Market, matches []order_book.Match) {
+	for _, match := range matches {
+		ex.Orders.Fill(match.Bid.ID, match.SizeFilled, match.Price, match.Bid.IsFilled())
+		ex.Orders.Fill(match.Ask.ID, match.SizeFilled, match.Price, match.Ask.IsFilled())
+		ex.releaseFilled(match)
+
+		ex.audit.Record(ctx, AuditEntry{
+			Actor:  ActorSystem,
+			Action: AuditOrderFilled,
+			Market: market,
+			Details: map[string]any{
+				"trade_id":     match.TradeID,
+				"bid_order_id": match.Bid.ID,
+				"bid_user_id":  match.Bid.UserID,
+				"ask_order_id": match.Ask.ID,
+				"ask_user_id":  match.Ask.UserID,
+				"size":         match.SizeFilled,
+				"price":        match.Price,
+			},
+		})
+	}
+}
+
+// statusChange is a change of the status of a market, announced once the
+// book lock is released.
+type statusChange struct {
+	ctx   context.Context
+	event MarketStatusEvent
+}
+
+// announceStatus queues a status change for the WebSocket clients, the
+// book lock must be held. Queued under the lock, the changes are announced
+// in the order they were made.
+func (ex *Exchange) announceStatus(ctx context.Context, market Market, status MarketStatus, reason string) {
+	ex.statuses = append(ex.statuses, statusChange{ctx, MarketStatusEvent{
+		Market: market,
+		Status: status,
+		Reason: reason,
+	}})
+}
+
+// unlockBooks releases the book lock and tells the WebSocket clients about
+// the status changes made while it was held.
+func (ex *Exchange) unlockBooks() {
+	statuses := ex.statuses
+	ex.statuses = nil
+	ex.bookMu.Unlock()
+
+	for _, change := range statuses {
+		ex.sessions.broadcast(change.ctx, WSEvent{
+			Type: WSEventMarketStatus,
+			Data: change.event,
+		})
+	}
+}
+
+func (ex *Exchange) handleSetIndexPrice(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	var data IndexPriceReq
+	if err := bindRequest(c, &data); err != nil {
+		return err
+	}
+
+	if _, ok := ex.orderBooks[market]; !ok {
+		return errNotFound("market")
+	}
+
+	guard, ok := ex.guards[market]
+	if !ok || guard.cfg.Reference != ReferenceIndex {
+		return NewAPIError(http.StatusConflict, CodeConflict, fmt.Sprintf("price bands of market %s don't follow an index", market))
+	}
+
+	ex.bookMu.Lock()
+	defer ex.unlockBooks()
+
+	previous := guard.index
+	guard.index = data.Price
+
+	ctx := c.Request().Context()
+	loggerFrom(ctx).Info("index price set", "market", market, "price", data.Price)
+	ex.audit.Record(ctx, AuditEntry{
+		Actor:  adminName(c),
+		Action: AuditIndexPriceSet,
+		Market: market,
+		Details: map[string]any{
+			"from": previous,
+			"to":   data.Price,
+		},
+	})
+
+	return c.JSON(http.StatusOK, ex.marketRes(market))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto_exchange/order_book"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newBandedExchange(t *testing.T, bands PriceBandConfig) *testExchange {
+	t.Helper()
+
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Assets = []AssetConfig{{Asset: "ETH", Settler: SettlerFake}}
+	cfg.Markets = []MarketConfig{{Name: ETH, Base: "ETH", PriceBands: &bands}}
+
+	return startExchange(t, users, cfg, map[Asset]Settler{"ETH": NewFakeSettler()})
+}
+
+func (te *testExchange) market(t *testing.T) MarketRes {
+	t.Helper()
+
+	var markets []MarketRes
+	assert(t, te.do(t, http.MethodGet, "/markets", nil, &markets), http.StatusOK)
+
+	return markets[0]
+}
+
+func (te *testExchange) waitForMarketStatus(t *testing.T, status MarketStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if te.market(t).Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("market never became %s", status)
+}
+
+func (te *testExchange) placeMarket(t *testing.T, userID string, isBid bool, size float64) (int, PlaceOrderRes) {
+	t.Helper()
+
+	var res PlaceOrderRes
+	status := te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    userID,
+		Market:    ETH,
+		OrderType: MarketOrder,
+		IsBid:     isBid,
+		Size:      size,
+	}, &res)
+
+	return status, res
+}
+
+func TestPriceBands(t *testing.T) {
+	te := newBandedExchange(t, PriceBandConfig{BandPct: 5})
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	// without a trade there is no reference price to band around
+	te.placeLimit(t, seller.ID, false, 10, 100)
+	te.placeLimit(t, seller.ID, false, 5, 120)
+	assert(t, te.market(t).PriceBand, (*PriceBandRes)(nil))
+
+	status, _ := te.placeMarket(t, buyer.ID, true, 1)
+	assert(t, status, http.StatusOK)
+	assert(t, te.market(t).PriceBand, &PriceBandRes{Reference: 100, Low: 95, High: 105})
+
+	var apiErr APIError
+	status = te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+		UserID:    buyer.ID,
+		Market:    ETH,
+		OrderType: LimitOrder,
+		IsBid:     true,
+		Size:      1,
+		Price:     110,
+	}, &apiErr)
+	assert(t, status, http.StatusUnprocessableEntity)
+	assert(t, apiErr.Code, CodePriceOutOfBand)
+
+	te.placeLimit(t, seller.ID, false, 5, 104)
+
+	// the market order stops at 105 instead of sweeping up to 120
+	status, res := te.placeMarket(t, buyer.ID, true, 20)
+	assert(t, status, http.StatusOK)
+	assert(t, res.Message, "Order stopped at price band")
+
+	order, err := te.Orders.Get(res.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, order.Status, OrderCancelled)
+	assert(t, order.ExecutedSize, 14.0)
+	assert(t, order.Reason, "stopped at price band 105.00")
+	assert(t, te.orderBooks[ETH].AsksTotalVolume(), 5.0)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	te := newBandedExchange(t, PriceBandConfig{
+		BreakerPct: 10,
+		Window:     time.Minute,
+		Cooldown:   50 * time.Millisecond,
+		Resume:     ResumeByAuction,
+		Auction:    200 * time.Millisecond,
+	})
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	te.placeLimit(t, seller.ID, false, 1, 100)
+	te.placeLimit(t, seller.ID, false, 1, 120)
+
+	status, _ := te.placeMarket(t, buyer.ID, true, 2)
+	assert(t, status, http.StatusOK)
+	assert(t, te.market(t).Status, MarketHalted)
+
+	status, _ = te.placeMarket(t, buyer.ID, true, 1)
+	assert(t, status, http.StatusConflict)
+
+	// the reopening auction collects crossing orders and uncrosses them
+	te.waitForMarketStatus(t, MarketPostOnly)
+	bidID := te.placeLimit(t, buyer.ID, true, 2, 115)
+	askID := te.placeLimit(t, seller.ID, false, 2, 110)
+
+	te.waitForMarketStatus(t, MarketOpen)
+	for _, id := range []string{bidID, askID} {
+		order, err := te.Orders.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, order.Status, OrderFilled)
+		assert(t, order.AvgFillPrice, 115.0)
+	}
+
+	var breakers int
+	for _, entry := range te.auditEntries(t) {
+		if entry.Action == AuditCircuitBreaker {
+			assert(t, entry.Actor, ActorSystem)
+			breakers++
+		}
+	}
+	assert(t, breakers, 1)
+}
+
+func TestAuctionSettlementFailure(t *testing.T) {
+	te := newBandedExchange(t, PriceBandConfig{
+		BreakerPct: 10,
+		Window:     time.Minute,
+		Cooldown:   50 * time.Millisecond,
+		Resume:     ResumeByAuction,
+		Auction:    200 * time.Millisecond,
+	})
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	te.placeLimit(t, seller.ID, false, 1, 100)
+	te.placeLimit(t, seller.ID, false, 1, 120)
+	te.placeMarket(t, buyer.ID, true, 2)
+
+	// the seller of the ask is unknown, so its trade can't be settled
+	te.waitForMarketStatus(t, MarketPostOnly)
+	te.placeLimit(t, buyer.ID, true, 2, 115)
+	te.bookMu.Lock()
+	te.orderBooks[ETH].PlaceLimitOrder(order_book.NewOrder("unknown", 2, false), 110)
+	te.bookMu.Unlock()
+
+	te.waitForMarketStatus(t, MarketHalted)
+
+	var failures int
+	for _, entry := range te.auditEntries(t) {
+		if entry.Action == AuditAuctionFailed {
+			assert(t, entry.Actor, ActorSystem)
+			failures++
+		}
+	}
+	assert(t, failures, 1)
+}
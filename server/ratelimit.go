@@ -0,0 +1,293 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderUserID names the user a request says it is made for. It is only
+	// recorded next to the user of the API key of the request, who acts.
+	HeaderUserID = "X-User-ID"
+
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+type (
+	// RateLimitConfig configures the token buckets requests are taken from.
+	// Every request takes its weight, 1 unless set in Weights under
+	// "METHOD /route", from the bucket of its IP and, if it is
+	// authenticated, of the user of its API key. Placing an order also
+	// takes a token from the user's bucket of the market, registering a
+	// user one from the registration bucket of the IP, which is kept
+	// small as every registration encrypts a key.
+	RateLimitConfig struct {
+		Enabled       bool           `json:"enabled"`
+		IP            LimitConfig    `json:"ip"`
+		User          LimitConfig    `json:"user"`
+		Orders        LimitConfig    `json:"orders"`
+		Registrations LimitConfig    `json:"registrations"`
+		Weights       map[string]int `json:"weights,omitempty"`
+	}
+
+	// LimitConfig is a token bucket refilled with Rate tokens per second up
+	// to Burst tokens.
+	LimitConfig struct {
+		Rate  float64 `json:"rate"`
+		Burst int     `json:"burst"`
+	}
+)
+
+var DefaultRateLimitConfig = RateLimitConfig{
+	Enabled: true,
+	IP:      LimitConfig{Rate: 50, Burst: 100},
+	User:    LimitConfig{Rate: 20, Burst: 40},
+	Orders:  LimitConfig{Rate: 10, Burst: 20},
+	// a registration a minute
+	Registrations: LimitConfig{Rate: 1.0 / 60, Burst: 5},
+	Weights: map[string]int{
+		"GET /book/:market":      5,
+		"DELETE /orders":         5,
+		"POST /orders/batch":     5,
+		"GET /admin/settlements": 5,
+		"GET /trades/:market":    2,
+	},
+}
+
+func (cfg LimitConfig) validate(name string) error {
+	if cfg.Rate <= 0 || math.IsInf(cfg.Rate, 0) || cfg.Burst < 1 {
+		return fmt.Errorf("rate_limit.%s needs a positive rate and burst", name)
+	}
+
+	return nil
+}
+
+func (cfg RateLimitConfig) validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	errs := []error{
+		cfg.IP.validate("ip"),
+		cfg.User.validate("user"),
+		cfg.Orders.validate("orders"),
+		cfg.Registrations.validate("registrations"),
+	}
+	for route, weight := range cfg.Weights {
+		if weight < 1 || weight > cfg.IP.Burst || weight > cfg.User.Burst {
+			errs = append(errs, fmt.Errorf("rate_limit.weights[%s] must be between 1 and the burst", route))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// limiterSet holds a token bucket per key, buckets idle for a while are
+// dropped.
+type limiterSet struct {
+	mu        sync.Mutex
+	cfg       LimitConfig
+	limiters  map[string]*limiter
+	lastSweep time.Time
+}
+
+type limiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newLimiterSet(cfg LimitConfig) *limiterSet {
+	return &limiterSet{
+		cfg:       cfg,
+		limiters:  make(map[string]*limiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// rateLimit is the outcome of taking tokens from a bucket.
+type rateLimit struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	retryAfter time.Duration
+	reset      time.Duration // until the bucket is full again
+}
+
+// take takes n tokens from the bucket of key.
+func (ls *limiterSet) take(key string, n int) rateLimit {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(ls.lastSweep) > limiterIdleTimeout {
+		for k, l := range ls.limiters {
+			if now.Sub(l.lastSeen) > limiterIdleTimeout {
+				delete(ls.limiters, k)
+			}
+		}
+		ls.lastSweep = now
+	}
+
+	l, ok := ls.limiters[key]
+	if !ok {
+		l = &limiter{Limiter: rate.NewLimiter(rate.Limit(ls.cfg.Rate), ls.cfg.Burst)}
+		ls.limiters[key] = l
+	}
+	l.lastSeen = now
+
+	rl := rateLimit{
+		allowed: l.AllowN(now, n),
+		limit:   ls.cfg.Burst,
+	}
+
+	tokens := l.TokensAt(now)
+	rl.remaining = int(math.Max(0, math.Floor(tokens)))
+	rl.reset = time.Duration((float64(ls.cfg.Burst) - tokens) / ls.cfg.Rate * float64(time.Second))
+	if !rl.allowed {
+		missing := float64(n) - tokens
+		rl.retryAfter = time.Duration(missing / ls.cfg.Rate * float64(time.Second))
+	}
+
+	return rl
+}
+
+// rateLimiter limits the requests to the exchange.
+type rateLimiter struct {
+	cfg           RateLimitConfig
+	ips           *limiterSet
+	users         *limiterSet
+	orders        *limiterSet
+	registrations *limiterSet
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:           cfg,
+		ips:           newLimiterSet(cfg.IP),
+		users:         newLimiterSet(cfg.User),
+		orders:        newLimiterSet(cfg.Orders),
+		registrations: newLimiterSet(cfg.Registrations),
+	}
+}
+
+func (rl *rateLimiter) weight(c echo.Context) int {
+	if weight, ok := rl.cfg.Weights[c.Request().Method+" "+c.Path()]; ok {
+		return weight
+	}
+
+	return 1
+}
+
+// requestUser returns the user a request says it is made for.
+func requestUser(c echo.Context) string {
+	if userID := c.Request().Header.Get(HeaderUserID); userID != "" {
+		return userID
+	}
+	if userID := c.QueryParam("user_id"); userID != "" {
+		return userID
+	}
+
+	return c.Param("userID")
+}
+
+// limitIP takes the weight of a request from the bucket of its IP and
+// rejects it once the bucket is empty. It runs before the request is
+// authenticated, so requests with invalid credentials are limited too.
+func (rl *rateLimiter) limitIP(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		result := rl.ips.take(c.RealIP(), rl.weight(c))
+
+		setRateLimitHeaders(c, result)
+		if !result.allowed {
+			return errRateLimited(c, result)
+		}
+
+		return next(c)
+	}
+}
+
+// limitUser takes the weight of an authenticated request from the bucket
+// of its user, or operator, and rejects it once the bucket is empty. The
+// headers tell the tighter of the two limits of the request.
+func (rl *rateLimiter) limitUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		p := principal(c)
+		if p == "" {
+			return next(c)
+		}
+
+		result := rl.users.take(p, rl.weight(c))
+		remaining, _ := strconv.Atoi(c.Response().Header().Get(HeaderRateLimitRemaining))
+		if !result.allowed || result.remaining < remaining {
+			setRateLimitHeaders(c, result)
+		}
+		if !result.allowed {
+			return errRateLimited(c, result)
+		}
+
+		return next(c)
+	}
+}
+
+// takeOrder takes a token from the order bucket of the user in market.
+func (rl *rateLimiter) takeOrder(userID string, market Market) rateLimit {
+	return rl.orders.take(userID+"/"+string(market), 1)
+}
+
+// allowOrder rejects an order once the order bucket of the user in market
+// is empty.
+func (rl *rateLimiter) allowOrder(c echo.Context, userID string, market Market) error {
+	result := rl.takeOrder(userID, market)
+	if !result.allowed {
+		setRateLimitHeaders(c, result)
+		return errRateLimited(c, result)
+	}
+
+	return nil
+}
+
+// allowRegistration rejects registering a user once the registration
+// bucket of the IP of the request is empty.
+func (rl *rateLimiter) allowRegistration(c echo.Context) error {
+	result := rl.registrations.take(c.RealIP(), 1)
+	if !result.allowed {
+		setRateLimitHeaders(c, result)
+		return errRateLimited(c, result)
+	}
+
+	return nil
+}
+
+func setRateLimitHeaders(c echo.Context, result rateLimit) {
+	header := c.Response().Header()
+	header.Set(HeaderRateLimitLimit, strconv.Itoa(result.limit))
+	header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.remaining))
+	header.Set(HeaderRateLimitReset, strconv.Itoa(retrySeconds(result.reset)))
+}
+
+func errRateLimited(c echo.Context, result rateLimit) error {
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(retrySeconds(result.retryAfter)))
+
+	return errRateLimit()
+}
+
+func errRateLimit() *APIError {
+	return NewAPIError(http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+}
+
+// retrySeconds rounds d up to whole seconds as used by the rate limit
+// headers.
+func retrySeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
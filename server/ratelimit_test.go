@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func newRateLimitedExchange(t *testing.T, cfg RateLimitConfig) *testExchange {
+	t.Helper()
+	return newRateLimitedExchangeWith(t, cfg, HTTPConfig{Addr: ":0"})
+}
+
+func newRateLimitedExchangeWith(t *testing.T, cfg RateLimitConfig, http HTTPConfig) *testExchange {
+	t.Helper()
+
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exCfg := testConfig()
+	exCfg.Assets = []AssetConfig{{Asset: "ETH", Settler: SettlerFake}}
+	exCfg.RateLimit = cfg
+	exCfg.HTTP = http
+
+	return startExchange(t, users, exCfg, map[Asset]Settler{"ETH": NewFakeSettler()})
+}
+
+func (te *testExchange) get(t *testing.T, path string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	return te.send(t, http.MethodGet, path, nil, header)
+}
+
+func TestRateLimitWeights(t *testing.T) {
+	te := newRateLimitedExchange(t, RateLimitConfig{
+		Enabled:       true,
+		IP:            LimitConfig{Rate: 0.001, Burst: 100},
+		User:          LimitConfig{Rate: 0.001, Burst: 5},
+		Orders:        LimitConfig{Rate: 0.001, Burst: 5},
+		Registrations: LimitConfig{Rate: 0.001, Burst: 2},
+		Weights:       map[string]int{"GET /book/:market": 3},
+	})
+
+	alice := map[string]string{HeaderAPIKey: te.registerUser(t).APIKey}
+	bob := map[string]string{HeaderAPIKey: te.registerUser(t).APIKey}
+
+	rec := te.get(t, "/book/ETH", alice)
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(HeaderRateLimitLimit), "5")
+	assert(t, rec.Header().Get(HeaderRateLimitRemaining), "2")
+
+	rec = te.get(t, "/book/ETH", alice)
+	assert(t, rec.Code, http.StatusTooManyRequests)
+	if rec.Header().Get(echo.HeaderRetryAfter) == "" {
+		t.Error("no Retry-After header")
+	}
+
+	// other users have their own bucket
+	rec = te.get(t, "/book/ETH", bob)
+	assert(t, rec.Code, http.StatusOK)
+
+	// naming a user without its key takes only from the IP bucket
+	rec = te.get(t, "/book/ETH", map[string]string{HeaderUserID: "carol"})
+	assert(t, rec.Code, http.StatusOK)
+	assert(t, rec.Header().Get(HeaderRateLimitLimit), "100")
+
+	var apiErr APIError
+	rec = te.get(t, "/book/ETH", map[string]string{HeaderAPIKey: "not a key"})
+	assert(t, rec.Code, http.StatusUnauthorized)
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &apiErr), nil)
+	assert(t, apiErr.Code, CodeUnauthorized)
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	cfg := RateLimitConfig{
+		Enabled:       true,
+		IP:            LimitConfig{Rate: 0.001, Burst: 1},
+		User:          LimitConfig{Rate: 0.001, Burst: 1},
+		Orders:        LimitConfig{Rate: 0.001, Burst: 1},
+		Registrations: LimitConfig{Rate: 0.001, Burst: 1},
+	}
+
+	// without trusted proxies X-Forwarded-For is ignored
+	te := newRateLimitedExchange(t, cfg)
+	assert(t, te.get(t, "/book/ETH", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}).Code, http.StatusOK)
+	assert(t, te.get(t, "/book/ETH", map[string]string{echo.HeaderXForwardedFor: "198.51.100.2"}).Code, http.StatusTooManyRequests)
+
+	// behind a trusted proxy each client has its own bucket, test requests
+	// come from 192.0.2.1
+	te = newRateLimitedExchangeWith(t, cfg, HTTPConfig{Addr: ":0", TrustedProxies: []string{"192.0.2.0/24"}})
+	assert(t, te.get(t, "/book/ETH", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}).Code, http.StatusOK)
+	assert(t, te.get(t, "/book/ETH", map[string]string{echo.HeaderXForwardedFor: "198.51.100.2"}).Code, http.StatusOK)
+	assert(t, te.get(t, "/book/ETH", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}).Code, http.StatusTooManyRequests)
+}
+
+func TestRateLimitOrdersPerMarket(t *testing.T) {
+	te := newRateLimitedExchange(t, RateLimitConfig{
+		Enabled:       true,
+		IP:            LimitConfig{Rate: 100, Burst: 100},
+		User:          LimitConfig{Rate: 100, Burst: 100},
+		Orders:        LimitConfig{Rate: 0.001, Burst: 2},
+		Registrations: LimitConfig{Rate: 0.001, Burst: 1},
+	})
+	user := te.registerUser(t)
+
+	req := &PlaceOrderReq{UserID: user.ID, Market: ETH, OrderType: LimitOrder, Size: 1, Price: 3500}
+	for i := 0; i < 2; i++ {
+		assert(t, te.do(t, http.MethodPost, "/order", req, nil), http.StatusOK)
+	}
+
+	var apiErr APIError
+	assert(t, te.do(t, http.MethodPost, "/order", req, &apiErr), http.StatusTooManyRequests)
+	assert(t, apiErr.Code, CodeRateLimited)
+}
+
+func TestRateLimitRegistrations(t *testing.T) {
+	te := newRateLimitedExchange(t, RateLimitConfig{
+		Enabled:       true,
+		IP:            LimitConfig{Rate: 100, Burst: 100},
+		User:          LimitConfig{Rate: 100, Burst: 100},
+		Orders:        LimitConfig{Rate: 100, Burst: 100},
+		Registrations: LimitConfig{Rate: 0.001, Burst: 2},
+	})
+	te.registerUser(t)
+	te.registerUser(t)
+
+	var apiErr APIError
+	assert(t, te.do(t, http.MethodPost, "/users", &RegisterUserReq{}, &apiErr), http.StatusTooManyRequests)
+	assert(t, apiErr.Code, CodeRateLimited)
+
+	// other requests of the IP go on
+	assert(t, te.get(t, "/book/ETH", nil).Code, http.StatusOK)
+}
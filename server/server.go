@@ -2,59 +2,227 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
-	"log"
+	"google.golang.org/grpc"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-func StartServer() {
-	e := echo.New()
+// shutdownTimeout bounds how long the servers wait for the requests and
+// streams in flight when the exchange shuts down.
+const shutdownTimeout = 10 * time.Second
+
+// StartServer runs the exchange until the process is interrupted or
+// terminated, exiting if it fails.
+func StartServer(cfg Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := Run(ctx, cfg); err != nil {
+		slog.Error("running the exchange", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Run serves the exchange until ctx is done or a server fails, then shuts
+// it down: the servers stop, the pending trades are submitted for
+// settlement and the audit log is closed.
+func Run(ctx context.Context, cfg Config) error {
+	logger, _ := newLogger(cfg.Log, os.Stderr)
+	slog.SetDefault(logger)
+
+	client, err := ethclient.Dial(cfg.Chain.RPCURL)
+	if err != nil {
+		return fmt.Errorf("connecting to the ethereum node: %w", err)
+	}
+
+	passphrase, err := cfg.Users.passphrase()
+	if err != nil {
+		return fmt.Errorf("reading the keystore passphrase: %w", err)
+	}
+
+	users, err := NewUserStore(cfg.Users.KeystoreDir, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+	if err != nil {
+		return fmt.Errorf("opening the user keystore: %w", err)
+	}
 
-	client, err := ethclient.Dial("http://localhost:8545")
+	settlements, err := NewSettlementQueue(cfg.Persistence.SettlementQueue)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("opening the settlement queue: %w", err)
 	}
 
-	ex, err := NewExchange(client, exchangePrivateKey)
+	audit, err := OpenAuditLog(cfg.Persistence.AuditLog)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("opening the audit log: %w", err)
 	}
+	defer audit.Close()
 
-	user1 := NewUser("ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80")
-	user1.ID = "1"
-	ex.Users[user1.ID] = user1
+	operator, err := cfg.Chain.operatorKey()
+	if err != nil {
+		return fmt.Errorf("reading the operator key: %w", err)
+	}
 
-	user2 := NewUser("59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d")
-	user2.ID = "2"
-	ex.Users[user2.ID] = user2
+	nonces := NewNonceManager(client)
+	settlers := make(map[Asset]Settler)
+	for _, asset := range cfg.Assets {
+		settler, err := NewSettler(asset, client, nonces, operator, cfg.Persistence.LedgerDir)
+		if err != nil {
+			return fmt.Errorf("creating the settler of %s: %w", asset.Asset, err)
+		}
+		settlers[asset.Asset] = settler
+	}
 
-	user3 := NewUser("5de4111afa1a4b94908f83103eb1f1706367c2e68ca870fc3fb9a804cdab365a")
-	user3.ID = "3"
-	ex.Users[user3.ID] = user3
+	ex, err := NewExchange(cfg, users, settlements, audit, settlers)
+	if err != nil {
+		return fmt.Errorf("creating the exchange: %w", err)
+	}
+	// from here on the level of every logger follows the admin API
+	slog.SetDefault(ex.log)
 
-	go checkBalances(ex.Client)
+	// settlement outlives the servers, so the trades of the last requests
+	// are batched before the exchange stops
+	settleCtx, stopSettlement := context.WithCancel(context.Background())
+	settled := make(chan struct{})
+	go func() {
+		ex.RunSettlement(settleCtx)
+		close(settled)
+	}()
+	defer func() {
+		stopSettlement()
+		<-settled
+	}()
+
+	go checkBalances(client, ex.Users)
+
+	errs := make(chan error, 3)
+
+	if cfg.GRPC.Addr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPC.Addr)
+		if err != nil {
+			return fmt.Errorf("listening for gRPC: %w", err)
+		}
+		s := ex.GRPCServer()
+		defer stopGRPC(s)
+		go func() {
+			if err := s.Serve(lis); err != nil {
+				errs <- fmt.Errorf("serving gRPC: %w", err)
+			}
+		}()
+	}
+
+	if cfg.FIX.Addr != "" {
+		lis, err := net.Listen("tcp", cfg.FIX.Addr)
+		if err != nil {
+			return fmt.Errorf("listening for FIX: %w", err)
+		}
+		acceptor := ex.FIXAcceptor(cfg.FIX)
+		defer acceptor.Close()
+		go func() {
+			if err := acceptor.Serve(lis); err != nil {
+				errs <- fmt.Errorf("serving FIX: %w", err)
+			}
+		}()
+	}
 
+	e := echo.New()
+	ex.Routes(e)
+	go func() {
+		if err := e.Start(cfg.HTTP.Addr); !errors.Is(err, http.ErrServerClosed) {
+			errs <- fmt.Errorf("serving HTTP: %w", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		ex.log.Info("shutting down")
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		ex.log.Error("shutting down HTTP", "error", err)
+	}
+
+	return err
+}
+
+// stopGRPC lets the calls in flight finish, closing the ones still open
+// after shutdownTimeout, such as order streams.
+func stopGRPC(s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		s.Stop()
+	}
+}
+
+func checkBalances(client ChainClient, users *UserStore) {
+	time.Sleep(10 * time.Second)
+
+	for _, user := range users.List() {
+		balance, _ := client.BalanceAt(context.Background(), user.Address, nil)
+		slog.Info("user balance", "user_id", user.ID, "address", user.Address.Hex(), "balance", balance)
+	}
+}
+
+func (ex *Exchange) Routes(e *echo.Echo) {
+	e.HTTPErrorHandler = handleError
+	e.IPExtractor = ex.clientIP
+	e.Use(ex.requestLogger)
+	e.Use(ex.metrics.middleware)
+	if ex.limiter != nil {
+		e.Use(ex.limiter.limitIP)
+	}
+	e.Use(ex.authenticate)
+	if ex.limiter != nil {
+		e.Use(ex.limiter.limitUser)
+	}
+
+	e.GET("/markets", ex.handleGetMarkets)
 	e.GET("/book/:market", ex.handleGetOrderBook)
 	e.GET("/book/:market/best-price", ex.handleGetBestPrice)
+	e.GET("/book/:market/depth", ex.handleGetBookDepth)
 	e.POST("/order", ex.handlePlaceOrder)
+	e.GET("/order/:id", ex.handleGetOrder)
+	e.PUT("/order/:id", ex.handleAmendOrder)
 	e.DELETE("/order/:id", ex.handleCancelOrder)
+	e.DELETE("/orders", ex.handleCancelAll)
+	e.POST("/orders/cancel-after", ex.handleCancelAfter)
+	e.POST("/orders/batch", ex.handleBatchOrders)
+	e.GET("/order/client/:userID/:clientOrderID", ex.handleGetClientOrder)
+	e.DELETE("/order/client/:userID/:clientOrderID", ex.handleCancelClientOrder)
 	e.GET("/users/:market/:userID/orders", ex.handleGetUserOrders)
 	e.GET("/trades/:market", ex.handleGetTrades)
+	e.POST("/users", ex.handleRegisterUser)
+	e.GET("/users/:id", ex.handleGetUser)
+	e.GET("/users/:userID/orders", ex.handleGetOrderHistory)
+	e.GET("/users/:userID/balances", ex.handleGetBalances)
+	e.GET("/ws", ex.handleWS)
+	e.GET("/metrics", ex.metrics.handler())
+	e.GET("/openapi.json", handleGetOpenAPI)
 
-	e.Logger.Fatal(e.Start(":3000"))
-}
-
-func checkBalances(client *ethclient.Client) {
-	time.Sleep(10 * time.Second)
-
-	address1 := "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
-	balance1, _ := client.BalanceAt(context.Background(), common.HexToAddress(address1), nil)
-	fmt.Printf("user1 - [address: %s], [balance: %d]\n", address1, balance1)
-
-	address2 := "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"
-	balance2, _ := client.BalanceAt(context.Background(), common.HexToAddress(address2), nil)
-	fmt.Printf("user2 - [address: %s], [balance: %d]\n", address2, balance2)
+	admin := e.Group("/admin", ex.adminAuth)
+	admin.GET("/log-level", ex.handleGetLogLevel)
+	admin.PUT("/log-level", ex.handleSetLogLevel)
+	admin.PUT("/markets/:market/status", ex.handleSetMarketStatus)
+	admin.PUT("/markets/:market/index-price", ex.handleSetIndexPrice)
+	admin.POST("/deposits", ex.handleDeposit)
+	admin.GET("/settlements", ex.handleGetSettlements)
+	admin.POST("/users/:userID/api-key", ex.handleIssueAPIKey)
 }
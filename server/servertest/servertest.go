@@ -0,0 +1,83 @@
+// Package servertest runs exchanges for the tests of the packages built on
+// the server, like httptest does for HTTP servers.
+package servertest
+
+import (
+	"context"
+	"crypto_exchange/server"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/labstack/echo/v4"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Config returns the configuration of a test exchange: an ETH market
+// settled by a fake settler, without rate limits and logging warnings only.
+func Config() server.Config {
+	cfg := server.DefaultConfig()
+	cfg.Assets = []server.AssetConfig{{Asset: "ETH", Settler: server.SettlerFake}}
+	cfg.Markets = []server.MarketConfig{{Name: server.ETH, Base: "ETH"}}
+	cfg.RateLimit.Enabled = false
+	cfg.Log.Level = "warn"
+
+	return cfg
+}
+
+// NewExchange returns an exchange of cfg keeping its state in a temporary
+// directory. Every asset gets a fake settler, trades are settled until the
+// test ends and settlement has stopped before the directory is removed.
+func NewExchange(t testing.TB, cfg server.Config) *server.Exchange {
+	t.Helper()
+
+	dir := t.TempDir()
+	users, err := server.NewUserStore(filepath.Join(dir, "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settlements, err := server.NewSettlementQueue(filepath.Join(dir, "settlements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := server.OpenAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+
+	settlers := make(map[server.Asset]server.Settler)
+	for _, asset := range cfg.Assets {
+		settlers[asset.Asset] = server.NewFakeSettler()
+	}
+
+	ex, err := server.NewExchange(cfg, users, settlements, audit, settlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ex.RunSettlement(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	return ex
+}
+
+// Serve serves the API of ex over HTTP until the test ends and returns its
+// URL.
+func Serve(t testing.TB, ex *server.Exchange) string {
+	t.Helper()
+
+	e := echo.New()
+	ex.Routes(e)
+	ts := httptest.NewServer(e)
+	t.Cleanup(ts.Close)
+
+	return ts.URL
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	SettlementPending   SettlementStatus = "pending"
+	SettlementSubmitted SettlementStatus = "submitted"
+	SettlementConfirmed SettlementStatus = "confirmed"
+	SettlementNetted    SettlementStatus = "netted"
+	SettlementFailed    SettlementStatus = "failed"
+)
+
+type (
+	SettlementStatus string
+
+	// Settlement is the settlement state of a single trade. A trade settles
+	// in one leg per asset moved, the trade is settled once all legs are.
+	Settlement struct {
+		TradeID string           `json:"trade_id"`
+		Status  SettlementStatus `json:"status"`
+		Legs    []SettlementLeg  `json:"legs,omitempty"`
+	}
+
+	// SettlementLeg is the state of the job moving one asset of a trade.
+	// Ref refers to the transfer made by the settler, for on-chain assets the
+	// transaction hash. Compensation legs move back what the other legs of a
+	// trade with a failed leg moved.
+	SettlementLeg struct {
+		JobID        string           `json:"job_id"`
+		Asset        Asset            `json:"asset"`
+		Status       SettlementStatus `json:"status"`
+		Ref          string           `json:"ref,omitempty"`
+		Error        string           `json:"error,omitempty"`
+		Compensation bool             `json:"compensation,omitempty"`
+	}
+)
+
+func (s SettlementStatus) IsFinal() bool {
+	return s == SettlementConfirmed || s == SettlementNetted || s == SettlementFailed
+}
+
+// combinedStatus returns the status of a trade from the status of its legs.
+// A single failed leg fails the trade, netted legs count as settled and a
+// trade with some legs under way is submitted.
+func combinedStatus(legs []SettlementLeg) SettlementStatus {
+	var pending, submitted, confirmed bool
+
+	for _, leg := range legs {
+		switch leg.Status {
+		case SettlementFailed:
+			return SettlementFailed
+		case SettlementPending:
+			pending = true
+		case SettlementSubmitted:
+			submitted = true
+		case SettlementConfirmed:
+			confirmed = true
+		}
+	}
+
+	switch {
+	case submitted || (pending && confirmed):
+		return SettlementSubmitted
+	case pending:
+		return SettlementPending
+	case confirmed:
+		return SettlementConfirmed
+	default:
+		return SettlementNetted
+	}
+}
+
+// TradeLeg is an asset moving between the users of a trade.
+type TradeLeg struct {
+	Asset    Asset
+	From, To *User
+	Amount   *big.Int
+}
+
+type pendingTransfer struct {
+	id        string
+	asset     Asset
+	from      *User
+	to        *User
+	amount    *big.Int
+	tradeID   string
+	requestID string
+}
+
+// userPair is an unordered pair of users trading an asset, a is always the
+// user with the lower address so transfers in both directions end up under
+// the same key.
+type userPair struct {
+	asset Asset
+	a, b  common.Address
+}
+
+type nettedTransfer struct {
+	asset      Asset
+	a, b       *User
+	amount     *big.Int // positive moves funds from a to b, negative from b to a
+	tradeIDs   []string
+	requestIDs []string
+	// transferIDs are the IDs of the queued transfers netted
+	transferIDs []string
+	transfers   []TradeTransfer
+}
+
+// SettlementBatcher collects transfers over a window and hands them to the
+// settlement pipeline as one job per user pair, transfers in opposite
+// directions cancel out. Transfers are stored in the settlement queue until
+// they are part of a job, so a restart doesn't lose the current window.
+type SettlementBatcher struct {
+	mu       sync.Mutex
+	window   time.Duration
+	pipeline *SettlementPipeline
+	pending  []pendingTransfer
+}
+
+// NewSettlementBatcher returns a batcher starting with the transfers left
+// in the queue of pipeline.
+func NewSettlementBatcher(window time.Duration, pipeline *SettlementPipeline) *SettlementBatcher {
+	sb := &SettlementBatcher{
+		window:   window,
+		pipeline: pipeline,
+	}
+
+	for _, queued := range pipeline.queue.queuedTransfers() {
+		from, fromErr := pipeline.users.Get(queued.From)
+		to, toErr := pipeline.users.Get(queued.To)
+		if err := errors.Join(fromErr, toErr); err != nil {
+			pipeline.log.Error("restoring queued settlement transfer", "trade_id", queued.TradeID, "error", err)
+			continue
+		}
+
+		sb.pending = append(sb.pending, pendingTransfer{
+			id:        queued.ID,
+			asset:     queued.Asset,
+			from:      from,
+			to:        to,
+			amount:    queued.Amount,
+			tradeID:   queued.TradeID,
+			requestID: queued.RequestID,
+		})
+	}
+
+	return sb
+}
+
+// Add queues the transfers settling the trade with the given ID, one per
+// asset the trade moves. The ID of the request ctx serves is kept on the
+// settlement jobs. The transfers are stored together, so a restart keeps
+// all or none of them, and are batched even if storing them fails, when
+// they are lost if the exchange stops before they are part of jobs.
+func (sb *SettlementBatcher) Add(ctx context.Context, tradeID string, transfers ...TradeLeg) error {
+	pending := make([]pendingTransfer, len(transfers))
+	queued := make([]*queuedTransfer, len(transfers))
+	for i, leg := range transfers {
+		pending[i] = pendingTransfer{
+			asset:     leg.Asset,
+			from:      leg.From,
+			to:        leg.To,
+			amount:    leg.Amount,
+			tradeID:   tradeID,
+			requestID: requestID(ctx),
+		}
+		queued[i] = &queuedTransfer{
+			Asset:     leg.Asset,
+			From:      leg.From.ID,
+			To:        leg.To.ID,
+			Amount:    leg.Amount,
+			TradeID:   tradeID,
+			RequestID: pending[i].requestID,
+		}
+	}
+
+	ids, err := sb.pipeline.queue.addTransfers(queued)
+	if err == nil {
+		for i, id := range ids {
+			pending[i].id = id
+		}
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	sb.pending = append(sb.pending, pending...)
+
+	return err
+}
+
+// IsPending reports whether the trade is waiting for the current window to
+// be flushed.
+func (sb *SettlementBatcher) IsPending(tradeID string) bool {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	for _, t := range sb.pending {
+		if t.tradeID == tradeID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run flushes the batcher every window until ctx is done.
+func (sb *SettlementBatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(sb.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			sb.Flush()
+			return
+		case <-ticker.C:
+			sb.Flush()
+		}
+	}
+}
+
+// Flush nets the queued transfers and submits them to the pipeline.
+func (sb *SettlementBatcher) Flush() {
+	sb.mu.Lock()
+	pending := sb.pending
+	sb.pending = nil
+	sb.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	var (
+		jobs    []*SettlementJob
+		batched []string
+	)
+	for _, nt := range netTransfers(pending) {
+		job := &SettlementJob{
+			Asset:      nt.asset,
+			From:       nt.a.ID,
+			To:         nt.b.ID,
+			Amount:     nt.amount,
+			TradeIDs:   nt.tradeIDs,
+			RequestIDs: nt.requestIDs,
+			Status:     SettlementPending,
+			Transfers:  nt.transfers,
+		}
+
+		switch {
+		case nt.amount.Sign() == 0 || nt.a.Address == nt.b.Address:
+			job.Status = SettlementNetted
+		case nt.amount.Sign() < 0:
+			job.From, job.To = nt.b.ID, nt.a.ID
+			job.Amount = new(big.Int).Neg(nt.amount)
+		}
+
+		jobs = append(jobs, job)
+		batched = append(batched, nt.transferIDs...)
+	}
+
+	sb.pipeline.submit(jobs, batched)
+}
+
+func netTransfers(transfers []pendingTransfer) []*nettedTransfer {
+	var (
+		netted []*nettedTransfer
+		byPair = make(map[userPair]*nettedTransfer)
+	)
+
+	for _, t := range transfers {
+		a, b, amount := t.from, t.to, t.amount
+		if bytes.Compare(a.Address.Bytes(), b.Address.Bytes()) > 0 {
+			a, b, amount = b, a, new(big.Int).Neg(amount)
+		}
+
+		pair := userPair{asset: t.asset, a: a.Address, b: b.Address}
+		nt, ok := byPair[pair]
+		if !ok {
+			nt = &nettedTransfer{asset: t.asset, a: a, b: b, amount: new(big.Int)}
+			byPair[pair] = nt
+			netted = append(netted, nt)
+		}
+
+		nt.amount.Add(nt.amount, amount)
+		nt.tradeIDs = append(nt.tradeIDs, t.tradeID)
+		nt.transfers = append(nt.transfers, TradeTransfer{
+			TradeID: t.tradeID,
+			From:    t.from.ID,
+			To:      t.to.ID,
+			Amount:  t.amount,
+		})
+		if t.id != "" {
+			nt.transferIDs = append(nt.transferIDs, t.id)
+		}
+		if t.requestID != "" && !slices.Contains(nt.requestIDs, t.requestID) {
+			nt.requestIDs = append(nt.requestIDs, t.requestID)
+		}
+	}
+
+	return netted
+}
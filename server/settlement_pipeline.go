@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrConfirmTimeout fails a transfer that wasn't confirmed within the
+// confirm timeout of the pipeline.
+var ErrConfirmTimeout = errors.New("transfer not confirmed in time")
+
+type SettlementConfig struct {
+	Workers       int
+	Confirmations uint64
+	MaxAttempts   int
+	Backoff       time.Duration
+	MaxBackoff    time.Duration
+	PollInterval  time.Duration
+	// ConfirmTimeout is how long a sent transfer may take to be confirmed
+	// before its job fails.
+	ConfirmTimeout time.Duration
+}
+
+var DefaultSettlementConfig = SettlementConfig{
+	Workers:        4,
+	Confirmations:  1,
+	MaxAttempts:    5,
+	Backoff:        time.Second,
+	MaxBackoff:     time.Minute,
+	PollInterval:   time.Second,
+	ConfirmTimeout: 30 * time.Minute,
+}
+
+// SettlementPipeline processes settlement jobs asynchronously. Workers hand
+// the transfer to the settler of the job's asset, retry failed transfers with
+// exponential backoff and poll until the transfer has enough confirmations.
+type SettlementPipeline struct {
+	cfg      SettlementConfig
+	queue    *SettlementQueue
+	users    *UserStore
+	settlers map[Asset]Settler
+	jobs     chan string
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu        sync.Mutex
+	scheduled map[string]bool
+
+	observe func(job *SettlementJob)
+	log     *slog.Logger
+}
+
+func NewSettlementPipeline(cfg SettlementConfig, queue *SettlementQueue, users *UserStore, settlers map[Asset]Settler) *SettlementPipeline {
+	return &SettlementPipeline{
+		cfg:       cfg,
+		queue:     queue,
+		users:     users,
+		settlers:  settlers,
+		jobs:      make(chan string, 1024),
+		done:      make(chan struct{}),
+		scheduled: make(map[string]bool),
+		log:       slog.Default(),
+	}
+}
+
+// SetObserver registers fn to be called with every job stored or updated by
+// the pipeline. It must be set before the pipeline runs.
+func (sp *SettlementPipeline) SetObserver(fn func(job *SettlementJob)) {
+	sp.observe = fn
+}
+
+// SetLogger sets the logger of the pipeline, it must be set before the
+// pipeline runs.
+func (sp *SettlementPipeline) SetLogger(logger *slog.Logger) {
+	sp.log = logger
+}
+
+// jobLogger returns the logger tagged with the job and the requests whose
+// trades it settles.
+func (sp *SettlementPipeline) jobLogger(job *SettlementJob) *slog.Logger {
+	return sp.log.With("job_id", job.ID, "asset", job.Asset, "request_ids", job.RequestIDs)
+}
+
+func (sp *SettlementPipeline) Queue() *SettlementQueue {
+	return sp.queue
+}
+
+// Submit stores the job and schedules it for processing.
+func (sp *SettlementPipeline) Submit(job *SettlementJob) {
+	sp.submit([]*SettlementJob{job}, nil)
+}
+
+// submit stores the jobs in place of the queued transfers with the given
+// IDs and schedules them for processing. If storing fails the transfers
+// stay queued and are batched again after a restart.
+func (sp *SettlementPipeline) submit(jobs []*SettlementJob, batched []string) {
+	stored, err := sp.queue.addBatch(jobs, batched)
+	if err != nil {
+		for _, job := range jobs {
+			sp.log.Error("storing settlement job", "trade_ids", job.TradeIDs, "request_ids", job.RequestIDs, "error", err)
+		}
+		return
+	}
+
+	for _, job := range stored {
+		sp.jobLogger(job).Info("settlement job submitted", "from", job.From, "to", job.To, "amount", job.Amount, "trade_ids", job.TradeIDs, "status", job.Status)
+
+		if sp.observe != nil {
+			sp.observe(job)
+		}
+
+		if job.Status.IsFinal() {
+			sp.compensate(job)
+		} else {
+			sp.schedule(job.ID, 0)
+		}
+	}
+}
+
+// Run resumes unfinished jobs and processes jobs until ctx is done.
+func (sp *SettlementPipeline) Run(ctx context.Context) {
+	defer sp.stopOnce.Do(func() { close(sp.done) })
+
+	for _, job := range sp.queue.Unfinished() {
+		sp.schedule(job.ID, time.Until(job.NextAttempt))
+	}
+	// trades whose compensation wasn't stored before a restart
+	for _, job := range sp.queue.List(SettlementFailed) {
+		sp.compensate(job)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < sp.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-sp.jobs:
+					sp.mu.Lock()
+					delete(sp.scheduled, id)
+					sp.mu.Unlock()
+
+					sp.process(ctx, id)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// schedule queues the job for a worker after delay. A job is scheduled at
+// most once at a time so two workers never process it concurrently.
+func (sp *SettlementPipeline) schedule(id string, delay time.Duration) {
+	sp.mu.Lock()
+	if sp.scheduled[id] {
+		sp.mu.Unlock()
+		return
+	}
+	sp.scheduled[id] = true
+	sp.mu.Unlock()
+
+	enqueue := func() {
+		select {
+		case sp.jobs <- id:
+		case <-sp.done:
+		}
+	}
+
+	if delay <= 0 {
+		go enqueue()
+		return
+	}
+
+	time.AfterFunc(delay, enqueue)
+}
+
+func (sp *SettlementPipeline) process(ctx context.Context, id string) {
+	job, err := sp.queue.Get(id)
+	if err != nil {
+		sp.log.Error("loading settlement job", "job_id", id, "error", err)
+		return
+	}
+
+	settler, ok := sp.settlers[job.Asset]
+	if !ok {
+		sp.fail(job, fmt.Errorf("no settler for asset %s", job.Asset))
+		return
+	}
+
+	switch job.Status {
+	case SettlementPending:
+		sp.send(ctx, settler, job)
+	case SettlementSubmitted:
+		sp.confirm(ctx, settler, job)
+	}
+}
+
+func (sp *SettlementPipeline) send(ctx context.Context, settler Settler, job *SettlementJob) {
+	from, err := sp.users.Get(job.From)
+	if err != nil {
+		sp.fail(job, fmt.Errorf("from user %s: %w", job.From, err))
+		return
+	}
+	to, err := sp.users.Get(job.To)
+	if err != nil {
+		sp.fail(job, fmt.Errorf("to user %s: %w", job.To, err))
+		return
+	}
+
+	job.Attempts++
+
+	ref, err := settler.Transfer(ctx, from, to, job.Amount)
+	if err != nil {
+		sp.retry(job, err)
+		return
+	}
+
+	job.Status = SettlementSubmitted
+	job.Ref = ref
+	job.Error = ""
+	job.SubmittedAt = time.Now()
+	sp.update(job)
+	sp.jobLogger(job).Info("settlement transfer sent", "ref", ref, "attempt", job.Attempts)
+
+	sp.schedule(job.ID, sp.cfg.PollInterval)
+}
+
+func (sp *SettlementPipeline) confirm(ctx context.Context, settler Settler, job *SettlementJob) {
+	confirmations, err := settler.Confirmations(ctx, job.Ref)
+	switch {
+	case errors.Is(err, ErrTransferPending):
+		sp.poll(job)
+		return
+	case errors.Is(err, ErrTransferReverted), errors.Is(err, ErrTransferNotFound):
+		sp.fail(job, err)
+		return
+	case err != nil:
+		sp.jobLogger(job).Warn("checking settlement transfer", "ref", job.Ref, "error", err)
+		job.Error = err.Error()
+		sp.update(job)
+		sp.poll(job)
+		return
+	}
+
+	job.Confirmations = confirmations
+	if job.Confirmations >= sp.cfg.Confirmations {
+		job.Status = SettlementConfirmed
+		job.Error = ""
+		sp.update(job)
+		sp.jobLogger(job).Info("settlement confirmed", "ref", job.Ref, "confirmations", job.Confirmations)
+		sp.compensate(job)
+		return
+	}
+
+	sp.update(job)
+	sp.poll(job)
+}
+
+// poll checks the transfer of a submitted job again after the poll
+// interval, or fails the job once the confirm timeout passed. The transfer
+// isn't sent again, it could still go through and move the funds twice.
+func (sp *SettlementPipeline) poll(job *SettlementJob) {
+	submittedAt := job.SubmittedAt
+	if submittedAt.IsZero() {
+		// jobs sent before the time was kept
+		submittedAt = job.UpdatedAt
+	}
+
+	if time.Since(submittedAt) >= sp.cfg.ConfirmTimeout {
+		sp.fail(job, fmt.Errorf("%w: %s after %s", ErrConfirmTimeout, job.Ref, sp.cfg.ConfirmTimeout))
+		return
+	}
+
+	sp.schedule(job.ID, sp.cfg.PollInterval)
+}
+
+func (sp *SettlementPipeline) retry(job *SettlementJob, err error) {
+	if job.Attempts >= sp.cfg.MaxAttempts {
+		sp.fail(job, err)
+		return
+	}
+
+	delay := sp.backoff(job.Attempts)
+	sp.jobLogger(job).Warn("settlement transfer failed, retrying", "attempt", job.Attempts, "retry_in", delay, "error", err)
+	job.Error = err.Error()
+	job.NextAttempt = time.Now().Add(delay)
+	sp.update(job)
+
+	sp.schedule(job.ID, delay)
+}
+
+func (sp *SettlementPipeline) backoff(attempts int) time.Duration {
+	delay := sp.cfg.Backoff
+	for i := 1; i < attempts && delay < sp.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, sp.cfg.MaxBackoff)
+}
+
+func (sp *SettlementPipeline) fail(job *SettlementJob, err error) {
+	sp.jobLogger(job).Error("settlement failed", "attempts", job.Attempts, "error", err)
+	job.Status = SettlementFailed
+	job.Error = err.Error()
+	sp.update(job)
+	sp.compensate(job)
+}
+
+// compensate reverses the legs of the trades of a final job that moved
+// funds, once every leg of a trade is final and one of them failed.
+func (sp *SettlementPipeline) compensate(job *SettlementJob) {
+	for _, tradeID := range job.TradeIDs {
+		jobs, err := sp.queue.compensate(tradeID)
+		if err != nil {
+			sp.jobLogger(job).Error("storing settlement compensation", "trade_id", tradeID, "error", err)
+			continue
+		}
+
+		for _, compensation := range jobs {
+			sp.jobLogger(compensation).Warn("compensating partly settled trade", "trade_id", tradeID, "from", compensation.From, "to", compensation.To, "amount", compensation.Amount)
+			if sp.observe != nil {
+				sp.observe(compensation)
+			}
+			sp.schedule(compensation.ID, 0)
+		}
+	}
+}
+
+func (sp *SettlementPipeline) update(job *SettlementJob) {
+	if err := sp.queue.Update(job); err != nil {
+		sp.jobLogger(job).Error("updating settlement job", "error", err)
+		return
+	}
+
+	if sp.observe != nil {
+		sp.observe(job)
+	}
+}
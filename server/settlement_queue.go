@@ -0,0 +1,504 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrSettlementNotFound = errors.New("settlement not found")
+
+type SettlementJob struct {
+	ID            string           `json:"id"`
+	Asset         Asset            `json:"asset"`
+	From          string           `json:"from"`
+	To            string           `json:"to"`
+	Amount        *big.Int         `json:"amount"`
+	TradeIDs      []string         `json:"trade_ids"`
+	RequestIDs    []string         `json:"request_ids,omitempty"`
+	Status        SettlementStatus `json:"status"`
+	Ref           string           `json:"ref,omitempty"`
+	Attempts      int              `json:"attempts"`
+	Confirmations uint64           `json:"confirmations"`
+	Error         string           `json:"error,omitempty"`
+	NextAttempt   time.Time        `json:"next_attempt,omitempty"`
+	SubmittedAt   time.Time        `json:"submitted_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	// Transfers are the transfers of the single trades the job nets.
+	Transfers []TradeTransfer `json:"transfers,omitempty"`
+	// Compensation is set on jobs reversing a leg of the trade in TradeIDs
+	// after another of its legs failed.
+	Compensation bool `json:"compensation,omitempty"`
+}
+
+// TradeTransfer is what a trade moves in the asset of a job.
+type TradeTransfer struct {
+	TradeID string   `json:"trade_id"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Amount  *big.Int `json:"amount"`
+}
+
+func (job *SettlementJob) clone() *SettlementJob {
+	c := *job
+	c.Amount = new(big.Int).Set(job.Amount)
+	c.TradeIDs = append([]string(nil), job.TradeIDs...)
+	c.RequestIDs = append([]string(nil), job.RequestIDs...)
+	c.Transfers = append([]TradeTransfer(nil), job.Transfers...)
+	return &c
+}
+
+// queuedTransfer is a transfer of a trade waiting in the settlement batcher.
+type queuedTransfer struct {
+	ID        string    `json:"id"`
+	Asset     Asset     `json:"asset"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Amount    *big.Int  `json:"amount"`
+	TradeID   string    `json:"trade_id"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// queueRecord is a line of the queue file. Records are replayed in order: a
+// job replaces the earlier state of the job with its ID, a transfer waits
+// for batching until a later record lists its ID in Batched and trades in
+// Compensated had their settled legs reversed. Everything a record holds
+// is written at once, so a batch of jobs replaces the transfers it nets
+// without a crash in between losing or doubling them.
+type queueRecord struct {
+	Jobs        []*SettlementJob  `json:"jobs,omitempty"`
+	Transfers   []*queuedTransfer `json:"transfers,omitempty"`
+	Batched     []string          `json:"batched,omitempty"`
+	Compensated []string          `json:"compensated,omitempty"`
+}
+
+// compactAfter is the least number of records appended before the queue
+// file is rewritten with the current state of every job only.
+const compactAfter = 1000
+
+// SettlementQueue is the persistent store of settlement jobs and of the
+// transfers waiting to be batched into jobs. Every change is appended to
+// the queue file, a log of JSON records that is compacted once it grew,
+// so unfinished jobs and transfers are picked up again after a restart.
+type SettlementQueue struct {
+	mu        sync.RWMutex
+	path      string
+	jobs      map[string]*SettlementJob
+	trades    map[string][]string
+	transfers map[string]*queuedTransfer
+	// compensated holds the trades whose legs were checked for compensation
+	compensated map[string]bool
+	// appended counts the records written since the last compaction
+	appended int
+}
+
+func NewSettlementQueue(path string) (*SettlementQueue, error) {
+	sq := &SettlementQueue{
+		path:        path,
+		jobs:        make(map[string]*SettlementJob),
+		trades:      make(map[string][]string),
+		transfers:   make(map[string]*queuedTransfer),
+		compensated: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sq, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sq.replay(data); err != nil {
+		return nil, err
+	}
+
+	// starting from a compacted file also drops a record cut short by a
+	// crash, which the next record would be appended to
+	if err := sq.compact(); err != nil {
+		return nil, err
+	}
+
+	return sq, nil
+}
+
+// replay loads the queue from the contents of its file. Files written
+// before the queue became a log hold a JSON array of jobs.
+func (sq *SettlementQueue) replay(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var jobs []*SettlementJob
+		if err := json.Unmarshal(trimmed, &jobs); err != nil {
+			return fmt.Errorf("decoding settlement queue: %w", err)
+		}
+		sq.apply(&queueRecord{Jobs: jobs})
+		return nil
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var record queueRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				// the last record was being written when the process died
+				break
+			}
+			return fmt.Errorf("decoding settlement queue line %d: %w", i+1, err)
+		}
+		sq.apply(&record)
+	}
+
+	return nil
+}
+
+func (sq *SettlementQueue) apply(record *queueRecord) {
+	for _, job := range record.Jobs {
+		sq.index(job)
+	}
+	for _, transfer := range record.Transfers {
+		sq.transfers[transfer.ID] = transfer
+	}
+	for _, id := range record.Batched {
+		delete(sq.transfers, id)
+	}
+	for _, tradeID := range record.Compensated {
+		sq.compensated[tradeID] = true
+	}
+}
+
+// index stores the state of a job, a job seen before keeps its trades.
+func (sq *SettlementQueue) index(job *SettlementJob) {
+	if _, ok := sq.jobs[job.ID]; !ok {
+		for _, tradeID := range job.TradeIDs {
+			sq.trades[tradeID] = append(sq.trades[tradeID], job.ID)
+			if job.Compensation {
+				sq.compensated[tradeID] = true
+			}
+		}
+	}
+	sq.jobs[job.ID] = job
+}
+
+// Add stores a new job and assigns it an ID.
+func (sq *SettlementQueue) Add(job *SettlementJob) (*SettlementJob, error) {
+	jobs, err := sq.addBatch([]*SettlementJob{job}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs[0], nil
+}
+
+// addBatch stores new jobs made of the queued transfers with the given IDs,
+// which leave the queue at the same time.
+func (sq *SettlementQueue) addBatch(jobs []*SettlementJob, batched []string) ([]*SettlementJob, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	record := &queueRecord{Batched: batched}
+	for _, job := range jobs {
+		job = job.clone()
+		job.ID = uuid.NewString()
+		job.CreatedAt = time.Now()
+		job.UpdatedAt = job.CreatedAt
+		record.Jobs = append(record.Jobs, job)
+	}
+
+	if err := sq.append(record); err != nil {
+		return nil, err
+	}
+
+	stored := make([]*SettlementJob, len(record.Jobs))
+	for i, job := range record.Jobs {
+		stored[i] = job.clone()
+	}
+
+	return stored, nil
+}
+
+func (sq *SettlementQueue) Update(job *SettlementJob) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	if _, ok := sq.jobs[job.ID]; !ok {
+		return ErrSettlementNotFound
+	}
+
+	job = job.clone()
+	job.UpdatedAt = time.Now()
+
+	return sq.append(&queueRecord{Jobs: []*SettlementJob{job}})
+}
+
+// compensate stores the jobs reversing the legs of a trade that moved funds
+// once another leg of the trade failed, so a trade is settled completely or
+// not at all. It returns the jobs stored, none until every leg of the trade
+// is final, if no leg failed or if the trade was compensated before.
+func (sq *SettlementQueue) compensate(tradeID string) ([]*SettlementJob, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	if sq.compensated[tradeID] {
+		return nil, nil
+	}
+
+	var (
+		failed bool
+		legs   []*SettlementJob
+	)
+	for _, jobID := range sq.trades[tradeID] {
+		job := sq.jobs[jobID]
+		switch {
+		case !job.Status.IsFinal():
+			return nil, nil
+		case job.Status == SettlementFailed:
+			failed = true
+		default:
+			legs = append(legs, job)
+		}
+	}
+	if !failed {
+		return nil, nil
+	}
+
+	record := &queueRecord{Compensated: []string{tradeID}}
+	for _, leg := range legs {
+		for _, t := range leg.Transfers {
+			if t.TradeID != tradeID || t.From == t.To {
+				continue
+			}
+
+			now := time.Now()
+			record.Jobs = append(record.Jobs, &SettlementJob{
+				ID:           uuid.NewString(),
+				Asset:        leg.Asset,
+				From:         t.To,
+				To:           t.From,
+				Amount:       new(big.Int).Set(t.Amount),
+				TradeIDs:     []string{tradeID},
+				RequestIDs:   append([]string(nil), leg.RequestIDs...),
+				Status:       SettlementPending,
+				CreatedAt:    now,
+				UpdatedAt:    now,
+				Compensation: true,
+			})
+		}
+	}
+
+	if err := sq.append(record); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*SettlementJob, len(record.Jobs))
+	for i, job := range record.Jobs {
+		jobs[i] = job.clone()
+	}
+
+	return jobs, nil
+}
+
+// addTransfers stores transfers waiting to be batched and returns the IDs
+// assigned to them.
+func (sq *SettlementQueue) addTransfers(transfers []*queuedTransfer) ([]string, error) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	ids := make([]string, len(transfers))
+	record := &queueRecord{}
+	for i, transfer := range transfers {
+		transfer := *transfer
+		transfer.ID = uuid.NewString()
+		transfer.CreatedAt = time.Now()
+		ids[i] = transfer.ID
+		record.Transfers = append(record.Transfers, &transfer)
+	}
+
+	return ids, sq.append(record)
+}
+
+// queuedTransfers returns the transfers waiting to be batched in the order
+// they were queued.
+func (sq *SettlementQueue) queuedTransfers() []queuedTransfer {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+
+	transfers := make([]queuedTransfer, 0, len(sq.transfers))
+	for _, transfer := range sq.transfers {
+		transfers = append(transfers, *transfer)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].CreatedAt.Before(transfers[j].CreatedAt)
+	})
+
+	return transfers
+}
+
+func (sq *SettlementQueue) Get(id string) (*SettlementJob, error) {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+
+	job, ok := sq.jobs[id]
+	if !ok {
+		return nil, ErrSettlementNotFound
+	}
+
+	return job.clone(), nil
+}
+
+// List returns the jobs ordered by creation time. An empty status returns
+// jobs in every status.
+func (sq *SettlementQueue) List(status SettlementStatus) []*SettlementJob {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+
+	jobs := make([]*SettlementJob, 0, len(sq.jobs))
+	for _, job := range sq.jobs {
+		if status == "" || job.Status == status {
+			jobs = append(jobs, job.clone())
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs
+}
+
+// Unfinished returns the jobs that still need work.
+func (sq *SettlementQueue) Unfinished() []*SettlementJob {
+	var jobs []*SettlementJob
+	for _, job := range sq.List("") {
+		if !job.Status.IsFinal() {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// TradeSettlement returns the settlement state of a trade combined from the
+// jobs settling its legs.
+func (sq *SettlementQueue) TradeSettlement(tradeID string) (Settlement, bool) {
+	sq.mu.RLock()
+	defer sq.mu.RUnlock()
+
+	jobIDs, ok := sq.trades[tradeID]
+	if !ok {
+		return Settlement{}, false
+	}
+
+	legs := make([]SettlementLeg, len(jobIDs))
+	for i, jobID := range jobIDs {
+		job := sq.jobs[jobID]
+		legs[i] = SettlementLeg{
+			JobID:        job.ID,
+			Asset:        job.Asset,
+			Status:       job.Status,
+			Ref:          job.Ref,
+			Error:        job.Error,
+			Compensation: job.Compensation,
+		}
+	}
+
+	return Settlement{
+		TradeID: tradeID,
+		Status:  combinedStatus(legs),
+		Legs:    legs,
+	}, true
+}
+
+// append writes a record to the queue file and applies it, the queue is
+// unchanged if writing fails. sq.mu must be held.
+func (sq *SettlementQueue) append(record *queueRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sq.path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(sq.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	sq.apply(record)
+	sq.appended++
+
+	// compacting once the records appended outnumber the ones kept keeps
+	// its cost proportional to the records written
+	if sq.appended >= max(compactAfter, len(sq.jobs)+len(sq.transfers)) {
+		// the record is stored, a failed compaction leaves a longer file
+		// and is tried again on the next append
+		sq.compact()
+	}
+
+	return nil
+}
+
+// compact rewrites the queue file with a record per job and one for the
+// queued transfers. sq.mu must be held unless the queue isn't shared yet.
+func (sq *SettlementQueue) compact() error {
+	jobs := make([]*SettlementJob, 0, len(sq.jobs))
+	for _, job := range sq.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, job := range jobs {
+		if err := enc.Encode(&queueRecord{Jobs: []*SettlementJob{job}}); err != nil {
+			return err
+		}
+	}
+	if len(sq.transfers) > 0 {
+		record := &queueRecord{}
+		for _, transfer := range sq.transfers {
+			record.Transfers = append(record.Transfers, transfer)
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sq.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := sq.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, sq.path); err != nil {
+		return err
+	}
+
+	sq.appended = 0
+
+	return nil
+}
@@ -0,0 +1,557 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/labstack/echo/v4"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+var testSettlementConfig = SettlementConfig{
+	Workers:        2,
+	Confirmations:  2,
+	MaxAttempts:    3,
+	Backoff:        10 * time.Millisecond,
+	MaxBackoff:     50 * time.Millisecond,
+	PollInterval:   10 * time.Millisecond,
+	ConfirmTimeout: 10 * time.Second,
+}
+
+type testChain struct {
+	backend *simulated.Backend
+	users   *UserStore
+	funded  []*User
+}
+
+// newTestChain starts a simulated backend with n funded users.
+func newTestChain(t *testing.T, n int) *testChain {
+	t.Helper()
+
+	users, err := NewUserStore(t.TempDir(), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alloc := make(types.GenesisAlloc)
+	funded := make([]*User, n)
+	for i := range funded {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user, _, err := users.Register(common.Bytes2Hex(crypto.FromECDSA(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alloc[user.Address] = types.Account{Balance: big.NewInt(1e18)}
+		funded[i] = user
+	}
+
+	backend := simulated.NewBackend(alloc)
+	t.Cleanup(func() {
+		backend.Close()
+	})
+
+	return &testChain{
+		backend: backend,
+		users:   users,
+		funded:  funded,
+	}
+}
+
+// mine commits a block every few milliseconds until the test ends.
+func (tc *testChain) mine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tc.backend.Commit()
+			}
+		}
+	}()
+}
+
+func (tc *testChain) pipeline(t *testing.T) *SettlementPipeline {
+	t.Helper()
+
+	queue, err := NewSettlementQueue(filepath.Join(t.TempDir(), "settlements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := tc.backend.Client()
+	settlers := map[Asset]Settler{
+		"ETH": NewETHSettler(client, NewNonceManager(client)),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sp := NewSettlementPipeline(testSettlementConfig, queue, tc.users, settlers)
+	go sp.Run(ctx)
+
+	return sp
+}
+
+func waitForJob(t *testing.T, queue *SettlementQueue, id string) *SettlementJob {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := queue.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status.IsFinal() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("settlement %s not finished", id)
+	return nil
+}
+
+func TestNetTransfers(t *testing.T) {
+	tc := newTestChain(t, 3)
+	a, b, c := tc.funded[0], tc.funded[1], tc.funded[2]
+
+	netted := netTransfers([]pendingTransfer{
+		{asset: "ETH", from: a, to: b, amount: big.NewInt(10), tradeID: "1"},
+		{asset: "ETH", from: b, to: a, amount: big.NewInt(4), tradeID: "2"},
+		{asset: "ETH", from: a, to: c, amount: big.NewInt(5), tradeID: "3"},
+		{asset: "ETH", from: c, to: a, amount: big.NewInt(5), tradeID: "4"},
+		{asset: "USDC", from: a, to: b, amount: big.NewInt(1), tradeID: "5"},
+	})
+
+	assert(t, len(netted), 3)
+	assert(t, netted[0].tradeIDs, []string{"1", "2"})
+	assert(t, netted[1].tradeIDs, []string{"3", "4"})
+	assert(t, netted[1].amount.Sign(), 0)
+	assert(t, netted[2].tradeIDs, []string{"5"})
+
+	// amount is relative to the lower address of the pair
+	if netted[0].a == a {
+		assert(t, netted[0].amount, big.NewInt(6))
+	} else {
+		assert(t, netted[0].amount, big.NewInt(-6))
+	}
+}
+
+func TestSettlementBatcherNets(t *testing.T) {
+	users := newTestUserStore(t, t.TempDir())
+	var u [3]*User
+	for i := range u {
+		user, _, err := users.Register("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u[i] = user
+	}
+
+	queue, err := NewSettlementQueue(filepath.Join(t.TempDir(), "settlements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pipeline isn't run, submitted jobs stay in the queue
+	sp := NewSettlementPipeline(testSettlementConfig, queue, users, map[Asset]Settler{"ETH": NewFakeSettler()})
+	batcher := NewSettlementBatcher(time.Hour, sp)
+
+	ctx := context.Background()
+	batcher.Add(ctx, "1", TradeLeg{Asset: "ETH", From: u[0], To: u[1], Amount: big.NewInt(4)})
+	batcher.Add(ctx, "2", TradeLeg{Asset: "ETH", From: u[1], To: u[0], Amount: big.NewInt(10)})
+	batcher.Add(ctx, "3", TradeLeg{Asset: "ETH", From: u[0], To: u[2], Amount: big.NewInt(5)})
+	batcher.Add(ctx, "4", TradeLeg{Asset: "ETH", From: u[2], To: u[0], Amount: big.NewInt(5)})
+	batcher.Add(ctx, "5", TradeLeg{Asset: "ETH", From: u[2], To: u[2], Amount: big.NewInt(1)})
+	batcher.Flush()
+	assert(t, batcher.IsPending("1"), false)
+
+	jobs := queue.List("")
+	assert(t, len(jobs), 3)
+
+	// the net amount is paid by whoever owes it
+	assert(t, jobs[0].From, u[1].ID)
+	assert(t, jobs[0].To, u[0].ID)
+	assert(t, jobs[0].Amount, big.NewInt(6))
+	assert(t, jobs[0].TradeIDs, []string{"1", "2"})
+	assert(t, jobs[0].Status, SettlementPending)
+
+	// transfers that cancel out or stay with the user move nothing
+	assert(t, jobs[1].TradeIDs, []string{"3", "4"})
+	assert(t, jobs[1].Status, SettlementNetted)
+	assert(t, jobs[2].TradeIDs, []string{"5"})
+	assert(t, jobs[2].Status, SettlementNetted)
+}
+
+func TestSettlementPipelineConfirms(t *testing.T) {
+	tc := newTestChain(t, 2)
+	tc.mine(t)
+	sp := tc.pipeline(t)
+	from, to := tc.funded[0], tc.funded[1]
+
+	batcher := NewSettlementBatcher(time.Hour, sp)
+	batcher.Add(context.Background(), "trade-1", TradeLeg{Asset: "ETH", From: from, To: to, Amount: big.NewInt(1000)})
+	batcher.Add(context.Background(), "trade-2", TradeLeg{Asset: "ETH", From: to, To: from, Amount: big.NewInt(400)})
+	assert(t, batcher.IsPending("trade-1"), true)
+	batcher.Flush()
+
+	settlement, ok := sp.Queue().TradeSettlement("trade-1")
+	assert(t, ok, true)
+
+	job := waitForJob(t, sp.Queue(), settlement.Legs[0].JobID)
+	assert(t, job.Status, SettlementConfirmed)
+	assert(t, job.Amount, big.NewInt(600))
+	assert(t, job.Attempts, 1)
+	if job.Confirmations < testSettlementConfig.Confirmations {
+		t.Errorf("confirmations %d < %d", job.Confirmations, testSettlementConfig.Confirmations)
+	}
+
+	settlement, _ = sp.Queue().TradeSettlement("trade-2")
+	assert(t, settlement.Status, SettlementConfirmed)
+	assert(t, settlement.Legs[0].Ref, job.Ref)
+
+	balance, err := tc.backend.Client().BalanceAt(context.Background(), to.Address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, balance, new(big.Int).Add(big.NewInt(1e18), big.NewInt(600)))
+}
+
+func TestSettlementPipelineRetries(t *testing.T) {
+	tc := newTestChain(t, 1)
+	tc.mine(t)
+	sp := tc.pipeline(t)
+
+	unfunded, _, err := tc.users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp.Submit(&SettlementJob{
+		Asset:    "ETH",
+		From:     unfunded.ID,
+		To:       tc.funded[0].ID,
+		Amount:   big.NewInt(1000),
+		TradeIDs: []string{"trade-1"},
+		Status:   SettlementPending,
+	})
+
+	settlement, _ := sp.Queue().TradeSettlement("trade-1")
+	job := waitForJob(t, sp.Queue(), settlement.Legs[0].JobID)
+
+	assert(t, job.Status, SettlementFailed)
+	assert(t, job.Attempts, testSettlementConfig.MaxAttempts)
+	if job.Error == "" {
+		t.Error("expected settlement error")
+	}
+}
+
+func TestSettlementPipelineConfirmTimeout(t *testing.T) {
+	users := newTestUserStore(t, t.TempDir())
+	from, _, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewSettlementQueue(filepath.Join(t.TempDir(), "settlements.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the transfer never gets a confirmation
+	settler := NewFakeSettler()
+	settler.SetConfirmations(0)
+
+	cfg := testSettlementConfig
+	cfg.ConfirmTimeout = 50 * time.Millisecond
+	sp := NewSettlementPipeline(cfg, queue, users, map[Asset]Settler{"ETH": settler})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sp.Run(ctx)
+
+	sp.Submit(&SettlementJob{
+		Asset:    "ETH",
+		From:     from.ID,
+		To:       to.ID,
+		Amount:   big.NewInt(1),
+		TradeIDs: []string{"trade-1"},
+		Status:   SettlementPending,
+	})
+
+	settlement, _ := queue.TradeSettlement("trade-1")
+	job := waitForJob(t, queue, settlement.Legs[0].JobID)
+	assert(t, job.Status, SettlementFailed)
+	assert(t, job.Attempts, 1)
+	assert(t, len(settler.Transfers()), 1)
+	if !strings.Contains(job.Error, ErrConfirmTimeout.Error()) {
+		t.Errorf("error %q isn't a timeout", job.Error)
+	}
+}
+
+func TestSettlementQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlements.json")
+
+	queue, err := NewSettlementQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := queue.Add(&SettlementJob{
+		From:     "a",
+		To:       "b",
+		Amount:   big.NewInt(1),
+		TradeIDs: []string{"trade-1"},
+		Status:   SettlementPending,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err = NewSettlementQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unfinished := queue.Unfinished()
+	assert(t, len(unfinished), 1)
+	assert(t, unfinished[0].ID, job.ID)
+	assert(t, unfinished[0].Amount, big.NewInt(1))
+
+	// updates are appended, a record cut short by a crash is dropped
+	job.Status = SettlementSubmitted
+	job.Ref = "0x1"
+	if err := queue.Update(job); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"jobs":[{"id":`)
+	f.Close()
+
+	queue, err = NewSettlementQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := queue.Get(job.ID)
+	assert(t, err, nil)
+	assert(t, restored.Status, SettlementSubmitted)
+	assert(t, restored.Ref, "0x1")
+	settlement, _ := queue.TradeSettlement("trade-1")
+	assert(t, len(settlement.Legs), 1)
+}
+
+func TestSettlementQueueCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlements.json")
+
+	// queues written as a JSON array of jobs are still read
+	legacy := `[{"id":"job-1","asset":"ETH","from":"a","to":"b","amount":1,"trade_ids":["trade-1"],"status":"pending"}]`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewSettlementQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := queue.Get("job-1")
+	assert(t, err, nil)
+
+	for i := 0; i < compactAfter+10; i++ {
+		job.Attempts = i
+		if err := queue.Update(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 11 {
+		t.Errorf("queue file of one job has %d records", lines)
+	}
+
+	queue, err = NewSettlementQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = queue.Get("job-1")
+	assert(t, err, nil)
+	assert(t, job.Attempts, compactAfter+9)
+}
+
+func TestSettlementBatcherSurvivesRestart(t *testing.T) {
+	users := newTestUserStore(t, t.TempDir())
+	a, _, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "settlements.json")
+	newBatcher := func() (*SettlementQueue, *SettlementBatcher) {
+		queue, err := NewSettlementQueue(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp := NewSettlementPipeline(testSettlementConfig, queue, users, map[Asset]Settler{"ETH": NewFakeSettler()})
+		return queue, NewSettlementBatcher(time.Hour, sp)
+	}
+
+	_, batcher := newBatcher()
+	assert(t, batcher.Add(context.Background(), "trade-1", TradeLeg{Asset: "ETH", From: a, To: b, Amount: big.NewInt(3)}), nil)
+	assert(t, batcher.Add(context.Background(), "trade-2", TradeLeg{Asset: "ETH", From: b, To: a, Amount: big.NewInt(1)}), nil)
+
+	// the exchange stops before the window is flushed
+	queue, batcher := newBatcher()
+	assert(t, batcher.IsPending("trade-1"), true)
+	assert(t, len(queue.List("")), 0)
+
+	batcher.Flush()
+	jobs := queue.List("")
+	assert(t, len(jobs), 1)
+	assert(t, jobs[0].From, a.ID)
+	assert(t, jobs[0].Amount, big.NewInt(2))
+	assert(t, jobs[0].TradeIDs, []string{"trade-1", "trade-2"})
+
+	// transfers that are part of a job aren't batched again
+	queue, batcher = newBatcher()
+	assert(t, batcher.IsPending("trade-1"), false)
+	assert(t, len(queue.List("")), 1)
+}
+
+func TestTradeCompensation(t *testing.T) {
+	te, eth, usd := newLedgerExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	// the buyer can't pay, the ETH already moved to it is moved back
+	te.placeLimit(t, seller.ID, false, 2, 10)
+	status, _ := te.placeMarket(t, buyer.ID, true, 2)
+	assert(t, status, http.StatusOK)
+
+	tradeID := te.waitForTrades(t, ETH, 1)[0].ID
+	var settlement Settlement
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		settlement, _ = te.Pipeline.Queue().TradeSettlement(tradeID)
+		if len(settlement.Legs) == 3 && settlement.Legs[2].Status.IsFinal() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert(t, settlement.Status, SettlementFailed)
+	assert(t, len(settlement.Legs), 3)
+	legs := make(map[Asset][]SettlementStatus)
+	for _, leg := range settlement.Legs {
+		legs[leg.Asset] = append(legs[leg.Asset], leg.Status)
+		assert(t, leg.Compensation, leg == settlement.Legs[2])
+	}
+	assert(t, legs["USD"], []SettlementStatus{SettlementFailed})
+	assert(t, legs["ETH"], []SettlementStatus{SettlementConfirmed, SettlementConfirmed})
+
+	transfers := eth.Transfers()
+	assert(t, len(transfers), 2)
+	assert(t, transfers[1].From, transfers[0].To)
+	assert(t, transfers[1].To, transfers[0].From)
+	assert(t, transfers[1].Amount, transfers[0].Amount)
+	assert(t, usd.Balance(seller.ID), new(big.Int))
+
+	// a trade that settles needs no compensation
+	te.send(t, http.MethodPost, "/admin/deposits", &DepositReq{UserID: buyer.ID, Asset: "USD", Amount: 20}, map[string]string{
+		echo.HeaderAuthorization: "Bearer 0123456789abcdef",
+	})
+	te.placeLimit(t, seller.ID, false, 2, 10)
+	te.placeMarket(t, buyer.ID, true, 2)
+
+	for _, trade := range te.waitForTrades(t, ETH, 2) {
+		if trade.ID != tradeID {
+			assert(t, trade.Settlement.Status, SettlementConfirmed)
+			assert(t, len(trade.Settlement.Legs), 2)
+		}
+	}
+	assert(t, usd.Balance(seller.ID), big.NewInt(2000))
+}
+
+func TestTradeFees(t *testing.T) {
+	users, err := NewUserStore(filepath.Join(t.TempDir(), "keystore"), "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	te, _, usd := startLedgerExchange(t, users, FeeConfig{MakerBps: 10, TakerBps: 20, Account: account.ID})
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+	te.send(t, http.MethodPost, "/admin/deposits", &DepositReq{UserID: buyer.ID, Asset: "USD", Amount: 21}, map[string]string{
+		echo.HeaderAuthorization: "Bearer 0123456789abcdef",
+	})
+
+	// the seller made the market and pays 10 bps of the 20 USD, the buyer
+	// took it and pays 20 bps
+	te.placeLimit(t, seller.ID, false, 2, 10)
+	status, _ := te.placeMarket(t, buyer.ID, true, 2)
+	assert(t, status, http.StatusOK)
+
+	trade := te.waitForTrades(t, ETH, 1)[0]
+	assert(t, trade.MakerFee, 0.02)
+	assert(t, trade.TakerFee, 0.04)
+
+	var settlement Settlement
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) && settlement.Status != SettlementConfirmed {
+		settlement, _ = te.Pipeline.Queue().TradeSettlement(trade.ID)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert(t, settlement.Status, SettlementConfirmed)
+	assert(t, len(settlement.Legs), 3)
+	assert(t, usd.Balance(seller.ID), big.NewInt(1998))
+	assert(t, usd.Balance(account.ID), big.NewInt(6))
+	assert(t, usd.Balance(buyer.ID), big.NewInt(96))
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"math"
+	"math/big"
+	"path/filepath"
+)
+
+const (
+	SettlerETH    SettlerKind = "eth"
+	SettlerERC20  SettlerKind = "erc20"
+	SettlerLedger SettlerKind = "ledger"
+	SettlerFake   SettlerKind = "fake"
+
+	// finalConfirmations is reported for transfers that can't be reorged,
+	// like the ones done on the internal ledger.
+	finalConfirmations uint64 = math.MaxUint64
+)
+
+var (
+	ErrTransferPending     = errors.New("transfer pending")
+	ErrTransferReverted    = errors.New("transfer reverted")
+	ErrTransferNotFound    = errors.New("transfer not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
+
+type (
+	SettlerKind string
+
+	// Settler moves an asset between two users. Transfer returns a reference
+	// to the submitted transfer that Confirmations is polled with until the
+	// transfer is final.
+	Settler interface {
+		Transfer(ctx context.Context, from, to *User, amount *big.Int) (string, error)
+		Confirmations(ctx context.Context, ref string) (uint64, error)
+	}
+)
+
+// NewSettler creates the settler configured for an asset. The operator key
+// is used by ERC-20 settlers moving tokens with transferFrom, ledger
+// settlers keep their balances in ledgerDir.
+func NewSettler(cfg AssetConfig, client ChainClient, nonces *NonceManager, operator *ecdsa.PrivateKey, ledgerDir string) (Settler, error) {
+	switch cfg.Settler {
+	case SettlerETH, SettlerERC20:
+		if client == nil {
+			return nil, fmt.Errorf("settler %s of %s needs a chain client", cfg.Settler, cfg.Asset)
+		}
+	}
+
+	switch cfg.Settler {
+	case SettlerETH:
+		return NewETHSettler(client, nonces), nil
+	case SettlerERC20:
+		if !common.IsHexAddress(cfg.Token) {
+			return nil, fmt.Errorf("invalid token address of %s: %q", cfg.Asset, cfg.Token)
+		}
+		if !cfg.TransferFrom {
+			operator = nil
+		}
+		return NewERC20Settler(client, nonces, common.HexToAddress(cfg.Token), operator)
+	case SettlerLedger:
+		return OpenLedgerSettler(filepath.Join(ledgerDir, string(cfg.Asset)+".json"))
+	case SettlerFake:
+		return NewFakeSettler(), nil
+	default:
+		return nil, fmt.Errorf("unknown settler kind of %s: %q", cfg.Asset, cfg.Settler)
+	}
+}
+
+// ETHSettler transfers native ETH.
+type ETHSettler struct {
+	client ChainClient
+	nonces *NonceManager
+}
+
+func NewETHSettler(client ChainClient, nonces *NonceManager) *ETHSettler {
+	return &ETHSettler{
+		client: client,
+		nonces: nonces,
+	}
+}
+
+func (s *ETHSettler) Transfer(ctx context.Context, from, to *User, amount *big.Int) (string, error) {
+	txHash, err := transferETH(ctx, s.client, s.nonces, from.PrivateKey, to.PrivateKey, amount)
+	if err != nil {
+		return "", err
+	}
+
+	return txHash.Hex(), nil
+}
+
+func (s *ETHSettler) BalanceOf(ctx context.Context, user *User) (*big.Int, error) {
+	return s.client.BalanceAt(ctx, user.Address, nil)
+}
+
+func (s *ETHSettler) Confirmations(ctx context.Context, ref string) (uint64, error) {
+	return txConfirmations(ctx, s.client, common.HexToHash(ref))
+}
+
+// txConfirmations returns the number of blocks including and built on top of
+// the block the transaction was mined in.
+func txConfirmations(ctx context.Context, client ChainClient, txHash common.Hash) (uint64, error) {
+	receipt, err := client.TransactionReceipt(ctx, txHash)
+	if errors.Is(err, ethereum.NotFound) {
+		return 0, ErrTransferPending
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return 0, fmt.Errorf("%w: %s", ErrTransferReverted, txHash.Hex())
+	}
+
+	head, err := client.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if head < receipt.BlockNumber.Uint64() {
+		return 0, nil
+	}
+
+	return head - receipt.BlockNumber.Uint64() + 1, nil
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto_exchange/token"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+)
+
+// ERC20Settler transfers an ERC-20 token. Without an operator every transfer
+// is a transfer signed by the sending user. With an operator the exchange
+// moves the tokens with transferFrom, paying the gas itself, which requires
+// users to approve the operator first.
+type ERC20Settler struct {
+	client   ChainClient
+	nonces   *NonceManager
+	token    *token.Token
+	operator *ecdsa.PrivateKey
+}
+
+func NewERC20Settler(client ChainClient, nonces *NonceManager, address common.Address, operator *ecdsa.PrivateKey) (*ERC20Settler, error) {
+	t, err := token.NewToken(address, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ERC20Settler{
+		client:   client,
+		nonces:   nonces,
+		token:    t,
+		operator: operator,
+	}, nil
+}
+
+func (s *ERC20Settler) Transfer(ctx context.Context, from, to *User, amount *big.Int) (string, error) {
+	if s.operator == nil {
+		return s.transact(ctx, from.PrivateKey, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+			return s.token.Transfer(opts, to.Address, amount)
+		})
+	}
+
+	return s.transact(ctx, s.operator, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return s.token.TransferFrom(opts, from.Address, to.Address, amount)
+	})
+}
+
+// Approve allows the operator to move amount of the user's tokens.
+func (s *ERC20Settler) Approve(ctx context.Context, user *User, amount *big.Int) (string, error) {
+	if s.operator == nil {
+		return "", fmt.Errorf("settler has no operator to approve")
+	}
+
+	operator := crypto.PubkeyToAddress(s.operator.PublicKey)
+
+	return s.transact(ctx, user.PrivateKey, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return s.token.Approve(opts, operator, amount)
+	})
+}
+
+func (s *ERC20Settler) Confirmations(ctx context.Context, ref string) (uint64, error) {
+	return txConfirmations(ctx, s.client, common.HexToHash(ref))
+}
+
+func (s *ERC20Settler) BalanceOf(ctx context.Context, user *User) (*big.Int, error) {
+	return s.token.BalanceOf(&bind.CallOpts{Context: ctx}, user.Address)
+}
+
+// transact sends the transaction created by send signed with key and returns
+// its hash.
+func (s *ERC20Settler) transact(ctx context.Context, key *ecdsa.PrivateKey, send func(opts *bind.TransactOpts) (*types.Transaction, error)) (string, error) {
+	chainID, err := s.client.ChainID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	opts, err := bind.NewKeyedTransactorWithChainID(key, chainID)
+	if err != nil {
+		return "", err
+	}
+	opts.Context = ctx
+
+	var txHash common.Hash
+
+	err = s.nonces.Send(ctx, opts.From, func(nonce uint64) error {
+		opts.Nonce = new(big.Int).SetUint64(nonce)
+
+		tx, err := send(opts)
+		if err != nil {
+			return err
+		}
+
+		txHash = tx.Hash()
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return txHash.Hex(), nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"crypto_exchange/token"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const ethUSDC Market = "ETH-USDC"
+
+// deployToken deploys a token whose whole supply belongs to owner.
+func (tc *testChain) deployToken(t *testing.T, owner *User, supply *big.Int) common.Address {
+	t.Helper()
+
+	opts, err := bind.NewKeyedTransactorWithChainID(owner.PrivateKey, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address, _, _, err := token.DeployToken(opts, tc.backend.Client(), supply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.backend.Commit()
+
+	return address
+}
+
+// waitForConfirmation waits until the transfer ref of settler is mined.
+func waitForConfirmation(t *testing.T, settler Settler, ref string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		confirmations, err := settler.Confirmations(context.Background(), ref)
+		if err == nil && confirmations > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("transfer %s not confirmed", ref)
+}
+
+func TestTwoLeggedSettlement(t *testing.T) {
+	for _, transferFrom := range []bool{false, true} {
+		name := "transfer"
+		if transferFrom {
+			name = "transferFrom"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			tc := newTestChain(t, 3)
+			seller, buyer, operator := tc.funded[0], tc.funded[1], tc.funded[2]
+			client := tc.backend.Client()
+			ctx := context.Background()
+
+			address := tc.deployToken(t, buyer, big.NewInt(1e12))
+			tc.mine(t)
+
+			cfg := testConfig()
+			cfg.Assets = []AssetConfig{
+				{Asset: "ETH", Decimals: 18, Settler: SettlerETH},
+				{Asset: "USDC", Decimals: 6, Settler: SettlerERC20, Token: address.Hex(), TransferFrom: transferFrom},
+			}
+			cfg.Markets = []MarketConfig{
+				{Name: ethUSDC, Base: "ETH", Quote: "USDC"},
+			}
+
+			nonces := NewNonceManager(client)
+			settlers := make(map[Asset]Settler)
+			for _, asset := range cfg.Assets {
+				settler, err := NewSettler(asset, client, nonces, operator.PrivateKey, t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+				settlers[asset.Asset] = settler
+			}
+			usdc := settlers["USDC"].(*ERC20Settler)
+
+			if transferFrom {
+				ref, err := usdc.Approve(ctx, buyer, big.NewInt(1e12))
+				if err != nil {
+					t.Fatal(err)
+				}
+				waitForConfirmation(t, usdc, ref)
+			}
+
+			buyerBalance, err := client.BalanceAt(ctx, buyer.Address, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			te := startExchange(t, tc.users, cfg, settlers)
+
+			status := te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+				UserID:    seller.ID,
+				Market:    ethUSDC,
+				OrderType: LimitOrder,
+				Size:      0.5,
+				Price:     3000,
+			}, nil)
+			assert(t, status, http.StatusOK)
+
+			status = te.do(t, http.MethodPost, "/order", &PlaceOrderReq{
+				UserID:    buyer.ID,
+				Market:    ethUSDC,
+				OrderType: MarketOrder,
+				IsBid:     true,
+				Size:      0.5,
+			}, nil)
+			assert(t, status, http.StatusOK)
+
+			te.Settlement.Flush()
+
+			trades := te.waitForTrades(t, ethUSDC, 1)
+			assert(t, len(trades), 1)
+			assert(t, trades[0].Settlement.Status, SettlementConfirmed)
+			assert(t, len(trades[0].Settlement.Legs), 2)
+
+			sellerTokens, err := usdc.BalanceOf(ctx, seller)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, sellerTokens, big.NewInt(1500_000000))
+
+			balance, err := client.BalanceAt(ctx, buyer.Address, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := new(big.Int).Sub(balance, buyerBalance)
+			if transferFrom {
+				// the operator pays the gas of moving the buyer's tokens
+				assert(t, received, big.NewInt(5e17))
+			} else if received.Sign() <= 0 {
+				t.Errorf("buyer received %s wei", received)
+			}
+		})
+	}
+}
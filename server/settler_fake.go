@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"math/big"
+	"sync"
+)
+
+type FakeTransfer struct {
+	Ref    string
+	From   string
+	To     string
+	Amount *big.Int
+}
+
+// FakeSettler records transfers in memory without moving anything, it lets
+// the matching and settlement path run in tests without a node.
+type FakeSettler struct {
+	mu            sync.Mutex
+	transfers     []FakeTransfer
+	err           error
+	confirmations uint64
+}
+
+func NewFakeSettler() *FakeSettler {
+	return &FakeSettler{
+		confirmations: finalConfirmations,
+	}
+}
+
+// SetError makes every following transfer fail with err, nil restores
+// successful transfers.
+func (s *FakeSettler) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+// SetConfirmations sets the number of confirmations reported for every
+// transfer.
+func (s *FakeSettler) SetConfirmations(confirmations uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.confirmations = confirmations
+}
+
+func (s *FakeSettler) Transfers() []FakeTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]FakeTransfer(nil), s.transfers...)
+}
+
+func (s *FakeSettler) Transfer(_ context.Context, from, to *User, amount *big.Int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return "", s.err
+	}
+
+	transfer := FakeTransfer{
+		Ref:    uuid.NewString(),
+		From:   from.ID,
+		To:     to.ID,
+		Amount: new(big.Int).Set(amount),
+	}
+	s.transfers = append(s.transfers, transfer)
+
+	return transfer.Ref, nil
+}
+
+func (s *FakeSettler) Confirmations(_ context.Context, ref string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, transfer := range s.transfers {
+		if transfer.Ref == ref {
+			return s.confirmations, nil
+		}
+	}
+
+	return 0, ErrTransferNotFound
+}
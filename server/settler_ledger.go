@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LedgerSettler keeps balances on the books of the exchange and never
+// touches a chain. It is used for assets that are only traded internally.
+// Opened on a file, every deposit and transfer is appended to it before it
+// is applied, so balances and transfer refs survive restarts.
+type LedgerSettler struct {
+	mu        sync.Mutex
+	path      string
+	balances  map[string]*big.Int
+	transfers map[string]bool
+}
+
+// ledgerRecord is one line of the file of a ledger: a deposit to To, or a
+// transfer from From to To with its Ref.
+type ledgerRecord struct {
+	Ref    string   `json:"ref,omitempty"`
+	From   string   `json:"from,omitempty"`
+	To     string   `json:"to"`
+	Amount *big.Int `json:"amount"`
+}
+
+// NewLedgerSettler returns a ledger kept in memory only.
+func NewLedgerSettler() *LedgerSettler {
+	return &LedgerSettler{
+		balances:  make(map[string]*big.Int),
+		transfers: make(map[string]bool),
+	}
+}
+
+// OpenLedgerSettler returns the ledger stored in the file at path, which is
+// created when the first record is written.
+func OpenLedgerSettler(path string) (*LedgerSettler, error) {
+	s := NewLedgerSettler()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.replay(data); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// replay applies the records of the file of the ledger. A last record cut
+// short by a crash is dropped from the file, the next record would be
+// appended to it.
+func (s *LedgerSettler) replay(data []byte) error {
+	var offset int
+	for len(data[offset:]) > 0 {
+		line, _, found := bytes.Cut(data[offset:], []byte("\n"))
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record ledgerRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				if !found {
+					return os.Truncate(s.path, int64(offset))
+				}
+				return fmt.Errorf("decoding ledger %s at byte %d: %w", s.path, offset, err)
+			}
+			s.apply(&record)
+		}
+		offset += len(line) + 1
+	}
+
+	return nil
+}
+
+// append writes a record to the file of the ledger and applies it, the
+// ledger is unchanged if writing fails. s.mu must be held.
+func (s *LedgerSettler) append(record *ledgerRecord) error {
+	if s.path != "" {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(data, '\n'))
+		if syncErr := f.Sync(); err == nil {
+			err = syncErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.apply(record)
+
+	return nil
+}
+
+func (s *LedgerSettler) apply(record *ledgerRecord) {
+	if record.From != "" {
+		s.balance(record.From).Sub(s.balance(record.From), record.Amount)
+	}
+	s.balance(record.To).Add(s.balance(record.To), record.Amount)
+	if record.Ref != "" {
+		s.transfers[record.Ref] = true
+	}
+}
+
+// Deposit credits the user's balance.
+func (s *LedgerSettler) Deposit(userID string, amount *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.append(&ledgerRecord{To: userID, Amount: amount})
+}
+
+func (s *LedgerSettler) Balance(userID string) *big.Int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return new(big.Int).Set(s.balance(userID))
+}
+
+func (s *LedgerSettler) BalanceOf(_ context.Context, user *User) (*big.Int, error) {
+	return s.Balance(user.ID), nil
+}
+
+func (s *LedgerSettler) balance(userID string) *big.Int {
+	balance, ok := s.balances[userID]
+	if !ok {
+		balance = new(big.Int)
+		s.balances[userID] = balance
+	}
+
+	return balance
+}
+
+func (s *LedgerSettler) Transfer(_ context.Context, from, to *User, amount *big.Int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.balance(from.ID).Cmp(amount) < 0 {
+		return "", ErrInsufficientBalance
+	}
+
+	ref := uuid.NewString()
+	if err := s.append(&ledgerRecord{Ref: ref, From: from.ID, To: to.ID, Amount: amount}); err != nil {
+		return "", err
+	}
+
+	return ref, nil
+}
+
+func (s *LedgerSettler) Confirmations(_ context.Context, ref string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.transfers[ref] {
+		return 0, ErrTransferNotFound
+	}
+
+	return finalConfirmations, nil
+}
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"crypto_exchange/order_book"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Streams a WebSocket session can subscribe to. The orders stream carries
+	// the orders of the user of the session, the others those of a market.
+	ChannelTrades = "trades"
+	ChannelBook   = "book"
+	ChannelTicker = "ticker"
+	ChannelOrders = "orders"
+
+	WSOpSubscribe   = "subscribe"
+	WSOpUnsubscribe = "unsubscribe"
+
+	WSEventSubscribed   = "subscribed"
+	WSEventUnsubscribed = "unsubscribed"
+	WSEventError        = "error"
+	WSEventTrade        = "trade"
+	WSEventBook         = "book"
+	WSEventTicker       = "ticker"
+	WSEventOrder        = "order"
+
+	// HeaderSequence is set on the REST snapshots of the book, trades and
+	// orders to the sequence number of the last stream event they include.
+	HeaderSequence = "X-Sequence"
+
+	// ChecksumDepth is the number of levels of each side covered by the
+	// checksum of a book.
+	ChecksumDepth = 10
+)
+
+type (
+	// WSCommand subscribes a WebSocket session to a stream or unsubscribes
+	// it. Market is required for every stream but the orders stream.
+	WSCommand struct {
+		Op      string `json:"op"`
+		Channel string `json:"channel"`
+		Market  Market `json:"market,omitempty"`
+	}
+
+	// BookLevel is the size resting at a price, zero once the level is gone.
+	BookLevel struct {
+		Price float64 `json:"price"`
+		Size  float64 `json:"size"`
+	}
+
+	// BookUpdate carries the levels of a book that changed, bids from the
+	// highest price down and asks from the lowest up, and the checksum of the
+	// book after the change.
+	BookUpdate struct {
+		Bids     []BookLevel `json:"bids"`
+		Asks     []BookLevel `json:"asks"`
+		Checksum uint32      `json:"checksum"`
+	}
+
+	// BookDepthRes holds every level of a book and its checksum.
+	BookDepthRes struct {
+		Bids     []BookLevel `json:"bids"`
+		Asks     []BookLevel `json:"asks"`
+		Checksum uint32      `json:"checksum"`
+	}
+
+	// Ticker is the top of a book, the prices and sizes of a side are zero
+	// while it is empty.
+	Ticker struct {
+		BidPrice float64 `json:"bid_price"`
+		BidSize  float64 `json:"bid_size"`
+		AskPrice float64 `json:"ask_price"`
+		AskSize  float64 `json:"ask_size"`
+	}
+)
+
+// streamKey names a stream, key is the market or, for the orders stream,
+// the user.
+type streamKey struct {
+	channel string
+	key     string
+}
+
+// subscribe adds wc to the stream and returns the sequence number of the
+// last event published on it.
+func (s *wsSessions) subscribe(wc *wsClient, stream streamKey) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subs[stream] == nil {
+		s.subs[stream] = make(map[*wsClient]bool)
+	}
+	s.subs[stream][wc] = true
+	wc.streams[stream] = true
+
+	return s.seqs[stream]
+}
+
+func (s *wsSessions) unsubscribe(wc *wsClient, stream streamKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unsubscribeLocked(wc, stream)
+}
+
+func (s *wsSessions) unsubscribeLocked(wc *wsClient, stream streamKey) {
+	delete(s.subs[stream], wc)
+	if len(s.subs[stream]) == 0 {
+		delete(s.subs, stream)
+	}
+	delete(wc.streams, stream)
+}
+
+// publish numbers event as the next one of the stream and queues it for
+// the subscribed sessions. Events are published while the book lock is held,
+// so their numbers follow the order of the changes.
+func (s *wsSessions) publish(stream streamKey, event WSEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seqs[stream]++
+	event.Seq = s.seqs[stream]
+
+	for wc := range s.subs[stream] {
+		wc.queue(event)
+	}
+}
+
+// seq returns the sequence number of the last event published on stream.
+func (s *wsSessions) seq(stream streamKey) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seqs[stream]
+}
+
+func setSequence(header http.Header, seq uint64) {
+	header.Set(HeaderSequence, strconv.FormatUint(seq, 10))
+}
+
+// streamOf returns the stream cmd names for a session of userID.
+func (ex *Exchange) streamOf(userID string, cmd WSCommand) (streamKey, error) {
+	fe := make(fieldErrors)
+	if cmd.Op != WSOpSubscribe && cmd.Op != WSOpUnsubscribe {
+		fe.add("op", "must be subscribe or unsubscribe")
+	}
+
+	switch cmd.Channel {
+	case ChannelOrders:
+		if userID == "" {
+			return streamKey{}, NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "the orders stream needs the API key of a user")
+		}
+		return streamKey{channel: ChannelOrders, key: userID}, fe.err()
+	case ChannelTrades, ChannelBook, ChannelTicker:
+		if _, ok := ex.orderBooks[cmd.Market]; !ok {
+			fe.add("market", fmt.Sprintf("unknown market %q", cmd.Market))
+		}
+	default:
+		fe.add("channel", "must be trades, book, ticker or orders")
+	}
+
+	return streamKey{channel: cmd.Channel, key: string(cmd.Market)}, fe.err()
+}
+
+// handleWSCommand subscribes or unsubscribes a session. The reply carries
+// the sequence number the stream is at, the next event of the stream has
+// the one after it. A ticker subscription is answered with the current top
+// of book too.
+func (ex *Exchange) handleWSCommand(wc *wsClient, cmd WSCommand) {
+	stream, err := ex.streamOf(wc.userID, cmd)
+	if err != nil {
+		wc.queue(WSEvent{Type: WSEventError, Data: err})
+		return
+	}
+
+	// no event is published while the book lock is held
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	reply := WSEvent{
+		Type:    WSEventUnsubscribed,
+		Channel: cmd.Channel,
+		Market:  cmd.Market,
+	}
+
+	if cmd.Op == WSOpUnsubscribe {
+		ex.sessions.unsubscribe(wc, stream)
+		wc.queue(reply)
+		return
+	}
+
+	reply.Type = WSEventSubscribed
+	reply.Seq = ex.sessions.subscribe(wc, stream)
+	if cmd.Channel == ChannelTicker {
+		reply.Data = ex.feeds[cmd.Market].ticker
+	}
+	wc.queue(reply)
+}
+
+// publishOrder tells the sessions of a user about a change to one of their
+// orders.
+func (ex *Exchange) publishOrder(order OrderRecord) {
+	ex.sessions.publish(streamKey{channel: ChannelOrders, key: order.UserID}, WSEvent{
+		Type:    WSEventOrder,
+		Channel: ChannelOrders,
+		Data:    order,
+	})
+}
+
+// tradeRes returns trade with the fees charged on it.
+func (cfg FeeConfig) tradeRes(trade *order_book.Trade) *Trade {
+	res := toTrade(trade)
+	res.MakerFee = cfg.charge(trade.Price*trade.Size, cfg.MakerBps)
+	res.TakerFee = cfg.charge(trade.Price*trade.Size, cfg.TakerBps)
+
+	return res
+}
+
+// marketFeed publishes the trades, level changes and top of book of a
+// market. As a hook it runs while the book is changed, it keeps the levels
+// last published to tell what changed.
+type marketFeed struct {
+	market   Market
+	sessions *wsSessions
+	fees     FeeConfig
+	bids     map[float64]float64
+	asks     map[float64]float64
+	ticker   Ticker
+}
+
+func newMarketFeed(market Market, sessions *wsSessions, fees FeeConfig) *marketFeed {
+	return &marketFeed{
+		market:   market,
+		sessions: sessions,
+		fees:     fees,
+		bids:     make(map[float64]float64),
+		asks:     make(map[float64]float64),
+	}
+}
+
+func (f *marketFeed) LimitOrderPlaced(ob *order_book.OrderBook, order *order_book.Order) {
+	f.update(ob)
+}
+
+func (f *marketFeed) MarketOrderFilled(ob *order_book.OrderBook, order *order_book.Order, matches []order_book.Match, took time.Duration) {
+	f.publishTrades(ob, len(matches))
+	f.update(ob)
+}
+
+func (f *marketFeed) OrderCancelled(ob *order_book.OrderBook, order *order_book.Order) {
+	f.update(ob)
+}
+
+func (f *marketFeed) AuctionUncrossed(ob *order_book.OrderBook, price float64, matches []order_book.Match, took time.Duration) {
+	f.publishTrades(ob, len(matches))
+	f.update(ob)
+}
+
+func (f *marketFeed) stream(channel string) streamKey {
+	return streamKey{channel: channel, key: string(f.market)}
+}
+
+// publishTrades publishes the last n trades of the book. Every trade is
+// published once and in order, so the trade with sequence number n is the
+// nth trade of the market.
+func (f *marketFeed) publishTrades(ob *order_book.OrderBook, n int) {
+	for _, trade := range ob.Trades[len(ob.Trades)-n:] {
+		f.sessions.publish(f.stream(ChannelTrades), WSEvent{
+			Type:    WSEventTrade,
+			Channel: ChannelTrades,
+			Market:  f.market,
+			Data:    f.fees.tradeRes(trade),
+		})
+	}
+}
+
+// update publishes the levels that changed since the last update and the
+// top of book if it moved.
+func (f *marketFeed) update(ob *order_book.OrderBook) {
+	bids, asks := bookLevels(ob.BidLimitsList()), bookLevels(ob.AskLimitsList())
+
+	update := BookUpdate{
+		Bids:     changedLevels(f.bids, bids, true),
+		Asks:     changedLevels(f.asks, asks, false),
+		Checksum: BookChecksum(depthOf(ob.BidLimitsList(), ChecksumDepth), depthOf(ob.AskLimitsList(), ChecksumDepth)),
+	}
+	f.bids, f.asks = bids, asks
+
+	if len(update.Bids) > 0 || len(update.Asks) > 0 {
+		f.sessions.publish(f.stream(ChannelBook), WSEvent{
+			Type:    WSEventBook,
+			Channel: ChannelBook,
+			Market:  f.market,
+			Data:    update,
+		})
+	}
+
+	if ticker := topOfBook(ob); ticker != f.ticker {
+		f.ticker = ticker
+		f.sessions.publish(f.stream(ChannelTicker), WSEvent{
+			Type:    WSEventTicker,
+			Channel: ChannelTicker,
+			Market:  f.market,
+			Data:    ticker,
+		})
+	}
+}
+
+// depthOf returns the first n levels of limits, all of them if n is zero.
+func depthOf(limits []*order_book.Limit, n int) []BookLevel {
+	if n == 0 || n > len(limits) {
+		n = len(limits)
+	}
+
+	levels := make([]BookLevel, n)
+	for i, limit := range limits[:n] {
+		levels[i] = BookLevel{Price: limit.Price, Size: limit.TotalVolume}
+	}
+
+	return levels
+}
+
+// BookChecksum returns the CRC-32 of the first ChecksumDepth levels of the
+// bids, best first, followed by those of the asks. Every level is written as
+// its price and size in the shortest decimal form, all separated by colons,
+// so a replica of the book can verify it holds the same levels.
+func BookChecksum(bids, asks []BookLevel) uint32 {
+	var b strings.Builder
+	for _, side := range [][]BookLevel{bids, asks} {
+		for i, level := range side {
+			if i == ChecksumDepth {
+				break
+			}
+			if b.Len() > 0 {
+				b.WriteByte(':')
+			}
+			b.WriteString(strconv.FormatFloat(level.Price, 'f', -1, 64))
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatFloat(level.Size, 'f', -1, 64))
+		}
+	}
+
+	return crc32.ChecksumIEEE([]byte(b.String()))
+}
+
+func bookLevels(limits []*order_book.Limit) map[float64]float64 {
+	levels := make(map[float64]float64, len(limits))
+	for _, limit := range limits {
+		levels[limit.Price] = limit.TotalVolume
+	}
+
+	return levels
+}
+
+// changedLevels returns the levels of current that differ from previous,
+// levels missing from current with a size of zero.
+func changedLevels(previous, current map[float64]float64, isBid bool) []BookLevel {
+	var changed []BookLevel
+	for price, size := range current {
+		if previous[price] != size {
+			changed = append(changed, BookLevel{Price: price, Size: size})
+		}
+	}
+	for price := range previous {
+		if _, ok := current[price]; !ok {
+			changed = append(changed, BookLevel{Price: price})
+		}
+	}
+
+	sortLevels(changed, isBid)
+
+	return changed
+}
+
+func sortLevels(levels []BookLevel, isBid bool) {
+	sort.Slice(levels, func(i, j int) bool {
+		if isBid {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+}
+
+func topOfBook(ob *order_book.OrderBook) Ticker {
+	var ticker Ticker
+	if bids := ob.BidLimitsList(); len(bids) > 0 {
+		ticker.BidPrice, ticker.BidSize = bids[0].Price, bids[0].TotalVolume
+	}
+	if asks := ob.AskLimitsList(); len(asks) > 0 {
+		ticker.AskPrice, ticker.AskSize = asks[0].Price, asks[0].TotalVolume
+	}
+
+	return ticker
+}
+
+// bookHooks passes the changes of a book on to several hooks.
+type bookHooks []order_book.Hooks
+
+func (hooks bookHooks) LimitOrderPlaced(ob *order_book.OrderBook, order *order_book.Order) {
+	for _, h := range hooks {
+		h.LimitOrderPlaced(ob, order)
+	}
+}
+
+func (hooks bookHooks) MarketOrderFilled(ob *order_book.OrderBook, order *order_book.Order, matches []order_book.Match, took time.Duration) {
+	for _, h := range hooks {
+		h.MarketOrderFilled(ob, order, matches, took)
+	}
+}
+
+func (hooks bookHooks) OrderCancelled(ob *order_book.OrderBook, order *order_book.Order) {
+	for _, h := range hooks {
+		h.OrderCancelled(ob, order)
+	}
+}
+
+func (hooks bookHooks) AuctionUncrossed(ob *order_book.OrderBook, price float64, matches []order_book.Match, took time.Duration) {
+	for _, h := range hooks {
+		h.AuctionUncrossed(ob, price, matches, took)
+	}
+}
+
+// handleGetBookDepth returns the levels of a book, all of them unless depth
+// limits the levels of each side.
+func (ex *Exchange) handleGetBookDepth(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	orderBook, ok := ex.orderBooks[market]
+	if !ok {
+		return errNotFound("market")
+	}
+
+	var depth int
+	if param := c.QueryParam("depth"); param != "" {
+		var err error
+		if depth, err = strconv.Atoi(param); err != nil || depth < 0 {
+			fe := make(fieldErrors)
+			fe.add("depth", "must be a non-negative integer")
+			return fe.err()
+		}
+	}
+
+	ex.bookMu.Lock()
+	defer ex.bookMu.Unlock()
+
+	setSequence(c.Response().Header(), ex.sessions.seq(streamKey{channel: ChannelBook, key: string(market)}))
+
+	return c.JSON(http.StatusOK, bookDepth(orderBook, depth))
+}
+
+// bookDepth returns the levels of a book, all of them unless depth limits
+// the levels of each side. The book lock must be held.
+func bookDepth(orderBook *order_book.OrderBook, depth int) BookDepthRes {
+	return BookDepthRes{
+		Bids: depthOf(orderBook.BidLimitsList(), depth),
+		Asks: depthOf(orderBook.AskLimitsList(), depth),
+		Checksum: BookChecksum(
+			depthOf(orderBook.BidLimitsList(), ChecksumDepth),
+			depthOf(orderBook.AskLimitsList(), ChecksumDepth),
+		),
+	}
+}
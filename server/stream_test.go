@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamEvent struct {
+	Type    string          `json:"type"`
+	Channel string          `json:"channel"`
+	Market  Market          `json:"market"`
+	Seq     uint64          `json:"seq"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// dialStream opens a session with apiKey, without a user if it is empty.
+func dialStream(t *testing.T, te *testExchange, apiKey string) *websocket.Conn {
+	t.Helper()
+
+	ts := httptest.NewServer(te.e)
+	t.Cleanup(ts.Close)
+
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set(HeaderAPIKey, apiKey)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn, data any) streamEvent {
+	t.Helper()
+
+	var event streamEvent
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if data != nil {
+		if err := json.Unmarshal(event.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return event
+}
+
+func TestStreams(t *testing.T) {
+	te := newTestExchange(t)
+	seller := te.registerUser(t)
+	buyer := te.registerUser(t)
+
+	conn := dialStream(t, te, buyer.APIKey)
+
+	for _, cmd := range []WSCommand{
+		{Op: WSOpSubscribe, Channel: ChannelBook, Market: ETH},
+		{Op: WSOpSubscribe, Channel: ChannelTrades, Market: ETH},
+		{Op: WSOpSubscribe, Channel: ChannelTicker, Market: ETH},
+		{Op: WSOpSubscribe, Channel: ChannelOrders},
+	} {
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		event := readEvent(t, conn, nil)
+		assert(t, event.Type, WSEventSubscribed)
+		assert(t, event.Channel, cmd.Channel)
+		assert(t, event.Seq, uint64(0))
+	}
+
+	te.placeLimit(t, seller.ID, false, 10, 3500)
+
+	var update BookUpdate
+	event := readEvent(t, conn, &update)
+	assert(t, event.Type, WSEventBook)
+	assert(t, event.Seq, uint64(1))
+	assert(t, update.Asks, []BookLevel{{Price: 3500, Size: 10}})
+	assert(t, update.Checksum, BookChecksum(nil, update.Asks))
+
+	var ticker Ticker
+	event = readEvent(t, conn, &ticker)
+	assert(t, event.Type, WSEventTicker)
+	assert(t, ticker, Ticker{AskPrice: 3500, AskSize: 10})
+
+	status, _ := te.placeMarket(t, buyer.ID, true, 4)
+	assert(t, status, http.StatusOK)
+
+	var order OrderRecord
+	event = readEvent(t, conn, &order)
+	assert(t, event.Type, WSEventOrder)
+	assert(t, event.Seq, uint64(1))
+	assert(t, order.Status, OrderNew)
+
+	var trade Trade
+	event = readEvent(t, conn, &trade)
+	assert(t, event.Type, WSEventTrade)
+	assert(t, event.Seq, uint64(1))
+	assert(t, trade.Size, 4.0)
+
+	event = readEvent(t, conn, &update)
+	assert(t, event.Seq, uint64(2))
+	assert(t, update.Asks, []BookLevel{{Price: 3500, Size: 6}})
+
+	event = readEvent(t, conn, &ticker)
+	assert(t, ticker, Ticker{AskPrice: 3500, AskSize: 6})
+
+	event = readEvent(t, conn, &order)
+	assert(t, event.Seq, uint64(2))
+	assert(t, order.Status, OrderFilled)
+
+	// the snapshots name the events they include
+	rec := te.get(t, "/book/ETH", nil)
+	assert(t, rec.Header().Get(HeaderSequence), "2")
+	rec = te.get(t, "/book/ETH/depth?depth=1", nil)
+	assert(t, rec.Header().Get(HeaderSequence), "2")
+	var depth BookDepthRes
+	if err := json.Unmarshal(rec.Body.Bytes(), &depth); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, depth.Asks, []BookLevel{{Price: 3500, Size: 6}})
+	assert(t, depth.Checksum, update.Checksum)
+	rec = te.get(t, "/trades/ETH", nil)
+	assert(t, rec.Header().Get(HeaderSequence), "1")
+	rec = te.get(t, "/users/"+buyer.ID+"/orders", nil)
+	assert(t, rec.Header().Get(HeaderSequence), "2")
+
+	if err := conn.WriteJSON(WSCommand{Op: WSOpSubscribe, Channel: ChannelBook, Market: "BTC"}); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr APIError
+	event = readEvent(t, conn, &apiErr)
+	assert(t, event.Type, WSEventError)
+	assert(t, apiErr.Details["market"], `unknown market "BTC"`)
+
+	// a new ticker subscriber gets the top of book right away
+	if err := conn.WriteJSON(WSCommand{Op: WSOpUnsubscribe, Channel: ChannelTicker, Market: ETH}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, readEvent(t, conn, nil).Type, WSEventUnsubscribed)
+
+	if err := conn.WriteJSON(WSCommand{Op: WSOpSubscribe, Channel: ChannelTicker, Market: ETH}); err != nil {
+		t.Fatal(err)
+	}
+	event = readEvent(t, conn, &ticker)
+	assert(t, event.Type, WSEventSubscribed)
+	assert(t, event.Seq, uint64(2))
+	assert(t, ticker, Ticker{AskPrice: 3500, AskSize: 6})
+}
+
+func TestOrderStreamUser(t *testing.T) {
+	te := newTestExchange(t)
+	alice := te.registerUser(t)
+	bob := te.registerUser(t)
+
+	// a session without an API key streams market data only
+	conn := dialStream(t, te, "")
+	if err := conn.WriteJSON(WSCommand{Op: WSOpSubscribe, Channel: ChannelOrders}); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr APIError
+	assert(t, readEvent(t, conn, &apiErr).Type, WSEventError)
+	assert(t, apiErr.Code, CodeUnauthorized)
+
+	// naming another user doesn't open a session of theirs
+	ts := httptest.NewServer(te.e)
+	defer ts.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?user_id="+bob.ID, http.Header{HeaderAPIKey: {alice.APIKey}})
+	if err == nil {
+		t.Fatal("session opened for another user")
+	}
+	assert(t, resp.StatusCode, http.StatusForbidden)
+
+	// the session of an API key streams the orders of its user
+	conn = dialStream(t, te, alice.APIKey)
+	if err := conn.WriteJSON(WSCommand{Op: WSOpSubscribe, Channel: ChannelOrders}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, readEvent(t, conn, nil).Type, WSEventSubscribed)
+
+	te.placeLimit(t, bob.ID, false, 1, 3600)
+	orderID := te.placeLimit(t, alice.ID, false, 1, 3700)
+
+	var order OrderRecord
+	assert(t, readEvent(t, conn, &order).Type, WSEventOrder)
+	assert(t, order.ID, orderID)
+}
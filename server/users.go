@@ -0,0 +1,349 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// apiKeyBytes is the length of the random API keys of users.
+const apiKeyBytes = 32
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserExists    = errors.New("key already registered")
+	ErrInvalidAPIKey = errors.New("invalid API key")
+)
+
+type userRecord struct {
+	ID      string         `json:"id"`
+	Address common.Address `json:"address"`
+	// APIKeyHash is the SHA-256 of the API key of the user, users without
+	// one can't make requests until an operator issues them a key.
+	APIKeyHash string `json:"api_key_hash,omitempty"`
+}
+
+// UserStore keeps exchange users and their private keys. Keys are stored
+// encrypted in a go-ethereum keystore, the mapping from user ID to address
+// is kept in an index file next to it so users survive restarts. Users
+// authenticate with an API key, of which only a hash is kept.
+type UserStore struct {
+	mu         sync.RWMutex
+	ks         *keystore.KeyStore
+	indexPath  string
+	passphrase string
+	users      map[string]*User
+	// apiKeys maps the hashes of API keys to their users
+	apiKeys map[string]string
+}
+
+func NewUserStore(dir, passphrase string, scryptN, scryptP int) (*UserStore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty keystore passphrase")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	us := &UserStore{
+		ks:         keystore.NewKeyStore(filepath.Join(dir, "keys"), scryptN, scryptP),
+		indexPath:  filepath.Join(dir, "users.json"),
+		passphrase: passphrase,
+		users:      make(map[string]*User),
+		apiKeys:    make(map[string]string),
+	}
+
+	if err := us.load(); err != nil {
+		return nil, err
+	}
+
+	return us, nil
+}
+
+func (us *UserStore) load() error {
+	data, err := os.ReadFile(us.indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []userRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("decoding user index: %w", err)
+	}
+
+	for _, record := range records {
+		pk, err := us.decryptKey(record.Address)
+		if err != nil {
+			return fmt.Errorf("loading key of user %s: %w", record.ID, err)
+		}
+
+		us.users[record.ID] = &User{
+			ID:         record.ID,
+			Address:    record.Address,
+			PrivateKey: pk,
+		}
+		if record.APIKeyHash != "" {
+			us.apiKeys[record.APIKeyHash] = record.ID
+		}
+	}
+
+	return nil
+}
+
+func (us *UserStore) decryptKey(address common.Address) (*ecdsa.PrivateKey, error) {
+	account, err := us.ks.Find(accounts.Account{Address: address})
+	if err != nil {
+		return nil, err
+	}
+
+	keyJSON, err := os.ReadFile(account.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, us.passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.PrivateKey, nil
+}
+
+// Register creates a new user and returns it with its API key, which isn't
+// stored and can't be read again. If privateKey is empty a new key is
+// generated, otherwise the given hex encoded key is imported.
+func (us *UserStore) Register(privateKey string) (*User, string, error) {
+	var (
+		pk  *ecdsa.PrivateKey
+		err error
+	)
+
+	if privateKey == "" {
+		pk, err = crypto.GenerateKey()
+	} else {
+		pk, err = crypto.HexToECDSA(privateKey)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey, apiKeyHash, err := newAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	address := crypto.PubkeyToAddress(pk.PublicKey)
+	if err := us.checkAddress(address); err != nil {
+		return nil, "", err
+	}
+
+	// encrypting the key is slow on purpose, it runs without the lock so
+	// registrations don't hold up the users being authenticated
+	account, err := us.ks.ImportECDSA(pk, us.passphrase)
+	if errors.Is(err, keystore.ErrAccountAlreadyExists) {
+		return nil, "", ErrUserExists
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	user := &User{
+		ID:         uuid.NewString(),
+		Address:    address,
+		PrivateKey: pk,
+	}
+	if err := us.add(user, apiKeyHash); err != nil {
+		// a key without a user would make registering it again fail
+		if delErr := us.ks.Delete(account, us.passphrase); delErr != nil {
+			return nil, "", errors.Join(err, delErr)
+		}
+		return nil, "", err
+	}
+
+	return user, apiKey, nil
+}
+
+// checkAddress fails if a user of address is registered.
+func (us *UserStore) checkAddress(address common.Address) error {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	for _, user := range us.users {
+		if user.Address == address {
+			return fmt.Errorf("%w for user %s", ErrUserExists, user.ID)
+		}
+	}
+
+	return nil
+}
+
+// add stores a new user with the hash of its API key.
+func (us *UserStore) add(user *User, apiKeyHash string) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	us.users[user.ID] = user
+	us.apiKeys[apiKeyHash] = user.ID
+
+	if err := us.save(); err != nil {
+		delete(us.users, user.ID)
+		delete(us.apiKeys, apiKeyHash)
+		return err
+	}
+
+	return nil
+}
+
+// IssueAPIKey replaces the API key of a user and returns the new one.
+func (us *UserStore) IssueAPIKey(userID string) (string, error) {
+	apiKey, apiKeyHash, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if _, ok := us.users[userID]; !ok {
+		return "", ErrUserNotFound
+	}
+
+	previous := us.apiKeyHash(userID)
+	delete(us.apiKeys, previous)
+	us.apiKeys[apiKeyHash] = userID
+
+	if err := us.save(); err != nil {
+		delete(us.apiKeys, apiKeyHash)
+		if previous != "" {
+			us.apiKeys[previous] = userID
+		}
+		return "", err
+	}
+
+	return apiKey, nil
+}
+
+// Authenticate returns the user of an API key.
+func (us *UserStore) Authenticate(apiKey string) (*User, error) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	userID, ok := us.apiKeys[hashAPIKey(apiKey)]
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	return us.users[userID], nil
+}
+
+// apiKeyHash returns the hash of the API key of a user, empty if it has
+// none. The lock must be held.
+func (us *UserStore) apiKeyHash(userID string) string {
+	for hash, id := range us.apiKeys {
+		if id == userID {
+			return hash
+		}
+	}
+
+	return ""
+}
+
+// newAPIKey returns a random API key and its hash.
+func newAPIKey() (string, string, error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	apiKey := hex.EncodeToString(b)
+
+	return apiKey, hashAPIKey(apiKey), nil
+}
+
+func hashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func (us *UserStore) save() error {
+	apiKeyHashes := make(map[string]string, len(us.apiKeys))
+	for hash, userID := range us.apiKeys {
+		apiKeyHashes[userID] = hash
+	}
+
+	records := make([]userRecord, 0, len(us.users))
+	for _, user := range us.users {
+		records = append(records, userRecord{ID: user.ID, Address: user.Address, APIKeyHash: apiKeyHashes[user.ID]})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := us.indexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, us.indexPath)
+}
+
+func (us *UserStore) Get(id string) (*User, error) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	user, ok := us.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (us *UserStore) List() []*User {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	users := make([]*User, 0, len(us.users))
+	for _, user := range us.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	return users
+}
+
+func (us *UserStore) GetByAddress(address common.Address) (*User, error) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	for _, user := range us.users {
+		if user.Address == address {
+			return user, nil
+		}
+	}
+
+	return nil, ErrUserNotFound
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"os"
+	"testing"
+)
+
+func newTestUserStore(t *testing.T, dir string) *UserStore {
+	t.Helper()
+
+	users, err := NewUserStore(dir, "test", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return users
+}
+
+func TestUserStore(t *testing.T) {
+	dir := t.TempDir()
+	users := newTestUserStore(t, dir)
+
+	generated, apiKey, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, _, err := users.Register(testOperatorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = users.Register(testOperatorKey)
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("registering a key twice: %v", err)
+	}
+
+	user, err := users.GetByAddress(imported.Address)
+	assert(t, err, nil)
+	assert(t, user.ID, imported.ID)
+
+	_, err = users.Get("unknown")
+	assert(t, err, ErrUserNotFound)
+
+	// users and their keys survive a restart
+	reloaded := newTestUserStore(t, dir)
+	assert(t, len(reloaded.List()), 2)
+	for _, want := range []*User{generated, imported} {
+		user, err := reloaded.Get(want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, user, want)
+	}
+
+	user, err = reloaded.Authenticate(apiKey)
+	assert(t, err, nil)
+	assert(t, user.ID, generated.ID)
+}
+
+func TestUserStoreRegisterConcurrently(t *testing.T) {
+	users := newTestUserStore(t, t.TempDir())
+
+	// registrations encrypt their keys concurrently, one key still gets a
+	// single user
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, _, err := users.Register(testOperatorKey)
+			errs <- err
+		}()
+	}
+
+	var registered int
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			registered++
+		case !errors.Is(err, ErrUserExists):
+			t.Errorf("registering a key concurrently: %v", err)
+		}
+	}
+	assert(t, registered, 1)
+	assert(t, len(users.List()), 1)
+}
+
+func TestUserStoreAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	users := newTestUserStore(t, dir)
+
+	registered, apiKey, err := users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := users.Authenticate(apiKey)
+	assert(t, err, nil)
+	assert(t, user, registered)
+
+	_, err = users.Authenticate("not a key")
+	assert(t, err, ErrInvalidAPIKey)
+
+	// a new key replaces the old one
+	newKey, err := users.IssueAPIKey(registered.ID)
+	assert(t, err, nil)
+	_, err = users.Authenticate(apiKey)
+	assert(t, err, ErrInvalidAPIKey)
+
+	user, err = newTestUserStore(t, dir).Authenticate(newKey)
+	assert(t, err, nil)
+	assert(t, user.ID, registered.ID)
+
+	_, err = users.IssueAPIKey("unknown")
+	assert(t, err, ErrUserNotFound)
+}
+
+func TestUserStoreRegisterSaveFails(t *testing.T) {
+	users := newTestUserStore(t, t.TempDir())
+
+	// a directory in the way of the index makes saving it fail
+	if err := os.Mkdir(users.indexPath+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.Register(testOperatorKey); err == nil {
+		t.Fatal("registered a user without saving the index")
+	}
+	assert(t, len(users.List()), 0)
+	assert(t, len(users.ks.Accounts()), 0)
+
+	// the key can be registered once the index can be saved
+	if err := os.Remove(users.indexPath + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.Register(testOperatorKey); err != nil {
+		t.Fatal(err)
+	}
+	_, err := os.Stat(users.indexPath)
+	assert(t, err, nil)
+}
@@ -8,56 +8,55 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
-	"log"
 	"math/big"
 )
 
-func transferETH(client *ethclient.Client, from *ecdsa.PrivateKey, to *ecdsa.PrivateKey, amount *big.Int) error {
-	ctx := context.Background()
-
-	chainID, err := client.NetworkID(context.Background())
+func transferETH(ctx context.Context, client ChainClient, nonces *NonceManager, from *ecdsa.PrivateKey, to *ecdsa.PrivateKey, amount *big.Int) (common.Hash, error) {
+	chainID, err := client.ChainID(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return common.Hash{}, err
 	}
 
 	fromAddress, err := getAddress(from)
 	if err != nil {
-		return err
+		return common.Hash{}, err
 	}
 	toAddress, err := getAddress(to)
 	if err != nil {
-		return err
-	}
-
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
-		return err
+		return common.Hash{}, err
 	}
 
 	gasPrice, err := client.SuggestGasPrice(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return common.Hash{}, err
 	}
 	gasLimit := uint64(21000)
 
-	txData := &types.AccessListTx{
-		ChainID:  chainID,
-		Nonce:    nonce,
-		GasPrice: gasPrice,
-		Gas:      gasLimit,
-		To:       &toAddress,
-		Value:    amount,
-	}
+	var txHash common.Hash
 
-	tx := types.NewTx(txData)
+	err = nonces.Send(ctx, fromAddress, func(nonce uint64) error {
+		txData := &types.AccessListTx{
+			ChainID:  chainID,
+			Nonce:    nonce,
+			GasPrice: gasPrice,
+			Gas:      gasLimit,
+			To:       &toAddress,
+			Value:    amount,
+		}
 
-	signedTx, err := types.SignTx(tx, types.NewLondonSigner(chainID), from)
-	if err != nil {
-		return err
-	}
+		tx := types.NewTx(txData)
+
+		signedTx, err := types.SignTx(tx, types.NewLondonSigner(chainID), from)
+		if err != nil {
+			return err
+		}
 
-	return client.SendTransaction(ctx, signedTx)
+		txHash = signedTx.Hash()
+
+		return client.SendTransaction(ctx, signedTx)
+	})
+
+	return txHash, err
 }
 
 func getAddress(privateKey *ecdsa.PrivateKey) (common.Address, error) {
@@ -72,11 +71,29 @@ func getAddress(privateKey *ecdsa.PrivateKey) (common.Address, error) {
 
 func toOrder(order *order_book.Order) *Order {
 	return &Order{
-		ID:        order.ID,
-		UserID:    order.UserID,
-		IsBid:     order.IsBid,
-		Size:      order.Size,
-		Price:     order.Limit.Price,
-		Timestamp: order.Timestamp,
+		ID:            order.ID,
+		ClientOrderID: order.ClientOrderID,
+		UserID:        order.UserID,
+		IsBid:         order.IsBid,
+		Size:          order.Size,
+		Price:         order.Limit.Price,
+		Timestamp:     order.Timestamp,
+	}
+}
+
+func toUserRes(user *User) *UserRes {
+	return &UserRes{
+		ID:      user.ID,
+		Address: user.Address.Hex(),
+	}
+}
+
+func toTrade(trade *order_book.Trade) *Trade {
+	return &Trade{
+		ID:        trade.ID,
+		IsBid:     trade.IsBid,
+		Price:     trade.Price,
+		Size:      trade.Size,
+		Timestamp: trade.Timestamp,
 	}
 }
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	wsPingInterval = 15 * time.Second
+	wsWriteTimeout = 5 * time.Second
+	wsQueueSize    = 256
+)
+
+// WSEvent is a message pushed to WebSocket clients, Data depends on Type.
+// Events of a stream carry its channel, the market unless it is the orders
+// stream, and their sequence number in the stream, which grows by one with
+// every event.
+type WSEvent struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	Market  Market `json:"market,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// wsClient is an open WebSocket session, or a gRPC stream subscribed to
+// the same streams. Messages are queued and written by its writer, so
+// publishing never waits for a slow client.
+type wsClient struct {
+	conn   *websocket.Conn
+	userID string
+	out    chan any
+	// drop ends the session
+	drop func()
+	// streams are the streams the session subscribed to, guarded by the
+	// mutex of wsSessions.
+	streams map[streamKey]bool
+}
+
+func newWSClient(conn *websocket.Conn, userID string) *wsClient {
+	wc := newStreamClient(userID, func() { conn.Close() })
+	wc.conn = conn
+
+	return wc
+}
+
+// newStreamClient returns a session without a WebSocket connection, its
+// messages are read from out. drop is called once it can't keep up.
+func newStreamClient(userID string, drop func()) *wsClient {
+	return &wsClient{
+		userID:  userID,
+		out:     make(chan any, wsQueueSize),
+		drop:    drop,
+		streams: make(map[streamKey]bool),
+	}
+}
+
+// queue hands v to the writer of the session. A session whose queue is full
+// can't keep up and is dropped, which ends its handler, the client catches
+// up from a snapshot once it reconnects.
+func (wc *wsClient) queue(v any) bool {
+	select {
+	case wc.out <- v:
+		return true
+	default:
+		wc.drop()
+		return false
+	}
+}
+
+// write writes the queued messages until done is closed.
+func (wc *wsClient) write(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case v := <-wc.out:
+			wc.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := wc.conn.WriteJSON(v); err != nil {
+				wc.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// wsSessions tracks the open WebSocket sessions with their subscriptions
+// and counts those of each user that asked for their orders to be cancelled
+// on disconnect.
+type wsSessions struct {
+	mu                 sync.Mutex
+	clients            map[*wsClient]bool
+	subs               map[streamKey]map[*wsClient]bool
+	seqs               map[streamKey]uint64
+	cancelOnDisconnect map[string]int
+}
+
+func newWSSessions() *wsSessions {
+	return &wsSessions{
+		clients:            make(map[*wsClient]bool),
+		subs:               make(map[streamKey]map[*wsClient]bool),
+		seqs:               make(map[streamKey]uint64),
+		cancelOnDisconnect: make(map[string]int),
+	}
+}
+
+func (s *wsSessions) add(wc *wsClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[wc] = true
+}
+
+func (s *wsSessions) remove(wc *wsClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stream := range wc.streams {
+		s.unsubscribeLocked(wc, stream)
+	}
+	delete(s.clients, wc)
+}
+
+// broadcast queues event for every open session. A session that can't keep
+// up is closed.
+func (s *wsSessions) broadcast(ctx context.Context, event WSEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for wc := range s.clients {
+		if !wc.queue(event) {
+			loggerFrom(ctx).Warn("dropping websocket session", "event", event.Type, "user_id", wc.userID)
+		}
+	}
+}
+
+func (s *wsSessions) connect(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancelOnDisconnect[userID]++
+}
+
+// disconnect reports whether the last session of the user asking for cancel
+// on disconnect is gone.
+func (s *wsSessions) disconnect(userID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancelOnDisconnect[userID]--
+	if s.cancelOnDisconnect[userID] > 0 {
+		return false
+	}
+
+	delete(s.cancelOnDisconnect, userID)
+	return true
+}
+
+// handleWS opens a WebSocket session. The session receives market status
+// changes and subscribes to streams with WSCommand messages. A session
+// opened with the API key of a user is the user's, an operator names the
+// user with user_id, and only a user's session streams its orders. With
+// cancel_on_disconnect set all orders of the user are cancelled once their
+// last such session drops, a session that stops answering pings counts as
+// dropped.
+func (ex *Exchange) handleWS(c echo.Context) error {
+	userID := c.QueryParam("user_id")
+	cancelOnDisconnect := c.QueryParam("cancel_on_disconnect") == "true"
+
+	if userID != "" {
+		if _, err := ex.Users.Get(userID); err != nil {
+			return errNotFound("user")
+		}
+		if err := authorize(c, userID); err != nil {
+			return err
+		}
+	} else if c.Get(adminContextKey) == nil {
+		userID = principal(c)
+	}
+
+	if cancelOnDisconnect && userID == "" {
+		return NewAPIError(http.StatusUnauthorized, CodeUnauthorized, "cancel_on_disconnect needs the API key of the user")
+	}
+
+	conn, err := ex.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// the upgrader already replied
+		loggerFrom(c.Request().Context()).Warn("websocket upgrade failed", "error", err)
+		return nil
+	}
+	defer conn.Close()
+
+	wc := newWSClient(conn, userID)
+	ex.sessions.add(wc)
+	defer ex.sessions.remove(wc)
+
+	if cancelOnDisconnect {
+		ex.sessions.connect(userID)
+		defer func() {
+			if ex.sessions.disconnect(userID) {
+				ctx := c.Request().Context()
+				loggerFrom(ctx).Info("cancelling orders on disconnect", "user_id", userID)
+				ex.cancelAll(ctx, ActorSystem, userID, "", "", OrderCancelled)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go ping(conn, done)
+	go wc.write(done)
+
+	conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+
+		var cmd WSCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			wc.queue(WSEvent{Type: WSEventError, Data: NewAPIError(http.StatusBadRequest, CodeInvalidRequest, "malformed command")})
+			continue
+		}
+
+		ex.handleWSCommand(wc, cmd)
+	}
+}
+
+func ping(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
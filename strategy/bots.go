@@ -0,0 +1,68 @@
+package strategy
+
+import (
+	"crypto_exchange/server"
+)
+
+// MarketMaker quotes inside the spread: every tick it bids Improve above the
+// best bid and asks Improve below the best ask, keeping up to MaxOrders
+// orders of Size open on each side. Orders it fails to place are logged and
+// tried again on the next tick.
+type MarketMaker struct {
+	Base
+	Size      float64
+	Improve   float64
+	MaxOrders int
+}
+
+func (m *MarketMaker) OnTimer(t *Trader) error {
+	bid, okBid := t.Book().BestBid()
+	ask, okAsk := t.Book().BestAsk()
+	if !okBid || !okAsk {
+		return nil
+	}
+
+	bids, asks := t.OpenOrders(true), t.OpenOrders(false)
+	t.Logger().Info("market maker quoting",
+		"best_bid", bid.Price,
+		"best_ask", ask.Price,
+		"spread", ask.Price-bid.Price,
+		"open_bids", len(bids),
+		"open_asks", len(asks),
+	)
+
+	if len(bids) < m.MaxOrders {
+		if _, err := t.PlaceLimit(true, m.Size, bid.Price+m.Improve); err != nil {
+			t.Logger().Warn("market maker failed to place a bid", "error", err)
+		}
+	}
+	if len(asks) < m.MaxOrders {
+		if _, err := t.PlaceLimit(false, m.Size, ask.Price-m.Improve); err != nil {
+			t.Logger().Warn("market maker failed to place an ask", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// MarketTaker sells and then buys Size with market orders every tick and
+// logs the trades of the market.
+type MarketTaker struct {
+	Base
+	Size float64
+}
+
+func (m *MarketTaker) OnTrade(t *Trader, trade *server.Trade) error {
+	t.Logger().Info("trade", "id", trade.ID, "is_bid", trade.IsBid, "price", trade.Price, "size", trade.Size)
+	return nil
+}
+
+func (m *MarketTaker) OnTimer(t *Trader) error {
+	for _, isBid := range []bool{false, true} {
+		if _, err := t.PlaceMarket(isBid, m.Size); err != nil {
+			t.Logger().Warn("market taker failed to place an order", "is_bid", isBid, "error", err)
+		}
+	}
+
+	return nil
+}
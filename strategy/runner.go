@@ -0,0 +1,162 @@
+package strategy
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultInterval = time.Second
+
+	// cancelTimeout bounds cancelling the open orders once Run is done.
+	cancelTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// Market is the market traded, server.ETH if empty.
+	Market server.Market
+	// Interval is the time between the calls of OnTimer, DefaultInterval if
+	// zero.
+	Interval time.Duration
+	// CancelOnExit cancels the open orders of the user in the market once
+	// Run returns.
+	CancelOnExit bool
+	Logger       *slog.Logger
+}
+
+// Run runs s on venue until ctx is done, when it returns nil, or s returns
+// an error. It subscribes to the market and calls OnStart once the book and
+// the open orders are known. A feed that ends or a book that doesn't match
+// the checksum of the exchange is subscribed to again after an Interval,
+// starting from new snapshots.
+func Run(ctx context.Context, venue Venue, s Strategy, cfg Config) error {
+	if cfg.Market == "" {
+		cfg.Market = server.ETH
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	t := newTrader(ctx, venue, cfg.Market, logger.With("market", cfg.Market))
+	if cfg.CancelOnExit {
+		defer cancelOnExit(t)
+	}
+
+	feed, err := venue.Subscribe(ctx, cfg.Market)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if feed != nil {
+			feed.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	started := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-feed.Events():
+			if ok {
+				started, err = handle(t, s, event, started)
+			}
+			if ok && !errors.Is(err, client.ErrChecksumMismatch) {
+				break
+			}
+			if ok {
+				t.log.Warn("strategy book out of sync, subscribing again")
+			}
+
+			feed.Close()
+			feed, err = resubscribe(t, cfg.Interval)
+			if ctx.Err() != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if started {
+				err = s.OnTimer(t)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle applies an event to the Trader and calls the methods of s it
+// concerns, starting s once it can be. It returns whether s is started.
+func handle(t *Trader, s Strategy, event client.Event, started bool) (bool, error) {
+	switch event.Type {
+	case client.EventBookSnapshot, client.EventBookUpdate:
+		if err := t.book.Apply(event); err != nil {
+			return started, err
+		}
+		if started && t.book.Synced() {
+			return started, s.OnBook(t)
+		}
+	case client.EventTrade:
+		if started && event.Market == t.market {
+			return started, s.OnTrade(t, event.Trade)
+		}
+	case client.EventOrdersSnapshot:
+		t.applyOrders(event.Orders)
+	case client.EventOrder:
+		if t.applyOrder(*event.Order) && started {
+			return started, s.OnOrderUpdate(t, *event.Order)
+		}
+	case client.EventDisconnected:
+		t.log.Warn("strategy feed disconnected", "error", event.Err)
+	}
+
+	if started || !t.book.Synced() || !t.ordersSynced {
+		return started, nil
+	}
+
+	return true, s.OnStart(t)
+}
+
+// resubscribe subscribes the Trader to its market again after wait, with a
+// new book and open orders.
+func resubscribe(t *Trader, wait time.Duration) (Feed, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-t.ctx.Done():
+		return nil, nil
+	case <-timer.C:
+	}
+
+	t.book = client.NewLocalBook(t.market)
+	t.ordersSynced = false
+
+	return t.venue.Subscribe(t.ctx, t.market)
+}
+
+// cancelOnExit cancels the open orders of the Trader, which Run is done
+// with.
+func cancelOnExit(t *Trader) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(t.ctx), cancelTimeout)
+	defer cancel()
+
+	t.ctx = ctx
+	if err := t.CancelAll(); err != nil {
+		t.log.Warn("strategy failed to cancel its orders", "error", err)
+	}
+}
@@ -0,0 +1,38 @@
+// Package strategy runs trading strategies against the exchange. A Strategy
+// reacts to the book, the trades of a market and the orders of its user,
+// Run feeds it from a Venue, which trades through the REST client, the gRPC
+// client or an exchange in the same process, and hands it a Trader to keep
+// track of its open orders and to place and cancel them.
+package strategy
+
+import (
+	"crypto_exchange/server"
+)
+
+// Strategy trades a market. Its methods are called one at a time from the
+// goroutine of Run, so a strategy needs no locking of its own. A method
+// returning an error stops Run, errors a strategy can live with, like a
+// rejected order, should be logged instead.
+type Strategy interface {
+	// OnStart is called once the book and the open orders of the user are
+	// known, before any other method.
+	OnStart(t *Trader) error
+	// OnBook is called after every change to the book.
+	OnBook(t *Trader) error
+	OnTrade(t *Trader, trade *server.Trade) error
+	// OnOrderUpdate is called with every change to an order of the user in
+	// the market, after the open orders of the Trader were updated.
+	OnOrderUpdate(t *Trader, order server.OrderRecord) error
+	// OnTimer is called every Config.Interval.
+	OnTimer(t *Trader) error
+}
+
+// Base implements every method of Strategy doing nothing, strategies embed
+// it and implement the methods they need.
+type Base struct{}
+
+func (Base) OnStart(*Trader) error                           { return nil }
+func (Base) OnBook(*Trader) error                            { return nil }
+func (Base) OnTrade(*Trader, *server.Trade) error            { return nil }
+func (Base) OnOrderUpdate(*Trader, server.OrderRecord) error { return nil }
+func (Base) OnTimer(*Trader) error                           { return nil }
@@ -0,0 +1,220 @@
+package strategy
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"crypto_exchange/server/servertest"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// newExchange returns an exchange with a fake settler that settles trades
+// for the duration of the test.
+func newExchange(t *testing.T) *server.Exchange {
+	t.Helper()
+
+	return servertest.NewExchange(t, servertest.Config())
+}
+
+func registerUser(t *testing.T, ex *server.Exchange) *server.UserRes {
+	t.Helper()
+
+	user, apiKey, err := ex.Users.Register("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &server.UserRes{ID: user.ID, APIKey: apiKey}
+}
+
+func inProcess(t *testing.T, ex *server.Exchange, user *server.UserRes) *GRPCVenue {
+	t.Helper()
+
+	venue, err := InProcess(ex, user.ID, user.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(venue.Close)
+
+	return venue
+}
+
+// run runs s until the test ends and returns the error of Run.
+func run(t *testing.T, venue Venue, s Strategy, cfg Config) <-chan error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx, venue, s, cfg) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return done
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+		var zero T
+		return zero
+	}
+}
+
+// recorder hands what it is called with to the test.
+type recorder struct {
+	Base
+	started chan []server.OrderRecord
+	books   chan server.BookLevel
+	trades  chan *server.Trade
+	updates chan server.OrderRecord
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		started: make(chan []server.OrderRecord, 1),
+		books:   make(chan server.BookLevel, 100),
+		trades:  make(chan *server.Trade, 100),
+		updates: make(chan server.OrderRecord, 100),
+	}
+}
+
+func (r *recorder) OnStart(t *Trader) error {
+	r.started <- t.OpenOrders(false)
+	return nil
+}
+
+func (r *recorder) OnBook(t *Trader) error {
+	bid, _ := t.Book().BestBid()
+	r.books <- bid
+	return nil
+}
+
+func (r *recorder) OnTrade(_ *Trader, trade *server.Trade) error {
+	r.trades <- trade
+	return nil
+}
+
+func (r *recorder) OnOrderUpdate(t *Trader, order server.OrderRecord) error {
+	r.updates <- order
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	venues := map[string]func(t *testing.T, ex *server.Exchange, user *server.UserRes) Venue{
+		"client": func(t *testing.T, ex *server.Exchange, user *server.UserRes) Venue {
+			url := servertest.Serve(t, ex)
+
+			return NewClientVenue(client.NewClient(client.WithBaseURL(url), client.WithUserID(user.ID), client.WithAPIKey(user.APIKey)))
+		},
+		"in-process": func(t *testing.T, ex *server.Exchange, user *server.UserRes) Venue {
+			return inProcess(t, ex, user)
+		},
+	}
+
+	for name, newVenue := range venues {
+		t.Run(name, func(t *testing.T) {
+			ex := newExchange(t)
+			taker := inProcess(t, ex, registerUser(t, ex))
+			venue := newVenue(t, ex, registerUser(t, ex))
+
+			ctx := context.Background()
+			ask, err := venue.PlaceOrder(ctx, &client.PlaceOrderArgs{Size: 10, Price: 3600}, server.LimitOrder)
+			assert(t, err, nil)
+
+			r := newRecorder()
+			done := run(t, venue, r, Config{Interval: time.Hour})
+
+			// orders placed before the start are known
+			open := receive(t, r.started)
+			assert(t, len(open), 1)
+			assert(t, open[0].ID, ask.OrderID)
+
+			_, err = taker.PlaceOrder(ctx, &client.PlaceOrderArgs{IsBid: true, Size: 4}, server.MarketOrder)
+			assert(t, err, nil)
+
+			trade := receive(t, r.trades)
+			assert(t, trade.Price, 3600.0)
+			assert(t, trade.Size, 4.0)
+
+			update := receive(t, r.updates)
+			assert(t, update.ID, ask.OrderID)
+			assert(t, update.Status, server.OrderPartiallyFilled)
+			assert(t, update.ExecutedSize, 4.0)
+
+			_, err = taker.PlaceOrder(ctx, &client.PlaceOrderArgs{IsBid: true, Size: 1, Price: 3500}, server.LimitOrder)
+			assert(t, err, nil)
+			for receive(t, r.books).Price != 3500 {
+			}
+
+			select {
+			case err := <-done:
+				t.Fatalf("run ended: %v", err)
+			default:
+			}
+		})
+	}
+}
+
+func TestMarketMaker(t *testing.T) {
+	ex := newExchange(t)
+	seed := inProcess(t, ex, registerUser(t, ex))
+	user := registerUser(t, ex)
+	venue := inProcess(t, ex, user)
+
+	ctx := context.Background()
+	_, err := seed.PlaceOrder(ctx, &client.PlaceOrderArgs{IsBid: true, Size: 10, Price: 3500}, server.LimitOrder)
+	assert(t, err, nil)
+	_, err = seed.PlaceOrder(ctx, &client.PlaceOrderArgs{Size: 10, Price: 3600}, server.LimitOrder)
+	assert(t, err, nil)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(runCtx, venue, &MarketMaker{Size: 1, Improve: 10, MaxOrders: 2}, Config{
+			Interval:     10 * time.Millisecond,
+			CancelOnExit: true,
+			Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ex.Orders.UserOrders(user.ID, server.OrderNew)) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("market maker didn't quote")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// no more than MaxOrders a side, each quote improving on the last
+	var prices []float64
+	time.Sleep(50 * time.Millisecond)
+	for _, order := range ex.Orders.UserOrders(user.ID, server.OrderNew) {
+		prices = append(prices, order.Price)
+	}
+	sort.Float64s(prices)
+	assert(t, prices, []float64{3510, 3520, 3580, 3590})
+
+	cancel()
+	assert(t, receive(t, done), nil)
+	assert(t, len(ex.Orders.UserOrders(user.ID, server.OrderNew)), 0)
+}
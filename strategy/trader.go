@@ -0,0 +1,168 @@
+package strategy
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Trader is what a strategy sees of the market it trades: a replica of the
+// book and the open orders of its user, kept up to date by Run. Orders
+// placed through it count as open as soon as the exchange accepted them,
+// before their first update arrives.
+type Trader struct {
+	ctx    context.Context
+	venue  Venue
+	market server.Market
+	book   *client.LocalBook
+	log    *slog.Logger
+
+	// open orders of the user in the market by ID
+	open map[string]server.OrderRecord
+	// ordersSynced is set once the open orders came from a snapshot
+	ordersSynced bool
+}
+
+func newTrader(ctx context.Context, venue Venue, market server.Market, logger *slog.Logger) *Trader {
+	return &Trader{
+		ctx:    ctx,
+		venue:  venue,
+		market: market,
+		book:   client.NewLocalBook(market),
+		log:    logger,
+		open:   make(map[string]server.OrderRecord),
+	}
+}
+
+// Context is done once Run returns.
+func (t *Trader) Context() context.Context {
+	return t.ctx
+}
+
+func (t *Trader) Market() server.Market {
+	return t.market
+}
+
+func (t *Trader) Book() *client.LocalBook {
+	return t.book
+}
+
+func (t *Trader) Logger() *slog.Logger {
+	return t.log
+}
+
+// OpenOrders returns the open orders of a side, best price first and the
+// oldest first at a price.
+func (t *Trader) OpenOrders(isBid bool) []server.OrderRecord {
+	var orders []server.OrderRecord
+	for _, order := range t.open {
+		if order.IsBid == isBid {
+			orders = append(orders, order)
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		a, b := orders[i], orders[j]
+		switch {
+		case a.Price != b.Price && isBid:
+			return a.Price > b.Price
+		case a.Price != b.Price:
+			return a.Price < b.Price
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+
+	return orders
+}
+
+// PlaceLimit places a limit order in the market of the Trader.
+func (t *Trader) PlaceLimit(isBid bool, size, price float64) (*server.PlaceOrderRes, error) {
+	return t.place(&client.PlaceOrderArgs{Market: t.market, IsBid: isBid, Size: size, Price: price}, server.LimitOrder)
+}
+
+// PlaceMarket places a market order in the market of the Trader.
+func (t *Trader) PlaceMarket(isBid bool, size float64) (*server.PlaceOrderRes, error) {
+	return t.place(&client.PlaceOrderArgs{Market: t.market, IsBid: isBid, Size: size}, server.MarketOrder)
+}
+
+func (t *Trader) place(args *client.PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error) {
+	res, err := t.venue.PlaceOrder(t.ctx, args, orderType)
+	if err != nil {
+		return nil, err
+	}
+
+	// market orders are done once placed
+	if orderType == server.LimitOrder {
+		now := time.Now()
+		t.open[res.OrderID] = server.OrderRecord{
+			ID:            res.OrderID,
+			ClientOrderID: res.ClientOrderID,
+			Market:        t.market,
+			Type:          orderType,
+			IsBid:         args.IsBid,
+			Price:         args.Price,
+			Size:          args.Size,
+			Status:        server.OrderNew,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+	}
+
+	return res, nil
+}
+
+// Cancel cancels an open order of the user.
+func (t *Trader) Cancel(orderID string) error {
+	if err := t.venue.CancelOrder(t.ctx, orderID); err != nil {
+		return err
+	}
+
+	delete(t.open, orderID)
+	return nil
+}
+
+// CancelSide cancels the open orders of a side, trying every one of them
+// and returning the errors of those it failed to cancel.
+func (t *Trader) CancelSide(isBid bool) error {
+	var errs []error
+	for _, order := range t.OpenOrders(isBid) {
+		errs = append(errs, t.Cancel(order.ID))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CancelAll cancels the open orders of both sides.
+func (t *Trader) CancelAll() error {
+	return errors.Join(t.CancelSide(true), t.CancelSide(false))
+}
+
+// applyOrders replaces the open orders with those of a snapshot of the
+// orders of the user.
+func (t *Trader) applyOrders(orders []server.OrderRecord) {
+	t.open = make(map[string]server.OrderRecord)
+	for _, order := range orders {
+		t.applyOrder(order)
+	}
+	t.ordersSynced = true
+}
+
+// applyOrder records a change to an order, reporting whether the order is
+// one of the market.
+func (t *Trader) applyOrder(order server.OrderRecord) bool {
+	if order.Market != t.market {
+		return false
+	}
+
+	if order.Status.IsOpen() {
+		t.open[order.ID] = order
+	} else {
+		delete(t.open, order.ID)
+	}
+
+	return true
+}
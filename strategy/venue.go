@@ -0,0 +1,202 @@
+package strategy
+
+import (
+	"context"
+	"crypto_exchange/client"
+	"crypto_exchange/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync"
+)
+
+// inProcessBuffer is the size of the in-memory connection to an exchange in
+// the same process.
+const inProcessBuffer = 1 << 20
+
+// Venue is where a strategy trades, for the user it was opened for.
+type Venue interface {
+	PlaceOrder(ctx context.Context, args *client.PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error)
+	CancelOrder(ctx context.Context, orderID string) error
+	// Subscribe streams the book and trades of market and the changes to
+	// the orders of the user. The book and the orders start from a
+	// snapshot.
+	Subscribe(ctx context.Context, market server.Market) (Feed, error)
+}
+
+// Feed delivers the events of a subscription until it is closed. Its events
+// are closed once the feed ended, a Feed isn't restarted.
+type Feed interface {
+	Events() <-chan client.Event
+	Close()
+}
+
+// ClientVenue trades through the REST API and its WebSocket streams.
+type ClientVenue struct {
+	c *client.Client
+}
+
+// NewClientVenue returns a venue of the user of c, c needs a user, see
+// client.WithUserID.
+func NewClientVenue(c *client.Client) *ClientVenue {
+	return &ClientVenue{c: c}
+}
+
+func (v *ClientVenue) PlaceOrder(ctx context.Context, args *client.PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error) {
+	if orderType == server.MarketOrder {
+		return v.c.PlaceMarketOrderContext(ctx, args)
+	}
+
+	return v.c.PlaceLimitOrderContext(ctx, args)
+}
+
+func (v *ClientVenue) CancelOrder(ctx context.Context, orderID string) error {
+	return v.c.CancelOrderContext(ctx, orderID)
+}
+
+// Subscribe opens a stream, which reconnects by itself when its connection
+// drops.
+func (v *ClientVenue) Subscribe(ctx context.Context, market server.Market) (Feed, error) {
+	stream, err := v.c.Subscribe(ctx, client.BookStream(market), client.TradeStream(market), client.OrderStream())
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// GRPCVenue trades through the gRPC API.
+type GRPCVenue struct {
+	c *client.GRPCClient
+	// stop stops the server of an in-process venue
+	stop func()
+}
+
+// NewGRPCVenue returns a venue of the user of c, c needs a user. Closing the
+// venue leaves c open.
+func NewGRPCVenue(c *client.GRPCClient) *GRPCVenue {
+	return &GRPCVenue{c: c}
+}
+
+// InProcess returns a venue of userID, with its API key, on an exchange of
+// the same process, served over an in-memory connection instead of the
+// network. The venue has to be closed.
+func InProcess(ex *server.Exchange, userID, apiKey string) (*GRPCVenue, error) {
+	lis := bufconn.Listen(inProcessBuffer)
+	srv := ex.GRPCServer()
+	go srv.Serve(lis)
+
+	c, err := client.DialGRPC("passthrough:///exchange", userID, client.WithGRPCAPIKey(apiKey), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}))
+	if err != nil {
+		srv.Stop()
+		return nil, err
+	}
+
+	return &GRPCVenue{
+		c: c,
+		stop: func() {
+			c.Close()
+			srv.Stop()
+		},
+	}, nil
+}
+
+// Close closes the connection and the server of an in-process venue, it
+// does nothing for other venues.
+func (v *GRPCVenue) Close() {
+	if v.stop != nil {
+		v.stop()
+	}
+}
+
+func (v *GRPCVenue) PlaceOrder(ctx context.Context, args *client.PlaceOrderArgs, orderType server.OrderType) (*server.PlaceOrderRes, error) {
+	if orderType == server.MarketOrder {
+		return v.c.PlaceMarketOrder(ctx, args)
+	}
+
+	return v.c.PlaceLimitOrder(ctx, args)
+}
+
+func (v *GRPCVenue) CancelOrder(ctx context.Context, orderID string) error {
+	return v.c.CancelOrder(ctx, orderID)
+}
+
+// Subscribe opens a market data and an orders stream and merges their
+// events. Once one of them ends the feed sends an EventDisconnected with
+// its error and ends too.
+func (v *GRPCVenue) Subscribe(ctx context.Context, market server.Market) (Feed, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	marketData, err := v.c.StreamMarketData(ctx, market, server.ChannelBook, server.ChannelTrades)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	orders, err := v.c.StreamOrders(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	f := &grpcFeed{
+		events: make(chan client.Event),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for _, stream := range []*client.GRPCStream{marketData, orders} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.forward(ctx, stream)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(f.events)
+		close(f.done)
+	}()
+
+	return f, nil
+}
+
+type grpcFeed struct {
+	events chan client.Event
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// forward hands the events of stream to the feed until it ends, which ends
+// the feed.
+func (f *grpcFeed) forward(ctx context.Context, stream *client.GRPCStream) {
+	for event := range stream.Events() {
+		select {
+		case f.events <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	f.once.Do(func() {
+		if ctx.Err() == nil {
+			select {
+			case f.events <- client.Event{Type: client.EventDisconnected, Err: stream.Err()}:
+			case <-ctx.Done():
+			}
+		}
+		f.cancel()
+	})
+}
+
+func (f *grpcFeed) Events() <-chan client.Event {
+	return f.events
+}
+
+func (f *grpcFeed) Close() {
+	f.cancel()
+	<-f.done
+}
@@ -0,0 +1,9 @@
+// Package token contains the go bindings of the ERC-20 token contract the
+// exchange settles token assets with.
+//
+// The contract is written in EVM assembly (constructor.easm and token.easm)
+// so it can be built with the go-ethereum tooling alone, without solc.
+package token
+
+//go:generate sh -c "(go run github.com/ethereum/go-ethereum/cmd/evm compile constructor.easm; go run github.com/ethereum/go-ethereum/cmd/evm compile token.easm) | tr -d '\\n' > token.bin"
+//go:generate go run github.com/ethereum/go-ethereum/cmd/abigen --abi token.abi --bin token.bin --pkg token --type Token --out token.go
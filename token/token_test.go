@@ -0,0 +1,129 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+type account struct {
+	key  *ecdsa.PrivateKey
+	addr common.Address
+}
+
+func newAccount(t *testing.T) account {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return account{key: key, addr: crypto.PubkeyToAddress(key.PublicKey)}
+}
+
+func (a account) opts(t *testing.T) *bind.TransactOpts {
+	opts, err := bind.NewKeyedTransactorWithChainID(a.key, big.NewInt(1337))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return opts
+}
+
+func mined(t *testing.T, backend *simulated.Backend, tx *types.Transaction, err error) *types.Receipt {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	receipt, err := backend.Client().TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return receipt
+}
+
+func TestToken(t *testing.T) {
+	owner, alice, bob := newAccount(t), newAccount(t), newAccount(t)
+
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		owner.addr: {Balance: big.NewInt(1e18)},
+		alice.addr: {Balance: big.NewInt(1e18)},
+		bob.addr:   {Balance: big.NewInt(1e18)},
+	})
+	defer backend.Close()
+
+	address, tx, token, err := DeployToken(owner.opts(t), backend.Client(), big.NewInt(1_000_000))
+	receipt := mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+	assert(t, receipt.ContractAddress, address)
+
+	supply, err := token.TotalSupply(nil)
+	assert(t, err, nil)
+	assert(t, supply, big.NewInt(1_000_000))
+
+	balance, _ := token.BalanceOf(nil, owner.addr)
+	assert(t, balance, big.NewInt(1_000_000))
+
+	tx, err = token.Transfer(owner.opts(t), alice.addr, big.NewInt(1000))
+	receipt = mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	transfer, err := token.ParseTransfer(*receipt.Logs[0])
+	assert(t, err, nil)
+	assert(t, transfer.From, owner.addr)
+	assert(t, transfer.To, alice.addr)
+	assert(t, transfer.Value, big.NewInt(1000))
+
+	balance, _ = token.BalanceOf(nil, owner.addr)
+	assert(t, balance, big.NewInt(999_000))
+	balance, _ = token.BalanceOf(nil, alice.addr)
+	assert(t, balance, big.NewInt(1000))
+
+	// spending more than the balance reverts
+	opts := alice.opts(t)
+	opts.GasLimit = 100_000
+	tx, err = token.Transfer(opts, bob.addr, big.NewInt(1001))
+	receipt = mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusFailed)
+
+	// bob moves alice's tokens after she approved him
+	tx, err = token.Approve(alice.opts(t), bob.addr, big.NewInt(600))
+	receipt = mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	allowance, _ := token.Allowance(nil, alice.addr, bob.addr)
+	assert(t, allowance, big.NewInt(600))
+
+	tx, err = token.TransferFrom(bob.opts(t), alice.addr, owner.addr, big.NewInt(400))
+	receipt = mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusSuccessful)
+
+	allowance, _ = token.Allowance(nil, alice.addr, bob.addr)
+	assert(t, allowance, big.NewInt(200))
+	balance, _ = token.BalanceOf(nil, alice.addr)
+	assert(t, balance, big.NewInt(600))
+
+	// moving more than the allowance reverts
+	opts = bob.opts(t)
+	opts.GasLimit = 100_000
+	tx, err = token.TransferFrom(opts, alice.addr, bob.addr, big.NewInt(201))
+	receipt = mined(t, backend, tx, err)
+	assert(t, receipt.Status, types.ReceiptStatusFailed)
+}